@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Access tokens are issued by the SDK service and verified here with the
+// public keys it publishes. aichat cannot see revocations, so a token
+// revoked by logout stays usable here until it expires (15 minutes by
+// default).
+
+const (
+	tokenIssuer    = "boringmedia-sdk"
+	tokenLeeway    = 30 * time.Second
+	jwksMaxAge     = 5 * time.Minute
+	jwksRefetchGap = 10 * time.Second
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID   string
+	Username string
+	Roles    []string
+	// AccessToken is forwarded to the SDK service for the caller's own data
+	AccessToken string
+}
+
+// identityFrom returns the caller attached by identityMiddleware, or nil
+func identityFrom(c echo.Context) *Identity {
+	identity, _ := c.Get("identity").(*Identity)
+	return identity
+}
+
+// jwksCache holds the SDK service's token verification keys
+var jwksCache struct {
+	sync.Mutex
+	keys      map[string]ed25519.PublicKey
+	fetchedAt time.Time
+}
+
+func getJWKSURL() string {
+	if jwksURL := os.Getenv("JWKS_URL"); jwksURL != "" {
+		return jwksURL
+	}
+	return getSDKURL() + "/.well-known/jwks.json"
+}
+
+func fetchJWKS() (map[string]ed25519.PublicKey, error) {
+	resp, err := sdkClient.Get(getJWKSURL())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			Kid string `json:"kid"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]ed25519.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.Kid] = ed25519.PublicKey(x)
+	}
+	return keys, nil
+}
+
+// verificationKey returns the public key with the given ID, refetching the
+// key set when it is stale or, at most every jwksRefetchGap, when the ID is
+// unknown (the SDK service rotated its key)
+func verificationKey(kid string) (ed25519.PublicKey, error) {
+	jwksCache.Lock()
+	defer jwksCache.Unlock()
+
+	key, ok := jwksCache.keys[kid]
+	age := time.Since(jwksCache.fetchedAt)
+	if ok && age < jwksMaxAge {
+		return key, nil
+	}
+	if !ok && age < jwksRefetchGap {
+		return nil, errInvalidToken
+	}
+	keys, err := fetchJWKS()
+	if err != nil {
+		if ok {
+			// Keep using a known key while the SDK service is unreachable
+			return key, nil
+		}
+		return nil, err
+	}
+	jwksCache.keys = keys
+	jwksCache.fetchedAt = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errInvalidToken
+}
+
+// verifyAccessToken checks an access token's signature, issuer and expiry
+func verifyAccessToken(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "EdDSA" {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := verificationKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims struct {
+		Issuer    string   `json:"iss"`
+		Subject   string   `json:"sub"`
+		Username  string   `json:"username"`
+		Roles     []string `json:"roles"`
+		Type      string   `json:"token_use"`
+		ExpiresAt int64    `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.Issuer != tokenIssuer || claims.Type != "access" || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Add(-tokenLeeway).Unix() >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+	return &Identity{UserID: claims.Subject, Username: claims.Username, Roles: claims.Roles, AccessToken: token}, nil
+}
+
+// identityMiddleware attaches the caller of a request bearing a valid
+// access token. Requests without a bearer token pass through anonymously;
+// an invalid or expired one is refused with 401.
+func identityMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok {
+			return next(c)
+		}
+		identity, err := verifyAccessToken(token)
+		if err != nil {
+			if !errors.Is(err, errInvalidToken) {
+				fmt.Printf("[Auth] verifying access token: %v\n", err)
+			}
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="aichat", error="invalid_token"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid access token"})
+		}
+		c.Set("identity", identity)
+		return next(c)
+	}
+}
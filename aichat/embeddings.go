@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Embedder turns text into a vector
+type Embedder interface {
+	Model() string
+	Embed(text string) ([]float32, error)
+}
+
+// getOllamaURL returns the Ollama base URL
+func getOllamaURL() string {
+	if ollamaURL := os.Getenv("OLLAMA_URL"); ollamaURL != "" {
+		return ollamaURL
+	}
+	return "http://localhost:11434"
+}
+
+// getEmbeddingModelName returns the model used for embeddings
+func getEmbeddingModelName() string {
+	if model := os.Getenv("OLLAMA_EMBED_MODEL"); model != "" {
+		return model
+	}
+	// ~270MB, 768 dimensions
+	return "nomic-embed-text"
+}
+
+// ollamaEmbedder calls Ollama's /api/embeddings
+type ollamaEmbedder struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+func newOllamaEmbedder() *ollamaEmbedder {
+	return &ollamaEmbedder{
+		baseURL: getOllamaURL(),
+		model:   getEmbeddingModelName(),
+		client:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (e *ollamaEmbedder) Model() string { return e.model }
+
+func (e *ollamaEmbedder) Embed(text string) ([]float32, error) {
+	reqBody, _ := json.Marshal(map[string]string{"model": e.model, "prompt": text})
+	res, err := e.client.Post(e.baseURL+"/api/embeddings", "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("ollama embeddings: %s: %s", res.Status, bytes.TrimSpace(body))
+	}
+
+	var out struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Embedding) == 0 {
+		return nil, errors.New("ollama embeddings: empty embedding")
+	}
+	return normalize(out.Embedding), nil
+}
+
+// normalize scales v to unit length so cosine similarity is a dot product
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(1 / math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x * norm
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Role-based access control with the roles the SDK service puts in access
+// tokens. Routes are checked against accessPolicy before their handler
+// runs.
+
+const (
+	roleViewer        = "viewer"
+	roleCreator       = "creator"
+	roleModerator     = "moderator"
+	roleSecurityAdmin = "security-admin"
+)
+
+// Role sets used by accessPolicy. A nil set lets anonymous requests in.
+var (
+	rolesPublic   []string
+	rolesSignedIn = []string{roleViewer, roleCreator, roleModerator, roleSecurityAdmin}
+	rolesStaff    = []string{roleModerator, roleSecurityAdmin}
+	rolesSecurity = []string{roleSecurityAdmin}
+)
+
+// accessPolicy maps "METHOD route" to the roles allowed to call it. Routes
+// not listed are refused.
+var accessPolicy = map[string][]string{
+	"GET /health":      rolesPublic,
+	"POST /chat":       rolesSignedIn,
+	"GET /recommend":   rolesPublic,
+	"POST /search":     rolesPublic,
+	"GET /index":       rolesStaff,
+	"POST /index/sync": rolesSecurity,
+}
+
+// effectiveRoles are the roles of an identity. Accounts without any are
+// viewers.
+func (i *Identity) effectiveRoles() []string {
+	if len(i.Roles) == 0 {
+		return []string{roleViewer}
+	}
+	return i.Roles
+}
+
+// hasRole reports whether the identity holds one of roles
+func (i *Identity) hasRole(roles ...string) bool {
+	if i == nil {
+		return false
+	}
+	for _, have := range i.effectiveRoles() {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// auditDenial logs a refused request as a JSON audit line
+func auditDenial(c echo.Context, status int, required []string) {
+	event := map[string]interface{}{
+		"time":       time.Now().UTC(),
+		"type":       "access_denied",
+		"service":    "aichat",
+		"method":     c.Request().Method,
+		"path":       c.Request().URL.Path,
+		"status":     status,
+		"remoteAddr": c.RealIP(),
+	}
+	if len(required) > 0 {
+		event["required"] = required
+	}
+	if identity := identityFrom(c); identity != nil {
+		event["actor"] = identity.Username
+		event["roles"] = identity.effectiveRoles()
+	}
+	line, _ := json.Marshal(event)
+	fmt.Printf("[Audit] %s\n", line)
+}
+
+// authorizeMiddleware enforces accessPolicy: 401 for anonymous callers and
+// 403 for signed-in callers without a required role
+func authorizeMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		required, ok := accessPolicy[c.Request().Method+" "+c.Path()]
+		if ok && required == nil {
+			return next(c)
+		}
+		identity := identityFrom(c)
+		if ok && identity.hasRole(required...) {
+			return next(c)
+		}
+		if identity == nil {
+			auditDenial(c, http.StatusUnauthorized, required)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="aichat"`)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Authentication required"})
+		}
+		auditDenial(c, http.StatusForbidden, required)
+		message := "No access rule for this request"
+		if ok {
+			message = "Requires one of the roles " + strings.Join(required, ", ")
+		}
+		return c.JSON(http.StatusForbidden, map[string]string{"error": message})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRecommendLimit = 10
+	maxRecommendLimit     = 50
+	defaultStrategy       = "trending"
+	defaultDiversity      = 0.3
+	defaultTrendHalfLife  = 72 * time.Hour
+)
+
+// Recommendation is one ranked video with the parts of its score
+type Recommendation struct {
+	Video     map[string]interface{} `json:"video"`
+	Score     float64                `json:"score"`
+	Breakdown map[string]float64     `json:"breakdown"`
+}
+
+// recommendContext is what a strategy may score against
+type recommendContext struct {
+	now      time.Time
+	halfLife time.Duration
+	// profile is the share of the history in each category and tag
+	categories map[string]float64
+	tags       map[string]float64
+	seen       map[string]bool
+
+	// Signals of a known user, for the personal strategy
+	subscriptions map[string]bool
+	coWatch       map[string]float64 // share of the top co-watch count
+	maxTrending   float64
+}
+
+// A recommendStrategy scores one video and explains the score
+type recommendStrategy func(ctx *recommendContext, video map[string]interface{}) (float64, map[string]float64)
+
+var recommendStrategies = map[string]recommendStrategy{
+	"engagement": engagementStrategy,
+	"trending":   trendingStrategy,
+	"affinity":   affinityStrategy,
+	"personal":   personalStrategy,
+}
+
+func numberField(video map[string]interface{}, key string) float64 {
+	n, _ := video[key].(float64)
+	return n
+}
+
+func stringsField(video map[string]interface{}, key string) []string {
+	values, _ := video[key].([]interface{})
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok && s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// engagementStrategy ranks by reach times approval. The like ratio is
+// smoothed with one like and one dislike so a video with a single like does
+// not beat one with a thousand likes and a few dislikes.
+func engagementStrategy(_ *recommendContext, video map[string]interface{}) (float64, map[string]float64) {
+	views := numberField(video, "views")
+	likes := numberField(video, "likes")
+	dislikes := numberField(video, "dislikes")
+	comments := numberField(video, "commentCount")
+
+	reach := math.Log1p(views)
+	approval := (likes + 1) / (likes + dislikes + 2)
+	discussion := math.Log1p(comments) / 4
+	score := reach*approval + discussion
+	return score, map[string]float64{
+		"reach":      reach,
+		"approval":   approval,
+		"discussion": discussion,
+	}
+}
+
+// trendingStrategy decays engagement exponentially with the video's age
+func trendingStrategy(ctx *recommendContext, video map[string]interface{}) (float64, map[string]float64) {
+	engagement, breakdown := engagementStrategy(ctx, video)
+	age := 0.0
+	if uploaded, err := time.Parse(time.RFC3339, stringField(video, "uploadDate")); err == nil && uploaded.Before(ctx.now) {
+		age = ctx.now.Sub(uploaded).Hours()
+	}
+	decay := math.Pow(0.5, age/ctx.halfLife.Hours())
+	breakdown["engagement"] = engagement
+	breakdown["ageHours"] = age
+	breakdown["decay"] = decay
+	return engagement * decay, breakdown
+}
+
+// profileAffinity is how much of the user's history shares the video's
+// category and tags, from 0 to 1
+func profileAffinity(ctx *recommendContext, video map[string]interface{}, breakdown map[string]float64) float64 {
+	category := ctx.categories[stringField(video, "category")]
+	var tags float64
+	for _, tag := range stringsField(video, "tags") {
+		tags = math.Max(tags, ctx.tags[strings.ToLower(tag)])
+	}
+	breakdown["categoryAffinity"] = category
+	breakdown["tagAffinity"] = tags
+	return 0.7*category + 0.3*tags
+}
+
+// affinityStrategy boosts trending videos in the categories and tags the
+// user's history is made of
+func affinityStrategy(ctx *recommendContext, video map[string]interface{}) (float64, map[string]float64) {
+	trending, breakdown := trendingStrategy(ctx, video)
+	affinity := profileAffinity(ctx, video, breakdown)
+	breakdown["trending"] = trending
+	// Unrelated videos keep a fifth of their score so the list never
+	// collapses to a single category
+	return trending * (0.2 + 0.8*affinity), breakdown
+}
+
+// personalStrategy mixes, each scaled to 0-1, how trending the video is,
+// the affinity of the user's completed videos, whether the user subscribes
+// to the uploader and how many users with the same completed videos
+// completed this one
+func personalStrategy(ctx *recommendContext, video map[string]interface{}) (float64, map[string]float64) {
+	trending, breakdown := trendingStrategy(ctx, video)
+	popularity := 0.0
+	if ctx.maxTrending > 0 {
+		popularity = trending / ctx.maxTrending
+	}
+	affinity := profileAffinity(ctx, video, breakdown)
+	subscribed := 0.0
+	if uploader, ok := video["uploader"].(map[string]interface{}); ok {
+		if ctx.subscriptions[stringField(uploader, "username")] || ctx.subscriptions[stringField(uploader, "id")] {
+			subscribed = 1
+		}
+	}
+	coWatch := ctx.coWatch[stringField(video, "_id")]
+
+	breakdown["trending"] = trending
+	breakdown["popularity"] = popularity
+	breakdown["subscribed"] = subscribed
+	breakdown["coWatch"] = coWatch
+	return 0.3*popularity + 0.3*affinity + 0.2*subscribed + 0.2*coWatch, breakdown
+}
+
+// newRecommendContext builds the user's profile from the videos in history
+func newRecommendContext(videos []map[string]interface{}, history []string) *recommendContext {
+	ctx := &recommendContext{
+		now:        time.Now().UTC(),
+		halfLife:   defaultTrendHalfLife,
+		categories: map[string]float64{},
+		tags:       map[string]float64{},
+		seen:       map[string]bool{},
+	}
+	if v := os.Getenv("TRENDING_HALF_LIFE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ctx.halfLife = d
+		}
+	}
+	for _, id := range history {
+		ctx.seen[id] = true
+	}
+
+	watched := 0
+	for _, video := range videos {
+		if !ctx.seen[stringField(video, "_id")] {
+			continue
+		}
+		watched++
+		if category := stringField(video, "category"); category != "" {
+			ctx.categories[category]++
+		}
+		for _, tag := range stringsField(video, "tags") {
+			ctx.tags[strings.ToLower(tag)]++
+		}
+	}
+	for k := range ctx.categories {
+		ctx.categories[k] /= float64(watched)
+	}
+	for k := range ctx.tags {
+		ctx.tags[k] /= float64(watched)
+	}
+	return ctx
+}
+
+// addSignals sets up ctx for the personal strategy
+func (ctx *recommendContext) addSignals(videos []map[string]interface{}, signals *userSignals) {
+	ctx.subscriptions = map[string]bool{}
+	for _, channel := range signals.Subscriptions {
+		ctx.subscriptions[channel] = true
+	}
+	ctx.coWatch = map[string]float64{}
+	for _, c := range signals.CoWatched {
+		// Sorted by users, so the first is the top count
+		if signals.CoWatched[0].Users > 0 {
+			ctx.coWatch[c.VideoID] = float64(c.Users) / float64(signals.CoWatched[0].Users)
+		}
+	}
+	for _, video := range videos {
+		trending, _ := trendingStrategy(ctx, video)
+		ctx.maxTrending = math.Max(ctx.maxTrending, trending)
+	}
+}
+
+// similarity is how alike two videos are for diversity re-ranking: half for
+// a shared category, half for the overlap of their tags
+func similarity(a, b map[string]interface{}) float64 {
+	var sim float64
+	if ca := stringField(a, "category"); ca != "" && ca == stringField(b, "category") {
+		sim += 0.5
+	}
+	ta, tb := map[string]bool{}, map[string]bool{}
+	for _, tag := range stringsField(a, "tags") {
+		ta[strings.ToLower(tag)] = true
+	}
+	for _, tag := range stringsField(b, "tags") {
+		tb[strings.ToLower(tag)] = true
+	}
+	shared := 0
+	for tag := range ta {
+		if tb[tag] {
+			shared++
+		}
+	}
+	if union := len(ta) + len(tb) - shared; union > 0 {
+		sim += 0.5 * float64(shared) / float64(union)
+	}
+	return sim
+}
+
+// diversify re-ranks candidates by maximal marginal relevance: each pick
+// is the candidate whose score, less lambda times its similarity to the
+// closest video already picked, is highest. Scores are first scaled to 0-1
+// so lambda means the same for every strategy.
+func diversify(candidates []Recommendation, lambda float64, limit int) []Recommendation {
+	if lambda <= 0 || len(candidates) < 2 {
+		if len(candidates) > limit {
+			candidates = candidates[:limit]
+		}
+		return candidates
+	}
+	top := candidates[0].Score
+	if top <= 0 {
+		top = 1
+	}
+
+	picked := make([]Recommendation, 0, limit)
+	remaining := append([]Recommendation(nil), candidates...)
+	for len(picked) < limit && len(remaining) > 0 {
+		best, bestValue, bestPenalty := 0, math.Inf(-1), 0.0
+		for i, candidate := range remaining {
+			var closest float64
+			for _, p := range picked {
+				closest = math.Max(closest, similarity(candidate.Video, p.Video))
+			}
+			penalty := lambda * closest
+			if value := candidate.Score/top - penalty; value > bestValue {
+				best, bestValue, bestPenalty = i, value, penalty
+			}
+		}
+		choice := remaining[best]
+		choice.Breakdown["diversityPenalty"] = bestPenalty
+		picked = append(picked, choice)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return picked
+}
+
+// recommend ranks the videos not in the history with strategy and returns
+// the top limit
+func recommend(videos []map[string]interface{}, ctx *recommendContext, strategy recommendStrategy, diversity float64, limit int) []Recommendation {
+	candidates := make([]Recommendation, 0, len(videos))
+	for _, video := range videos {
+		if ctx.seen[stringField(video, "_id")] {
+			continue
+		}
+		score, breakdown := strategy(ctx, video)
+		candidates = append(candidates, Recommendation{Video: video, Score: score, Breakdown: breakdown})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return diversify(candidates, diversity, limit)
+}
+
+// handleRecommend serves GET /recommend. Query parameters: strategy
+// (engagement, trending, affinity or personal), limit, diversity (0-1, 0
+// disables re-ranking), history (comma separated IDs of videos the user
+// watched, used by affinity) and user. Signed-in callers get personal
+// results by default; user, if given, must be the caller.
+func handleRecommend(c echo.Context) error {
+	// Watch histories are private: personal results are for the caller only
+	user := strings.TrimSpace(c.QueryParam("user"))
+	if identity := identityFrom(c); identity != nil {
+		if user != "" && user != identity.Username {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "recommendations for another user"})
+		}
+		user = identity.Username
+	} else if user != "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "sign in for personal recommendations"})
+	}
+	name := c.QueryParam("strategy")
+	if name == "" {
+		name = defaultStrategy
+		if user != "" {
+			name = "personal"
+		}
+	}
+	strategy, ok := recommendStrategies[name]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "strategy must be engagement, trending, affinity or personal"})
+	}
+
+	limit := defaultRecommendLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecommendLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxRecommendLimit)})
+		}
+		limit = n
+	}
+
+	diversity := defaultDiversity
+	if v := c.QueryParam("diversity"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "diversity must be between 0 and 1"})
+		}
+		diversity = f
+	}
+
+	var history []string
+	for _, id := range strings.Split(c.QueryParam("history"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			history = append(history, id)
+		}
+	}
+
+	var signals *userSignals
+	if name == "personal" {
+		if user == "" {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "sign in for personal recommendations"})
+		}
+		var err error
+		signals, err = fetchUserSignals(identityFrom(c))
+		if err != nil && err != errSDKNotFound {
+			fmt.Printf("[Recommend] fetching signals of %q: %v\n", user, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user history from SDK"})
+		}
+		// The profile is built from, and excludes, completed videos only
+		history = nil
+		if signals != nil {
+			for _, h := range signals.History {
+				if h.Completed {
+					history = append(history, h.VideoID)
+				}
+			}
+		}
+	}
+
+	videos, err := fetchAllVideos()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch videos from SDK"})
+	}
+
+	ctx := newRecommendContext(videos, history)
+	response := map[string]interface{}{"strategy": name, "diversity": diversity}
+	if user != "" {
+		response["user"] = user
+	}
+	coldStart := len(ctx.categories) == 0 && len(ctx.tags) == 0
+	if signals != nil {
+		ctx.addSignals(videos, signals)
+		coldStart = coldStart && len(ctx.subscriptions) == 0 && len(ctx.coWatch) == 0
+	}
+	if (name == "affinity" || name == "personal") && coldStart {
+		// Nothing known about the user yet
+		strategy = trendingStrategy
+		response["fallback"] = "trending"
+	}
+	response["recommendations"] = recommend(videos, ctx, strategy, diversity, limit)
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxVideoPages bounds how many pages fetchAllVideos follows
+const maxVideoPages = 100
+
+var sdkClient = &http.Client{Timeout: 30 * time.Second}
+
+// nextLink finds the rel="next" target of a Link header
+var nextLink = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?next"?`)
+
+func getSDKURL() string {
+	if sdkURL := os.Getenv("SDK_URL"); sdkURL != "" {
+		return sdkURL
+	}
+	return "http://sdk-service:5000"
+}
+
+// fetchAllVideos fetches the whole catalog from the SDK service, following
+// the Link headers of the paginated GET /videos
+func fetchAllVideos() ([]map[string]interface{}, error) {
+	base, err := url.Parse(getSDKURL())
+	if err != nil {
+		return nil, err
+	}
+	next := base.ResolveReference(&url.URL{Path: "/videos", RawQuery: "limit=100"})
+
+	videos := []map[string]interface{}{}
+	for page := 0; next != nil; page++ {
+		if page == maxVideoPages {
+			return nil, fmt.Errorf("more than %d pages of videos", maxVideoPages)
+		}
+		resp, err := sdkClient.Get(next.String())
+		if err != nil {
+			return nil, err
+		}
+		var batch []map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&batch)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", next.Path, resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, batch...)
+
+		next = nil
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			if ref, err := url.Parse(m[1]); err == nil {
+				next = base.ResolveReference(ref)
+			}
+		}
+	}
+	return videos, nil
+}
+
+// searchVideos runs a keyword search with the SDK service's GET /search and
+// returns the matching videos, best first, each with its score and
+// highlights added
+func searchVideos(query string, limit int) ([]map[string]interface{}, error) {
+	base, err := url.Parse(getSDKURL())
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"q": {query}, "limit": {strconv.Itoa(limit)}}
+	target := base.ResolveReference(&url.URL{Path: "/search", RawQuery: params.Encode()})
+
+	resp, err := sdkClient.Get(target.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		// Nothing searchable in the query, such as a single letter
+		return []map[string]interface{}{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /search: %s", resp.Status)
+	}
+
+	var page struct {
+		Results []struct {
+			Video      map[string]interface{} `json:"video"`
+			Score      float64                `json:"score"`
+			Highlights map[string]interface{} `json:"highlights"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	videos := make([]map[string]interface{}, 0, len(page.Results))
+	for _, result := range page.Results {
+		result.Video["score"] = result.Score
+		result.Video["highlights"] = result.Highlights
+		videos = append(videos, result.Video)
+	}
+	return videos, nil
+}
+
+// errSDKNotFound is returned by getSDKJSON for a 404
+var errSDKNotFound = errors.New("not found")
+
+// getSDKJSON decodes the JSON answer to a GET of path on the SDK service,
+// sent with the access token when it is not empty
+func getSDKJSON(path string, params url.Values, token string, out interface{}) error {
+	base, err := url.Parse(getSDKURL())
+	if err != nil {
+		return err
+	}
+	target := base.ResolveReference(&url.URL{Path: path, RawQuery: params.Encode()})
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := sdkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errSDKNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// watchSummary is one entry of a user's watch history
+type watchSummary struct {
+	VideoID   string `json:"videoId"`
+	Completed bool   `json:"completed"`
+}
+
+// coWatch is a video completed by users with the same taste
+type coWatch struct {
+	VideoID string `json:"videoId"`
+	Users   int    `json:"users"`
+}
+
+// userSignals is what the SDK service knows about a user's taste
+type userSignals struct {
+	Subscriptions []string
+	History       []watchSummary
+	CoWatched     []coWatch
+}
+
+// fetchUserSignals fetches the subscriptions, watch history and co-watched
+// videos of the signed-in caller, whose access token the SDK service needs
+// for the history. It returns errSDKNotFound for an unknown user.
+func fetchUserSignals(identity *Identity) (*userSignals, error) {
+	userPath := "/users/" + url.PathEscape(identity.Username)
+	var user struct {
+		Subscriptions []string `json:"subscriptions"`
+	}
+	if err := getSDKJSON(userPath, nil, identity.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	signals := &userSignals{Subscriptions: user.Subscriptions}
+	if err := getSDKJSON(userPath+"/history", url.Values{"limit": {"200"}}, identity.AccessToken, &signals.History); err != nil {
+		return nil, err
+	}
+	if err := getSDKJSON(userPath+"/cowatched", url.Values{"limit": {"100"}}, identity.AccessToken, &signals.CoWatched); err != nil {
+		return nil, err
+	}
+	return signals, nil
+}
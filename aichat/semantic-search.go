@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// searchCandidates is how many hits each retriever contributes
+	searchCandidates = 50
+	defaultSyncEvery = 2 * time.Minute
+)
+
+// semanticSearch owns the video embeddings and the catalog they were made from
+type semanticSearch struct {
+	embedder Embedder
+	index    *vectorIndex
+	path     string
+
+	// weight of the semantic score in the blend, the rest is keyword score
+	weight float64
+	// semantic hits below this cosine similarity are dropped
+	minSimilarity float64
+
+	syncing sync.Mutex
+
+	mu       sync.RWMutex
+	videos   map[string]map[string]interface{}
+	lastSync time.Time
+	syncErr  string
+}
+
+var vectorSearch *semanticSearch
+
+func newSemanticSearchFromEnv() *semanticSearch {
+	embedder := newOllamaEmbedder()
+	s := &semanticSearch{
+		embedder:      embedder,
+		index:         newVectorIndex(embedder.Model()),
+		path:          os.Getenv("VECTOR_INDEX_PATH"),
+		weight:        envFloat("SEARCH_SEMANTIC_WEIGHT", 0.6),
+		minSimilarity: envFloat("SEARCH_MIN_SIMILARITY", 0.35),
+		videos:        map[string]map[string]interface{}{},
+	}
+	if s.path == "" {
+		s.path = "data/vector-index.gob"
+	}
+	if s.weight < 0 || s.weight > 1 {
+		fmt.Printf("[Search] SEARCH_SEMANTIC_WEIGHT %v out of range, using 0.6\n", s.weight)
+		s.weight = 0.6
+	}
+
+	if err := s.index.Load(s.path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("[Search] ignoring vector index snapshot: %v\n", err)
+	} else if err == nil {
+		fmt.Printf("[Search] loaded %d embeddings from %s\n", s.index.Len(), s.path)
+	}
+	return s
+}
+
+func envFloat(name string, fallback float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		fmt.Printf("[Search] invalid %s %q, using %v\n", name, v, fallback)
+	}
+	return fallback
+}
+
+// run keeps the index in sync with the catalog until the process exits
+func (s *semanticSearch) run() {
+	every := defaultSyncEvery
+	if v := os.Getenv("VECTOR_SYNC_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			every = d
+		}
+	}
+	for {
+		if err := s.sync(); err != nil {
+			fmt.Printf("[Search] index sync failed: %v\n", err)
+		}
+		time.Sleep(every)
+	}
+}
+
+// embeddingText is what gets embedded for a video
+func embeddingText(video map[string]interface{}) string {
+	var b strings.Builder
+	b.WriteString(stringField(video, "title"))
+	if description := stringField(video, "description"); description != "" {
+		b.WriteString("\n")
+		b.WriteString(description)
+	}
+	if category := stringField(video, "category"); category != "" {
+		b.WriteString("\nCategory: ")
+		b.WriteString(category)
+	}
+	if tags, ok := video["tags"].([]interface{}); ok && len(tags) > 0 {
+		names := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if name, ok := tag.(string); ok {
+				names = append(names, name)
+			}
+		}
+		b.WriteString("\nTags: ")
+		b.WriteString(strings.Join(names, ", "))
+	}
+	return b.String()
+}
+
+func stringField(video map[string]interface{}, key string) string {
+	s, _ := video[key].(string)
+	return s
+}
+
+func textHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// sync embeds new and changed videos and drops deleted ones. Videos whose
+// text is unchanged keep their embedding, so a sync of a quiet catalog
+// costs one paginated listing.
+func (s *semanticSearch) sync() error {
+	if !s.syncing.TryLock() {
+		return nil
+	}
+	defer s.syncing.Unlock()
+
+	videos, err := fetchAllVideos()
+	if err != nil {
+		s.setSyncResult(nil, err)
+		return err
+	}
+
+	catalog := make(map[string]map[string]interface{}, len(videos))
+	embedded, failed := 0, 0
+	var firstErr error
+	for _, video := range videos {
+		id := stringField(video, "_id")
+		if id == "" {
+			continue
+		}
+		catalog[id] = video
+
+		text := embeddingText(video)
+		hash := textHash(text)
+		if old, ok := s.index.Hash(id); ok && old == hash {
+			continue
+		}
+		vector, err := s.embedder.Embed(text)
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.index.Upsert(id, hash, vector)
+		embedded++
+	}
+
+	keep := make(map[string]bool, len(catalog))
+	for id := range catalog {
+		keep[id] = true
+	}
+	deleted := s.index.Retain(keep)
+
+	if embedded > 0 || deleted > 0 {
+		if err := s.index.Save(s.path); err != nil {
+			fmt.Printf("[Search] saving vector index: %v\n", err)
+		}
+		fmt.Printf("[Search] index sync: %d embedded, %d deleted, %d total\n", embedded, deleted, s.index.Len())
+	}
+	if failed > 0 {
+		firstErr = fmt.Errorf("%d videos not embedded: %w", failed, firstErr)
+	}
+	s.setSyncResult(catalog, firstErr)
+	return firstErr
+}
+
+func (s *semanticSearch) setSyncResult(catalog map[string]map[string]interface{}, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if catalog != nil {
+		s.videos = catalog
+		s.lastSync = time.Now().UTC()
+	}
+	s.syncErr = ""
+	if err != nil {
+		s.syncErr = err.Error()
+	}
+}
+
+func (s *semanticSearch) video(id string) map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.videos[id]
+}
+
+// search blends nearest neighbours of the query embedding with the SDK's
+// keyword results. Both scores are scaled to 0-1 before blending, so a video
+// found by only one retriever can still rank first. If the query cannot be
+// embedded the keyword results are returned as they are.
+func (s *semanticSearch) search(query string) ([]map[string]interface{}, error) {
+	keyword, keywordErr := searchVideos(query, searchCandidates)
+
+	var hits []vectorHit
+	if s.index.Len() > 0 {
+		vector, err := s.embedder.Embed(query)
+		if err != nil {
+			fmt.Printf("[Search] embedding query failed, keyword only: %v\n", err)
+		} else {
+			hits = s.index.Search(vector, searchCandidates)
+		}
+	}
+	if keywordErr != nil && len(hits) == 0 {
+		return nil, keywordErr
+	}
+	if len(hits) == 0 {
+		return keyword, nil
+	}
+
+	type blended struct {
+		video    map[string]interface{}
+		semantic float64
+		keyword  float64
+	}
+	results := map[string]*blended{}
+	order := []string{}
+	add := func(id string, video map[string]interface{}) *blended {
+		if r, ok := results[id]; ok {
+			return r
+		}
+		r := &blended{video: video}
+		results[id] = r
+		order = append(order, id)
+		return r
+	}
+
+	var maxKeyword float64
+	for _, video := range keyword {
+		if score, _ := video["score"].(float64); score > maxKeyword {
+			maxKeyword = score
+		}
+	}
+	for _, video := range keyword {
+		id := stringField(video, "_id")
+		score, _ := video["score"].(float64)
+		if maxKeyword > 0 {
+			add(id, video).keyword = score / maxKeyword
+		}
+	}
+	for _, hit := range hits {
+		if hit.Similarity < s.minSimilarity {
+			continue
+		}
+		video := s.video(hit.ID)
+		if r, ok := results[hit.ID]; ok {
+			video = r.video
+		}
+		if video == nil {
+			continue
+		}
+		add(hit.ID, video).semantic = hit.Similarity
+	}
+
+	out := make([]map[string]interface{}, 0, len(order))
+	scores := make(map[string]float64, len(order))
+	for _, id := range order {
+		r := results[id]
+		score := s.weight*r.semantic + (1-s.weight)*r.keyword
+		video := make(map[string]interface{}, len(r.video)+3)
+		for k, v := range r.video {
+			video[k] = v
+		}
+		video["score"] = score
+		video["semanticScore"] = r.semantic
+		video["keywordScore"] = r.keyword
+		scores[id] = score
+		out = append(out, video)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return scores[stringField(out[i], "_id")] > scores[stringField(out[j], "_id")]
+	})
+	if len(out) > searchCandidates {
+		out = out[:searchCandidates]
+	}
+	return out, nil
+}
+
+func handleSemanticSearch(c echo.Context) error {
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	if strings.TrimSpace(req.Query) == "" {
+		return c.JSON(http.StatusOK, []map[string]interface{}{})
+	}
+
+	videos, err := vectorSearch.search(req.Query)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search videos"})
+	}
+
+	return c.JSON(http.StatusOK, videos)
+}
+
+// handleIndexStatus reports the state of the vector index
+func handleIndexStatus(c echo.Context) error {
+	vectorSearch.mu.RLock()
+	defer vectorSearch.mu.RUnlock()
+	status := map[string]interface{}{
+		"model":      vectorSearch.embedder.Model(),
+		"embeddings": vectorSearch.index.Len(),
+		"videos":     len(vectorSearch.videos),
+	}
+	if !vectorSearch.lastSync.IsZero() {
+		status["lastSync"] = vectorSearch.lastSync
+	}
+	if vectorSearch.syncErr != "" {
+		status["error"] = vectorSearch.syncErr
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// handleIndexSync syncs the index now instead of waiting for the next tick
+func handleIndexSync(c echo.Context) error {
+	if err := vectorSearch.sync(); err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": err.Error()})
+	}
+	return handleIndexStatus(c)
+}
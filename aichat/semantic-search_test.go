@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubTopics is the vocabulary of the stub embedding model: each word
+// counts towards one dimension, so texts about the same topic are similar
+// without sharing words
+var stubTopics = []map[string]bool{
+	{"phishing": true, "email": true, "scam": true, "inbox": true},
+	{"ransomware": true, "encrypt": true, "backup": true},
+	{"pasta": true, "recipe": true, "cooking": true},
+}
+
+// stubOllama answers /api/embeddings with topic count vectors
+type stubOllama struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func newStubOllama(t *testing.T) *stubOllama {
+	t.Helper()
+	o := &stubOllama{}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model  string `json:"model"`
+			Prompt string `json:"prompt"`
+		}
+		if r.URL.Path != "/api/embeddings" || json.NewDecoder(r.Body).Decode(&req) != nil || req.Model != "stub-embed" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		o.mu.Lock()
+		o.prompts = append(o.prompts, req.Prompt)
+		o.mu.Unlock()
+
+		embedding := make([]float32, len(stubTopics))
+		for _, word := range strings.Fields(strings.ToLower(req.Prompt)) {
+			for i, topic := range stubTopics {
+				if topic[strings.Trim(word, ",.:")] {
+					embedding[i]++
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"embedding": embedding})
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+// calls returns how many texts were embedded
+func (o *stubOllama) calls() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.prompts)
+}
+
+// stubSDK serves the paginated GET /videos and a canned GET /search
+type stubSDK struct {
+	mu      sync.Mutex
+	videos  []map[string]interface{}
+	results []map[string]interface{} // GET /search results, best first
+	down    bool
+}
+
+func newStubSDK(t *testing.T) *stubSDK {
+	t.Helper()
+	s := &stubSDK{}
+	server := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(server.Close)
+	t.Setenv("SDK_URL", server.URL)
+	return s
+}
+
+func (s *stubSDK) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.URL.Path {
+	case "/videos":
+		// Two videos a page, so a sync follows the Link header
+		start := 0
+		fmt.Sscan(r.URL.Query().Get("after"), &start)
+		end := start + 2
+		if end >= len(s.videos) {
+			end = len(s.videos)
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`</videos?limit=100&after=%d>; rel="next"`, end))
+		}
+		json.NewEncoder(w).Encode(s.videos[start:end])
+	case "/search":
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": s.results})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *stubSDK) setVideos(videos ...map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.videos = videos
+}
+
+// setResults sets the keyword hits, each a video with its score
+func (s *stubSDK) setResults(hits ...map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = nil
+	for _, hit := range hits {
+		video := map[string]interface{}{}
+		for k, v := range hit {
+			if k != "score" {
+				video[k] = v
+			}
+		}
+		s.results = append(s.results, map[string]interface{}{"video": video, "score": hit["score"], "highlights": map[string]interface{}{}})
+	}
+}
+
+func testVideo(id, title string) map[string]interface{} {
+	return map[string]interface{}{"_id": id, "title": title, "category": "Security"}
+}
+
+func newTestSemanticSearch(t *testing.T, ollamaURL string) *semanticSearch {
+	t.Helper()
+	return &semanticSearch{
+		embedder:      &ollamaEmbedder{baseURL: ollamaURL, model: "stub-embed", client: http.DefaultClient},
+		index:         newVectorIndex("stub-embed"),
+		path:          filepath.Join(t.TempDir(), "vector-index.gob"),
+		weight:        0.6,
+		minSimilarity: 0.35,
+		videos:        map[string]map[string]interface{}{},
+	}
+}
+
+func resultIDs(videos []map[string]interface{}) []string {
+	ids := make([]string, 0, len(videos))
+	for _, video := range videos {
+		ids = append(ids, stringField(video, "_id"))
+	}
+	return ids
+}
+
+func TestSemanticSearchSync(t *testing.T) {
+	ollama := newStubOllama(t)
+	sdk := newStubSDK(t)
+	s := newTestSemanticSearch(t, ollama.server.URL)
+
+	sdk.setVideos(
+		testVideo("v1", "Spotting phishing email"),
+		testVideo("v2", "Ransomware backup drills"),
+		testVideo("v3", "Pasta recipe"),
+	)
+	if err := s.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if s.index.Len() != 3 || ollama.calls() != 3 {
+		t.Fatalf("index has %d embeddings after %d calls, want 3 and 3", s.index.Len(), ollama.calls())
+	}
+	if s.video("v3") == nil {
+		t.Error("catalog is missing the video from the second page")
+	}
+
+	// Unchanged videos keep their embeddings
+	if err := s.sync(); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if ollama.calls() != 3 {
+		t.Errorf("unchanged catalog re-embedded %d videos", ollama.calls()-3)
+	}
+
+	// An edited video is embedded again and a deleted one dropped
+	sdk.setVideos(
+		testVideo("v1", "Spotting phishing email in your inbox"),
+		testVideo("v2", "Ransomware backup drills"),
+	)
+	if err := s.sync(); err != nil {
+		t.Fatalf("third sync: %v", err)
+	}
+	if ollama.calls() != 4 {
+		t.Errorf("embedded %d videos for one edit", ollama.calls()-3)
+	}
+	if _, ok := s.index.Hash("v3"); ok || s.index.Len() != 2 || s.video("v3") != nil {
+		t.Errorf("deleted video still indexed: %d embeddings", s.index.Len())
+	}
+
+	// The snapshot on disk matches
+	loaded := newVectorIndex("stub-embed")
+	if err := loaded.Load(s.path); err != nil {
+		t.Fatalf("loading snapshot: %v", err)
+	}
+	if loaded.Len() != 2 {
+		t.Errorf("snapshot has %d embeddings, want 2", loaded.Len())
+	}
+}
+
+func TestSemanticSearchSyncErrors(t *testing.T) {
+	sdk := newStubSDK(t)
+	sdk.setVideos(testVideo("v1", "Spotting phishing email"))
+
+	// Ollama is down: the catalog is kept and the failure reported
+	ollama := newStubOllama(t)
+	s := newTestSemanticSearch(t, ollama.server.URL)
+	ollama.server.Close()
+	if err := s.sync(); err == nil || !strings.Contains(err.Error(), "1 videos not embedded") {
+		t.Fatalf("err = %v, want the embedding failure", err)
+	}
+	if s.video("v1") == nil || s.syncErr == "" {
+		t.Errorf("catalog = %v, syncErr = %q", s.videos, s.syncErr)
+	}
+
+	// The SDK is down: the previous catalog stays
+	sdk.mu.Lock()
+	sdk.down = true
+	sdk.mu.Unlock()
+	if err := s.sync(); err == nil {
+		t.Fatal("sync succeeded without the SDK")
+	}
+	if s.video("v1") == nil {
+		t.Error("failed listing dropped the catalog")
+	}
+}
+
+func TestSemanticSearchBlendsScores(t *testing.T) {
+	ollama := newStubOllama(t)
+	sdk := newStubSDK(t)
+	s := newTestSemanticSearch(t, ollama.server.URL)
+
+	phishing := testVideo("v1", "Spotting phishing email")
+	ransomware := testVideo("v2", "Ransomware backup drills")
+	pasta := testVideo("v3", "Pasta recipe")
+	sdk.setVideos(phishing, ransomware, pasta)
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// v1 matches the query's meaning but none of its words; the keyword
+	// search only finds v2 and v3
+	ransomwareHit := testVideo("v2", "Ransomware backup drills")
+	ransomwareHit["score"] = 4.0
+	pastaHit := testVideo("v3", "Pasta recipe")
+	pastaHit["score"] = 2.0
+	sdk.setResults(ransomwareHit, pastaHit)
+
+	results, err := s.search("inbox scam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(resultIDs(results), ","); got != "v1,v2,v3" {
+		t.Fatalf("order = %s, want v1,v2,v3", got)
+	}
+
+	want := map[string][3]float64{ // score, semanticScore, keywordScore
+		"v1": {0.6, 1, 0},
+		"v2": {0.4, 0, 1},
+		"v3": {0.2, 0, 0.5},
+	}
+	for _, video := range results {
+		w := want[stringField(video, "_id")]
+		got := [3]float64{video["score"].(float64), video["semanticScore"].(float64), video["keywordScore"].(float64)}
+		for i := range got {
+			if diff := got[i] - w[i]; diff > 1e-6 || diff < -1e-6 {
+				t.Errorf("%s: scores = %v, want %v", video["_id"], got, w)
+				break
+			}
+		}
+	}
+	if stringField(results[0], "title") != "Spotting phishing email" {
+		t.Errorf("semantic-only hit was not filled in from the catalog: %v", results[0])
+	}
+
+	// Found by both retrievers, v1 adds up both scores
+	phishingHit := testVideo("v1", "Spotting phishing email")
+	phishingHit["score"] = 4.0
+	sdk.setResults(phishingHit, ransomwareHit)
+	results, err = s.search("inbox scam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score := results[0]["score"].(float64); stringField(results[0], "_id") != "v1" || score < 0.999 {
+		t.Errorf("top result = %v with score %v, want v1 with 1", results[0]["_id"], score)
+	}
+}
+
+func TestSemanticSearchKeywordFallback(t *testing.T) {
+	sdk := newStubSDK(t)
+	ollama := newStubOllama(t)
+	s := newTestSemanticSearch(t, ollama.server.URL)
+
+	sdk.setVideos(testVideo("v1", "Spotting phishing email"), testVideo("v2", "Ransomware backup drills"))
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	first := testVideo("v2", "Ransomware backup drills")
+	first["score"] = 7.5
+	second := testVideo("v1", "Spotting phishing email")
+	second["score"] = 1.5
+	sdk.setResults(first, second)
+
+	// Ollama goes down after indexing: results are the keyword ones as-is
+	ollama.server.Close()
+	results, err := s.search("inbox scam")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	if got := strings.Join(resultIDs(results), ","); got != "v2,v1" {
+		t.Fatalf("order = %s, want the keyword order v2,v1", got)
+	}
+	if results[0]["score"] != 7.5 {
+		t.Errorf("keyword score changed to %v", results[0]["score"])
+	}
+	if _, ok := results[0]["semanticScore"]; ok {
+		t.Error("keyword-only result has a semantic score")
+	}
+
+	// Both retrievers down is an error
+	sdk.mu.Lock()
+	sdk.down = true
+	sdk.mu.Unlock()
+	if _, err := s.search("inbox scam"); err == nil {
+		t.Error("search succeeded with neither retriever")
+	}
+}
+
+func TestSemanticSearchEmptyIndexSkipsEmbedding(t *testing.T) {
+	sdk := newStubSDK(t)
+	ollama := newStubOllama(t)
+	s := newTestSemanticSearch(t, ollama.server.URL)
+
+	hit := testVideo("v1", "Spotting phishing email")
+	hit["score"] = 3.0
+	sdk.setResults(hit)
+	results, err := s.search("phishing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || ollama.calls() != 0 {
+		t.Errorf("%d results after %d embedding calls, want 1 and 0", len(results), ollama.calls())
+	}
+}
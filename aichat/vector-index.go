@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// vectorEntry is the embedding of one video
+type vectorEntry struct {
+	Vector    []float32
+	Hash      string // hash of the embedded text, to spot changes
+	UpdatedAt time.Time
+}
+
+// vectorHit is a nearest neighbour of a query
+type vectorHit struct {
+	ID         string
+	Similarity float64
+}
+
+// vectorIndex is a flat cosine similarity index over unit vectors. A linear
+// scan is exact and, at catalog sizes, fast enough not to need HNSW.
+type vectorIndex struct {
+	mu      sync.RWMutex
+	model   string
+	entries map[string]vectorEntry
+}
+
+// vectorSnapshot is the on-disk form of a vectorIndex
+type vectorSnapshot struct {
+	Version int
+	Model   string
+	Entries map[string]vectorEntry
+}
+
+const vectorSnapshotVersion = 1
+
+func newVectorIndex(model string) *vectorIndex {
+	return &vectorIndex{model: model, entries: map[string]vectorEntry{}}
+}
+
+func (x *vectorIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.entries)
+}
+
+// Hash returns the text hash stored for id
+func (x *vectorIndex) Hash(id string) (string, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	entry, ok := x.entries[id]
+	return entry.Hash, ok
+}
+
+func (x *vectorIndex) Upsert(id, hash string, vector []float32) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[id] = vectorEntry{Vector: vector, Hash: hash, UpdatedAt: time.Now().UTC()}
+}
+
+// Retain deletes every entry whose id is not in keep and returns how many
+// were deleted
+func (x *vectorIndex) Retain(keep map[string]bool) int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	deleted := 0
+	for id := range x.entries {
+		if !keep[id] {
+			delete(x.entries, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Search returns the k entries most similar to the unit vector query
+func (x *vectorIndex) Search(query []float32, k int) []vectorHit {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	hits := make([]vectorHit, 0, len(x.entries))
+	for id, entry := range x.entries {
+		if len(entry.Vector) != len(query) {
+			continue
+		}
+		var dot float64
+		for i, v := range entry.Vector {
+			dot += float64(v) * float64(query[i])
+		}
+		hits = append(hits, vectorHit{ID: id, Similarity: dot})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Similarity != hits[j].Similarity {
+			return hits[i].Similarity > hits[j].Similarity
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// Save writes the index to path atomically
+func (x *vectorIndex) Save(path string) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".vector-index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	snapshot := vectorSnapshot{Version: vectorSnapshotVersion, Model: x.model, Entries: x.entries}
+	if err := gob.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load replaces the index with the snapshot at path. Snapshots made with
+// another embedding model are ignored, since their vectors are not
+// comparable.
+func (x *vectorIndex) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snapshot vectorSnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != vectorSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	if snapshot.Model != x.model {
+		return fmt.Errorf("snapshot was made with model %q, not %q", snapshot.Model, x.model)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = snapshot.Entries
+	if x.entries == nil {
+		x.entries = map[string]vectorEntry{}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access tokens are issued by the SDK service and verified with the public
+// keys it publishes at /.well-known/jwks.json. The terminal is a root shell,
+// so only security admins may get a ticket for it (see tickets.go).
+
+const (
+	tokenIssuer    = "boringmedia-sdk"
+	tokenLeeway    = 30 * time.Second
+	jwksMaxAge     = 5 * time.Minute
+	jwksRefetchGap = 10 * time.Second
+
+	roleViewer        = "viewer"
+	roleSecurityAdmin = "security-admin"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// accessPolicy maps routes to the roles allowed to use them. Routes not
+// listed are refused. /terminal is checked against the roles in the ticket.
+var accessPolicy = map[string][]string{
+	"/terminal/ticket": {roleSecurityAdmin},
+	"/terminal":        {roleSecurityAdmin},
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID   string
+	Username string
+	Roles    []string
+}
+
+// hasRole reports whether the identity holds one of roles. Accounts without
+// roles are viewers.
+func (i *Identity) hasRole(roles ...string) bool {
+	if i == nil {
+		return false
+	}
+	have := i.Roles
+	if len(have) == 0 {
+		have = []string{roleViewer}
+	}
+	for _, role := range have {
+		for _, want := range roles {
+			if role == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksCache holds the SDK service's token verification keys
+var jwksCache struct {
+	sync.Mutex
+	keys      map[string]ed25519.PublicKey
+	fetchedAt time.Time
+}
+
+func getJWKSURL() string {
+	if jwksURL := os.Getenv("JWKS_URL"); jwksURL != "" {
+		return jwksURL
+	}
+	sdkURL := os.Getenv("SDK_URL")
+	if sdkURL == "" {
+		sdkURL = "http://sdk-service:5000"
+	}
+	return sdkURL + "/.well-known/jwks.json"
+}
+
+func fetchJWKS() (map[string]ed25519.PublicKey, error) {
+	resp, err := jwksClient.Get(getJWKSURL())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			Kid string `json:"kid"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]ed25519.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.Kid] = ed25519.PublicKey(x)
+	}
+	return keys, nil
+}
+
+// verificationKey returns the public key with the given ID, refetching the
+// key set when it is stale or, at most every jwksRefetchGap, when the ID is
+// unknown
+func verificationKey(kid string) (ed25519.PublicKey, error) {
+	jwksCache.Lock()
+	defer jwksCache.Unlock()
+
+	key, ok := jwksCache.keys[kid]
+	age := time.Since(jwksCache.fetchedAt)
+	if ok && age < jwksMaxAge {
+		return key, nil
+	}
+	if !ok && age < jwksRefetchGap {
+		return nil, errInvalidToken
+	}
+	keys, err := fetchJWKS()
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	jwksCache.keys = keys
+	jwksCache.fetchedAt = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errInvalidToken
+}
+
+// verifyAccessToken checks an access token's signature, issuer and expiry
+func verifyAccessToken(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "EdDSA" {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := verificationKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims struct {
+		Issuer    string   `json:"iss"`
+		Subject   string   `json:"sub"`
+		Username  string   `json:"username"`
+		Roles     []string `json:"roles"`
+		Type      string   `json:"token_use"`
+		ExpiresAt int64    `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.Issuer != tokenIssuer || claims.Type != "access" || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Add(-tokenLeeway).Unix() >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+	return &Identity{UserID: claims.Subject, Username: claims.Username, Roles: claims.Roles}, nil
+}
+
+// auditEvent logs a security relevant event as a JSON audit line
+func auditEvent(r *http.Request, eventType string, identity *Identity, details map[string]interface{}) {
+	event := map[string]interface{}{
+		"time":       time.Now().UTC(),
+		"type":       eventType,
+		"service":    "containerxdr",
+		"path":       r.URL.Path,
+		"remoteAddr": r.RemoteAddr,
+	}
+	for k, v := range details {
+		event[k] = v
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event["remoteAddr"] = host
+	}
+	if identity != nil {
+		event["actor"] = identity.Username
+		if len(identity.Roles) > 0 {
+			event["roles"] = identity.Roles
+		}
+	}
+	line, _ := json.Marshal(event)
+	log.Printf("AUDIT %s", line)
+}
+
+// denied returns the details of an access_denied audit event
+func denied(status int, reason string) map[string]interface{} {
+	return map[string]interface{}{"status": status, "reason": reason}
+}
+
+// authorize checks the bearer access token of r against accessPolicy. It
+// answers 401 or 403 and returns nil when the caller may not continue.
+func authorize(w http.ResponseWriter, r *http.Request) *Identity {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		auditEvent(r, "access_denied", nil, denied(http.StatusUnauthorized, "no access token"))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="containerxdr"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil
+	}
+	identity, err := verifyAccessToken(token)
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			log.Printf("verifying access token: %v", err)
+		}
+		auditEvent(r, "access_denied", nil, denied(http.StatusUnauthorized, "invalid access token"))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="containerxdr", error="invalid_token"`)
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return nil
+	}
+	required, ok := accessPolicy[r.URL.Path]
+	if !ok || !identity.hasRole(required...) {
+		auditEvent(r, "access_denied", identity, denied(http.StatusForbidden, "missing role"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+	return identity
+}
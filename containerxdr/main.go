@@ -3,7 +3,9 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
@@ -58,25 +60,23 @@ var upgrader = websocket.Upgrader{
 		}
 		
 		// Check wildcard patterns (for cloud load balancers and localhost)
+		// against the parsed origin, so "http://x.run.app.evil.com" does not
+		// pass as "*.run.app"
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Printf("WebSocket origin rejected: %s", origin)
+			return false
+		}
+		host := u.Hostname()
 		for _, allowed := range allowedOrigins {
-			if strings.Contains(allowed, "*") {
-				// Handle localhost:* pattern
-				if strings.Contains(allowed, "localhost:*") {
-					if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "https://localhost:") {
-						return true
-					}
-					continue
-				}
-				
-				// Extract the domain part after the wildcard
-				// "http://*.cloudapp.azure.com" → ".cloudapp.azure.com"
-				parts := strings.Split(allowed, "*")
-				if len(parts) == 2 && strings.Contains(origin, parts[1]) {
-					// Also check the protocol matches
-					if strings.HasPrefix(origin, parts[0]) {
-						return true
-					}
-				}
+			// "http://*.run.app" → "http://" and ".run.app"; localhost:* is
+			// handled below
+			scheme, domain, ok := strings.Cut(allowed, "*")
+			if !ok || !strings.HasPrefix(domain, ".") {
+				continue
+			}
+			if u.Scheme+"://" == scheme && strings.HasSuffix(host, domain) {
+				return true
 			}
 		}
 		
@@ -89,15 +89,12 @@ var upgrader = websocket.Upgrader{
 			}
 		}
 		
-		// Allow development IPs and localhost with common ports
-		if strings.Contains(origin, "127.0.0.1") ||
-		   strings.Contains(origin, "192.168.") ||
-		   strings.Contains(origin, "10.0.") {
+		// Allow localhost with any port for development; other development
+		// origins, such as a LAN address, go in ALLOWED_ORIGINS
+		if host == "localhost" {
 			return true
 		}
-		
-		// Allow localhost with any port for development
-		if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "https://localhost:") {
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
 			return true
 		}
 		
@@ -114,6 +111,22 @@ var upgrader = websocket.Upgrader{
 }
 
 func terminalWS(w http.ResponseWriter, r *http.Request) {
+	// The shell is only started for a valid, unused ticket of a user the
+	// policy lets in; see tickets.go
+	ticket, err := redeemTicket(r.URL.Query().Get("ticket"), r.Header.Get("Origin"))
+	if err != nil {
+		auditEvent(r, "access_denied", nil, denied(http.StatusUnauthorized, err.Error()))
+		w.Header().Set("WWW-Authenticate", `Ticket realm="containerxdr"`)
+		http.Error(w, "A valid terminal ticket is required", http.StatusUnauthorized)
+		return
+	}
+	identity := &Identity{UserID: ticket.UserID, Username: ticket.Username, Roles: ticket.Roles}
+	if !identity.hasRole(accessPolicy["/terminal"]...) {
+		auditEvent(r, "access_denied", identity, denied(http.StatusForbidden, "missing role"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("upgrade:", err)
@@ -121,8 +134,19 @@ func terminalWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	// Record the session against the ticket's user
+	started := time.Now()
+	auditEvent(r, "terminal_session_opened", identity, map[string]interface{}{"session": ticket.ID})
+	defer func() {
+		auditEvent(r, "terminal_session_closed", identity, map[string]interface{}{
+			"session":         ticket.ID,
+			"durationSeconds": int(time.Since(started).Seconds()),
+		})
+	}()
+
 	// 1. Launch a login shell inside a PTY
 	cmd := exec.Command("bash", "-l") // or "sh" on alpine
+	cmd.Env = append(os.Environ(), "TERMINAL_USER="+ticket.Username, "TERMINAL_SESSION="+ticket.ID)
 	ptyFile, err := pty.Start(cmd)
 	if err != nil {
 		log.Println("pty start:", err)
@@ -159,6 +183,10 @@ func terminalWS(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if err := initTickets(); err != nil {
+		log.Fatalf("terminal tickets: %v", err)
+	}
+	http.HandleFunc("/terminal/ticket", ticketHandler)
 	http.HandleFunc("/terminal", terminalWS)
 	log.Println("WS PTY ready on :8081/terminal")
 	log.Fatal(http.ListenAndServe(":8081", nil))
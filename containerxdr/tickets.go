@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Terminal tickets let a browser open the terminal WebSocket, whose
+// handshake cannot carry an Authorization header, without putting an
+// access token in the URL. A ticket is issued to a security admin by
+// POST /terminal/ticket and is an HMAC-signed claim set bound to the user,
+// the requesting Origin and a short expiry. It opens one session: redeemed
+// ticket IDs are remembered until they expire. The signing key lives in
+// memory only, so tickets are valid on the replica that issued them.
+
+const (
+	defaultTicketTTL = 30 * time.Second
+	maxTicketTTL     = 5 * time.Minute
+)
+
+var (
+	errTicketInvalid = errors.New("invalid ticket")
+	errTicketExpired = errors.New("ticket expired")
+	errTicketUsed    = errors.New("ticket already used")
+	errTicketOrigin  = errors.New("ticket issued to another origin")
+)
+
+// terminalTicket is the signed content of a ticket
+type terminalTicket struct {
+	ID        string   `json:"jti"`
+	UserID    string   `json:"sub"`
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles,omitempty"`
+	Origin    string   `json:"origin,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// tickets holds the signing key and the IDs of redeemed tickets
+var tickets struct {
+	sync.Mutex
+	key  []byte
+	ttl  time.Duration
+	used map[string]time.Time // ticket ID -> expiry
+}
+
+// initTickets makes the signing key and reads TERMINAL_TICKET_TTL
+func initTickets() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	ttl := defaultTicketTTL
+	if value := os.Getenv("TERMINAL_TICKET_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxTicketTTL {
+			return fmt.Errorf("TERMINAL_TICKET_TTL must be a duration up to %s, got %q", maxTicketTTL, value)
+		}
+		ttl = d
+	}
+	tickets.Lock()
+	defer tickets.Unlock()
+	tickets.key = key
+	tickets.ttl = ttl
+	tickets.used = map[string]time.Time{}
+	return nil
+}
+
+func signTicket(payload string) string {
+	mac := hmac.New(sha256.New, tickets.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueTicket makes a ticket for identity, usable from origin
+func issueTicket(identity *Identity, origin string) (string, *terminalTicket, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	tickets.Lock()
+	defer tickets.Unlock()
+
+	ticket := &terminalTicket{
+		ID:        hex.EncodeToString(id),
+		UserID:    identity.UserID,
+		Username:  identity.Username,
+		Roles:     identity.Roles,
+		Origin:    origin,
+		ExpiresAt: time.Now().Add(tickets.ttl).Unix(),
+	}
+	payload, err := json.Marshal(ticket)
+	if err != nil {
+		return "", nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signTicket(encoded), ticket, nil
+}
+
+// redeemTicket verifies a ticket presented from origin and marks it used
+func redeemTicket(value, origin string) (*terminalTicket, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errTicketInvalid
+	}
+
+	tickets.Lock()
+	defer tickets.Unlock()
+
+	if !hmac.Equal([]byte(signature), []byte(signTicket(encoded))) {
+		return nil, errTicketInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errTicketInvalid
+	}
+	var ticket terminalTicket
+	if err := json.Unmarshal(payload, &ticket); err != nil || ticket.ID == "" {
+		return nil, errTicketInvalid
+	}
+	now := time.Now()
+	if now.Unix() >= ticket.ExpiresAt {
+		return nil, errTicketExpired
+	}
+	if ticket.Origin != origin {
+		return nil, errTicketOrigin
+	}
+
+	for id, expiry := range tickets.used {
+		if now.After(expiry) {
+			delete(tickets.used, id)
+		}
+	}
+	if _, used := tickets.used[ticket.ID]; used {
+		return nil, errTicketUsed
+	}
+	tickets.used[ticket.ID] = time.Unix(ticket.ExpiresAt, 0)
+	return &ticket, nil
+}
+
+// ticketHandler serves POST /terminal/ticket to callers whose access token
+// carries a role accessPolicy allows
+func ticketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := authorize(w, r)
+	if identity == nil {
+		return
+	}
+
+	value, ticket, err := issueTicket(identity, r.Header.Get("Origin"))
+	if err != nil {
+		log.Printf("issuing terminal ticket: %v", err)
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+	auditEvent(r, "terminal_ticket_issued", identity, map[string]interface{}{"ticket": ticket.ID})
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":    value,
+		"expiresAt": time.Unix(ticket.ExpiresAt, 0).UTC(),
+		"expiresIn": ticket.ExpiresAt - time.Now().Unix(),
+	})
+}
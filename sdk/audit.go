@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditEvent records a security relevant action
+type AuditEvent struct {
+	ID         primitive.ObjectID     `json:"_id" bson:"_id"`
+	Time       time.Time              `json:"time" bson:"time"`
+	Type       string                 `json:"type" bson:"type"`
+	Actor      string                 `json:"actor,omitempty" bson:"actor,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty" bson:"remoteAddr,omitempty"`
+	UserAgent  string                 `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+func auditEvents() *mongo.Collection {
+	return db.Collection("audit_events")
+}
+
+// recordAudit logs an audit event and stores it in the audit_events
+// collection. r may be nil for events not caused by a request.
+func recordAudit(r *http.Request, eventType string, details map[string]interface{}) {
+	event := AuditEvent{
+		ID:      primitive.NewObjectID(),
+		Time:    time.Now().UTC(),
+		Type:    eventType,
+		Details: details,
+	}
+	if r != nil {
+		event.RemoteAddr = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			event.RemoteAddr = host
+		}
+		event.UserAgent = r.UserAgent()
+		if identity := identityFrom(r); identity != nil {
+			event.Actor = identity.Username
+		}
+	}
+
+	detailsJSON, _ := json.Marshal(details)
+	log.Printf("AUDIT %s from %q: %s", eventType, event.RemoteAddr, detailsJSON)
+
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := auditEvents().InsertOne(ctx, event); err != nil {
+		log.Printf("Failed to store audit event %s: %v", eventType, err)
+	}
+}
+
+// List audit events, newest first. ?type= filters by event type and
+// ?limit= caps the result (default 100, max 1000).
+func listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, "GET, OPTIONS")
+		return
+	}
+	setCORSHeaders(w, r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filter["type"] = eventType
+	}
+	limit := int64(100)
+	if n, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && n > 0 && n <= 1000 {
+		limit = n
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit)
+	cursor, err := auditEvents().Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("Failed to list audit events: %v", err)
+		http.Error(w, "Failed to list audit events", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	events := []AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		log.Printf("Failed to decode audit events: %v", err)
+		http.Error(w, "Failed to decode audit events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tokenSettings holds the token lifetimes, from the environment
+var tokenSettings = struct {
+	accessTTL   time.Duration
+	refreshTTL  time.Duration
+	keyRotation time.Duration
+}{
+	accessTTL:   15 * time.Minute,
+	refreshTTL:  30 * 24 * time.Hour,
+	keyRotation: 24 * time.Hour,
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
+// dummyPasswordHash is verified against when a login names an unknown user,
+// so the response takes as long as for a wrong password
+var dummyPasswordHash string
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID    string
+	Username  string
+	Roles     []string
+	TokenID   string
+	ExpiresAt time.Time
+}
+
+type identityKey struct{}
+
+// identityFrom returns the caller attached by withIdentity, or nil
+func identityFrom(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// refreshToken records an issued refresh token. Each refresh uses the token
+// up and issues the next one in the same family; presenting a used token
+// again revokes the whole family, since one of the two holders stole it.
+type refreshToken struct {
+	ID        string             `bson:"_id"`
+	Family    string             `bson:"family"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	IssuedAt  time.Time          `bson:"issuedAt"`
+	ExpireAt  time.Time          `bson:"expireAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty"`
+	RevokedAt *time.Time         `bson:"revokedAt,omitempty"`
+}
+
+func refreshTokens() *mongo.Collection {
+	return db.Collection("refresh_tokens")
+}
+
+// revokedTokens lists access tokens revoked before they expire
+func revokedTokens() *mongo.Collection {
+	return db.Collection("revoked_tokens")
+}
+
+// initAuth reads the token settings and prepares the auth collections
+func initAuth() error {
+	for name, setting := range map[string]*time.Duration{
+		"ACCESS_TOKEN_TTL":  &tokenSettings.accessTTL,
+		"REFRESH_TOKEN_TTL": &tokenSettings.refreshTTL,
+		"JWT_KEY_ROTATION":  &tokenSettings.keyRotation,
+	} {
+		if v := strings.TrimSpace(getEnvOrDefault(name, "")); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s %q", name, v)
+			}
+			*setting = d
+		}
+	}
+
+	hash, err := hashPassword("not a real password")
+	if err != nil {
+		return err
+	}
+	dummyPasswordHash = hash
+
+	if db == nil {
+		return nil
+	}
+	ensureSigningKeyIndexes()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ttl := options.Index().SetExpireAfterSeconds(0)
+	if _, err := refreshTokens().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: ttl},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	}); err != nil {
+		log.Printf("Failed to create refresh token indexes: %v", err)
+	}
+	if _, err := revokedTokens().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: ttl,
+	}); err != nil {
+		log.Printf("Failed to create revoked token indexes: %v", err)
+	}
+	// Accounts with a password must have distinct usernames. The seeded
+	// profiles share the plain username index, so this one is partial.
+	if _, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetName("username_account").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"passwordHash": bson.M{"$exists": true}}),
+	}); err != nil {
+		log.Printf("Failed to create user account index: %v", err)
+	}
+	// Emails are unique so an account can be found, and linked, by its
+	// email; accounts without one store ""
+	if _, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetName("email_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+	}); err != nil {
+		log.Printf("Failed to create user email index: %v", err)
+	}
+	return nil
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tokenResponse is the answer to register, login and refresh
+type tokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"`
+	User         *User  `json:"user,omitempty"`
+}
+
+// issueTokens signs an access token and a refresh token in family, starting
+// a new family when family is empty
+func issueTokens(ctx context.Context, user *User, family string) (*tokenResponse, error) {
+	now := time.Now().UTC()
+	if family == "" {
+		family = newTokenID()
+	}
+	access := tokenClaims{
+		Issuer:    tokenIssuer,
+		Subject:   user.ID.Hex(),
+		Username:  user.Username,
+		Roles:     user.Roles,
+		Type:      tokenTypeAccess,
+		ID:        newTokenID(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenSettings.accessTTL).Unix(),
+	}
+	refresh := access
+	refresh.Type = tokenTypeRefresh
+	refresh.ID = newTokenID()
+	refresh.Family = family
+	refresh.ExpiresAt = now.Add(tokenSettings.refreshTTL).Unix()
+
+	accessToken, err := signToken(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+	refreshTokenString, err := signToken(ctx, refresh)
+	if err != nil {
+		return nil, err
+	}
+	_, err = refreshTokens().InsertOne(ctx, refreshToken{
+		ID:       refresh.ID,
+		Family:   family,
+		UserID:   user.ID,
+		IssuedAt: now,
+		ExpireAt: time.Unix(refresh.ExpiresAt, 0).UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshTokenString,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(tokenSettings.accessTTL.Seconds()),
+	}, nil
+}
+
+func writeTokens(w http.ResponseWriter, status int, tokens *tokenResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// decodeAuthBody decodes a small JSON request body
+func decodeAuthBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(v); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// registerHandler creates an account: POST /auth/register with
+// {"username", "password", "name", "email"}
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+	}
+	if !decodeAuthBody(w, r, &req) {
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	req.Name = strings.TrimSpace(req.Name)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if !usernamePattern.MatchString(req.Username) {
+		http.Error(w, "username must be 3-30 lowercase letters, digits or underscores", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Email != "" {
+		if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Name == "" {
+		req.Name = req.Username
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	users := db.Collection("users")
+	taken := bson.A{bson.M{"username": req.Username}}
+	if req.Email != "" {
+		taken = append(taken, bson.M{"email": req.Email})
+	}
+	err := users.FindOne(ctx, bson.M{"$or": taken}).Err()
+	if err == nil {
+		http.Error(w, "Username or email already registered", http.StatusConflict)
+		return
+	} else if err != mongo.ErrNoDocuments {
+		log.Printf("Failed to check for existing user: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		log.Printf("Failed to hash password: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	user := User{
+		Username:      req.Username,
+		Name:          req.Name,
+		Email:         req.Email,
+		JoinDate:      time.Now().UTC(),
+		Subscriptions: []string{},
+		PasswordHash:  hash,
+		Roles:         []string{roleViewer},
+	}
+	result, err := users.InsertOne(ctx, user)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "Username or email already registered", http.StatusConflict)
+		} else {
+			log.Printf("Failed to insert user: %v", err)
+			http.Error(w, "Failed to register", http.StatusInternalServerError)
+		}
+		return
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+
+	tokens, err := issueTokens(ctx, &user, "")
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "auth.register", map[string]interface{}{"username": user.Username})
+	tokens.User = &user
+	w.Header().Set("Location", "/users/"+user.Username)
+	writeTokens(w, http.StatusCreated, tokens)
+}
+
+// loginHandler checks a password: POST /auth/login with
+// {"username", "password"}
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !decodeAuthBody(w, r, &req) {
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if req.Username == "" || req.Password == "" || len(req.Password) > maxPasswordLength {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user User
+	err := db.Collection("users").FindOne(ctx, bson.M{
+		"username":     req.Username,
+		"passwordHash": bson.M{"$exists": true},
+	}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Failed to find user: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	hash := user.PasswordHash
+	if err == mongo.ErrNoDocuments {
+		hash = dummyPasswordHash
+	}
+	ok, verr := verifyPassword(req.Password, hash)
+	if verr != nil {
+		log.Printf("Unusable password hash for %q: %v", req.Username, verr)
+	}
+	if err == mongo.ErrNoDocuments || !ok {
+		recordAudit(r, "auth.login_failed", map[string]interface{}{"username": req.Username})
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	if needsRehash(user.PasswordHash) {
+		if hash, err := hashPassword(req.Password); err == nil {
+			db.Collection("users").UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"passwordHash": hash}})
+		}
+	}
+
+	tokens, err := issueTokens(ctx, &user, "")
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "auth.login", map[string]interface{}{"username": user.Username})
+	tokens.User = &user
+	writeTokens(w, http.StatusOK, tokens)
+}
+
+// revokeFamily revokes every refresh token of a family
+func revokeFamily(ctx context.Context, family string) error {
+	now := time.Now().UTC()
+	_, err := refreshTokens().UpdateMany(ctx,
+		bson.M{"family": family, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now}})
+	return err
+}
+
+// refreshHandler trades a refresh token for a new token pair: POST
+// /auth/refresh with {"refreshToken"}
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if !decodeAuthBody(w, r, &req) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claims, err := parseToken(ctx, req.RefreshToken, tokenTypeRefresh)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	var stored refreshToken
+	err = refreshTokens().FindOneAndUpdate(ctx,
+		bson.M{"_id": claims.ID, "usedAt": bson.M{"$exists": false}, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": now}}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		// Used or revoked already: treat as theft and end the session
+		if err := revokeFamily(ctx, claims.Family); err != nil {
+			log.Printf("Failed to revoke token family %s: %v", claims.Family, err)
+		}
+		recordAudit(r, "auth.refresh_reuse", map[string]interface{}{"username": claims.Username, "family": claims.Family})
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Failed to use refresh token: %v", err)
+		http.Error(w, "Failed to refresh", http.StatusInternalServerError)
+		return
+	}
+
+	var user User
+	err = db.Collection("users").FindOne(ctx, bson.M{"_id": stored.UserID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		revokeFamily(ctx, stored.Family)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Failed to find user: %v", err)
+		http.Error(w, "Failed to refresh", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(ctx, &user, stored.Family)
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		http.Error(w, "Failed to refresh", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, http.StatusOK, tokens)
+}
+
+// logoutHandler ends a session: POST /auth/logout with the access token in
+// Authorization and optionally {"refreshToken"}. The access token is
+// revoked until it expires and the refresh token's family is revoked.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	identity := identityFrom(r)
+	if identity == nil || identity.TokenID == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sdk"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if r.ContentLength != 0 && !decodeAuthBody(w, r, &req) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := revokedTokens().UpdateOne(ctx, bson.M{"_id": identity.TokenID},
+		bson.M{"$set": bson.M{"expireAt": identity.ExpiresAt.Add(tokenLeeway)}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Failed to revoke access token: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	if req.RefreshToken != "" {
+		claims, err := parseToken(ctx, req.RefreshToken, tokenTypeRefresh)
+		if err == nil && claims.Subject == identity.UserID {
+			if err := revokeFamily(ctx, claims.Family); err != nil {
+				log.Printf("Failed to revoke token family %s: %v", claims.Family, err)
+			}
+		}
+	}
+	recordAudit(r, "auth.logout", map[string]interface{}{"username": identity.Username})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// meHandler returns the caller's account: GET /auth/me
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	identity := identityFrom(r)
+	if identity == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sdk"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(identity.UserID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user User
+	err = db.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to find user: %v", err)
+		http.Error(w, "Failed to find user", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// authHandler routes /auth/{action}
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, "/auth/")
+	methods := map[string]string{
+		"register": http.MethodPost,
+		"login":    http.MethodPost,
+		"refresh":  http.MethodPost,
+		"logout":   http.MethodPost,
+		"me":       http.MethodGet,
+	}
+	method, ok := methods[action]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, method+", OPTIONS")
+		return
+	}
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "register":
+		registerHandler(w, r)
+	case "login":
+		loginHandler(w, r)
+	case "refresh":
+		refreshHandler(w, r)
+	case "logout":
+		logoutHandler(w, r)
+	case "me":
+		meHandler(w, r)
+	}
+}
+
+// withIdentity attaches the caller of a request bearing a valid access
+// token or ADMIN_TOKEN. Requests without a bearer token pass through
+// anonymously; any other token, or a JWT that has expired or was revoked,
+// is refused with 401.
+func withIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !looksLikeJWT(token) {
+			identity := adminTokenIdentity(token)
+			if identity == nil {
+				setCORSHeaders(w, r)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sdk", error="invalid_token"`)
+				http.Error(w, "Invalid access token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		claims, err := parseToken(ctx, token, tokenTypeAccess)
+		if err == nil {
+			err = revokedTokens().FindOne(ctx, bson.M{"_id": claims.ID}).Err()
+			if err == nil {
+				err = errInvalidToken
+			} else if err == mongo.ErrNoDocuments {
+				err = nil
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, errInvalidToken) && !errors.Is(err, errTokenExpired) {
+				log.Printf("Failed to verify access token: %v", err)
+			}
+			setCORSHeaders(w, r)
+			description := "invalid"
+			if errors.Is(err, errTokenExpired) {
+				description = "expired"
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="sdk", error="invalid_token", error_description="token %s"`, description))
+			http.Error(w, "Invalid access token", http.StatusUnauthorized)
+			return
+		}
+
+		identity := &Identity{
+			UserID:    claims.Subject,
+			Username:  claims.Username,
+			Roles:     claims.Roles,
+			TokenID:   claims.ID,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
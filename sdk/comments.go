@@ -0,0 +1,726 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Comments live in their own collection, one document per comment or reply,
+// so a busy thread does not grow the video document. Videos keep only
+// commentCount, the number of comments and replies that are not deleted.
+
+const (
+	defaultCommentPageSize = 20
+	maxCommentPageSize     = 100
+	maxCommentLength       = 5000
+	maxCommentRevisions    = 50
+)
+
+// Comment is a comment on a video, or a reply to another comment
+type Comment struct {
+	ID             primitive.ObjectID  `json:"_id" bson:"_id"`
+	VideoID        primitive.ObjectID  `json:"videoId" bson:"videoId"`
+	ParentID       *primitive.ObjectID `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	Author         string              `json:"author" bson:"author"`
+	AuthorUsername string              `json:"authorUsername" bson:"authorUsername"`
+	AuthorAvatar   string              `json:"authorAvatar" bson:"authorAvatar"`
+	Text           string              `json:"text" bson:"text"`
+	Timestamp      time.Time           `json:"timestamp" bson:"timestamp"`
+	EditedAt       *time.Time          `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+	History        []CommentRevision   `json:"history,omitempty" bson:"history,omitempty"`
+	Likes          int                 `json:"likes" bson:"likes"`
+	Replies        int                 `json:"replies" bson:"replies"`
+	Deleted        bool                `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	DeletedAt      *time.Time          `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	DeletedBy      string              `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	LegacyID       string              `json:"-" bson:"legacyId,omitempty"` // ID in the old embedded array
+}
+
+// CommentRevision is an earlier text of an edited comment
+type CommentRevision struct {
+	Text      string    `json:"text" bson:"text"`
+	WrittenAt time.Time `json:"writtenAt" bson:"writtenAt"`
+}
+
+// redact hides the content of a deleted comment from everyone but staff
+func (c *Comment) redact(r *http.Request) {
+	if !c.Deleted || identityFrom(r).hasRole(roleModerator, roleSecurityAdmin) {
+		return
+	}
+	c.Author, c.AuthorUsername, c.AuthorAvatar, c.Text = "", "", "", ""
+	c.History = nil
+	c.DeletedBy = ""
+}
+
+// commentSorts are the orders of GET /videos/{id}/comments, paged with the
+// same cursors as the video list
+var commentSorts = map[string]videoSort{
+	"newest": {"timestamp", false},
+	"oldest": {"timestamp", true},
+	"top":    {"likes", false},
+}
+
+func comments() *mongo.Collection {
+	return db.Collection("comments")
+}
+
+func commentLikes() *mongo.Collection {
+	return db.Collection("comment_likes")
+}
+
+func ensureCommentIndexes() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := comments().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "parentId", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "parentId", Value: 1}, {Key: "likes", Value: -1}, {Key: "_id", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "legacyId", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"legacyId": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to create comment indexes: %v", err)
+	}
+	_, err = commentLikes().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "videoId", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create comment like indexes: %v", err)
+	}
+}
+
+// legacyComment is a comment in the comments array of a video document
+type legacyComment struct {
+	ID             string    `bson:"id"`
+	Author         string    `bson:"author"`
+	AuthorUsername string    `bson:"authorUsername"`
+	AuthorAvatar   string    `bson:"authorAvatar"`
+	Text           string    `bson:"text"`
+	Timestamp      time.Time `bson:"timestamp"`
+	Likes          int       `bson:"likes"`
+}
+
+// migrateEmbeddedComments moves the comments arrays of video documents into
+// the comments collection and sets commentCount. Comments are upserted by
+// their old ID and the array is only removed afterwards, so an interrupted
+// migration is finished at the next start.
+func migrateEmbeddedComments() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	videos := db.Collection("videos")
+	cursor, err := videos.Find(ctx, bson.M{"comments": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"comments": 1}))
+	if err != nil {
+		log.Printf("Failed to find videos with embedded comments: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	migratedVideos, migratedComments := 0, 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Comments []legacyComment    `bson:"comments"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			log.Printf("Failed to decode embedded comments: %v", err)
+			continue
+		}
+		failed := false
+		for i, old := range doc.Comments {
+			legacyID := old.ID
+			if legacyID == "" {
+				legacyID = "index_" + strconv.Itoa(i)
+			}
+			if old.Timestamp.IsZero() {
+				old.Timestamp = time.Now().UTC()
+			}
+			comment := Comment{
+				ID:             primitive.NewObjectID(),
+				VideoID:        doc.ID,
+				Author:         old.Author,
+				AuthorUsername: old.AuthorUsername,
+				AuthorAvatar:   old.AuthorAvatar,
+				Text:           old.Text,
+				Timestamp:      old.Timestamp,
+				Likes:          old.Likes,
+				LegacyID:       legacyID,
+			}
+			_, err := comments().UpdateOne(ctx,
+				bson.M{"videoId": doc.ID, "legacyId": legacyID},
+				bson.M{"$setOnInsert": comment},
+				options.Update().SetUpsert(true))
+			if err != nil {
+				log.Printf("Failed to migrate comment %s of video %s: %v", legacyID, doc.ID.Hex(), err)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			continue
+		}
+		count, err := comments().CountDocuments(ctx, bson.M{"videoId": doc.ID, "deleted": bson.M{"$ne": true}})
+		if err != nil {
+			log.Printf("Failed to count comments of video %s: %v", doc.ID.Hex(), err)
+			continue
+		}
+		_, err = videos.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{
+			"$set":   bson.M{"commentCount": count},
+			"$unset": bson.M{"comments": ""},
+		})
+		if err != nil {
+			log.Printf("Failed to finish comment migration of video %s: %v", doc.ID.Hex(), err)
+			continue
+		}
+		migratedVideos++
+		migratedComments += len(doc.Comments)
+	}
+	if migratedVideos > 0 {
+		log.Printf("Moved %d comments of %d videos into the comments collection", migratedComments, migratedVideos)
+	}
+}
+
+// deleteVideoComments removes the comments and comment likes of a deleted
+// video
+func deleteVideoComments(ctx context.Context, videoID primitive.ObjectID) {
+	if _, err := comments().DeleteMany(ctx, bson.M{"videoId": videoID}); err != nil {
+		log.Printf("Failed to delete comments of video %s: %v", videoID.Hex(), err)
+	}
+	if _, err := commentLikes().DeleteMany(ctx, bson.M{"videoId": videoID}); err != nil {
+		log.Printf("Failed to delete comment likes of video %s: %v", videoID.Hex(), err)
+	}
+}
+
+// commentsHandler routes /videos/{id}/comments[/{commentId}[/like]]
+func commentsHandler(w http.ResponseWriter, r *http.Request, id, path string) {
+	videoID, err := primitive.ObjectIDFromHex(id)
+	if err != nil && r.Method != http.MethodOptions {
+		setCORSHeaders(w, r)
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+	commentID, action, _ := strings.Cut(path, "/")
+
+	switch {
+	case commentID == "":
+		switch r.Method {
+		case http.MethodOptions:
+			handlePreflight(w, r, "GET, POST, OPTIONS")
+		case http.MethodGet:
+			listComments(w, r, videoID)
+		case http.MethodPost:
+			createComment(w, r, videoID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case action == "":
+		switch r.Method {
+		case http.MethodOptions:
+			handlePreflight(w, r, "GET, PATCH, DELETE, OPTIONS")
+		case http.MethodGet:
+			getComment(w, r, videoID, commentID)
+		case http.MethodPatch:
+			editComment(w, r, videoID, commentID)
+		case http.MethodDelete:
+			deleteComment(w, r, videoID, commentID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case action == "like":
+		switch r.Method {
+		case http.MethodOptions:
+			handlePreflight(w, r, "PUT, DELETE, OPTIONS")
+		case http.MethodPut, http.MethodDelete:
+			likeComment(w, r, videoID, commentID, r.Method == http.MethodPut)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// findComment loads a comment of a video, answering 400 or 404 when there
+// is none
+func findComment(ctx context.Context, w http.ResponseWriter, videoID primitive.ObjectID, id string) (*Comment, bool) {
+	commentID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return nil, false
+	}
+	var comment Comment
+	err = comments().FindOne(ctx, bson.M{"_id": commentID, "videoId": videoID}).Decode(&comment)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("Failed to find comment %s: %v", id, err)
+		http.Error(w, "Failed to find comment", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &comment, true
+}
+
+// validateCommentText trims a comment and checks its length
+func validateCommentText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("text is required")
+	}
+	if utf8.RuneCountInString(text) > maxCommentLength {
+		return "", fmt.Errorf("text must be at most %d characters", maxCommentLength)
+	}
+	return text, nil
+}
+
+// List a page of a video's comments. Query parameters: parent (a comment ID
+// to list its replies instead of the top-level comments), sort (newest,
+// oldest or top), limit (1-100, default 20) and after (the cursor from the
+// previous page's next link). Deleted comments are only listed while they
+// have replies. The number of listed comments is returned in X-Total-Count
+// and the next page in Link.
+func listComments(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	filter := bson.M{
+		"videoId":  videoID,
+		"parentId": nil,
+		"$or":      bson.A{bson.M{"deleted": bson.M{"$ne": true}}, bson.M{"replies": bson.M{"$gt": 0}}},
+	}
+	if parent := query.Get("parent"); parent != "" {
+		parentID, err := primitive.ObjectIDFromHex(parent)
+		if err != nil {
+			http.Error(w, "Invalid parent comment ID", http.StatusBadRequest)
+			return
+		}
+		filter["parentId"] = parentID
+	}
+
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = "newest"
+	}
+	sort, ok := commentSorts[sortName]
+	if !ok {
+		http.Error(w, "Invalid sort: use newest, oldest or top", http.StatusBadRequest)
+		return
+	}
+	limit, ok := queryLimit(r, defaultCommentPageSize, maxCommentPageSize)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invalid limit: must be between 1 and %d", maxCommentPageSize), http.StatusBadRequest)
+		return
+	}
+
+	total, err := comments().CountDocuments(ctx, filter)
+	if err != nil {
+		log.Printf("Failed to count comments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+
+	pageFilter := filter
+	if token := query.Get("after"); token != "" {
+		after, id, err := decodeVideoCursor(token)
+		if err != nil || after.Sort != sortName {
+			http.Error(w, "Invalid cursor for this sort", http.StatusBadRequest)
+			return
+		}
+		pageFilter = bson.M{"$and": bson.A{filter, afterFilter(sort, after, id)}}
+	}
+	direction := -1
+	if sort.asc {
+		direction = 1
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: sort.field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(bson.M{"history": 0, "legacyId": 0})
+	cursor, err := comments().Find(ctx, pageFilter, opts)
+	if err != nil {
+		log.Printf("Failed to query comments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var docs []bson.Raw
+	if err := cursor.All(ctx, &docs); err != nil {
+		log.Printf("Failed to decode comments: %v", err)
+		http.Error(w, "Failed to decode comments", http.StatusInternalServerError)
+		return
+	}
+
+	// The extra document only tells whether there is a next page
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = cursorAfter(sortName, sort, docs[limit-1]).encode()
+	}
+
+	page := make([]Comment, 0, len(docs))
+	for _, doc := range docs {
+		var comment Comment
+		if err := bson.Unmarshal(doc, &comment); err != nil {
+			log.Printf("Failed to decode comment: %v", err)
+			http.Error(w, "Failed to decode comments", http.StatusInternalServerError)
+			return
+		}
+		comment.redact(r)
+		page = append(page, comment)
+	}
+
+	base := "/videos/" + videoID.Hex() + "/comments"
+	links := []string{}
+	if query.Get("after") != "" {
+		first := cloneValues(query)
+		first.Del("after")
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="first"`, base, first.Encode()))
+	}
+	if next != "" {
+		nextQuery := cloneValues(query)
+		nextQuery.Set("after", next)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="next"`, base, nextQuery.Encode()))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// Get one comment with its edit history
+func getComment(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	comment, ok := findComment(ctx, w, videoID, id)
+	if !ok {
+		return
+	}
+	comment.redact(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+// Comment on a video as the caller: POST /videos/{id}/comments with
+// {"text", "parentId"}, parentId replying to a comment of the same video
+func createComment(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req struct {
+		Text     string `json:"text"`
+		ParentID string `json:"parentId"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	text, err := validateCommentText(req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := identityFrom(r)
+	var author User
+	err = db.Collection("users").FindOne(ctx, bson.M{"username": identity.Username}).Decode(&author)
+	if err == mongo.ErrNoDocuments {
+		denyAccess(w, r, nil, "comments need an account")
+		return
+	} else if err != nil {
+		log.Printf("Failed to find user %q: %v", identity.Username, err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.Collection("videos").FindOne(ctx, bson.M{"_id": videoID},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to find video %s: %v", videoID.Hex(), err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+
+	comment := Comment{
+		ID:             primitive.NewObjectID(),
+		VideoID:        videoID,
+		Author:         author.Name,
+		AuthorUsername: author.Username,
+		AuthorAvatar:   author.Avatar,
+		Text:           text,
+		Timestamp:      time.Now().UTC(),
+	}
+	if req.ParentID != "" {
+		parent, ok := findComment(ctx, w, videoID, req.ParentID)
+		if !ok {
+			return
+		}
+		if parent.Deleted {
+			http.Error(w, "Cannot reply to a deleted comment", http.StatusConflict)
+			return
+		}
+		comment.ParentID = &parent.ID
+	}
+
+	if _, err := comments().InsertOne(ctx, comment); err != nil {
+		log.Printf("Failed to insert comment: %v", err)
+		http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+		return
+	}
+	if comment.ParentID != nil {
+		if _, err := comments().UpdateByID(ctx, *comment.ParentID, bson.M{"$inc": bson.M{"replies": 1}}); err != nil {
+			log.Printf("Failed to count reply to comment %s: %v", comment.ParentID.Hex(), err)
+		}
+	}
+	if _, err := db.Collection("videos").UpdateByID(ctx, videoID, bson.M{"$inc": bson.M{"commentCount": 1}}); err != nil {
+		log.Printf("Failed to count comment on video %s: %v", videoID.Hex(), err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/videos/"+videoID.Hex()+"/comments/"+comment.ID.Hex())
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// Edit a comment: PATCH with {"text"}, by its author only. The previous
+// text is kept in the comment's history.
+func editComment(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	text, err := validateCommentText(req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comment, ok := findComment(ctx, w, videoID, id)
+	if !ok {
+		return
+	}
+	if !requireOwnerOr(w, r, comment.AuthorUsername) {
+		return
+	}
+	if comment.Deleted {
+		http.Error(w, "Comment was deleted", http.StatusConflict)
+		return
+	}
+	if text == comment.Text {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comment)
+		return
+	}
+
+	writtenAt := comment.Timestamp
+	if comment.EditedAt != nil {
+		writtenAt = *comment.EditedAt
+	}
+	now := time.Now().UTC()
+	var updated Comment
+	// Matching the text read above makes concurrent edits fail instead of
+	// losing a revision
+	err = comments().FindOneAndUpdate(ctx,
+		bson.M{"_id": comment.ID, "text": comment.Text, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set": bson.M{"text": text, "editedAt": now},
+			"$push": bson.M{"history": bson.M{
+				"$each":  bson.A{CommentRevision{Text: comment.Text, WrittenAt: writtenAt}},
+				"$slice": -maxCommentRevisions,
+			}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Comment changed while editing, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to edit comment %s: %v", id, err)
+		http.Error(w, "Failed to edit comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Soft-delete a comment, by its author or a moderator. The document stays
+// so replies keep their thread; its content is hidden from everyone but
+// staff.
+func deleteComment(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	comment, ok := findComment(ctx, w, videoID, id)
+	if !ok {
+		return
+	}
+	if !requireOwnerOr(w, r, comment.AuthorUsername, roleModerator) {
+		return
+	}
+
+	identity := identityFrom(r)
+	result, err := comments().UpdateOne(ctx,
+		bson.M{"_id": comment.ID, "deleted": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"deleted": true, "deletedAt": time.Now().UTC(), "deletedBy": identity.Username}})
+	if err != nil {
+		log.Printf("Failed to delete comment %s: %v", id, err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		// Already deleted
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if comment.ParentID != nil {
+		if _, err := comments().UpdateByID(ctx, *comment.ParentID, bson.M{"$inc": bson.M{"replies": -1}}); err != nil {
+			log.Printf("Failed to uncount reply to comment %s: %v", comment.ParentID.Hex(), err)
+		}
+	}
+	if _, err := db.Collection("videos").UpdateByID(ctx, videoID, bson.M{"$inc": bson.M{"commentCount": -1}}); err != nil {
+		log.Printf("Failed to uncount comment on video %s: %v", videoID.Hex(), err)
+	}
+	if identity.Username != comment.AuthorUsername {
+		recordAudit(r, "comment_deleted", map[string]interface{}{
+			"video":   videoID.Hex(),
+			"comment": comment.ID.Hex(),
+			"author":  comment.AuthorUsername,
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commentLike records that a user likes a comment
+type commentLike struct {
+	ID struct {
+		Comment  primitive.ObjectID `bson:"comment"`
+		Username string             `bson:"username"`
+	} `bson:"_id"`
+	VideoID primitive.ObjectID `bson:"videoId"`
+	LikedAt time.Time          `bson:"likedAt"`
+}
+
+// Like (PUT) or unlike (DELETE) a comment as the caller. Each user counts
+// once; the answer is {"likes", "liked"}.
+func likeComment(w http.ResponseWriter, r *http.Request, videoID primitive.ObjectID, id string, like bool) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	comment, ok := findComment(ctx, w, videoID, id)
+	if !ok {
+		return
+	}
+	if comment.Deleted && like {
+		http.Error(w, "Comment was deleted", http.StatusConflict)
+		return
+	}
+
+	var record commentLike
+	record.ID.Comment = comment.ID
+	record.ID.Username = identityFrom(r).Username
+	record.VideoID = videoID
+	record.LikedAt = time.Now().UTC()
+
+	// The like document makes the counter change once per user
+	changed := false
+	if like {
+		_, err := commentLikes().InsertOne(ctx, record)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			log.Printf("Failed to like comment %s: %v", id, err)
+			http.Error(w, "Failed to like comment", http.StatusInternalServerError)
+			return
+		}
+		changed = err == nil
+	} else {
+		// The same struct as the insert: an embedded _id only matches with
+		// its fields in the same order, which a bson.M does not keep
+		result, err := commentLikes().DeleteOne(ctx, bson.M{"_id": record.ID})
+		if err != nil {
+			log.Printf("Failed to unlike comment %s: %v", id, err)
+			http.Error(w, "Failed to unlike comment", http.StatusInternalServerError)
+			return
+		}
+		changed = result.DeletedCount > 0
+	}
+
+	likes := comment.Likes
+	if changed {
+		delta := 1
+		if !like {
+			delta = -1
+		}
+		var updated Comment
+		err := comments().FindOneAndUpdate(ctx, bson.M{"_id": comment.ID},
+			bson.M{"$inc": bson.M{"likes": delta}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"likes": 1}),
+		).Decode(&updated)
+		if err != nil {
+			log.Printf("Failed to count like of comment %s: %v", id, err)
+			http.Error(w, "Failed to like comment", http.StatusInternalServerError)
+			return
+		}
+		likes = updated.Likes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"likes": likes, "liked": like})
+}
+
+// commentsPath splits the part of a /videos/{id}/... path after the ID into
+// the path below /comments, reporting whether it is a comments path
+func commentsPath(action string) (string, bool) {
+	rest, ok := strings.CutPrefix(action, "comments")
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	return strings.TrimPrefix(rest, "/"), true
+}
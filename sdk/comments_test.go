@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUnlikeCommentMatchesTheLikeID(t *testing.T) {
+	videoID, commentID := primitive.NewObjectID(), primitive.NewObjectID()
+	comment := bson.D{{Key: "_id", Value: commentID}, {Key: "videoId", Value: videoID}, {Key: "likes", Value: 3}}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("unlike", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "boringmedia.comments", mtest.FirstBatch, comment),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			findAndModifyResponse(t, bson.D{{Key: "_id", Value: commentID}, {Key: "likes", Value: 2}}),
+		)
+
+		r := httptest.NewRequest(http.MethodDelete, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Username: "alice"}))
+		w := httptest.NewRecorder()
+		likeComment(w, r, videoID, commentID.Hex(), false)
+
+		var answer struct {
+			Likes int  `json:"likes"`
+			Liked bool `json:"liked"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&answer); err != nil || answer.Likes != 2 || answer.Liked {
+			mt.Fatalf("answer = %+v, %v", answer, err)
+		}
+
+		mt.GetStartedEvent() // findComment
+		id, err := mt.GetStartedEvent().Command.LookupErr("deletes", "0", "q", "_id")
+		if err != nil {
+			mt.Fatal(err)
+		}
+		elements, _ := id.Document().Elements()
+		if len(elements) != 2 || elements[0].Key() != "comment" || elements[1].Key() != "username" {
+			mt.Fatalf("delete matches _id %s, want {comment, username} in insert order", id)
+		}
+		if elements[1].Value().StringValue() != "alice" {
+			mt.Errorf("username = %s", elements[1].Value())
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vulnerable demo mode gates /upload-vulnerable. While it is on, vulnerable
+// uploads land in a per-session sandbox below uploadFolder that is wiped when
+// the session is disabled or expires, and every use is audited.
+const (
+	defaultDemoModeTTL = time.Hour
+	maxDemoModeTTL     = 24 * time.Hour
+	demoSandboxPrefix  = "demo-"
+)
+
+// DemoModeStatus is the public state of vulnerable demo mode
+type DemoModeStatus struct {
+	Enabled   bool       `json:"enabled"`
+	SessionID string     `json:"sessionId,omitempty"`
+	EnabledAt *time.Time `json:"enabledAt,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Uploads   int        `json:"uploads"`
+}
+
+var demoMode struct {
+	sync.Mutex
+	status  DemoModeStatus
+	session *demoSession
+	timer   *time.Timer
+}
+
+// demoSession is the sandbox of one session. Uploads hold it while they
+// write, so a session that ends meanwhile is wiped by the last writer
+// instead of having its sandbox re-created after the wipe.
+type demoSession struct {
+	sandbox string
+	writers int
+	ended   bool
+}
+
+// demoSessionEnd is what is left to do for an ended session once demoMode
+// is unlocked: wiping the sandbox, unless a write still holds it, and the
+// audit record, which may wait on MongoDB
+type demoSessionEnd struct {
+	reason  string
+	status  DemoModeStatus
+	sandbox string
+}
+
+func (e *demoSessionEnd) finish(r *http.Request) {
+	if e == nil {
+		return
+	}
+	if e.sandbox != "" {
+		wipeDemoSandbox(e.sandbox)
+	}
+	recordAudit(r, "demo_mode."+e.reason, map[string]interface{}{
+		"session": e.status.SessionID,
+		"uploads": e.status.Uploads,
+	})
+}
+
+func wipeDemoSandbox(sandbox string) {
+	if err := os.RemoveAll(sandbox); err != nil {
+		log.Printf("Failed to wipe demo sandbox %s: %v", sandbox, err)
+	}
+}
+
+// initDemoMode wipes sandboxes left by earlier runs and, if DEMO_MODE is
+// "on", starts a session lasting DEMO_MODE_TTL
+func initDemoMode() {
+	leftovers, _ := filepath.Glob(filepath.Join(uploadFolder, demoSandboxPrefix+"*"))
+	for _, dir := range leftovers {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove stale demo sandbox %s: %v", dir, err)
+		}
+	}
+
+	if strings.ToLower(os.Getenv("DEMO_MODE")) != "on" {
+		log.Println("Vulnerable demo mode is off; enable it with PUT /admin/demo-mode")
+		return
+	}
+	ttl := defaultDemoModeTTL
+	if value := os.Getenv("DEMO_MODE_TTL"); value != "" {
+		parsed, err := parseDemoModeTTL(value)
+		if err != nil {
+			log.Printf("Warning: %v, using %s", err, defaultDemoModeTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+	if _, err := enableDemoMode(nil, ttl); err != nil {
+		log.Printf("Failed to enable demo mode: %v", err)
+	}
+}
+
+func parseDemoModeTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 || ttl > maxDemoModeTTL {
+		return 0, fmt.Errorf("invalid demo mode TTL %q: must be a duration up to %s", value, maxDemoModeTTL)
+	}
+	return ttl, nil
+}
+
+// enableDemoMode starts a new session with a fresh sandbox, ending any
+// current one
+func enableDemoMode(r *http.Request, ttl time.Duration) (DemoModeStatus, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return DemoModeStatus{}, err
+	}
+	sessionID := hex.EncodeToString(id)
+	sandbox := filepath.Join(uploadFolder, demoSandboxPrefix+sessionID)
+	if err := os.MkdirAll(sandbox, 0755); err != nil {
+		return DemoModeStatus{}, err
+	}
+
+	demoMode.Lock()
+	var ended *demoSessionEnd
+	if demoMode.status.Enabled {
+		ended = endDemoSessionLocked("replaced")
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(ttl)
+	demoMode.status = DemoModeStatus{Enabled: true, SessionID: sessionID, EnabledAt: &now, ExpiresAt: &expires}
+	demoMode.session = &demoSession{sandbox: sandbox}
+	demoMode.timer = time.AfterFunc(ttl, func() { expireDemoMode(sessionID) })
+	status := demoMode.status
+	demoMode.Unlock()
+
+	ended.finish(r)
+	recordAudit(r, "demo_mode.enabled", map[string]interface{}{
+		"session":   sessionID,
+		"ttl":       ttl.String(),
+		"expiresAt": expires,
+	})
+	return status, nil
+}
+
+// disableDemoMode ends the current session, if any
+func disableDemoMode(r *http.Request) DemoModeStatus {
+	demoMode.Lock()
+	var ended *demoSessionEnd
+	if demoMode.status.Enabled {
+		ended = endDemoSessionLocked("disabled")
+	}
+	status := demoMode.status
+	demoMode.Unlock()
+
+	ended.finish(r)
+	return status
+}
+
+func expireDemoMode(sessionID string) {
+	demoMode.Lock()
+	var ended *demoSessionEnd
+	if demoMode.status.Enabled && demoMode.status.SessionID == sessionID {
+		ended = endDemoSessionLocked("expired")
+	}
+	demoMode.Unlock()
+
+	ended.finish(nil)
+}
+
+// endDemoSessionLocked turns demo mode off and returns the rest of ending
+// the session for the caller to finish after unlocking. demoMode must be
+// locked.
+func endDemoSessionLocked(reason string) *demoSessionEnd {
+	if demoMode.timer != nil {
+		demoMode.timer.Stop()
+	}
+	ended := &demoSessionEnd{reason: reason, status: demoMode.status}
+	if session := demoMode.session; session != nil {
+		session.ended = true
+		if session.writers == 0 {
+			ended.sandbox = session.sandbox
+		}
+	}
+	demoMode.status = DemoModeStatus{}
+	demoMode.session = nil
+	demoMode.timer = nil
+	return ended
+}
+
+// acquireDemoSandbox returns the current session ID and sandbox and counts
+// a use of the vulnerable path. The sandbox is held until
+// releaseDemoSandbox, so it is not wiped under a write.
+func acquireDemoSandbox() (string, *demoSession, bool) {
+	demoMode.Lock()
+	defer demoMode.Unlock()
+	if !demoMode.status.Enabled || demoMode.session == nil {
+		return "", nil, false
+	}
+	demoMode.status.Uploads++
+	demoMode.session.writers++
+	return demoMode.status.SessionID, demoMode.session, true
+}
+
+// releaseDemoSandbox ends a write, wiping the sandbox when its session
+// ended during the write
+func releaseDemoSandbox(session *demoSession) {
+	demoMode.Lock()
+	session.writers--
+	wipe := session.ended && session.writers == 0
+	demoMode.Unlock()
+
+	if wipe {
+		wipeDemoSandbox(session.sandbox)
+	}
+}
+
+func demoModeStatus() DemoModeStatus {
+	demoMode.Lock()
+	defer demoMode.Unlock()
+	return demoMode.status
+}
+
+// sandboxPath resolves an unsanitized file name inside the sandbox. Names
+// that traverse out of it are re-rooted at the sandbox, so the demo still
+// shows where an unconfined server would have written.
+func sandboxPath(sandbox, filename string) (path, attempted string) {
+	attempted = filepath.Join(sandbox, filename)
+	return filepath.Join(sandbox, filepath.Clean("/"+filename)), attempted
+}
+
+// Get the demo mode state (public, so the UI can offer the vulnerable path)
+func getDemoMode(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeDemoModeStatus(w, demoModeStatus())
+}
+
+// demoModeAdminHandler enables (PUT {"enabled": true, "ttl": "30m"}) or
+// disables (PUT {"enabled": false} or DELETE) vulnerable demo mode
+func demoModeAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, "GET, PUT, DELETE, OPTIONS")
+		return
+	}
+	setCORSHeaders(w, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		writeDemoModeStatus(w, demoModeStatus())
+	case http.MethodPut:
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			TTL     string `json:"ttl"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !req.Enabled {
+			writeDemoModeStatus(w, disableDemoMode(r))
+			return
+		}
+		ttl := defaultDemoModeTTL
+		if req.TTL != "" {
+			parsed, err := parseDemoModeTTL(req.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl = parsed
+		}
+		status, err := enableDemoMode(r, ttl)
+		if err != nil {
+			log.Printf("Failed to enable demo mode: %v", err)
+			http.Error(w, "Failed to enable demo mode", http.StatusInternalServerError)
+			return
+		}
+		writeDemoModeStatus(w, status)
+	case http.MethodDelete:
+		writeDemoModeStatus(w, disableDemoMode(r))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeDemoModeStatus(w http.ResponseWriter, status DemoModeStatus) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
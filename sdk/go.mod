@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/trendmicro/tm-v1-fs-golang-sdk v1.5.1
 	go.mongodb.org/mongo-driver v1.14.0
+	golang.org/x/crypto v0.31.0
 )
 
 require (
@@ -16,7 +17,6 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Transcode jobs go through the same states as scan jobs
+const (
+	transcodeMaxAttempts    = 3
+	transcodeRetryDelay     = time.Minute
+	transcodeJobLease       = 10 * time.Minute // renewed while ffmpeg reports progress
+	transcodeTimeout        = 4 * time.Hour
+	transcodeProgressPeriod = 5 * time.Second
+	transcodePollInterval   = 10 * time.Second
+	transcodeJobRetention   = 30 * 24 * time.Hour
+	defaultTranscodeWorkers = 1
+)
+
+// HLSInfo describes the packaged HLS renditions of a video
+type HLSInfo struct {
+	MasterURL  string         `json:"masterUrl" bson:"masterUrl"`
+	Version    string         `json:"version" bson:"version"`
+	Renditions []HLSRendition `json:"renditions" bson:"renditions"`
+	PackagedAt time.Time      `json:"packagedAt" bson:"packagedAt"`
+}
+
+// HLSRendition is one packaged rendition
+type HLSRendition struct {
+	Name      string `json:"name" bson:"name"`
+	Width     int    `json:"width,omitempty" bson:"width,omitempty"`
+	Height    int    `json:"height" bson:"height"`
+	Bandwidth int    `json:"bandwidth" bson:"bandwidth"` // bit/s
+}
+
+// TranscodeJob is the persisted state of packaging a video for HLS
+type TranscodeJob struct {
+	ID            primitive.ObjectID `json:"_id" bson:"_id"`
+	VideoID       primitive.ObjectID `json:"videoId" bson:"videoId"`
+	Status        string             `json:"status" bson:"status"`
+	Progress      float64            `json:"progress" bson:"progress"` // percent
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LeaseExpires  time.Time          `json:"-" bson:"leaseExpiresAt,omitempty"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt" bson:"updatedAt"`
+	CompletedAt   *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ExpireAt      time.Time          `json:"-" bson:"expireAt,omitempty"`
+}
+
+var errHLSDisabled = errors.New("HLS packaging is disabled")
+
+// transcodeWakeup nudges idle workers when a job is enqueued
+var transcodeWakeup = make(chan struct{}, 1)
+
+func transcodeJobs() *mongo.Collection {
+	return db.Collection("transcode_jobs")
+}
+
+// startTranscodeWorkers creates the transcode_jobs indexes and starts
+// HLS_WORKERS workers when packaging is enabled
+func startTranscodeWorkers() {
+	if hlsTranscoder == nil {
+		return
+	}
+	workers := defaultTranscodeWorkers
+	if n, err := strconv.Atoi(getEnvOrDefault("HLS_WORKERS", "")); err == nil && n >= 0 {
+		workers = n
+	}
+	if db == nil {
+		log.Println("Warning: MongoDB unavailable; transcode workers not started")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := transcodeJobs().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Failed to create transcode job indexes: %v", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		go transcodeWorker()
+	}
+	log.Printf("Started %d transcode workers", workers)
+}
+
+// enqueueTranscodeJob queues HLS packaging of a video unless a job for it is
+// already pending, in which case that job is returned
+func enqueueTranscodeJob(ctx context.Context, videoID primitive.ObjectID) (*TranscodeJob, error) {
+	if hlsTranscoder == nil {
+		return nil, errHLSDisabled
+	}
+
+	var pending TranscodeJob
+	err := transcodeJobs().FindOne(ctx, bson.M{
+		"videoId": videoID,
+		"status":  bson.M{"$in": []string{scanJobQueued, scanJobRetrying}},
+	}).Decode(&pending)
+	if err == nil {
+		return &pending, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	job := &TranscodeJob{
+		ID:            primitive.NewObjectID(),
+		VideoID:       videoID,
+		Status:        scanJobQueued,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if _, err := transcodeJobs().InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case transcodeWakeup <- struct{}{}:
+	default:
+	}
+	log.Printf("Queued transcode job %s for video %s", job.ID.Hex(), videoID.Hex())
+	return job, nil
+}
+
+func transcodeWorker() {
+	for {
+		job, err := claimTranscodeJob()
+		if err != nil {
+			log.Printf("Failed to claim transcode job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-transcodeWakeup:
+			case <-time.After(transcodePollInterval):
+			}
+			continue
+		}
+		runTranscodeJob(job)
+	}
+}
+
+// claimTranscodeJob atomically takes the oldest due job, if any
+func claimTranscodeJob() (*TranscodeJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{"$or": []bson.M{
+		{"status": bson.M{"$in": []string{scanJobQueued, scanJobRetrying}}, "nextAttemptAt": bson.M{"$lte": now}},
+		{"status": scanJobRunning, "leaseExpiresAt": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": scanJobRunning, "progress": 0, "leaseExpiresAt": now.Add(transcodeJobLease), "updatedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job TranscodeJob
+	err := transcodeJobs().FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// runTranscodeJob packages one video and records the outcome
+func runTranscodeJob(job *TranscodeJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	log.Printf("Running transcode job %s for video %s (attempt %d/%d)", job.ID.Hex(), job.VideoID.Hex(), job.Attempts, transcodeMaxAttempts)
+	hls, err := packageHLS(ctx, job)
+
+	now := time.Now().UTC()
+	set := bson.M{"updatedAt": now}
+	switch {
+	case err == nil:
+		log.Printf("Packaged video %s for HLS in %d renditions", job.VideoID.Hex(), len(hls.Renditions))
+		set["status"] = scanJobCompleted
+		set["progress"] = 100
+		set["completedAt"] = now
+		set["expireAt"] = now.Add(transcodeJobRetention)
+	case job.Attempts < transcodeMaxAttempts && !errors.Is(err, mongo.ErrNoDocuments):
+		log.Printf("Transcode job %s failed, retrying in %s: %v", job.ID.Hex(), transcodeRetryDelay, err)
+		set["status"] = scanJobRetrying
+		set["nextAttemptAt"] = now.Add(transcodeRetryDelay)
+		set["lastError"] = err.Error()
+	default:
+		log.Printf("Transcode job %s failed: %v", job.ID.Hex(), err)
+		set["status"] = scanJobFailed
+		set["lastError"] = err.Error()
+		set["expireAt"] = now.Add(transcodeJobRetention)
+	}
+
+	updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer updateCancel()
+	if _, err := transcodeJobs().UpdateOne(updateCtx, bson.M{"_id": job.ID}, bson.M{"$set": set, "$unset": bson.M{"leaseExpiresAt": ""}}); err != nil {
+		log.Printf("Failed to record transcode job %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// packageHLS transcodes the video's media into the HLS ladder, stores the
+// output and records it on the video
+func packageHLS(ctx context.Context, job *TranscodeJob) (*HLSInfo, error) {
+	var video Video
+	if err := db.Collection("videos").FindOne(ctx, bson.M{"_id": job.VideoID}).Decode(&video); err != nil {
+		return nil, fmt.Errorf("cannot load video: %w", err)
+	}
+	key, ok := mediaKeyForURL(video.VideoURL)
+	if !ok {
+		return nil, fmt.Errorf("video has no stored media: %w", mongo.ErrNoDocuments)
+	}
+
+	media := video.Media
+	if media == nil {
+		var err error
+		if media, err = mediaInfoForKey(ctx, key); err != nil {
+			log.Printf("Failed to read metadata of video %s, assuming defaults: %v", video.ID.Hex(), err)
+		}
+	}
+	duration := float64(video.Duration)
+	if media != nil && media.Duration > 0 {
+		duration = media.Duration
+	}
+	hasAudio := hlsHasAudio(media)
+	renditions := hlsRenditionsFor(media)
+
+	outDir, err := os.MkdirTemp("", "hls-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outDir)
+	for _, r := range renditions {
+		if err := os.Mkdir(filepath.Join(outDir, r.Name), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	// Record progress and keep the lease while ffmpeg runs
+	var mu sync.Mutex
+	lastReport := time.Now()
+	progress := func(processed time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(lastReport) < transcodeProgressPeriod {
+			return
+		}
+		lastReport = time.Now()
+		now := time.Now().UTC()
+		set := bson.M{"leaseExpiresAt": now.Add(transcodeJobLease), "updatedAt": now}
+		if duration > 0 {
+			percent := processed.Seconds() / duration * 100
+			if percent > 99 {
+				percent = 99
+			}
+			set["progress"] = float64(int(percent*10)) / 10
+		}
+		transcodeJobs().UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": set})
+	}
+
+	err = withLocalFile(ctx, mediaStore, key, func(input string) error {
+		return hlsTranscoder.Run(ctx, hlsArgs(input, outDir, renditions, hasAudio), progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	version := job.ID.Hex()
+	if err := storeHLSOutput(ctx, video.ID.Hex(), version, outDir, renditions); err != nil {
+		return nil, fmt.Errorf("cannot store HLS output: %w", err)
+	}
+
+	hls := &HLSInfo{
+		MasterURL:  "/videos/" + video.ID.Hex() + "/hls/master.m3u8",
+		Version:    version,
+		PackagedAt: time.Now().UTC(),
+	}
+	for _, r := range renditions {
+		rendition := HLSRendition{Name: r.Name, Height: r.Height, Bandwidth: (r.VideoBitrate + r.AudioBitrate) * 1000}
+		if media != nil && media.Height > 0 {
+			rendition.Width = (media.Width*r.Height/media.Height + 1) &^ 1
+		}
+		hls.Renditions = append(hls.Renditions, rendition)
+	}
+
+	result, err := db.Collection("videos").UpdateOne(ctx, bson.M{"_id": video.ID}, bson.M{"$set": bson.M{"hls": hls}})
+	if err == nil && result.MatchedCount == 0 {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		// The video was deleted while it was being packaged
+		deleteHLSOutput(context.Background(), video.ID.Hex())
+		return nil, fmt.Errorf("cannot record HLS output: %w", err)
+	}
+	return hls, nil
+}
+
+// deleteTranscodeJobs drops pending jobs of a deleted video along with its
+// HLS output
+func deleteTranscodeJobs(ctx context.Context, videoID primitive.ObjectID) {
+	if _, err := transcodeJobs().DeleteMany(ctx, bson.M{
+		"videoId": videoID,
+		"status":  bson.M{"$in": []string{scanJobQueued, scanJobRetrying}},
+	}); err != nil {
+		log.Printf("Failed to delete transcode jobs of video %s: %v", videoID.Hex(), err)
+	}
+	deleteHLSOutput(ctx, videoID.Hex())
+}
+
+// Get a video's HLS packaging state: the packaged renditions, if any, and
+// the latest transcode job
+func getVideoHLS(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	var video Video
+	err = db.Collection("videos").FindOne(ctx, bson.M{"_id": objectID}).Decode(&video)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find video: %v", err)
+			http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var job *TranscodeJob
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	var latest TranscodeJob
+	err = transcodeJobs().FindOne(ctx, bson.M{"videoId": objectID}, opts).Decode(&latest)
+	switch {
+	case err == nil:
+		job = &latest
+	case err != mongo.ErrNoDocuments:
+		log.Printf("Failed to find transcode job: %v", err)
+		http.Error(w, "Failed to find transcode job", http.StatusInternalServerError)
+		return
+	}
+
+	if job != nil && (job.Status == scanJobQueued || job.Status == scanJobRunning || job.Status == scanJobRetrying) {
+		w.Header().Set("Retry-After", "5")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": hlsTranscoder != nil,
+		"hls":     video.HLS,
+		"job":     job,
+	})
+}
+
+// Queue HLS packaging of a video (moderators and security admins)
+func packageVideoHLS(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+	count, err := db.Collection("videos").CountDocuments(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		log.Printf("Failed to find video: %v", err)
+		http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := enqueueTranscodeJob(ctx, objectID)
+	if errors.Is(err, errHLSDisabled) {
+		http.Error(w, "HLS packaging is not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to queue transcode job: %v", err)
+		http.Error(w, "Failed to queue transcode job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/videos/"+id+"/hls")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// hlsFileName matches the files served below /videos/{id}/hls/: the master
+// playlist, and the playlists and segments of a packaging version
+var hlsFileName = regexp.MustCompile(`^(master\.m3u8|[0-9a-f]{24}/[0-9]+p/(index\.m3u8|segment_[0-9]+\.ts))$`)
+
+// Serve an HLS playlist or segment. The master playlist is revalidated on
+// every request since repackaging replaces it; everything else lives under
+// a per-run version directory and never changes.
+func serveHLSFile(w http.ResponseWriter, r *http.Request, id, name string) {
+	setCORSHeaders(w, r)
+
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+	if !hlsFileName.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name == "master.m3u8" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", hlsContentType(name))
+	serveBlob(w, r, hlsPrefix+id+"/"+name)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tokens are EdDSA (Ed25519) JWTs so other services can verify them with
+// the public keys from /.well-known/jwks.json without sharing a secret.
+// Keys live in the signing_keys collection: a new one takes over signing
+// every JWT_KEY_ROTATION and old ones keep verifying until the last token
+// they signed has expired.
+
+const (
+	tokenIssuer   = "boringmedia-sdk"
+	tokenLeeway   = 30 * time.Second
+	keyReloadWait = 10 * time.Second
+
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenClaims are the claims of access and refresh tokens
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"` // user ID
+	Username  string   `json:"username"`
+	Roles     []string `json:"roles,omitempty"`
+	Type      string   `json:"token_use"`
+	ID        string   `json:"jti"`
+	Family    string   `json:"fam,omitempty"` // refresh token family
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// signingKey is an Ed25519 key in the signing_keys collection
+type signingKey struct {
+	ID        string    `bson:"_id"`
+	Seed      []byte    `bson:"seed"`
+	CreatedAt time.Time `bson:"createdAt"`
+	RetireAt  time.Time `bson:"retireAt"` // stops signing
+	ExpireAt  time.Time `bson:"expireAt"` // stops verifying, TTL index
+}
+
+func (k *signingKey) private() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(k.Seed)
+}
+
+func signingKeys() *mongo.Collection {
+	return db.Collection("signing_keys")
+}
+
+// keyring caches the signing keys
+var keyring struct {
+	sync.Mutex
+	keys     map[string]*signingKey
+	active   *signingKey
+	loadedAt time.Time
+}
+
+func ensureSigningKeyIndexes() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := signingKeys().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create signing key indexes: %v", err)
+	}
+}
+
+// loadSigningKeys reloads the keyring from the database. The caller holds
+// the keyring lock.
+func loadSigningKeys(ctx context.Context) error {
+	now := time.Now().UTC()
+	cursor, err := signingKeys().Find(ctx, bson.M{"expireAt": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return err
+	}
+	var keys []*signingKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return err
+	}
+	keyring.keys = make(map[string]*signingKey, len(keys))
+	keyring.active = nil
+	for _, k := range keys {
+		keyring.keys[k.ID] = k
+		if keyring.active == nil && now.Before(k.RetireAt) {
+			keyring.active = k
+		}
+	}
+	keyring.loadedAt = now
+	return nil
+}
+
+// activeSigningKey returns the key to sign with, making a new one when the
+// current one is due for retirement
+func activeSigningKey(ctx context.Context) (*signingKey, error) {
+	keyring.Lock()
+	defer keyring.Unlock()
+
+	now := time.Now().UTC()
+	if keyring.active != nil && now.Before(keyring.active.RetireAt) {
+		return keyring.active, nil
+	}
+	// Another replica may have rotated already
+	if err := loadSigningKeys(ctx); err != nil {
+		return nil, err
+	}
+	if keyring.active != nil {
+		return keyring.active, nil
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	rotation := tokenSettings.keyRotation
+	key := &signingKey{
+		ID:        hex.EncodeToString(id),
+		Seed:      seed,
+		CreatedAt: now,
+		RetireAt:  now.Add(rotation),
+		// Tokens signed just before retirement must verify until they expire
+		ExpireAt: now.Add(rotation + tokenSettings.refreshTTL + tokenLeeway),
+	}
+	if _, err := signingKeys().InsertOne(ctx, key); err != nil {
+		return nil, err
+	}
+	log.Printf("Rotated token signing key to %s", key.ID)
+	keyring.keys[key.ID] = key
+	keyring.active = key
+	return key, nil
+}
+
+// verificationKey returns the key with the given ID, reloading the keyring
+// at most every keyReloadWait for IDs it does not know
+func verificationKey(ctx context.Context, id string) (*signingKey, error) {
+	keyring.Lock()
+	defer keyring.Unlock()
+
+	if k, ok := keyring.keys[id]; ok && time.Now().Before(k.ExpireAt) {
+		return k, nil
+	}
+	if time.Since(keyring.loadedAt) < keyReloadWait {
+		return nil, errInvalidToken
+	}
+	if err := loadSigningKeys(ctx); err != nil {
+		return nil, err
+	}
+	if k, ok := keyring.keys[id]; ok {
+		return k, nil
+	}
+	return nil, errInvalidToken
+}
+
+// signToken makes a JWT of claims with the active key
+func signToken(ctx context.Context, claims tokenClaims) (string, error) {
+	key, err := activeSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": key.ID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key.private(), []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// looksLikeJWT tells a JWT from other bearer tokens such as ADMIN_TOKEN
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// parseToken verifies a JWT of the given type and returns its claims
+func parseToken(ctx context.Context, token, tokenType string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "EdDSA" || header.Kid == "" {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := verificationKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	public := key.private().Public().(ed25519.PublicKey)
+	if !ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.Issuer != tokenIssuer || claims.Type != tokenType || claims.Subject == "" || claims.ID == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Add(-tokenLeeway).Unix() >= claims.ExpiresAt {
+		return nil, errTokenExpired
+	}
+	return &claims, nil
+}
+
+// jwksHandler serves the public keys that verify tokens, as a JWK Set
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Make sure there is a key to publish before the first login
+	if _, err := activeSigningKey(ctx); err != nil {
+		log.Printf("Failed to load signing keys: %v", err)
+		http.Error(w, "Failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+
+	keyring.Lock()
+	keys := make([]map[string]string, 0, len(keyring.keys))
+	for _, k := range keyring.keys {
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": k.ID,
+			"x":   base64.RawURLEncoding.EncodeToString(k.private().Public().(ed25519.PublicKey)),
+		})
+	}
+	keyring.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,14 +15,22 @@ import (
 	"strings"
 	"time"
 
-	amaasclient "github.com/trendmicro/tm-v1-fs-golang-sdk"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 const (
 	uploadFolder = "./uploads"
 	maxUploadSize = 10 << 20 // 10 MB
+	maxScanSize = 100 << 20  // 100 MB, the File Security limit
 )
 
+func getEnvOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 // setCORSHeaders sets appropriate CORS headers for multi-cloud support
 func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
@@ -69,41 +81,230 @@ func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handlePreflight answers a CORS preflight request for a route supporting the given methods
+func handlePreflight(w http.ResponseWriter, r *http.Request, methods string) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Requested-With")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusOK)
+}
+
 func main() {
 	// Ensure upload directory exists
 	if err := os.MkdirAll(uploadFolder, os.ModePerm); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
+	// Ensure the tus assembly directory exists and expire stale uploads
+	if err := os.MkdirAll(tusFolder, 0700); err != nil {
+		log.Fatalf("Failed to create tus directory: %v", err)
+	}
+	go sweepTusUploads()
+
+	// Initialize blob storage for protected uploads and published media
+	store, err := newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	mediaStore = store
+
 	// Initialize MongoDB
 	initMongoDB()
+	ensureVideoIndexes()
+	ensureSearchIndex()
+	ensureWatchIndexes()
+	ensureCommentIndexes()
+	migrateEmbeddedComments()
+
+	// Token lifetimes and the account, session and signing key collections
+	if err := initAuth(); err != nil {
+		log.Fatalf("Failed to initialize auth: %v", err)
+	}
+	if err := initOIDC(); err != nil {
+		log.Fatalf("Failed to initialize single sign-on: %v", err)
+	}
+
+	// Clean up old demo sandboxes and start demo mode if DEMO_MODE=on
+	initDemoMode()
+
+	// Load per-endpoint upload policies
+	if err := loadUploadPolicies(); err != nil {
+		log.Fatalf("Failed to load upload policies: %v", err)
+	}
+
+	// Load the quarantine encryption key
+	if err := initQuarantine(); err != nil {
+		log.Fatalf("Failed to initialize quarantine: %v", err)
+	}
+
+	// Select the malware scanner and start the asynchronous scan workers
+	fileScanner, err = newScannerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize scanner: %v", err)
+	}
+	initScanCache()
+	startScanWorkers()
+
+	// Choose how thumbnail frames are extracted
+	frameExtractor, err = newFrameExtractorFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize thumbnails: %v", err)
+	}
+
+	// Package published videos for adaptive streaming when ffmpeg is available
+	hlsTranscoder, err = newTranscoderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize HLS packaging: %v", err)
+	}
+	startTranscodeWorkers()
 
 	// Setup routes
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/upload", uploadHandler)           // Protected upload with scanning
 	http.HandleFunc("/upload-vulnerable", vulnerableUploadHandler) // Vulnerable upload without scanning
+	http.HandleFunc("/media/", mediaHandler)                      // Published media from blob storage
+	http.HandleFunc("/files", tusHandler)                         // Resumable (tus) uploads, scanned on completion
+	http.HandleFunc("/files/", tusHandler)
 
 	// MongoDB API endpoints
 	http.HandleFunc("/videos", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
+		switch r.Method {
+		case http.MethodOptions:
+			handlePreflight(w, r, "GET, POST, OPTIONS")
+		case http.MethodGet:
 			getAllVideos(w, r)
-		} else {
+		case http.MethodPost:
+			createVideo(w, r)
+		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
 	http.HandleFunc("/videos/", func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Path[len("/videos/"):]
-		if r.Method == "GET" {
-			getVideoByID(w, r, id)
-		} else if r.Method == "PUT" && r.URL.Path[len(r.URL.Path)-6:] == "/views" {
-			incrementVideoViews(w, r, id[:len(id)-6])
+		id, action, _ := strings.Cut(r.URL.Path[len("/videos/"):], "/")
+		if name, ok := strings.CutPrefix(action, "hls/"); ok {
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, HEAD, OPTIONS")
+			case http.MethodGet, http.MethodHead:
+				serveHLSFile(w, r, id, name)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if path, ok := commentsPath(action); ok {
+			commentsHandler(w, r, id, path)
+			return
+		}
+		switch action {
+		case "":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, PATCH, DELETE, OPTIONS")
+			case http.MethodGet:
+				getVideoByID(w, r, id)
+			case http.MethodPatch:
+				updateVideo(w, r, id)
+			case http.MethodDelete:
+				deleteVideo(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "views":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "PUT, OPTIONS")
+			case http.MethodPut:
+				incrementVideoViews(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "watch":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "POST, OPTIONS")
+			case http.MethodPost:
+				recordWatch(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "metadata":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, OPTIONS")
+			case http.MethodGet:
+				getVideoMetadata(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "thumbnail":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, HEAD, OPTIONS")
+			case http.MethodGet, http.MethodHead:
+				getVideoThumbnail(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "hls":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, POST, OPTIONS")
+			case http.MethodGet:
+				getVideoHLS(w, r, id)
+			case http.MethodPost:
+				packageVideoHLS(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		case "stream":
+			switch r.Method {
+			case http.MethodOptions:
+				handlePreflight(w, r, "GET, HEAD, OPTIONS")
+			case http.MethodGet, http.MethodHead:
+				streamVideo(w, r, id)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	http.HandleFunc("/search", searchHandler)
+
+	http.HandleFunc("/schemas/scan-result.json", scanResultSchemaHandler)
+
+	http.HandleFunc("/scans/", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[len("/scans/"):]
+		if r.Method == http.MethodGet {
+			getScanJob(w, r, id)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	// Vulnerable demo mode state and audit trail
+	http.HandleFunc("/demo-mode", getDemoMode)
+	http.HandleFunc("/admin/demo-mode", demoModeAdminHandler)
+	http.HandleFunc("/admin/audit", listAuditEvents)
+
+	// Admin review of quarantined uploads
+	http.HandleFunc("/admin/quarantine", quarantineHandler)
+	http.HandleFunc("/admin/quarantine/", quarantineHandler)
+
+	// Role assignment
+	http.HandleFunc("/admin/users/", adminUsersHandler)
+
+	// Accounts and session tokens
+	http.HandleFunc("/auth/", authHandler)
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	http.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	http.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+
 	http.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			getAllUsers(w, r)
@@ -113,16 +314,25 @@ func main() {
 	})
 
 	http.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
-		username := r.URL.Path[len("/users/"):]
-		if r.Method == "GET" {
-			getUserByUsername(w, r, username)
-		} else {
+		username, action, _ := strings.Cut(r.URL.Path[len("/users/"):], "/")
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch action {
+		case "":
+			getUserByUsername(w, r, username)
+		case "history":
+			getWatchHistory(w, r, username)
+		case "cowatched":
+			getCoWatched(w, r, username)
+		default:
+			http.NotFound(w, r)
 		}
 	})
 
 	log.Println("Starting server on :5000")
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	log.Fatal(http.ListenAndServe(":5000", withIdentity(authorize(http.DefaultServeMux))))
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -164,10 +374,28 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
 		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
 			log.Printf("Form parse error: %v", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writePolicyViolation(w, &PolicyViolation{
+					Status:  http.StatusRequestEntityTooLarge,
+					Code:    "file_too_large",
+					Message: fmt.Sprintf("Uploads to this endpoint are limited to %d bytes; use /files for larger videos", maxUploadSize),
+					Policy:  "upload",
+					Limit:   maxUploadSize,
+				})
+				return
+			}
 			http.Error(w, fmt.Sprintf("Cannot parse form: %v", err), http.StatusBadRequest)
 			return
 		}
 
+		// The video is published as the caller
+		owner, ok := uploadOwner(w, r, formOwner(r.MultipartForm.Value))
+		if !ok {
+			return
+		}
+		r.MultipartForm.Value["uploader"] = []string{owner}
+
 		// Get the file
 		file, handler, err := r.FormFile("file")
 		if err != nil {
@@ -187,40 +415,43 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		// Log file details
 		log.Printf("Uploaded file: %s, Size: %d bytes", handler.Filename, handler.Size)
 
-		// Save file
-		filename := filepath.Base(handler.Filename)
-		filePath := filepath.Join(uploadFolder, filename)
-		
-		dst, err := os.Create(filePath)
-		if err != nil {
-			log.Printf("File creation error: %v", err)
-			http.Error(w, fmt.Sprintf("Cannot create file: %v", err), http.StatusInternalServerError)
+		// Check the content against the upload policy before staging it
+		kind, violation := uploadPolicyFor("upload").Check(handler.Filename, handler.Size, file)
+		if violation != nil {
+			log.Printf("Upload rejected by policy: %s: %s", violation.Code, violation.Message)
+			writePolicyViolation(w, violation)
 			return
 		}
-		defer dst.Close()
-		defer os.Remove(filePath)
+		contentType := handler.Header.Get("Content-Type")
+		if kind != nil {
+			contentType = kind.MIME
+		}
 
-		// Copy file
-		bytesWritten, err := io.Copy(dst, file)
+		// Stage file in blob storage until the scan verdict is known
+		filename := filepath.Base(handler.Filename)
+		key := incomingPrefix + primitive.NewObjectID().Hex() + "-" + filename
+
+		digest := sha256.New()
+		info, err := mediaStore.Put(r.Context(), key, io.TeeReader(file, digest), handler.Size, contentType)
 		if err != nil {
 			log.Printf("File write error: %v", err)
 			http.Error(w, fmt.Sprintf("Cannot write file: %v", err), http.StatusInternalServerError)
 			return
 		}
+		fileHash := hex.EncodeToString(digest.Sum(nil))
+		log.Printf("File staged: %s, Bytes written: %d, SHA-256: %s", key, info.Size, fileHash)
 
-		log.Printf("File saved: %s, Bytes written: %d", filePath, bytesWritten)
-
-		// Scan file (ALWAYS scan in protected endpoint)
-		scanResult, err := scanUploadedFile(filePath, handler.Size)
+		// Queue the scan (ALWAYS scan in protected endpoint); a worker publishes
+		// or quarantines the file once the verdict is in
+		job, err := enqueueScanJob(r.Context(), key, filename, handler.Size, fileHash, r.MultipartForm.Value)
 		if err != nil {
-			log.Printf("Scan error: %v", err)
-			http.Error(w, fmt.Sprintf("Scan failed: %v", err), http.StatusInternalServerError)
+			mediaStore.Delete(context.Background(), key)
+			log.Printf("Scan enqueue error: %v", err)
+			http.Error(w, fmt.Sprintf("Cannot queue scan: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Render results
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(scanResult))
+		writeScanAccepted(w, job)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -241,6 +472,12 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The vulnerable path only exists while demo mode is on
+	if !demoModeStatus().Enabled {
+		http.Error(w, "Vulnerable demo mode is disabled", http.StatusNotFound)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		fmt.Fprintln(w, "VULNERABLE Upload Page - Files will NOT be scanned")
@@ -279,11 +516,40 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		// Log file details
 		log.Printf("VULNERABLE upload: %s, Size: %d bytes", handler.Filename, handler.Size)
 
+		// SECURITY ISSUE: the upload-vulnerable policy enforces nothing by default
+		if _, violation := uploadPolicyFor("upload-vulnerable").Check(handler.Filename, handler.Size, file); violation != nil {
+			writePolicyViolation(w, violation)
+			return
+		}
+
+		session, sandbox, ok := acquireDemoSandbox()
+		if !ok {
+			http.Error(w, "Vulnerable demo mode is disabled", http.StatusNotFound)
+			return
+		}
+		defer releaseDemoSandbox(sandbox)
+
 		// SECURITY ISSUE: No filename sanitization - allows path traversal attacks
 		filename := handler.Filename // Use original filename without sanitization!
-		filePath := filepath.Join(uploadFolder, filename)
-		
+		// Demo mode re-roots traversal inside the session sandbox; attemptedPath
+		// is where an unconfined server would have written
+		filePath, attemptedPath := sandboxPath(sandbox.sandbox, filename)
+		traversal := filePath != attemptedPath
+		recordAudit(r, "vulnerable_upload", map[string]interface{}{
+			"session":        session,
+			"filename":       filename,
+			"size":           handler.Size,
+			"path":           filePath,
+			"attempted_path": attemptedPath,
+			"traversal":      traversal,
+		})
+
 		// SECURITY ISSUE: No directory traversal protection
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			log.Printf("Directory creation error: %v", err)
+			http.Error(w, fmt.Sprintf("Cannot create file: %v", err), http.StatusInternalServerError)
+			return
+		}
 		dst, err := os.Create(filePath)
 		if err != nil {
 			log.Printf("File creation error: %v", err)
@@ -291,7 +557,8 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer dst.Close()
-		// SECURITY ISSUE: File is NOT deleted after processing - persists on disk!
+		// SECURITY ISSUE: File is NOT deleted after processing - persists on disk
+		// until the demo session ends!
 
 		// Copy file
 		bytesWritten, err := io.Copy(dst, file)
@@ -304,15 +571,18 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("VULNERABLE file saved: %s, Bytes written: %d", filePath, bytesWritten)
 
 		// SECURITY ISSUE: NO SCANNING - File is uploaded without any security checks
-		response := map[string]interface{}{
-			"scan_result_code": -4, // -4 indicates vulnerable upload (no scanning)
-			"scan_results": map[string]interface{}{
-				"status": "vulnerable",
-				"reason": "Vulnerable endpoint - no scanning performed",
-				"message": "File uploaded successfully but NO security scanning was performed",
-				"file_path": filePath,
-				"file_size": bytesWritten,
-			},
+		response := newScanResult(ScanStatusUnscanned, filepath.Base(filePath), bytesWritten)
+		response.Reason = "Vulnerable endpoint - no scanning performed"
+		response.Raw = map[string]interface{}{
+			"status":    "vulnerable",
+			"reason":    response.Reason,
+			"message":   "File uploaded successfully but NO security scanning was performed",
+			"file_path": filePath,
+			"file_size": bytesWritten,
+			"session":   session,
+		}
+		if traversal {
+			response.Raw["attempted_path"] = attemptedPath
 		}
 		responseJSON, _ := json.Marshal(response)
 		w.Header().Set("Content-Type", "application/json")
@@ -323,154 +593,125 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func scanUploadedFile(filePath string, fileSize int64) (string, error) {
-	// Get API key and region from environment
-	apiKey := os.Getenv("API_KEY")
-	region := os.Getenv("REGION")
-
-	// Log API configuration (without exposing the key)
-	log.Printf("API configuration - Region: %s, Key length: %d", region, len(apiKey))
-
-	// Check if API key is available
-	if apiKey == "" {
-		log.Println("Warning: API_KEY not set; file scanning will be skipped")
-		response := map[string]interface{}{
-			"scan_result_code": -1, // -1 indicates scan was skipped
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "No API key configured",
-				"message": "File uploaded successfully but not scanned due to missing API key",
-			},
+// scanUploadedFile scans a local file with the configured scanner. A transient
+// scanner failure is reported as an error result together with an error
+// wrapping errTransientScan so the caller can retry.
+func scanUploadedFile(ctx context.Context, filePath string, fileSize int64) (*ScanResult, error) {
+	fileName := filepath.Base(filePath)
+
+	// Check if a scanner is available
+	if fileScanner == nil {
+		log.Println("Warning: no scanner configured; file scanning will be skipped")
+		result := newScanResult(ScanStatusSkippedNoKey, fileName, fileSize)
+		result.Reason = "No API key configured"
+		result.Raw = map[string]interface{}{
+			"status":  "skipped",
+			"reason":  result.Reason,
+			"message": "File uploaded successfully but not scanned due to missing API key",
 		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return result, nil
 	}
 
-	start := time.Now()
-
-	// Initialize client
-	c, err := amaasclient.NewClient(apiKey, region)
-	if err != nil {
-		log.Printf("Failed to create client: %v", err)
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "Failed to create scan client",
-				"error": err.Error(),
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-	defer c.Destroy()
-
 	// Log file details before scanning
 	log.Printf("Scanning file: %s (size: %d bytes)", filePath, fileSize)
-	
+
 	// Validate file before scanning
 	if fileSize == 0 {
 		log.Printf("Warning: File is empty, skipping scan")
-		response := map[string]interface{}{
-			"scan_result_code": -3, // -3 indicates empty file
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "Empty file",
-				"message": "File is empty, no scan needed",
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
+		result := newScanResult(ScanStatusSkippedEmpty, fileName, fileSize)
+		result.Reason = "Empty file"
+		result.Raw = map[string]interface{}{
+			"status":    "skipped",
+			"reason":    result.Reason,
+			"message":   "File is empty, no scan needed",
+			"file_name": fileName,
+			"file_size": fileSize,
 		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return result, nil
 	}
-	
+
 	// Check file size limits (Trend Micro has limits)
-	if fileSize > 100*1024*1024 { // 100MB limit
+	if fileSize > maxScanSize {
 		log.Printf("Warning: File too large for scanning (%d bytes), skipping", fileSize)
-		response := map[string]interface{}{
-			"scan_result_code": -3, // -3 indicates file too large
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "File too large",
-				"message": "File exceeds maximum size for scanning",
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
+		result := newScanResult(ScanStatusSkippedTooLarge, fileName, fileSize)
+		result.Reason = "File too large"
+		result.Raw = map[string]interface{}{
+			"status":    "skipped",
+			"reason":    result.Reason,
+			"message":   "File exceeds maximum size for scanning",
+			"file_name": fileName,
+			"file_size": fileSize,
 		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return result, nil
 	}
-	
+
+	// scanError builds the -2 result shared by every failure below
+	scanError := func(reason string, err error) *ScanResult {
+		result := newScanResult(ScanStatusError, fileName, fileSize)
+		result.Scanner = fileScanner.Name()
+		result.Reason = reason
+		result.Error = err.Error()
+		result.Raw = map[string]interface{}{
+			"status":    "error",
+			"reason":    reason,
+			"error":     err.Error(),
+			"file_name": fileName,
+			"file_size": fileSize,
+		}
+		return result
+	}
+
+	start := time.Now()
+
 	// Scan file
 	tags := []string{"bpc-uploads"}
-	result, err := c.ScanFile(filePath, tags)
+	raw, err := fileScanner.ScanFile(ctx, filePath, tags)
+	if errors.Is(err, errScanClient) {
+		log.Printf("Failed to create client: %v", err)
+		return scanError("Failed to create scan client", err), nil
+	}
 	if err != nil {
 		log.Printf("Scan failed: %v", err)
 		// Check if this is a specific API error that should be retried
 		if strings.Contains(err.Error(), "unknown error") || strings.Contains(err.Error(), "Ecountered") {
 			log.Printf("API returned unknown error, this might be a transient issue")
+			return scanError("File scan failed", err), fmt.Errorf("%w: %v", errTransientScan, err)
 		}
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "File scan failed",
-				"error": err.Error(),
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return scanError("File scan failed", err), nil
 	}
 
 	elapsed := time.Since(start)
-	log.Printf("Scanning completed in %.2f seconds.", elapsed.Seconds())
-	log.Printf("Scanning complete: %s", result)
+	log.Printf("Scanning with %s completed in %.2f seconds.", fileScanner.Name(), elapsed.Seconds())
+	log.Printf("Scanning complete: %s", raw)
 
 	// Parse result to check scan status
-	var resultMap map[string]interface{}
-	if err := json.Unmarshal([]byte(result), &resultMap); err != nil {
+	resultMap, verdict, malware, err := parseScannerResult(raw)
+	if err != nil {
 		log.Printf("Failed to parse scan result: %v", err)
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "Failed to parse scan result",
-				"error": err.Error(),
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return scanError("Failed to parse scan result", err), nil
 	}
 
-	// Mimic Python version's result handling
-	scanResultCode := 0
-	if val, ok := resultMap["scanResult"].(float64); ok && val == 1 {
-		scanResultCode = 1
-		log.Println("File is malicious")
-	} else if val, ok := resultMap["scanResult"].(float64); ok && val == 0 {
+	// foundMalwares counts as a detection whatever scanResult says
+	status := verdictStatus(verdict, malware)
+	switch status {
+	case ScanStatusMalicious:
+		log.Printf("File is malicious - found malwares: %v", malware)
+	case ScanStatusClean:
 		log.Println("File is clean")
-	} else {
-		log.Printf("Unexpected scanResult value: %v (type: %T)", resultMap["scanResult"], resultMap["scanResult"])
-	}
-	
-	// Also check foundMalwares array for additional detection
-	if malwares, ok := resultMap["foundMalwares"].([]interface{}); ok && len(malwares) > 0 {
-		scanResultCode = 1
-		log.Printf("File is malicious - found malwares: %v", malwares)
+	default:
+		log.Printf("Unexpected scanResult value: %v", resultMap["scanResult"])
+		result := scanError("Unexpected scan verdict", fmt.Errorf("scanResult is %v", resultMap["scanResult"]))
+		result.DurationMs = elapsed.Milliseconds()
+		result.Raw["scanner_response"] = resultMap
+		return result, nil
 	}
 
-	// Prepare response similar to Python version
-	response := map[string]interface{}{
-		"scan_result_code": scanResultCode,
-		"scan_results":     resultMap,
+	result := newScanResult(status, fileName, fileSize)
+	result.Scanner = fileScanner.Name()
+	result.DurationMs = elapsed.Milliseconds()
+	result.Raw = resultMap
+	if malware != nil {
+		result.Malware = malware
 	}
-
-	responseJSON, _ := json.Marshal(response)
-	return string(responseJSON), nil
-}
\ No newline at end of file
+	return result, nil
+}
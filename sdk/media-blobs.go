@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MediaBlob is a published media object shared by every video with the same
+// content. Refs counts those videos; the object is deleted with the last one.
+type MediaBlob struct {
+	SHA256    string    `bson:"_id"`
+	Key       string    `bson:"key"`
+	Size      int64     `bson:"size"`
+	Refs      int       `bson:"refs"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+func mediaBlobs() *mongo.Collection {
+	return db.Collection("media_blobs")
+}
+
+// storeMediaBlob publishes the clean upload staged under key and returns the
+// key it is served from. Content that is already published is not stored a
+// second time: the staged copy is dropped and the existing object gains a
+// reference. Without a hash the upload is stored under fallbackKey.
+func storeMediaBlob(ctx context.Context, key, sha256, ext, fallbackKey string, size int64) (string, error) {
+	if sha256 == "" {
+		return fallbackKey, moveObject(ctx, mediaStore, key, fallbackKey)
+	}
+
+	blobKey := videosPrefix + sha256 + ext
+	update := bson.M{
+		"$inc":         bson.M{"refs": 1},
+		"$setOnInsert": bson.M{"key": blobKey, "size": size, "createdAt": time.Now().UTC()},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var existing MediaBlob
+	err := mediaBlobs().FindOneAndUpdate(ctx, bson.M{"_id": sha256}, update, opts).Decode(&existing)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", fmt.Errorf("cannot reference media blob: %w", err)
+	}
+
+	if err == nil {
+		// Already published; keep the stored copy unless it has gone missing
+		if _, statErr := mediaStore.Stat(ctx, existing.Key); statErr == nil {
+			if err := mediaStore.Delete(ctx, key); err != nil {
+				log.Printf("Failed to delete staged duplicate %s: %v", key, err)
+			}
+			log.Printf("Deduplicated upload %s into %s (%d refs)", key, existing.Key, existing.Refs+1)
+			return existing.Key, nil
+		}
+		blobKey = existing.Key
+	}
+
+	if err := moveObject(ctx, mediaStore, key, blobKey); err != nil {
+		releaseMediaBlob(context.Background(), sha256)
+		return "", err
+	}
+	return blobKey, nil
+}
+
+// releaseMediaBlob drops one reference to published content and deletes the
+// object once nothing refers to it
+func releaseMediaBlob(ctx context.Context, sha256 string) {
+	if sha256 == "" {
+		return
+	}
+
+	var blob MediaBlob
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := mediaBlobs().FindOneAndUpdate(ctx, bson.M{"_id": sha256}, bson.M{"$inc": bson.M{"refs": -1}}, opts).Decode(&blob)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to release media blob %s: %v", sha256, err)
+		}
+		return
+	}
+	if blob.Refs > 0 {
+		return
+	}
+
+	// Only delete if no upload took a new reference in the meantime
+	result, err := mediaBlobs().DeleteOne(ctx, bson.M{"_id": sha256, "refs": bson.M{"$lte": 0}})
+	if err != nil || result.DeletedCount == 0 {
+		return
+	}
+	if err := mediaStore.Delete(ctx, blob.Key); err != nil {
+		log.Printf("Failed to delete media object %s: %v", blob.Key, err)
+		return
+	}
+	log.Printf("Deleted unreferenced media object %s", blob.Key)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// processStagedUpload scans an upload staged under key in the blob store and
+// then publishes it when clean or quarantines it when malicious. Anything else
+// stays staged. The scan response is returned with the publication outcome
+// added; on a transient scan failure it is returned together with an error
+// wrapping errTransientScan, and when a clean upload cannot be published or
+// a malicious one quarantined with one wrapping errUploadNotMoved. When the content's
+// SHA-256 is known a cached verdict for it is reused instead of scanning.
+func processStagedUpload(ctx context.Context, key, filename string, size int64, sha256 string, form map[string][]string) (*ScanResult, error) {
+	scanResult := cachedScanResult(ctx, sha256, filename, size)
+	if scanResult == nil {
+		err := withLocalFile(ctx, mediaStore, key, func(filePath string) error {
+			var err error
+			scanResult, err = scanUploadedFile(ctx, filePath, size)
+			return err
+		})
+		if err != nil {
+			return scanResult, err
+		}
+		storeScanVerdict(ctx, sha256, scanResult)
+	}
+	scanResult.FileName = filename
+	scanResult.SHA256 = sha256
+
+	switch scanResult.Status {
+	case ScanStatusClean:
+		video, err := publishUpload(ctx, key, filename, sha256, size, form)
+		if errors.Is(err, errInvalidUploadForm) {
+			return nil, fmt.Errorf("cannot publish video: %w", err)
+		} else if err != nil {
+			return scanResult, fmt.Errorf("%w: cannot publish: %w", errUploadNotMoved, err)
+		}
+		scanResult.VideoID = video.ID.Hex()
+		scanResult.VideoURL = video.VideoURL
+		scanResult.Published = true
+	case ScanStatusMalicious:
+		item, err := quarantineUpload(ctx, key, filename, form, scanResult)
+		if err != nil {
+			return scanResult, fmt.Errorf("%w: cannot quarantine: %w", errUploadNotMoved, err)
+		}
+		scanResult.Quarantined = true
+		scanResult.QuarantineID = item.ID.Hex()
+	}
+	return scanResult, nil
+}
+
+// errInvalidUploadForm marks uploads that cannot be published because of
+// their form fields, so publishing them again would not help
+var errInvalidUploadForm = errors.New("invalid upload form")
+
+// publishTimeout leaves time to move an upload of the given size in the
+// blob store, at 1 MB/s or better
+func publishTimeout(size int64) time.Duration {
+	return 30*time.Second + time.Duration(size>>20)*time.Second
+}
+
+// maxTitleNumber bounds the numbered titles tried for an upload
+const maxTitleNumber = 20
+
+// numberedTitle is the title of the n-th video of an uploader sharing a
+// title, e.g. "clip (2)"
+func numberedTitle(title string, n int) string {
+	suffix := fmt.Sprintf(" (%d)", n)
+	if len(title)+len(suffix) > maxVideoTitleLength {
+		title = strings.TrimSpace(strings.ToValidUTF8(title[:maxVideoTitleLength-len(suffix)], ""))
+	}
+	return title + suffix
+}
+
+// publishUpload moves a clean upload into the published videos area of the
+// blob store, shared with any identical content already there, and records
+// it as a Video. Optional metadata is read from the upload form fields title,
+// description, category, tags (comma separated) and uploader (a username).
+// When it fails the upload is left staged under key.
+func publishUpload(ctx context.Context, key, originalName, sha256 string, size int64, form map[string][]string) (*Video, error) {
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout(size))
+	defer cancel()
+
+	formValue := func(key string) string {
+		if values := form[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(originalName))
+	video := Video{
+		ID:          primitive.NewObjectID(),
+		Title:       formValue("title"),
+		Description: formValue("description"),
+		Category:    formValue("category"),
+		Tags:        []string{},
+	}
+	if video.Title == "" {
+		video.Title = strings.TrimSuffix(originalName, filepath.Ext(originalName))
+	}
+	if video.Category == "" {
+		video.Category = "General"
+	}
+	for _, tag := range strings.Split(formValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			video.Tags = append(video.Tags, tag)
+		}
+	}
+	if err := validateVideoFields(video.Title, video.Category, video.Duration); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidUploadForm, err)
+	}
+
+	if username := formValue("uploader"); username != "" {
+		var user User
+		err := db.Collection("users").FindOne(ctx, bson.M{"username": username}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("%w: unknown uploader %q", errInvalidUploadForm, username)
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot find uploader %q: %w", username, err)
+		}
+		video.Uploader = UploaderInfo{
+			ID:       user.ID.Hex(),
+			Name:     user.Name,
+			Username: user.Username,
+			Avatar:   user.Avatar,
+		}
+	}
+
+	info, err := mediaStore.Stat(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot store upload: %w", err)
+	}
+
+	// Read duration, resolution and codecs from the file itself
+	media, err := extractMediaInfo(&blobReaderAt{ctx: ctx, store: mediaStore, key: key, size: info.Size}, info.Size)
+	switch {
+	case err == nil:
+		video.Media = media
+		if video.Duration == 0 {
+			video.Duration = int(math.Round(media.Duration))
+		}
+	case !errors.Is(err, errUnsupportedMedia):
+		log.Printf("Failed to extract metadata from %s: %v", originalName, err)
+	}
+	storedKey, err := storeMediaBlob(ctx, key, sha256, ext, videosPrefix+video.ID.Hex()+ext, info.Size)
+	if err != nil {
+		return nil, fmt.Errorf("cannot store upload: %w", err)
+	}
+
+	now := time.Now().UTC()
+	video.VideoURL = "/media/" + strings.TrimPrefix(storedKey, videosPrefix)
+	video.SHA256 = sha256
+	video.ThumbnailURL = "/videos/" + video.ID.Hex() + "/thumbnail"
+	video.UploadDate = now
+	video.UpdatedAt = now
+
+	// The uploader may already have a video with this title, often the
+	// same file name; number the new one instead of failing the upload
+	videos := db.Collection("videos")
+	title := video.Title
+	_, err = videos.InsertOne(ctx, video)
+	for n := 2; mongo.IsDuplicateKeyError(err) && n <= maxTitleNumber; n++ {
+		video.Title = numberedTitle(title, n)
+		_, err = videos.InsertOne(ctx, video)
+	}
+	if err != nil {
+		// Stage the upload again so publishing can be retried
+		if err := copyObject(context.Background(), mediaStore, storedKey, key); err != nil {
+			log.Printf("Failed to restage upload %s: %v", key, err)
+		}
+		if sha256 != "" {
+			releaseMediaBlob(context.Background(), sha256)
+		} else {
+			mediaStore.Delete(context.Background(), storedKey)
+		}
+		return nil, fmt.Errorf("cannot insert video: %w", err)
+	}
+
+	log.Printf("Published upload %s as video %s (%s)", originalName, video.ID.Hex(), video.VideoURL)
+	generateThumbnailsAsync(video)
+	if hlsTranscoder != nil {
+		if _, err := enqueueTranscodeJob(ctx, video.ID); err != nil {
+			log.Printf("Failed to queue transcode job for video %s: %v", video.ID.Hex(), err)
+		}
+	}
+	return &video, nil
+}
+
+// mediaKeyForURL maps a VideoURL to its blob store key. Published uploads use
+// /media/<id>.<ext>; the seeded catalog uses /videos/<name>.mp4, which resolves
+// when those files are copied under the videos/ prefix of the store.
+func mediaKeyForURL(videoURL string) (string, bool) {
+	for _, prefix := range []string{"/media/", "/videos/"} {
+		name := strings.TrimPrefix(videoURL, prefix)
+		if name == videoURL {
+			continue
+		}
+		if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+			return "", false
+		}
+		return videosPrefix + name, true
+	}
+	return "", false
+}
+
+// mediaHandler serves published media from the blob store. Only keys under
+// the videos prefix are reachable, so staged and quarantined uploads are not.
+func mediaHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := mediaKeyForURL(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	serveBlob(w, r, key)
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MediaInfo is technical metadata read from a video file
+type MediaInfo struct {
+	Container       string    `json:"container" bson:"container"`
+	Duration        float64   `json:"duration" bson:"duration"` // seconds, 0 if unknown
+	Width           int       `json:"width,omitempty" bson:"width,omitempty"`
+	Height          int       `json:"height,omitempty" bson:"height,omitempty"`
+	VideoCodec      string    `json:"videoCodec,omitempty" bson:"videoCodec,omitempty"`
+	AudioCodec      string    `json:"audioCodec,omitempty" bson:"audioCodec,omitempty"`
+	Bitrate         int64     `json:"bitrate,omitempty" bson:"bitrate,omitempty"` // bits per second, whole file
+	FrameRate       float64   `json:"frameRate,omitempty" bson:"frameRate,omitempty"`
+	AudioChannels   int       `json:"audioChannels,omitempty" bson:"audioChannels,omitempty"`
+	AudioSampleRate int       `json:"audioSampleRate,omitempty" bson:"audioSampleRate,omitempty"`
+	Size            int64     `json:"size" bson:"size"`
+	ExtractedAt     time.Time `json:"extractedAt" bson:"extractedAt"`
+}
+
+var errUnsupportedMedia = errors.New("unsupported media container")
+
+const (
+	maxMoovSize        = 64 << 20 // the index of very long MP4s runs to a few MB
+	maxEBMLElementSize = 16 << 20 // Info and Tracks are tiny; this only bounds bad input
+)
+
+// Bounds on values read from the file. Anything outside them is corrupt or
+// crafted and recorded as unknown, since JSON cannot encode NaN or Inf and
+// durations end up as ints.
+const (
+	maxMediaDuration   = 7 * 24 * 3600 // seconds
+	maxMediaFrameRate  = 1000
+	maxMediaSampleRate = 1 << 20
+)
+
+// plausible returns v if it is in (0, max], and 0 otherwise, including for
+// NaN and Inf
+func plausible(v, max float64) float64 {
+	if v > 0 && v <= max {
+		return v
+	}
+	return 0
+}
+
+// extractMediaInfo reads the metadata of an MP4/MOV or WebM/Matroska file
+func extractMediaInfo(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	head := make([]byte, 64)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	var info *MediaInfo
+	switch {
+	case ebmlDocType(head) != "":
+		info, err = extractMatroskaInfo(r, size, ebmlDocType(head))
+	case isMP4(head) || isQuickTime(head):
+		info, err = extractMP4Info(r, size)
+	default:
+		return nil, errUnsupportedMedia
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.Size = size
+	if info.Duration > 0 {
+		info.Bitrate = int64(float64(size*8) / info.Duration)
+		info.Duration = math.Round(info.Duration*1000) / 1000
+	}
+	info.FrameRate = math.Round(info.FrameRate*1000) / 1000
+	info.ExtractedAt = time.Now().UTC()
+	return info, nil
+}
+
+// mp4CodecNames maps sample entry types to common codec names
+var mp4CodecNames = map[string]string{
+	"avc1": "h264", "avc3": "h264", "hvc1": "hevc", "hev1": "hevc", "av01": "av1",
+	"vp08": "vp8", "vp09": "vp9", "mp4v": "mpeg4", "apcn": "prores", "apch": "prores",
+	"apcs": "prores", "apco": "prores", "ap4h": "prores", "jpeg": "mjpeg",
+	"mp4a": "aac", "Opus": "opus", "ac-3": "ac3", "ec-3": "eac3", ".mp3": "mp3",
+	"fLaC": "flac", "alac": "alac", "lpcm": "pcm", "sowt": "pcm", "twos": "pcm",
+}
+
+func mp4CodecName(format string) string {
+	if name, ok := mp4CodecNames[format]; ok {
+		return name
+	}
+	return strings.TrimSpace(format)
+}
+
+// eachMP4Box calls fn with the type and body of every box in data
+func eachMP4Box(data []byte, fn func(boxType string, body []byte)) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		boxType := string(data[4:8])
+		headerLen := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerLen = 16
+		}
+		if size < headerLen || size > uint64(len(data)) {
+			return
+		}
+		fn(boxType, data[headerLen:size])
+		data = data[size:]
+	}
+}
+
+// mp4TimeFields reads the timescale and duration of an mvhd or mdhd box
+func mp4TimeFields(body []byte) (timescale uint32, duration uint64) {
+	if len(body) >= 32 && body[0] == 1 {
+		return binary.BigEndian.Uint32(body[20:24]), binary.BigEndian.Uint64(body[24:32])
+	}
+	if len(body) >= 20 {
+		return binary.BigEndian.Uint32(body[12:16]), uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+	return 0, 0
+}
+
+// mp4Track is what a trak box says about one track
+type mp4Track struct {
+	handler       string
+	width, height int
+	timescale     uint32
+	duration      uint64
+	format        string
+	channels      int
+	sampleRate    int
+	samples       uint64
+}
+
+func parseMP4Track(trak []byte) mp4Track {
+	var track mp4Track
+	eachMP4Box(trak, func(boxType string, body []byte) {
+		switch boxType {
+		case "tkhd":
+			// Width and height are 16.16 fixed point at the end of the box
+			offset := 76
+			if len(body) > 0 && body[0] == 1 {
+				offset = 88
+			}
+			if len(body) >= offset+8 {
+				track.width = int(binary.BigEndian.Uint32(body[offset:]) >> 16)
+				track.height = int(binary.BigEndian.Uint32(body[offset+4:]) >> 16)
+			}
+		case "mdia":
+			eachMP4Box(body, func(boxType string, body []byte) {
+				switch boxType {
+				case "mdhd":
+					track.timescale, track.duration = mp4TimeFields(body)
+				case "hdlr":
+					if len(body) >= 12 {
+						track.handler = string(body[8:12])
+					}
+				case "minf":
+					eachMP4Box(body, func(boxType string, body []byte) {
+						if boxType == "stbl" {
+							parseMP4SampleTable(body, &track)
+						}
+					})
+				}
+			})
+		}
+	})
+	return track
+}
+
+func parseMP4SampleTable(stbl []byte, track *mp4Track) {
+	eachMP4Box(stbl, func(boxType string, body []byte) {
+		switch boxType {
+		case "stsd":
+			// Only the first sample entry matters
+			if len(body) < 16 {
+				return
+			}
+			entry := body[8:]
+			size := int(binary.BigEndian.Uint32(entry[:4]))
+			if size < 8 || size > len(entry) {
+				return
+			}
+			track.format = string(entry[4:8])
+			sample := entry[8:size]
+			if len(sample) < 28 {
+				return
+			}
+			switch track.handler {
+			case "vide":
+				// Coded size, after 24 bytes of reserved fields; tkhd's
+				// display size wins when present
+				if track.width == 0 {
+					track.width = int(binary.BigEndian.Uint16(sample[24:26]))
+					track.height = int(binary.BigEndian.Uint16(sample[26:28]))
+				}
+			case "soun":
+				// Channel count, then a 16.16 fixed point sample rate
+				track.channels = int(binary.BigEndian.Uint16(sample[16:18]))
+				track.sampleRate = int(binary.BigEndian.Uint32(sample[24:28]) >> 16)
+			}
+		case "stts":
+			if len(body) < 8 {
+				return
+			}
+			count := int(binary.BigEndian.Uint32(body[4:8]))
+			for i := 0; i < count && 8+i*8+8 <= len(body); i++ {
+				track.samples += uint64(binary.BigEndian.Uint32(body[8+i*8:]))
+			}
+		}
+	})
+}
+
+// extractMP4Info reads the moov box of an ISO BMFF (MP4) or QuickTime file
+func extractMP4Info(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	// QuickTime files have a "qt  " ftyp brand or no ftyp at all
+	info := &MediaInfo{Container: "mov"}
+	var moov []byte
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= size && moov == nil; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerLen := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if boxSize < headerLen || offset+boxSize > size {
+			return nil, fmt.Errorf("invalid %q box at offset %d", boxType, offset)
+		}
+
+		switch boxType {
+		case "ftyp":
+			brand := make([]byte, 4)
+			if _, err := r.ReadAt(brand, offset+headerLen); err == nil && string(brand) != "qt  " {
+				info.Container = "mp4"
+			}
+		case "moov":
+			if boxSize-headerLen > maxMoovSize {
+				return nil, errors.New("moov box too large")
+			}
+			moov = make([]byte, boxSize-headerLen)
+			if _, err := r.ReadAt(moov, offset+headerLen); err != nil {
+				return nil, err
+			}
+		}
+		offset += boxSize
+	}
+	if moov == nil {
+		return nil, errors.New("no moov box")
+	}
+	var video, audio *mp4Track
+	eachMP4Box(moov, func(boxType string, body []byte) {
+		switch boxType {
+		case "mvhd":
+			if timescale, duration := mp4TimeFields(body); timescale > 0 {
+				info.Duration = plausible(float64(duration)/float64(timescale), maxMediaDuration)
+			}
+		case "trak":
+			track := parseMP4Track(body)
+			switch {
+			case track.handler == "vide" && video == nil:
+				video = &track
+			case track.handler == "soun" && audio == nil:
+				audio = &track
+			}
+		}
+	})
+
+	if video != nil {
+		info.Width, info.Height = video.width, video.height
+		info.VideoCodec = mp4CodecName(video.format)
+		if video.timescale > 0 && video.duration > 0 {
+			info.FrameRate = plausible(float64(video.samples)*float64(video.timescale)/float64(video.duration), maxMediaFrameRate)
+			if info.Duration == 0 {
+				info.Duration = plausible(float64(video.duration)/float64(video.timescale), maxMediaDuration)
+			}
+		}
+	}
+	if audio != nil {
+		info.AudioCodec = mp4CodecName(audio.format)
+		info.AudioChannels = audio.channels
+		info.AudioSampleRate = audio.sampleRate
+	}
+	return info, nil
+}
+
+// Matroska element IDs
+const (
+	ebmlIDSegment         = 0x18538067
+	ebmlIDInfo            = 0x1549A966
+	ebmlIDTracks          = 0x1654AE6B
+	ebmlIDCluster         = 0x1F43B675
+	ebmlIDTimecodeScale   = 0x2AD7B1
+	ebmlIDDuration        = 0x4489
+	ebmlIDTrackEntry      = 0xAE
+	ebmlIDTrackType       = 0x83
+	ebmlIDCodecID         = 0x86
+	ebmlIDDefaultDuration = 0x23E383
+	ebmlIDVideo           = 0xE0
+	ebmlIDPixelWidth      = 0xB0
+	ebmlIDPixelHeight     = 0xBA
+	ebmlIDAudio           = 0xE1
+	ebmlIDSamplingFreq    = 0xB5
+	ebmlIDChannels        = 0x9F
+)
+
+// ebmlUnknownSize marks elements, usually live-recorded segments and
+// clusters, whose size was not known when they were written
+const ebmlUnknownSize = -1
+
+// parseEBMLVint decodes a variable length integer. IDs keep their length
+// marker bit; sizes drop it, and an all-ones size means unknown.
+func parseEBMLVint(data []byte, isID bool) (value int64, length int, ok bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+	length = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || (isID && length > 4) || len(data) < length {
+		return 0, 0, false
+	}
+	first := uint64(data[0])
+	allOnes := data[0]&(0xFF>>length) == 0xFF>>length
+	if !isID {
+		first &= uint64(0xFF >> length)
+	}
+	value = int64(first)
+	for _, b := range data[1:length] {
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !isID && allOnes {
+		return ebmlUnknownSize, length, true
+	}
+	return value, length, true
+}
+
+// eachEBMLElement calls fn with the ID and body of every element in data
+func eachEBMLElement(data []byte, fn func(id int64, body []byte)) {
+	for len(data) > 0 {
+		id, idLen, ok := parseEBMLVint(data, true)
+		if !ok {
+			return
+		}
+		size, sizeLen, ok := parseEBMLVint(data[idLen:], false)
+		if !ok || size == ebmlUnknownSize || int64(idLen+sizeLen)+size > int64(len(data)) {
+			return
+		}
+		start := idLen + sizeLen
+		fn(id, data[start:start+int(size)])
+		data = data[start+int(size):]
+	}
+}
+
+func ebmlUint(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(body []byte) float64 {
+	switch len(body) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(body))
+	}
+	return 0
+}
+
+// matroskaCodecNames maps Matroska codec IDs to common codec names
+var matroskaCodecNames = map[string]string{
+	"V_VP8": "vp8", "V_VP9": "vp9", "V_AV1": "av1", "V_MPEG4/ISO/AVC": "h264",
+	"V_MPEGH/ISO/HEVC": "hevc", "V_THEORA": "theora", "V_MJPEG": "mjpeg",
+	"A_OPUS": "opus", "A_VORBIS": "vorbis", "A_AAC": "aac", "A_MPEG/L3": "mp3",
+	"A_AC3": "ac3", "A_EAC3": "eac3", "A_FLAC": "flac", "A_PCM/INT/LIT": "pcm",
+}
+
+func matroskaCodecName(codecID string) string {
+	if name, ok := matroskaCodecNames[codecID]; ok {
+		return name
+	}
+	if strings.HasPrefix(codecID, "A_AAC") {
+		return "aac"
+	}
+	return strings.ToLower(codecID)
+}
+
+// readEBMLHeader reads the ID and size of the element at offset
+func readEBMLHeader(r io.ReaderAt, offset int64) (id, size int64, headerLen int, err error) {
+	buf := make([]byte, 12)
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	id, idLen, ok := parseEBMLVint(buf[:n], true)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid EBML element at offset %d", offset)
+	}
+	size, sizeLen, ok := parseEBMLVint(buf[idLen:n], false)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid EBML element size at offset %d", offset)
+	}
+	return id, size, idLen + sizeLen, nil
+}
+
+// extractMatroskaInfo reads the Info and Tracks elements of a WebM or
+// Matroska file, which precede the media clusters
+func extractMatroskaInfo(r io.ReaderAt, size int64, docType string) (*MediaInfo, error) {
+	info := &MediaInfo{Container: "mkv"}
+	if docType == "webm" {
+		info.Container = "webm"
+	}
+
+	// Skip the EBML header to the Segment
+	_, headerSize, headerLen, err := readEBMLHeader(r, 0)
+	if err != nil || headerSize == ebmlUnknownSize {
+		return nil, errors.New("invalid EBML header")
+	}
+	offset := int64(headerLen) + headerSize
+	id, segmentSize, headerLen, err := readEBMLHeader(r, offset)
+	if err != nil || id != ebmlIDSegment {
+		return nil, errors.New("no Matroska segment")
+	}
+	offset += int64(headerLen)
+	end := size
+	if segmentSize != ebmlUnknownSize && offset+segmentSize < size {
+		end = offset + segmentSize
+	}
+
+	timecodeScale := uint64(1000000)
+	var rawDuration float64
+	var seenInfo, seenTracks, seenVideo, seenAudio bool
+	for offset < end && !(seenInfo && seenTracks) {
+		id, elementSize, headerLen, err := readEBMLHeader(r, offset)
+		if err != nil {
+			return nil, err
+		}
+		if id == ebmlIDCluster || elementSize == ebmlUnknownSize {
+			break
+		}
+		bodyStart := offset + int64(headerLen)
+		offset = bodyStart + elementSize
+		if id != ebmlIDInfo && id != ebmlIDTracks {
+			continue
+		}
+		if elementSize > maxEBMLElementSize || offset > size {
+			return nil, errors.New("matroska element too large")
+		}
+		body := make([]byte, elementSize)
+		if _, err := r.ReadAt(body, bodyStart); err != nil {
+			return nil, err
+		}
+
+		if id == ebmlIDInfo {
+			seenInfo = true
+			eachEBMLElement(body, func(id int64, body []byte) {
+				switch id {
+				case ebmlIDTimecodeScale:
+					if scale := ebmlUint(body); scale > 0 {
+						timecodeScale = scale
+					}
+				case ebmlIDDuration:
+					rawDuration = ebmlFloat(body)
+				}
+			})
+			continue
+		}
+
+		seenTracks = true
+		eachEBMLElement(body, func(id int64, entry []byte) {
+			if id != ebmlIDTrackEntry {
+				return
+			}
+			var trackType uint64
+			var codecID string
+			var defaultDuration uint64
+			var width, height, channels int
+			var sampleRate float64
+			eachEBMLElement(entry, func(id int64, body []byte) {
+				switch id {
+				case ebmlIDTrackType:
+					trackType = ebmlUint(body)
+				case ebmlIDCodecID:
+					codecID = strings.TrimRight(string(body), "\x00")
+				case ebmlIDDefaultDuration:
+					defaultDuration = ebmlUint(body)
+				case ebmlIDVideo:
+					eachEBMLElement(body, func(id int64, body []byte) {
+						switch id {
+						case ebmlIDPixelWidth:
+							width = int(ebmlUint(body))
+						case ebmlIDPixelHeight:
+							height = int(ebmlUint(body))
+						}
+					})
+				case ebmlIDAudio:
+					channels = 1 // the Matroska default
+					eachEBMLElement(body, func(id int64, body []byte) {
+						switch id {
+						case ebmlIDSamplingFreq:
+							sampleRate = ebmlFloat(body)
+						case ebmlIDChannels:
+							channels = int(ebmlUint(body))
+						}
+					})
+				}
+			})
+
+			switch {
+			case trackType == 1 && !seenVideo:
+				seenVideo = true
+				info.VideoCodec = matroskaCodecName(codecID)
+				info.Width, info.Height = width, height
+				if defaultDuration > 0 {
+					info.FrameRate = plausible(1e9/float64(defaultDuration), maxMediaFrameRate)
+				}
+			case trackType == 2 && !seenAudio:
+				seenAudio = true
+				info.AudioCodec = matroskaCodecName(codecID)
+				info.AudioChannels = channels
+				info.AudioSampleRate = int(plausible(sampleRate, maxMediaSampleRate))
+			}
+		})
+	}
+	if !seenTracks {
+		return nil, errors.New("no Matroska tracks")
+	}
+
+	info.Duration = plausible(rawDuration*float64(timecodeScale)/1e9, maxMediaDuration)
+	return info, nil
+}
+
+// mediaInfoForKey extracts the metadata of a stored object
+func mediaInfoForKey(ctx context.Context, key string) (*MediaInfo, error) {
+	obj, err := mediaStore.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return extractMediaInfo(&blobReaderAt{ctx: ctx, store: mediaStore, key: key, size: obj.Size}, obj.Size)
+}
+
+// Get a video's media metadata, extracting and saving it on first request
+// for videos published before extraction existed
+func getVideoMetadata(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := db.Collection("videos")
+	var video Video
+	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&video)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find video: %v", err)
+			http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if video.Media == nil {
+		key, ok := mediaKeyForURL(video.VideoURL)
+		if !ok {
+			http.Error(w, "Media file not found", http.StatusNotFound)
+			return
+		}
+		media, err := mediaInfoForKey(ctx, key)
+		if errors.Is(err, errObjectNotFound) {
+			http.Error(w, "Media file not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to extract metadata for video %s: %v", id, err)
+			http.Error(w, "Cannot read media metadata", http.StatusUnprocessableEntity)
+			return
+		}
+
+		set := bson.M{"media": media}
+		if video.Duration == 0 {
+			set["duration"] = int(math.Round(media.Duration))
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{"$set": set}); err != nil {
+			log.Printf("Failed to save metadata for video %s: %v", id, err)
+		}
+		video.Media = media
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(video.Media)
+}
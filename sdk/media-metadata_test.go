@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// MP4 fixtures
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func mp4Box(boxType string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	return append(append(u32(uint32(8+len(body))), boxType...), body...)
+}
+
+// mp4TimeBox is a version 0 mvhd or mdhd
+func mp4TimeBox(boxType string, timescale, duration uint32) []byte {
+	return mp4Box(boxType, make([]byte, 12), u32(timescale), u32(duration), make([]byte, 80))
+}
+
+func mp4Tkhd(width, height uint32) []byte {
+	body := make([]byte, 84)
+	binary.BigEndian.PutUint32(body[76:], width<<16)
+	binary.BigEndian.PutUint32(body[80:], height<<16)
+	return mp4Box("tkhd", body)
+}
+
+func mp4Hdlr(handler string) []byte {
+	return mp4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 13))
+}
+
+func mp4Stsd(format string, sample []byte) []byte {
+	entry := append(append(u32(uint32(8+len(sample))), format...), sample...)
+	return mp4Box("stsd", make([]byte, 4), u32(1), entry)
+}
+
+func mp4Stts(count, delta uint32) []byte {
+	return mp4Box("stts", make([]byte, 4), u32(1), u32(count), u32(delta))
+}
+
+// mp4Trak is a track whose sample entry is format and sample
+func mp4Trak(handler, format string, sample []byte, timescale, duration, samples uint32) []byte {
+	stbl := mp4Box("stbl", mp4Stsd(format, sample), mp4Stts(samples, duration/max32(samples, 1)))
+	mdia := mp4Box("mdia", mp4TimeBox("mdhd", timescale, duration), mp4Hdlr(handler), mp4Box("minf", stbl))
+	return mp4Box("trak", mp4Tkhd(0, 0), mdia)
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func mp4VideoSample(width, height uint16) []byte {
+	sample := make([]byte, 70)
+	copy(sample[24:], u16(width))
+	copy(sample[26:], u16(height))
+	return sample
+}
+
+func mp4AudioSample(channels uint16, rate uint32) []byte {
+	sample := make([]byte, 28)
+	copy(sample[16:], u16(channels))
+	copy(sample[24:], u32(rate<<16))
+	return sample
+}
+
+// mp4File is a 10 second 1280x720 30 fps h264 + stereo AAC file
+func mp4File(brand string, mvhd []byte, videoTrak []byte) []byte {
+	if mvhd == nil {
+		mvhd = mp4TimeBox("mvhd", 1000, 10000)
+	}
+	if videoTrak == nil {
+		videoTrak = mp4Trak("vide", "avc1", mp4VideoSample(1280, 720), 30000, 300000, 300)
+	}
+	audioTrak := mp4Trak("soun", "mp4a", mp4AudioSample(2, 48000), 48000, 480000, 469)
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte(brand), u32(512), []byte(brand+"mp41")),
+		mp4Box("moov", mvhd, videoTrak, audioTrak),
+		mp4Box("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+// EBML fixtures
+
+func ebmlElement(id uint32, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	idBytes := u32(id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	var size []byte
+	if len(body) < 0x7F {
+		size = []byte{0x80 | byte(len(body))}
+	} else {
+		size = binary.BigEndian.AppendUint64(nil, uint64(len(body)))
+		size[0] = 0x01
+	}
+	return append(append(idBytes, size...), body...)
+}
+
+func ebmlUintBody(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func ebmlFloat64Body(v float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+}
+
+func ebmlFloat32Body(v float32) []byte { return u32(math.Float32bits(v)) }
+
+// matroskaFile is a VP9 640x360 30 fps + stereo Opus file. duration is the
+// raw Duration element body, in milliseconds with the default scale.
+func matroskaFile(docType string, duration, samplingFreq []byte, defaultDuration uint64) []byte {
+	header := ebmlElement(0x1A45DFA3, ebmlElement(0x4282, []byte(docType)))
+	info := ebmlElement(ebmlIDInfo,
+		ebmlElement(ebmlIDTimecodeScale, ebmlUintBody(1000000)),
+		ebmlElement(ebmlIDDuration, duration),
+	)
+	tracks := ebmlElement(ebmlIDTracks,
+		ebmlElement(ebmlIDTrackEntry,
+			ebmlElement(ebmlIDTrackType, []byte{1}),
+			ebmlElement(ebmlIDCodecID, []byte("V_VP9")),
+			ebmlElement(ebmlIDDefaultDuration, ebmlUintBody(defaultDuration)),
+			ebmlElement(ebmlIDVideo,
+				ebmlElement(ebmlIDPixelWidth, ebmlUintBody(640)),
+				ebmlElement(ebmlIDPixelHeight, ebmlUintBody(360)),
+			),
+		),
+		ebmlElement(ebmlIDTrackEntry,
+			ebmlElement(ebmlIDTrackType, []byte{2}),
+			ebmlElement(ebmlIDCodecID, []byte("A_OPUS")),
+			ebmlElement(ebmlIDAudio,
+				ebmlElement(ebmlIDSamplingFreq, samplingFreq),
+				ebmlElement(ebmlIDChannels, []byte{2}),
+			),
+		),
+	)
+	cluster := ebmlElement(ebmlIDCluster, make([]byte, 32))
+	return append(header, ebmlElement(ebmlIDSegment, info, tracks, cluster)...)
+}
+
+func webmFile(durationMs float64) []byte {
+	return matroskaFile("webm", ebmlFloat64Body(durationMs), ebmlFloat64Body(48000), 33333333)
+}
+
+func TestExtractMediaInfo(t *testing.T) {
+	mp4 := MediaInfo{
+		Container: "mp4", Duration: 10, Width: 1280, Height: 720, VideoCodec: "h264", FrameRate: 30,
+		AudioCodec: "aac", AudioChannels: 2, AudioSampleRate: 48000,
+	}
+	webm := MediaInfo{
+		Container: "webm", Duration: 12.345, Width: 640, Height: 360, VideoCodec: "vp9", FrameRate: 30,
+		AudioCodec: "opus", AudioChannels: 2, AudioSampleRate: 48000,
+	}
+	with := func(info MediaInfo, change func(*MediaInfo)) MediaInfo {
+		change(&info)
+		return info
+	}
+	// A 30 fps track of 10 seconds, for files whose mvhd is unusable
+	trackDuration := func(info *MediaInfo) { info.Duration = 10 }
+
+	tests := []struct {
+		name string
+		file []byte
+		want MediaInfo
+	}{
+		{"mp4", mp4File("isom", nil, nil), mp4},
+		{"quicktime", mp4File("qt  ", nil, nil), with(mp4, func(i *MediaInfo) { i.Container = "mov" })},
+		{"mp4 without movie timescale", mp4File("isom", mp4TimeBox("mvhd", 0, 10000), nil), with(mp4, trackDuration)},
+		{"mp4 with an absurd movie duration", mp4File("isom", mp4TimeBox("mvhd", 1, 0xFFFFFFFF), nil), with(mp4, trackDuration)},
+		{
+			"mp4 with an absurd frame rate",
+			mp4File("isom", nil, mp4Trak("vide", "avc1", mp4VideoSample(1280, 720), 1000000000, 1, 0xFFFFFFFF)),
+			with(mp4, func(i *MediaInfo) { i.FrameRate = 0 }),
+		},
+		{
+			"mp4 with a truncated sample entry",
+			mp4File("isom", nil, mp4Trak("vide", "avc1", make([]byte, 4), 30000, 300000, 300)),
+			with(mp4, func(i *MediaInfo) { i.Width, i.Height = 0, 0 }),
+		},
+		{"webm", webmFile(12345), webm},
+		{"matroska", matroskaFile("matroska", ebmlFloat64Body(12345), ebmlFloat64Body(48000), 33333333), with(webm, func(i *MediaInfo) { i.Container = "mkv" })},
+		{"float32 duration", matroskaFile("webm", ebmlFloat32Body(12345), ebmlFloat64Body(48000), 33333333), webm},
+		{"infinite duration", webmFile(math.Inf(1)), with(webm, func(i *MediaInfo) { i.Duration = 0 })},
+		{"infinite float32 duration", matroskaFile("webm", ebmlFloat32Body(float32(math.Inf(1))), ebmlFloat64Body(48000), 33333333), with(webm, func(i *MediaInfo) { i.Duration = 0 })},
+		{"NaN duration", webmFile(math.NaN()), with(webm, func(i *MediaInfo) { i.Duration = 0 })},
+		{"negative duration", webmFile(-5000), with(webm, func(i *MediaInfo) { i.Duration = 0 })},
+		{"huge duration", webmFile(1e300), with(webm, func(i *MediaInfo) { i.Duration = 0 })},
+		{"infinite sampling rate", matroskaFile("webm", ebmlFloat64Body(12345), ebmlFloat64Body(math.Inf(1)), 33333333), with(webm, func(i *MediaInfo) { i.AudioSampleRate = 0 })},
+		{"absurd frame rate", matroskaFile("webm", ebmlFloat64Body(12345), ebmlFloat64Body(48000), 1), with(webm, func(i *MediaInfo) { i.FrameRate = 0 })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractMediaInfo(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if err != nil {
+				t.Fatalf("extractMediaInfo: %v", err)
+			}
+			want := tt.want
+			want.Size = int64(len(tt.file))
+			if want.Duration > 0 {
+				want.Bitrate = int64(float64(want.Size*8) / want.Duration)
+			}
+			want.ExtractedAt = got.ExtractedAt
+			if *got != want {
+				t.Errorf("got  %+v\nwant %+v", *got, want)
+			}
+			if _, err := json.Marshal(got); err != nil {
+				t.Errorf("MediaInfo does not encode: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractMediaInfoInvalid(t *testing.T) {
+	valid := mp4File("isom", nil, nil)
+	moovAt := bytes.Index(valid, []byte("moov")) - 4
+	ftyp := mp4Box("ftyp", []byte("isom"), u32(512), []byte("isommp41"))
+	largesize := append(append(u32(1), "moov"...), binary.BigEndian.AppendUint64(nil, 1<<40)...)
+
+	webm := webmFile(12345)
+	segment := bytes.Index(webm, []byte{0x18, 0x53, 0x80, 0x67})
+	noTracks := append(webm[:segment:segment], ebmlElement(ebmlIDSegment,
+		ebmlElement(ebmlIDInfo, ebmlElement(ebmlIDDuration, ebmlFloat64Body(math.Inf(1)))),
+		ebmlElement(ebmlIDCluster, make([]byte, 8)),
+	)...)
+
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"not media", []byte("just some text, definitely not a video"), errUnsupportedMedia.Error()},
+		{"mp4 without moov", append(ftyp, mp4Box("mdat", make([]byte, 16))...), "no moov"},
+		{"mp4 box shorter than its header", append(ftyp, 0, 0, 0, 4, 'm', 'o', 'o', 'v'), "invalid"},
+		{"mp4 moov past the end", valid[:moovAt+20], "invalid"},
+		{"mp4 largesize past the end", append(ftyp, largesize...), "invalid"},
+		{"matroska without tracks", noTracks, "no Matroska tracks"},
+		{"matroska truncated in tracks", webm[:len(webm)-60], "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractMediaInfo(bytes.NewReader(tt.file), int64(len(tt.file)))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want it to mention %q", err, tt.err)
+			}
+			if tt.err == errUnsupportedMedia.Error() && !errors.Is(err, errUnsupportedMedia) {
+				t.Errorf("err = %v, want errUnsupportedMedia", err)
+			}
+		})
+	}
+}
+
+// Every prefix of a valid file parses or fails cleanly, and whatever is
+// returned can be stored and served
+func TestExtractMediaInfoTruncated(t *testing.T) {
+	files := map[string][]byte{
+		"mp4":  mp4File("isom", nil, nil),
+		"webm": webmFile(12345),
+	}
+	for name, file := range files {
+		for n := 0; n <= len(file); n++ {
+			info, err := extractMediaInfo(bytes.NewReader(file[:n]), int64(n))
+			if err != nil {
+				continue
+			}
+			if _, err := json.Marshal(info); err != nil {
+				t.Fatalf("%s cut at %d: %v", name, n, err)
+			}
+			if info.Duration < 0 || info.Duration > maxMediaDuration || info.FrameRate < 0 || info.FrameRate > maxMediaFrameRate {
+				t.Fatalf("%s cut at %d: implausible %+v", name, n, info)
+			}
+		}
+	}
+}
+
+func TestParseEBMLVint(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		isID   bool
+		value  int64
+		length int
+		ok     bool
+	}{
+		{[]byte{0x81}, false, 1, 1, true},
+		{[]byte{0x40, 0x02}, false, 2, 2, true},
+		{[]byte{0xFF}, false, ebmlUnknownSize, 1, true},
+		{[]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, false, ebmlUnknownSize, 8, true},
+		{[]byte{0x1A, 0x45, 0xDF, 0xA3}, true, 0x1A45DFA3, 4, true},
+		{[]byte{0x01, 0x00, 0x00, 0x00, 0x00}, true, 0, 0, false}, // IDs are at most 4 bytes
+		{[]byte{0x00}, false, 0, 0, false},
+		{[]byte{0x40}, false, 0, 0, false}, // truncated
+		{nil, false, 0, 0, false},
+	}
+	for _, tt := range tests {
+		value, length, ok := parseEBMLVint(tt.data, tt.isID)
+		if value != tt.value || length != tt.length || ok != tt.ok {
+			t.Errorf("parseEBMLVint(%x, %v) = %d, %d, %v; want %d, %d, %v", tt.data, tt.isID, value, length, ok, tt.value, tt.length, tt.ok)
+		}
+	}
+}
+
+func TestEachMP4BoxStopsAtBadSizes(t *testing.T) {
+	tests := map[string][]byte{
+		"size below header":    {0, 0, 0, 7, 'f', 'r', 'e', 'e'},
+		"size past the end":    {0, 0, 0, 64, 'f', 'r', 'e', 'e', 0},
+		"short largesize":      {0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0},
+		"largesize past end":   append([]byte{0, 0, 0, 1, 'f', 'r', 'e', 'e'}, binary.BigEndian.AppendUint64(nil, math.MaxUint64)...),
+		"trailing partial box": append(mp4Box("free"), 0, 0, 0),
+	}
+	for name, data := range tests {
+		var types []string
+		eachMP4Box(data, func(boxType string, body []byte) { types = append(types, boxType) })
+		if name == "trailing partial box" {
+			if len(types) != 1 {
+				t.Errorf("%s: boxes = %v, want just the complete one", name, types)
+			}
+		} else if len(types) != 0 {
+			t.Errorf("%s: boxes = %v, want none", name, types)
+		}
+	}
+}
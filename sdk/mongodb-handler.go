@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -24,6 +27,9 @@ type Video struct {
 	Description string             `json:"description" bson:"description"`
 	Uploader    UploaderInfo       `json:"uploader" bson:"uploader"`
 	VideoURL    string             `json:"videoUrl" bson:"videoUrl"`
+	SHA256      string             `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	Media       *MediaInfo         `json:"media,omitempty" bson:"media,omitempty"`
+	HLS         *HLSInfo           `json:"hls,omitempty" bson:"hls,omitempty"`
 	ThumbnailURL string            `json:"thumbnailUrl" bson:"thumbnailUrl"`
 	Duration    int                `json:"duration" bson:"duration"`
 	Category    string             `json:"category" bson:"category"`
@@ -32,9 +38,33 @@ type Video struct {
 	Dislikes    int                `json:"dislikes" bson:"dislikes"`
 	UploadDate  time.Time          `json:"uploadDate" bson:"uploadDate"`
 	Tags        []string           `json:"tags" bson:"tags"`
-	Comments    []Comment          `json:"comments" bson:"comments"`
+	CommentCount int               `json:"commentCount" bson:"commentCount"`
+	UpdatedAt   time.Time          `json:"updatedAt" bson:"updatedAt,omitempty"`
 }
 
+// VideoPatch holds the fields a client may change with PATCH /videos/{id}.
+// Nil fields are left untouched.
+type VideoPatch struct {
+	Title        *string       `json:"title"`
+	Description  *string       `json:"description"`
+	Uploader     *UploaderInfo `json:"uploader"`
+	VideoURL     *string       `json:"videoUrl"`
+	ThumbnailURL *string       `json:"thumbnailUrl"`
+	Duration     *int          `json:"duration"`
+	Category     *string       `json:"category"`
+	Tags         *[]string     `json:"tags"`
+}
+
+const (
+	maxVideoTitleLength = 200
+	maxVideoBodySize    = 1 << 20 // 1 MB
+)
+
+// videoCategories is the whitelist of categories a video may be filed under
+var videoCategories = []string{"Security", "DevOps", "Cloud", "Research", "General"}
+
+var errDuplicateVideo = errors.New("a video with this title already exists for this uploader")
+
 // UploaderInfo represents the uploader information embedded in videos
 type UploaderInfo struct {
 	ID       string `json:"id" bson:"id"`
@@ -43,22 +73,15 @@ type UploaderInfo struct {
 	Avatar   string `json:"avatar" bson:"avatar"`
 }
 
-// Comment represents a comment on a video
-type Comment struct {
-	ID      string    `json:"id" bson:"id"`
-	Author  string    `json:"author" bson:"author"`
-	AuthorAvatar string `json:"authorAvatar" bson:"authorAvatar"`
-	Text    string    `json:"text" bson:"text"`
-	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
-	Likes   int       `json:"likes" bson:"likes"`
-}
-
 // User represents a user document in MongoDB
 type User struct {
 	ID           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	Username     string             `json:"username" bson:"username"`
 	Name         string             `json:"name" bson:"name"`
 	Email        string             `json:"email" bson:"email"`
+	// EmailVerified is set when an identity provider vouched for Email;
+	// registration does not verify it
+	EmailVerified bool              `json:"-" bson:"emailVerified,omitempty"`
 	Avatar       string             `json:"avatar" bson:"avatar"`
 	Bio          string             `json:"bio" bson:"bio"`
 	Subscribers  int                `json:"subscribers" bson:"subscribers"`
@@ -66,6 +89,39 @@ type User struct {
 	TotalViews   int                `json:"totalViews" bson:"totalViews"`
 	JoinDate     time.Time          `json:"joinDate" bson:"joinDate"`
 	Subscriptions []string          `json:"subscriptions" bson:"subscriptions"`
+	Roles        []string           `json:"roles,omitempty" bson:"roles,omitempty"`
+	PasswordHash string             `json:"-" bson:"passwordHash,omitempty"`
+	Identities   []ExternalIdentity `json:"-" bson:"identities,omitempty"`
+}
+
+// PublicUser is the profile anyone may see: a User without its email and
+// roles, which only the user gets from /auth/me
+type PublicUser struct {
+	ID            primitive.ObjectID `json:"_id,omitempty"`
+	Username      string             `json:"username"`
+	Name          string             `json:"name"`
+	Avatar        string             `json:"avatar"`
+	Bio           string             `json:"bio"`
+	Subscribers   int                `json:"subscribers"`
+	TotalVideos   int                `json:"totalVideos"`
+	TotalViews    int                `json:"totalViews"`
+	JoinDate      time.Time          `json:"joinDate"`
+	Subscriptions []string           `json:"subscriptions"`
+}
+
+func publicUser(u *User) PublicUser {
+	return PublicUser{
+		ID:            u.ID,
+		Username:      u.Username,
+		Name:          u.Name,
+		Avatar:        u.Avatar,
+		Bio:           u.Bio,
+		Subscribers:   u.Subscribers,
+		TotalVideos:   u.TotalVideos,
+		TotalViews:    u.TotalViews,
+		JoinDate:      u.JoinDate,
+		Subscriptions: u.Subscriptions,
+	}
 }
 
 // Initialize MongoDB connection
@@ -96,33 +152,6 @@ func initMongoDB() {
 	log.Println("✅ Connected to MongoDB successfully")
 }
 
-// Get all videos from MongoDB
-func getAllVideos(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, r)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	collection := db.Collection("videos")
-	cursor, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		log.Printf("Failed to query videos: %v", err)
-		http.Error(w, "Failed to fetch videos", http.StatusInternalServerError)
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var videos []Video
-	if err = cursor.All(ctx, &videos); err != nil {
-		log.Printf("Failed to decode videos: %v", err)
-		http.Error(w, "Failed to decode videos", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(videos)
-}
-
 // Get a specific video by ID
 func getVideoByID(w http.ResponseWriter, r *http.Request, id string) {
 	setCORSHeaders(w, r)
@@ -175,9 +204,13 @@ func getAllUsers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to decode users", http.StatusInternalServerError)
 		return
 	}
+	profiles := make([]PublicUser, 0, len(users))
+	for i := range users {
+		profiles = append(profiles, publicUser(&users[i]))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(profiles)
 }
 
 // Get a specific user by username
@@ -201,7 +234,7 @@ func getUserByUsername(w http.ResponseWriter, r *http.Request, username string)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(publicUser(&user))
 }
 
 // Get videos by user ID
@@ -268,3 +301,313 @@ func incrementVideoViews(w http.ResponseWriter, r *http.Request, id string) {
 	})
 }
 
+
+// validateVideoFields checks the user-editable fields shared by create and update
+func validateVideoFields(title, category string, duration int) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return errors.New("title is required")
+	}
+	if len(title) > maxVideoTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxVideoTitleLength)
+	}
+	validCategory := false
+	for _, c := range videoCategories {
+		if c == category {
+			validCategory = true
+			break
+		}
+	}
+	if !validCategory {
+		return fmt.Errorf("category must be one of: %s", strings.Join(videoCategories, ", "))
+	}
+	if duration < 0 {
+		return errors.New("duration must be >= 0")
+	}
+	return nil
+}
+
+// checkDuplicateVideo reports errDuplicateVideo if the uploader already has a
+// video with the given title, ignoring the video identified by exclude
+func checkDuplicateVideo(ctx context.Context, title, username string, exclude primitive.ObjectID) error {
+	filter := bson.M{"title": title, "uploader.username": username}
+	if !exclude.IsZero() {
+		filter["_id"] = bson.M{"$ne": exclude}
+	}
+	count, err := db.Collection("videos").CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateVideo
+	}
+	return nil
+}
+
+// videoExists reports whether a video is stored, assuming it is when that
+// cannot be told
+func videoExists(ctx context.Context, id primitive.ObjectID) bool {
+	count, err := db.Collection("videos").CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	return err != nil || count > 0
+}
+
+// Create a new video
+func createVideo(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var video Video
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&video); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Creators publish as themselves, moderators for anyone
+	if !requireOwnerOr(w, r, video.Uploader.Username, roleModerator) {
+		return
+	}
+
+	video.Title = strings.TrimSpace(video.Title)
+	if err := validateVideoFields(video.Title, video.Category, video.Duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkDuplicateVideo(ctx, video.Title, video.Uploader.Username, primitive.NilObjectID); err != nil {
+		if errors.Is(err, errDuplicateVideo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			log.Printf("Failed to check for duplicate video: %v", err)
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	video.ID = primitive.NilObjectID
+	video.Views, video.Likes, video.Dislikes, video.CommentCount = 0, 0, 0, 0
+	// The stored media and what was read from it are the server's to fill
+	// in: a sha256 names a shared blob that deleting the video releases
+	video.SHA256, video.Media, video.HLS = "", nil, nil
+	if video.UploadDate.IsZero() {
+		video.UploadDate = now
+	}
+	video.UpdatedAt = now
+	if video.Tags == nil {
+		video.Tags = []string{}
+	}
+
+	collection := db.Collection("videos")
+	result, err := collection.InsertOne(ctx, video)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, errDuplicateVideo.Error(), http.StatusConflict)
+		} else {
+			log.Printf("Failed to insert video: %v", err)
+			http.Error(w, "Failed to create video", http.StatusInternalServerError)
+		}
+		return
+	}
+	video.ID = result.InsertedID.(primitive.ObjectID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/videos/"+video.ID.Hex())
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(video)
+}
+
+// Update selected fields of a video
+func updateVideo(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	var patch VideoPatch
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	collection := db.Collection("videos")
+	var current Video
+	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find video: %v", err)
+			http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !requireOwnerOr(w, r, current.Uploader.Username, roleModerator) {
+		return
+	}
+	if patch.Uploader != nil && !identityFrom(r).hasRole(roleModerator) {
+		denyAccess(w, r, []string{roleModerator}, "only moderators change the uploader")
+		return
+	}
+
+	set := bson.M{}
+	if patch.Title != nil {
+		current.Title = strings.TrimSpace(*patch.Title)
+		set["title"] = current.Title
+	}
+	if patch.Description != nil {
+		set["description"] = *patch.Description
+	}
+	if patch.Uploader != nil {
+		current.Uploader = *patch.Uploader
+		set["uploader"] = current.Uploader
+	}
+	// New media drops the blob reference and everything read from the old
+	// media; the blob is released once the update is stored
+	update := bson.M{}
+	mediaChanged := patch.VideoURL != nil && *patch.VideoURL != current.VideoURL
+	if patch.VideoURL != nil {
+		set["videoUrl"] = *patch.VideoURL
+	}
+	if mediaChanged {
+		update["$unset"] = bson.M{"sha256": "", "media": "", "hls": ""}
+	}
+	if patch.ThumbnailURL != nil {
+		set["thumbnailUrl"] = *patch.ThumbnailURL
+	}
+	if patch.Duration != nil {
+		current.Duration = *patch.Duration
+		set["duration"] = current.Duration
+	}
+	if patch.Category != nil {
+		current.Category = *patch.Category
+		set["category"] = current.Category
+	}
+	if patch.Tags != nil {
+		tags := *patch.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		set["tags"] = tags
+	}
+
+	if err := validateVideoFields(current.Title, current.Category, current.Duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if patch.Title != nil || patch.Uploader != nil {
+		if err := checkDuplicateVideo(ctx, current.Title, current.Uploader.Username, objectID); err != nil {
+			if errors.Is(err, errDuplicateVideo) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				log.Printf("Failed to check for duplicate video: %v", err)
+				http.Error(w, "Failed to update video", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	set["updatedAt"] = time.Now().UTC()
+	update["$set"] = set
+
+	// Matching the media read above keeps a concurrent change from
+	// releasing the old blob twice
+	filter := bson.M{"_id": objectID}
+	if mediaChanged {
+		filter["videoUrl"] = current.VideoURL
+	}
+
+	var updated Video
+	err = collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		switch {
+		case mongo.IsDuplicateKeyError(err):
+			http.Error(w, errDuplicateVideo.Error(), http.StatusConflict)
+		case err == mongo.ErrNoDocuments && mediaChanged && videoExists(ctx, objectID):
+			http.Error(w, "The video's media changed meanwhile; reload it and try again", http.StatusConflict)
+		case err == mongo.ErrNoDocuments:
+			http.Error(w, "Video not found", http.StatusNotFound)
+		default:
+			log.Printf("Failed to update video: %v", err)
+			http.Error(w, "Failed to update video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if mediaChanged {
+		releaseMediaBlob(ctx, current.SHA256)
+	}
+
+	// Generated thumbnails show the title or a frame of the media; drop them
+	// so they are regenerated on the next request
+	if patch.Title != nil || patch.VideoURL != nil {
+		deleteThumbnails(ctx, objectID)
+	}
+
+	// Repackage when the media changes
+	if patch.VideoURL != nil && hlsTranscoder != nil {
+		if _, err := enqueueTranscodeJob(ctx, objectID); err != nil {
+			log.Printf("Failed to queue transcode job for video %s: %v", id, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Delete a video
+func deleteVideo(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	collection := db.Collection("videos")
+	var video Video
+	err = collection.FindOne(ctx, bson.M{"_id": objectID}, options.FindOne().SetProjection(bson.M{"uploader": 1})).Decode(&video)
+	if err == nil {
+		if !requireOwnerOr(w, r, video.Uploader.Username, roleModerator) {
+			return
+		}
+		err = collection.FindOneAndDelete(ctx, bson.M{"_id": objectID}).Decode(&video)
+	}
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to delete video: %v", err)
+			http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Uploaded media is shared by identical uploads; drop this video's reference
+	releaseMediaBlob(ctx, video.SHA256)
+	deleteThumbnails(ctx, objectID)
+	deleteTranscodeJobs(ctx, objectID)
+	deleteWatchEvents(ctx, objectID)
+	deleteVideoComments(ctx, objectID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestPublicProfilesHideEmailAndRoles(t *testing.T) {
+	user := bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "username", Value: "alice"},
+		{Key: "name", Value: "Alice"},
+		{Key: "email", Value: "alice@example.com"},
+		{Key: "roles", Value: bson.A{roleModerator}},
+		{Key: "passwordHash", Value: "$2a$10$secret"},
+	}
+	check := func(mt *mtest.T, profile map[string]interface{}) {
+		if profile["username"] != "alice" || profile["name"] != "Alice" {
+			mt.Errorf("profile = %v", profile)
+		}
+		for _, field := range []string{"email", "roles", "passwordHash", "identities"} {
+			if _, ok := profile[field]; ok {
+				mt.Errorf("public profile has %s: %v", field, profile[field])
+			}
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("list", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "boringmedia.users", mtest.FirstBatch, user))
+		w := httptest.NewRecorder()
+		getAllUsers(w, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+		var profiles []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&profiles); err != nil || len(profiles) != 1 {
+			mt.Fatalf("profiles = %v, %v", profiles, err)
+		}
+		check(mt, profiles[0])
+	})
+
+	mt.Run("one", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "boringmedia.users", mtest.FirstBatch, user))
+		w := httptest.NewRecorder()
+		getUserByUsername(w, httptest.NewRequest(http.MethodGet, "/users/alice", nil), "alice")
+
+		var profile map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&profile); err != nil {
+			mt.Fatal(err)
+		}
+		check(mt, profile)
+	})
+
+	mt.Run("me", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "boringmedia.users", mtest.FirstBatch, user))
+		r := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{UserID: user[0].Value.(primitive.ObjectID).Hex(), Username: "alice"}))
+		w := httptest.NewRecorder()
+		meHandler(w, r)
+
+		var account map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&account); err != nil {
+			mt.Fatal(err)
+		}
+		if account["email"] != "alice@example.com" || account["roles"] == nil {
+			mt.Errorf("/auth/me = %v, want the email and roles", account)
+		}
+		if _, ok := account["passwordHash"]; ok {
+			mt.Error("/auth/me has the password hash")
+		}
+	})
+}
+
+func TestUpdateVideoConflicts(t *testing.T) {
+	videoID := primitive.NewObjectID()
+	current := bson.D{
+		{Key: "_id", Value: videoID},
+		{Key: "title", Value: "Spotting phishing email"},
+		{Key: "category", Value: "Security"},
+		{Key: "videoUrl", Value: "/media/old.mp4"},
+		{Key: "uploader", Value: bson.D{{Key: "username", Value: "alice"}}},
+	}
+	patchVideo := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPatch, "/videos/"+videoID.Hex(), strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Username: "alice"}))
+		w := httptest.NewRecorder()
+		updateVideo(w, r, videoID.Hex())
+		return w
+	}
+	count := func(n int) bson.D {
+		return mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("media changed meanwhile", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, current),
+			findAndModifyResponse(t, nil), // the videoUrl no longer matches
+			count(1),
+		)
+		if w := patchVideo(`{"videoUrl": "/media/new.mp4"}`); w.Code != http.StatusConflict {
+			mt.Errorf("status = %d, want 409: %s", w.Code, w.Body)
+		}
+		mt.GetStartedEvent() // find
+		update := mt.GetStartedEvent().Command
+		if got := update.Lookup("query", "videoUrl").StringValue(); got != "/media/old.mp4" {
+			mt.Errorf("update matches videoUrl %q, want the one read", got)
+		}
+	})
+
+	mt.Run("deleted meanwhile", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, current),
+			findAndModifyResponse(t, nil),
+			count(0),
+		)
+		if w := patchVideo(`{"videoUrl": "/media/new.mp4"}`); w.Code != http.StatusNotFound {
+			mt.Errorf("status = %d, want 404: %s", w.Code, w.Body)
+		}
+	})
+
+	mt.Run("title taken meanwhile", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, current),
+			count(0), // checkDuplicateVideo
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"}),
+		)
+		w := patchVideo(`{"title": "Ransomware drills"}`)
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), errDuplicateVideo.Error()) {
+			mt.Errorf("status = %d, want 409: %s", w.Code, w.Body)
+		}
+	})
+}
+
+func TestNumberedTitle(t *testing.T) {
+	if got := numberedTitle("clip", 2); got != "clip (2)" {
+		t.Errorf("numberedTitle = %q", got)
+	}
+	long := strings.Repeat("é", maxVideoTitleLength)
+	got := numberedTitle(long, 12)
+	if len(got) > maxVideoTitleLength || !strings.HasSuffix(got, " (12)") || !utf8.ValidString(got) {
+		t.Errorf("numberedTitle of a long title = %q (%d bytes)", got, len(got))
+	}
+}
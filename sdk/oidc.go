@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Single sign-on with an OpenID Connect provider, using the Authorization
+// Code flow with PKCE. GET /auth/oidc/login redirects to the provider;
+// the provider redirects back to GET /auth/oidc/callback, which validates
+// the ID token, provisions or links the User and signs in with the same
+// tokens as /auth/login.
+
+const (
+	oidcLoginTTL      = 10 * time.Minute
+	oidcDiscoveryTTL  = time.Hour
+	oidcDefaultScopes = "openid profile email"
+)
+
+var errOIDCDisabled = errors.New("single sign-on is not configured")
+
+// ExternalIdentity links a User to an account at an identity provider
+type ExternalIdentity struct {
+	Issuer  string `json:"issuer" bson:"issuer"`
+	Subject string `json:"subject" bson:"subject"`
+}
+
+// oidcConfig is the provider configuration, from the environment
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+	GroupsClaim  string
+	// RoleMap maps provider groups to platform roles
+	RoleMap map[string][]string
+	// PostLoginURL receives the tokens in its fragment; without it the
+	// callback answers with JSON
+	PostLoginURL string
+}
+
+// oidcProvider is the endpoints and keys found by discovery
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	Issuer                string `json:"issuer"`
+
+	keys       *oidcKeySet
+	discovered time.Time
+}
+
+var oidc struct {
+	config *oidcConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+}
+
+// oidcLogin is a login in progress, in the oidc_logins collection
+type oidcLogin struct {
+	State    string    `bson:"_id"`
+	Nonce    string    `bson:"nonce"`
+	Verifier string    `bson:"verifier"`
+	ReturnTo string    `bson:"returnTo,omitempty"`
+	ExpireAt time.Time `bson:"expireAt"`
+}
+
+func oidcLogins() *mongo.Collection {
+	return db.Collection("oidc_logins")
+}
+
+// parseRoleMap parses OIDC_ROLE_MAP: group=role pairs separated by commas,
+// e.g. "video-team=creator,secops=security-admin"
+func parseRoleMap(value string) (map[string][]string, error) {
+	roles := map[string][]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid OIDC_ROLE_MAP entry %q, want group=role", pair)
+		}
+		if !validRole(role) {
+			return nil, fmt.Errorf("unknown role %q in OIDC_ROLE_MAP, want one of %s", role, strings.Join(knownRoles, ", "))
+		}
+		roles[group] = append(roles[group], role)
+	}
+	return roles, nil
+}
+
+// initOIDC reads the provider configuration. Single sign-on stays off
+// while OIDC_ISSUER is unset.
+func initOIDC() error {
+	issuer := strings.TrimRight(getEnvOrDefault("OIDC_ISSUER", ""), "/")
+	if issuer == "" {
+		return nil
+	}
+	roleMap, err := parseRoleMap(getEnvOrDefault("OIDC_ROLE_MAP", ""))
+	if err != nil {
+		return err
+	}
+	config := &oidcConfig{
+		Issuer:       issuer,
+		ClientID:     getEnvOrDefault("OIDC_CLIENT_ID", ""),
+		ClientSecret: getEnvOrDefault("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  getEnvOrDefault("OIDC_REDIRECT_URL", ""),
+		Scopes:       getEnvOrDefault("OIDC_SCOPES", oidcDefaultScopes),
+		GroupsClaim:  getEnvOrDefault("OIDC_GROUPS_CLAIM", "groups"),
+		RoleMap:      roleMap,
+		PostLoginURL: getEnvOrDefault("OIDC_POST_LOGIN_URL", ""),
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return errors.New("OIDC_ISSUER needs OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	if !strings.Contains(" "+config.Scopes+" ", " openid ") {
+		config.Scopes = "openid " + config.Scopes
+	}
+	oidc.config = config
+	oidc.client = &http.Client{Timeout: 10 * time.Second}
+
+	if db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := oidcLogins().Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0),
+		}); err != nil {
+			log.Printf("Failed to create OIDC login indexes: %v", err)
+		}
+		if _, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+		}); err != nil {
+			log.Printf("Failed to create user identity index: %v", err)
+		}
+	}
+	log.Printf("Single sign-on enabled with %s", issuer)
+	return nil
+}
+
+// discoverOIDC returns the provider's endpoints, fetching its discovery
+// document when there is none or it is older than oidcDiscoveryTTL
+func discoverOIDC() (*oidcProvider, error) {
+	if oidc.config == nil {
+		return nil, errOIDCDisabled
+	}
+	oidc.mu.Lock()
+	defer oidc.mu.Unlock()
+	if oidc.provider != nil && time.Since(oidc.provider.discovered) < oidcDiscoveryTTL {
+		return oidc.provider, nil
+	}
+
+	resp, err := oidc.client.Get(oidc.config.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return oidc.provider, staleOr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oidc.provider, staleOr(fmt.Errorf("OIDC discovery: %s", resp.Status))
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&provider); err != nil {
+		return oidc.provider, staleOr(err)
+	}
+	if strings.TrimRight(provider.Issuer, "/") != oidc.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", provider.Issuer, oidc.config.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: missing endpoints")
+	}
+	provider.Issuer = oidc.config.Issuer
+	provider.discovered = time.Now()
+	if oidc.provider != nil && oidc.provider.JWKSURI == provider.JWKSURI {
+		provider.keys = oidc.provider.keys
+	} else {
+		provider.keys = &oidcKeySet{url: provider.JWKSURI, client: oidc.client}
+	}
+	oidc.provider = &provider
+	return oidc.provider, nil
+}
+
+// staleOr keeps a previously discovered provider usable while discovery
+// fails. The caller holds oidc.mu.
+func staleOr(err error) error {
+	if oidc.provider != nil {
+		log.Printf("OIDC discovery failed, using the previous document: %v", err)
+		return nil
+	}
+	return err
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeReturnTo keeps a post-login return path only if it is a local path
+func safeReturnTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, `\`) {
+		return ""
+	}
+	return path
+}
+
+// oidcLoginHandler starts a login: GET /auth/oidc/login[?returnTo=/path]
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, err := discoverOIDC()
+	if err == errOIDCDisabled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		ReturnTo: safeReturnTo(r.URL.Query().Get("returnTo")),
+		ExpireAt: time.Now().UTC().Add(oidcLoginTTL),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := oidcLogins().InsertOne(ctx, login); err != nil {
+		log.Printf("Failed to store OIDC login: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.config.ClientID},
+		"redirect_uri":          {oidc.config.RedirectURL},
+		"scope":                 {oidc.config.Scopes},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	query := target.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	target.RawQuery = query.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// exchangeCode trades an authorization code for the provider's ID token
+func exchangeCode(ctx context.Context, provider *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidc.config.RedirectURL},
+		"client_id":     {oidc.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidc.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidc.config.ClientID), url.QueryEscape(oidc.config.ClientSecret))
+	}
+	resp, err := oidc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || out.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, out.Error, out.ErrorDescription)
+	}
+	if out.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token")
+	}
+	return out.IDToken, nil
+}
+
+// idTokenClaims are the ID token claims the platform uses. Groups is read
+// separately since its claim name is configurable.
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	ExpiresAt         json.Number     `json:"exp"`
+	IssuedAt          json.Number     `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     interface{}     `json:"email_verified"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Picture           string          `json:"picture"`
+
+	Groups []string `json:"-"`
+}
+
+func (c *idTokenClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// validateIDToken verifies an ID token's signature and claims (OpenID
+// Connect Core 3.1.3.7) and checks it carries the login's nonce
+func validateIDToken(provider *oidcProvider, token, nonce string) (*idTokenClaims, error) {
+	payload, err := provider.keys.verifyJWS(token)
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+	var claims idTokenClaims
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != provider.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	audiences := claims.audiences()
+	found := false
+	for _, aud := range audiences {
+		found = found || aud == oidc.config.ClientID
+	}
+	if !found {
+		return nil, errors.New("ID token is for another client")
+	}
+	if (len(audiences) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != oidc.config.ClientID {
+		return nil, errors.New("ID token authorized party is another client")
+	}
+	now := time.Now()
+	exp, err := claims.ExpiresAt.Int64()
+	if err != nil || now.Add(-tokenLeeway).Unix() >= exp {
+		return nil, errors.New("ID token expired")
+	}
+	if iat, err := claims.IssuedAt.Int64(); err != nil || iat > now.Add(tokenLeeway).Unix() {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	var raw map[string]interface{}
+	json.Unmarshal(payload, &raw)
+	switch groups := raw[oidc.config.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				claims.Groups = append(claims.Groups, s)
+			}
+		}
+	case string:
+		claims.Groups = strings.Fields(strings.ReplaceAll(groups, ",", " "))
+	}
+	return &claims, nil
+}
+
+// mapRoles turns provider groups into platform roles with the role map.
+// Users in no mapped group are viewers.
+func mapRoles(groups []string) []string {
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, group := range groups {
+		for _, role := range oidc.config.RoleMap[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		roles = append(roles, roleViewer)
+	}
+	return roles
+}
+
+var usernameInvalid = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// newUsername derives a free username from the provider's claims
+func newUsername(ctx context.Context, claims *idTokenClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(usernameInvalid.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	users := db.Collection("users")
+	for i := 1; i <= 100; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = base + "_" + strconv.Itoa(i)
+		}
+		err := users.FindOne(ctx, bson.M{"username": candidate}).Err()
+		if err == mongo.ErrNoDocuments {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return base + "_" + randomToken()[:5], nil
+}
+
+// emailLinkFilter selects the account a provider identity may be linked to
+// by email once the provider has verified the address. Password accounts
+// are never linked: registration takes any email, so whoever registered
+// the address first would keep a password into the account that gets the
+// provider user's roles. Password-less accounts, such as seeded ones, have
+// no other way to sign in.
+func emailLinkFilter(issuer string, claims *idTokenClaims) (bson.M, bool) {
+	if claims.Email == "" || !claims.emailVerified() {
+		return nil, false
+	}
+	return bson.M{
+		"email":        strings.ToLower(claims.Email),
+		"passwordHash": bson.M{"$exists": false},
+		// An account already linked to another subject of this provider
+		// belongs to someone else
+		"identities.issuer": bson.M{"$ne": issuer},
+	}, true
+}
+
+// provisionOIDCUser finds the User linked to the provider account, links
+// an existing password-less User with the verified email, or creates one. The
+// user's roles follow the provider's groups on every login when a role map
+// is configured.
+func provisionOIDCUser(ctx context.Context, r *http.Request, claims *idTokenClaims) (*User, error) {
+	users := db.Collection("users")
+	link := ExternalIdentity{Issuer: oidc.config.Issuer, Subject: claims.Subject}
+	set := bson.M{}
+	if len(oidc.config.RoleMap) > 0 {
+		set["roles"] = mapRoles(claims.Groups)
+	}
+
+	var user User
+	after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$addToSet": bson.M{"identities": link}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	err := users.FindOneAndUpdate(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": link.Issuer, "subject": link.Subject}}}, update, after).Decode(&user)
+	if err == nil {
+		return &user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if filter, ok := emailLinkFilter(link.Issuer, claims); ok {
+		// The provider vouched for the address the account was matched on
+		linkSet := bson.M{"emailVerified": true}
+		for k, v := range set {
+			linkSet[k] = v
+		}
+		linkUpdate := bson.M{"$addToSet": update["$addToSet"], "$set": linkSet}
+		err = users.FindOneAndUpdate(ctx, filter, linkUpdate, after).Decode(&user)
+		if err == nil {
+			recordAudit(r, "auth.oidc_link", map[string]interface{}{"username": user.Username, "issuer": link.Issuer, "subject": link.Subject})
+			return &user, nil
+		} else if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+
+	username, err := newUsername(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	user = User{
+		Username:      username,
+		Name:          claims.Name,
+		Avatar:        claims.Picture,
+		JoinDate:      time.Now().UTC(),
+		Subscriptions: []string{},
+		Identities:    []ExternalIdentity{link},
+		Roles:         mapRoles(claims.Groups),
+	}
+	if user.Name == "" {
+		user.Name = username
+	}
+	if claims.Email != "" && claims.emailVerified() {
+		// An address held by an account that was not linked, such as a
+		// password registration, stays with it; emails are unique
+		email := strings.ToLower(claims.Email)
+		err := users.FindOne(ctx, bson.M{"email": email}).Err()
+		if err == mongo.ErrNoDocuments {
+			user.Email, user.EmailVerified = email, true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	result, err := users.InsertOne(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	recordAudit(r, "auth.oidc_provision", map[string]interface{}{"username": user.Username, "issuer": link.Issuer, "subject": link.Subject})
+	return &user, nil
+}
+
+// oidcCallbackHandler finishes a login: GET /auth/oidc/callback
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	query := r.URL.Query()
+	fail := func(status int, message string) {
+		if oidc.config != nil && oidc.config.PostLoginURL != "" {
+			http.Redirect(w, r, oidc.config.PostLoginURL+"#"+url.Values{"error": {message}}.Encode(), http.StatusFound)
+			return
+		}
+		http.Error(w, message, status)
+	}
+
+	provider, err := discoverOIDC()
+	if err == errOIDCDisabled {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		fail(http.StatusBadGateway, "Identity provider unavailable")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The state is single use whatever the outcome
+	var login oidcLogin
+	err = oidcLogins().FindOneAndDelete(ctx, bson.M{"_id": query.Get("state")}).Decode(&login)
+	if err != nil || time.Now().After(login.ExpireAt) {
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("Failed to load OIDC login: %v", err)
+		}
+		fail(http.StatusBadRequest, "Unknown or expired login, please sign in again")
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		recordAudit(r, "auth.oidc_failed", map[string]interface{}{"error": providerErr, "description": query.Get("error_description")})
+		fail(http.StatusUnauthorized, "Sign-in was not completed: "+providerErr)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		fail(http.StatusBadRequest, "Missing authorization code")
+		return
+	}
+
+	idToken, err := exchangeCode(ctx, provider, code, login.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		fail(http.StatusBadGateway, "Failed to complete sign-in")
+		return
+	}
+	claims, err := validateIDToken(provider, idToken, login.Nonce)
+	if err != nil {
+		recordAudit(r, "auth.oidc_failed", map[string]interface{}{"error": err.Error()})
+		fail(http.StatusUnauthorized, "Invalid ID token")
+		return
+	}
+
+	user, err := provisionOIDCUser(ctx, r, claims)
+	if err != nil {
+		log.Printf("Failed to provision OIDC user: %v", err)
+		fail(http.StatusInternalServerError, "Failed to complete sign-in")
+		return
+	}
+	tokens, err := issueTokens(ctx, user, "")
+	if err != nil {
+		log.Printf("Failed to issue tokens: %v", err)
+		fail(http.StatusInternalServerError, "Failed to complete sign-in")
+		return
+	}
+	recordAudit(r, "auth.oidc_login", map[string]interface{}{"username": user.Username, "issuer": oidc.config.Issuer, "groups": claims.Groups})
+
+	if oidc.config.PostLoginURL == "" {
+		tokens.User = user
+		writeTokens(w, http.StatusOK, tokens)
+		return
+	}
+	// Tokens travel in the fragment so they reach the UI but not server logs
+	fragment := url.Values{
+		"accessToken":  {tokens.AccessToken},
+		"refreshToken": {tokens.RefreshToken},
+		"expiresIn":    {strconv.Itoa(tokens.ExpiresIn)},
+	}
+	if login.ReturnTo != "" {
+		fragment.Set("returnTo", login.ReturnTo)
+	}
+	http.Redirect(w, r, oidc.config.PostLoginURL+"#"+fragment.Encode(), http.StatusFound)
+}
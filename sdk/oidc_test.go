@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const (
+	testClientID     = "bpc-web"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "http://localhost:8080/api/sdk/auth/oidc/callback"
+)
+
+// testIdP is an OpenID provider: discovery, a JWK Set whose signing key can
+// be rotated, and a token endpoint that checks the PKCE verifier
+type testIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu            sync.Mutex
+	issuer        string // advertised issuer, the server URL by default
+	keys          map[string]*rsa.PrivateKey
+	signingKid    string
+	discoveries   int
+	jwksFetches   int
+	tokenRequests int
+	verifiers     []string
+	codes         map[string]testAuthorization
+}
+
+// testAuthorization is what the token endpoint knows about a code
+type testAuthorization struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	idp := &testIdP{t: t, keys: map[string]*rsa.PrivateKey{}, codes: map[string]testAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	idp.issuer = idp.server.URL
+	idp.rotate()
+	return idp
+}
+
+// rotate publishes a new signing key in place of the current one
+func (idp *testIdP) rotate() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.signingKid = fmt.Sprintf("key-%d", len(idp.keys)+1)
+	idp.keys = map[string]*rsa.PrivateKey{idp.signingKid: key}
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	idp.discoveries++
+	issuer := idp.issuer
+	idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": idp.server.URL + "/authorize",
+		"token_endpoint":         idp.server.URL + "/token",
+		"jwks_uri":               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.jwksFetches++
+	keys := []map[string]string{}
+	for kid, key := range idp.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	idp.tokenRequests++
+	idp.verifiers = append(idp.verifiers, r.FormValue("code_verifier"))
+	auth, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+
+	fail := func(code, description string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+	}
+	user, password, _ := r.BasicAuth()
+	switch {
+	case user != testClientID || password != testClientSecret:
+		fail("invalid_client", "bad client credentials")
+	case r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != testRedirectURL:
+		fail("invalid_request", "bad grant")
+	case !ok:
+		fail("invalid_grant", "unknown code")
+	case pkceChallenge(r.FormValue("code_verifier")) != auth.challenge:
+		fail("invalid_grant", "PKCE verification failed")
+	default:
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(auth.claims), "token_type": "Bearer"})
+	}
+}
+
+// authorize registers a code as if the user had signed in at the provider
+func (idp *testIdP) authorize(code, challenge string, claims map[string]interface{}) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code] = testAuthorization{challenge: challenge, claims: claims}
+}
+
+// claims are valid ID token claims for the test client
+func (idp *testIdP) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                idp.server.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"email":              "Alice@Example.com",
+		"email_verified":     true,
+		"name":               "Alice",
+		"preferred_username": "alice",
+		"groups":             []string{"video-team"},
+	}
+}
+
+// sign issues claims as an RS256 ID token with the current key
+func (idp *testIdP) sign(claims map[string]interface{}) string {
+	idp.mu.Lock()
+	kid, key := idp.signingKid, idp.keys[idp.signingKid]
+	idp.mu.Unlock()
+	return signTestJWS(idp.t, map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}, claims, key)
+}
+
+func (idp *testIdP) counts() (discoveries, jwksFetches, tokenRequests int) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.discoveries, idp.jwksFetches, idp.tokenRequests
+}
+
+// signTestJWS builds a compact JWS; a nil key leaves the signature empty
+func signTestJWS(t *testing.T, header map[string]string, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	t.Helper()
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	if key == nil {
+		return signed + "."
+	}
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func pkceChallenge(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// useOIDC configures single sign-on against idp for the length of a test
+func useOIDC(t *testing.T, idp *testIdP) {
+	t.Helper()
+	config, client, provider := oidc.config, oidc.client, oidc.provider
+	oidc.config = &oidcConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       oidcDefaultScopes,
+		GroupsClaim:  "groups",
+		RoleMap: map[string][]string{
+			"video-team": {roleCreator},
+			"secops":     {roleSecurityAdmin, roleModerator},
+		},
+	}
+	oidc.client = idp.server.Client()
+	oidc.provider = nil
+	t.Cleanup(func() { oidc.config, oidc.client, oidc.provider = config, client, provider })
+}
+
+// useMockDB points db at an mtest mock deployment
+func useMockDB(mt *mtest.T) {
+	previous := db
+	db = mt.DB
+	mt.Cleanup(func() { db = previous })
+}
+
+// findAndModifyResponse is a mock reply to FindOneAndUpdate or
+// FindOneAndDelete; a nil doc means no document matched
+func findAndModifyResponse(t *testing.T, doc interface{}) bson.D {
+	t.Helper()
+	if doc == nil {
+		return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}}
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: bson.Raw(raw)}}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatalf("discoverOIDC: %v", err)
+	}
+	if provider.TokenEndpoint != idp.server.URL+"/token" || provider.JWKSURI != idp.server.URL+"/jwks" {
+		t.Errorf("endpoints = %+v", provider)
+	}
+	if again, _ := discoverOIDC(); again != provider {
+		t.Error("discovery document was not cached")
+	}
+	if discoveries, _, _ := idp.counts(); discoveries != 1 {
+		t.Errorf("discovery fetched %d times, want 1", discoveries)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	idp.issuer = "https://idp.attacker.example"
+
+	if _, err := discoverOIDC(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("err = %v, want issuer mismatch", err)
+	}
+}
+
+func TestValidateIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(claims map[string]interface{})
+		err    string // "" for a valid token
+	}{
+		{name: "valid"},
+		{name: "nonce mismatch", mutate: func(c map[string]interface{}) { c["nonce"] = "another-login" }, err: "nonce"},
+		{name: "missing nonce", mutate: func(c map[string]interface{}) { delete(c, "nonce") }, err: "nonce"},
+		{name: "issuer mismatch", mutate: func(c map[string]interface{}) { c["iss"] = "https://idp.attacker.example" }, err: "issued by"},
+		{name: "issuer trailing slash", mutate: func(c map[string]interface{}) { c["iss"] = idp.server.URL + "/" }},
+		{name: "other audience", mutate: func(c map[string]interface{}) { c["aud"] = "other-client" }, err: "another client"},
+		{name: "several audiences without azp", mutate: func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other-client"}
+		}, err: "authorized party"},
+		{name: "several audiences with azp", mutate: func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other-client"}
+			c["azp"] = testClientID
+		}},
+		{name: "azp of another client", mutate: func(c map[string]interface{}) { c["azp"] = "other-client" }, err: "authorized party"},
+		{name: "expired", mutate: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, err: "expired"},
+		{name: "issued in the future", mutate: func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, err: "future"},
+		{name: "no subject", mutate: func(c map[string]interface{}) { delete(c, "sub") }, err: "subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims("nonce-1")
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			got, err := validateIDToken(provider, idp.sign(claims), "nonce-1")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got.Subject != "user-1" || !got.emailVerified() || !reflect.DeepEqual(got.Groups, []string{"video-team"}) {
+					t.Errorf("claims = %+v", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want it to mention %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateIDTokenSignature(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := idp.claims("nonce-1")
+	valid := idp.sign(claims)
+	parts := strings.Split(valid, ".")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := idp.signingKid
+	tampered := map[string]interface{}{}
+	for k, v := range claims {
+		tampered[k] = v
+	}
+	tampered["sub"] = "admin"
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	tokens := map[string]string{
+		"unsigned":         signTestJWS(t, map[string]string{"alg": "none", "kid": kid}, claims, nil),
+		"symmetric":        signTestJWS(t, map[string]string{"alg": "HS256", "kid": kid}, claims, otherKey),
+		"wrong key":        signTestJWS(t, map[string]string{"alg": "RS256", "kid": kid}, claims, otherKey),
+		"tampered payload": parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2],
+		"not a JWS":        "not-a-token",
+	}
+	for name, token := range tokens {
+		if _, err := validateIDToken(provider, token, "nonce-1"); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := idp.sign(idp.claims("nonce-1"))
+	if _, err := validateIDToken(provider, before, "nonce-1"); err != nil {
+		t.Fatalf("token from the first key: %v", err)
+	}
+
+	idp.rotate()
+	after := idp.sign(idp.claims("nonce-1"))
+
+	// An unknown key right after a fetch does not refetch the set
+	if _, err := validateIDToken(provider, after, "nonce-1"); err == nil {
+		t.Fatal("unknown key accepted without a refetch")
+	}
+	if _, jwksFetches, _ := idp.counts(); jwksFetches != 1 {
+		t.Fatalf("JWKS fetched %d times within the refetch gap, want 1", jwksFetches)
+	}
+
+	provider.keys.mu.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-oidcKeysRefetchGap - time.Second)
+	provider.keys.mu.Unlock()
+
+	if _, err := validateIDToken(provider, after, "nonce-1"); err != nil {
+		t.Fatalf("token from the rotated key: %v", err)
+	}
+	if _, jwksFetches, _ := idp.counts(); jwksFetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", jwksFetches)
+	}
+	if _, err := validateIDToken(provider, before, "nonce-1"); err == nil {
+		t.Error("token from the retired key was accepted")
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+
+	tests := []struct {
+		groups []string
+		want   []string
+	}{
+		{[]string{"video-team"}, []string{roleCreator}},
+		{[]string{"secops", "video-team", "secops"}, []string{roleSecurityAdmin, roleModerator, roleCreator}},
+		{[]string{"unmapped"}, []string{roleViewer}},
+		{nil, []string{roleViewer}},
+	}
+	for _, tt := range tests {
+		if got := mapRoles(tt.groups); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mapRoles(%v) = %v, want %v", tt.groups, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCGroupsClaim(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	oidc.config.GroupsClaim = "roles"
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := idp.claims("nonce-1")
+	claims["roles"] = "secops, video-team"
+	got, err := validateIDToken(provider, idp.sign(claims), "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Groups, []string{"secops", "video-team"}) {
+		t.Fatalf("groups = %v", got.Groups)
+	}
+	if roles := mapRoles(got.Groups); !reflect.DeepEqual(roles, []string{roleSecurityAdmin, roleModerator, roleCreator}) {
+		t.Errorf("roles = %v", roles)
+	}
+}
+
+func TestParseRoleMap(t *testing.T) {
+	roles, err := parseRoleMap("video-team=creator, secops=security-admin,secops=moderator,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"video-team": {roleCreator}, "secops": {roleSecurityAdmin, roleModerator}}
+	if !reflect.DeepEqual(roles, want) {
+		t.Errorf("roles = %v, want %v", roles, want)
+	}
+
+	for _, value := range []string{"video-team", "=creator", "video-team=root"} {
+		if _, err := parseRoleMap(value); err == nil {
+			t.Errorf("parseRoleMap(%q) succeeded", value)
+		}
+	}
+}
+
+func TestEmailLinkFilter(t *testing.T) {
+	issuer := "https://idp.example"
+	claims := &idTokenClaims{Email: "Alice@Example.com", EmailVerified: "true"}
+
+	filter, ok := emailLinkFilter(issuer, claims)
+	if !ok {
+		t.Fatal("verified email was not linkable")
+	}
+	want := bson.M{
+		"email":             "alice@example.com",
+		"passwordHash":      bson.M{"$exists": false},
+		"identities.issuer": bson.M{"$ne": issuer},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("filter = %v, want %v", filter, want)
+	}
+
+	for _, claims := range []*idTokenClaims{
+		{Email: "alice@example.com"},
+		{Email: "alice@example.com", EmailVerified: false},
+		{Email: "alice@example.com", EmailVerified: "false"},
+		{EmailVerified: true},
+	} {
+		if _, ok := emailLinkFilter(issuer, claims); ok {
+			t.Errorf("emailLinkFilter(%+v) allowed linking", claims)
+		}
+	}
+}
+
+func TestOIDCLoginUsesPKCE(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("login", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		w := httptest.NewRecorder()
+		oidcLoginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login?returnTo=/watch/1", nil))
+		if w.Code != http.StatusFound {
+			mt.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		target, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(target.String(), idp.server.URL+"/authorize?") {
+			mt.Fatalf("redirect = %q", w.Header().Get("Location"))
+		}
+		query := target.Query()
+		if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL || query.Get("code_challenge_method") != "S256" {
+			mt.Errorf("authorization request = %v", query)
+		}
+
+		var login oidcLogin
+		doc := mt.GetStartedEvent().Command.Lookup("documents", "0").Document()
+		if err := bson.Unmarshal(doc, &login); err != nil {
+			mt.Fatal(err)
+		}
+		if login.State != query.Get("state") || login.Nonce != query.Get("nonce") || login.ReturnTo != "/watch/1" {
+			mt.Errorf("stored login %+v does not match the request %v", login, query)
+		}
+		if pkceChallenge(login.Verifier) != query.Get("code_challenge") {
+			mt.Fatal("code_challenge is not the S256 of the stored verifier")
+		}
+
+		// Only the stored verifier redeems the code
+		provider, _ := discoverOIDC()
+		idp.authorize("code-1", query.Get("code_challenge"), idp.claims(login.Nonce))
+		if _, err := exchangeCode(context.Background(), provider, "code-1", "guessed-verifier"); err == nil {
+			mt.Error("code redeemed with the wrong verifier")
+		}
+		idp.authorize("code-2", query.Get("code_challenge"), idp.claims(login.Nonce))
+		idToken, err := exchangeCode(context.Background(), provider, "code-2", login.Verifier)
+		if err != nil {
+			mt.Fatalf("exchangeCode: %v", err)
+		}
+		if _, err := validateIDToken(provider, idToken, login.Nonce); err != nil {
+			mt.Errorf("validateIDToken: %v", err)
+		}
+	})
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+
+	login := oidcLogin{State: "state-1", Nonce: "nonce-1", Verifier: "verifier-1", ExpireAt: time.Now().Add(time.Minute)}
+	callback := func(state string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oidcCallbackHandler(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code=code-1&state="+state, nil))
+		return w
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("nonce mismatch then reuse", func(mt *mtest.T) {
+		useMockDB(mt)
+		idp.authorize("code-1", pkceChallenge(login.Verifier), idp.claims("nonce-of-another-login"))
+
+		// The login is found and deleted; the ID token is then rejected
+		mt.AddMockResponses(findAndModifyResponse(t, login), mtest.CreateSuccessResponse())
+		w := callback(login.State)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid ID token") {
+			mt.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		claim := mt.GetStartedEvent().Command
+		if !claim.Lookup("remove").Boolean() || claim.Lookup("query", "_id").StringValue() != login.State {
+			mt.Errorf("login was not claimed with a delete: %s", claim)
+		}
+		if _, _, tokenRequests := idp.counts(); tokenRequests != 1 || idp.verifiers[0] != login.Verifier {
+			mt.Fatalf("token requests = %d, verifiers = %v", tokenRequests, idp.verifiers)
+		}
+
+		// A replayed state finds nothing and never reaches the token endpoint
+		mt.AddMockResponses(findAndModifyResponse(t, nil))
+		w = callback(login.State)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Unknown or expired login") {
+			mt.Fatalf("replay: status = %d: %s", w.Code, w.Body)
+		}
+		if _, _, tokenRequests := idp.counts(); tokenRequests != 1 {
+			mt.Errorf("replayed state reached the token endpoint")
+		}
+	})
+
+	mt.Run("expired login", func(mt *mtest.T) {
+		useMockDB(mt)
+		expired := login
+		expired.ExpireAt = time.Now().Add(-time.Second)
+		_, _, before := idp.counts()
+
+		mt.AddMockResponses(findAndModifyResponse(t, expired))
+		w := callback(expired.State)
+		if w.Code != http.StatusBadRequest {
+			mt.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		if _, _, after := idp.counts(); after != before {
+			mt.Error("expired login reached the token endpoint")
+		}
+	})
+}
+
+func TestProvisionOIDCUserEmailLinking(t *testing.T) {
+	idp := newTestIdP(t)
+	useOIDC(t, idp)
+	issuer := idp.server.URL
+	r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback", nil)
+	noDocuments := func() bson.D { return mtest.CreateCursorResponse(0, "boringmedia.users", mtest.FirstBatch) }
+
+	claimsWith := func(verified interface{}) *idTokenClaims {
+		return &idTokenClaims{
+			Issuer: issuer, Subject: "user-1", Email: "Alice@Example.com", EmailVerified: verified,
+			PreferredUsername: "alice", Groups: []string{"video-team"},
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("links a seeded account with the verified email", func(mt *mtest.T) {
+		useMockDB(mt)
+		existing := User{ID: primitive.NewObjectID(), Username: "alice", Email: "alice@example.com"}
+		mt.AddMockResponses(
+			findAndModifyResponse(t, nil),      // no account has this identity yet
+			findAndModifyResponse(t, existing), // the email match
+			mtest.CreateSuccessResponse(),      // audit event
+		)
+
+		user, err := provisionOIDCUser(context.Background(), r, claimsWith(true))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if user.Username != "alice" {
+			mt.Errorf("linked user = %q", user.Username)
+		}
+
+		mt.GetStartedEvent() // identity lookup
+		link := mt.GetStartedEvent().Command
+		if got := link.Lookup("query", "email").StringValue(); got != "alice@example.com" {
+			mt.Errorf("email = %q", got)
+		}
+		if _, err := link.LookupErr("query", "emailVerified"); err == nil {
+			mt.Error("link requires a verified email on the account, which seeded accounts lack")
+		}
+		if !link.Lookup("update", "$set", "emailVerified").Boolean() {
+			mt.Error("link does not mark the provider-verified email")
+		}
+		if _, err := link.LookupErr("query", "passwordHash", "$exists"); err != nil {
+			mt.Error("link does not exclude password accounts")
+		}
+		if got := link.Lookup("query", "identities.issuer", "$ne").StringValue(); got != issuer {
+			mt.Errorf("link does not exclude accounts of another subject: %q", got)
+		}
+		if got := link.Lookup("update", "$set", "roles", "0").StringValue(); got != roleCreator {
+			mt.Errorf("roles[0] = %q, want %q", got, roleCreator)
+		}
+	})
+
+	mt.Run("unverified email gets a new account without the email", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			findAndModifyResponse(t, nil), // identity lookup
+			noDocuments(),                 // username is free
+			mtest.CreateSuccessResponse(), // insert user
+			mtest.CreateSuccessResponse(), // audit event
+		)
+
+		user, err := provisionOIDCUser(context.Background(), r, claimsWith(false))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if user.Email != "" || user.EmailVerified {
+			mt.Errorf("unverified email stored: %+v", user)
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if _, err := event.Command.LookupErr("query", "email"); err == nil {
+				mt.Errorf("%s looked up the unverified email", event.CommandName)
+			}
+		}
+	})
+
+	mt.Run("verified email held by an unlinkable account stays with it", func(mt *mtest.T) {
+		useMockDB(mt)
+		holder := mtest.CreateCursorResponse(0, "boringmedia.users", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "email", Value: "alice@example.com"}})
+		mt.AddMockResponses(
+			findAndModifyResponse(t, nil), // identity lookup
+			findAndModifyResponse(t, nil), // no linkable account, e.g. a password registration
+			noDocuments(),                 // username is free
+			holder,                        // the email is taken
+			mtest.CreateSuccessResponse(), // insert user
+			mtest.CreateSuccessResponse(), // audit event
+		)
+
+		user, err := provisionOIDCUser(context.Background(), r, claimsWith(true))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if user.Email != "" || user.EmailVerified {
+			mt.Errorf("new account took a registered email: %+v", user)
+		}
+		if !reflect.DeepEqual(user.Roles, []string{roleCreator}) {
+			mt.Errorf("roles = %v", user.Roles)
+		}
+	})
+
+	mt.Run("verified free email is kept on the new account", func(mt *mtest.T) {
+		useMockDB(mt)
+		mt.AddMockResponses(
+			findAndModifyResponse(t, nil), // identity lookup
+			findAndModifyResponse(t, nil), // no linkable account
+			noDocuments(),                 // username is free
+			noDocuments(),                 // email is free
+			mtest.CreateSuccessResponse(), // insert user
+			mtest.CreateSuccessResponse(), // audit event
+		)
+
+		user, err := provisionOIDCUser(context.Background(), r, claimsWith("true"))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if user.Email != "alice@example.com" || !user.EmailVerified || user.Username != "alice" {
+			mt.Errorf("user = %+v", user)
+		}
+	})
+}
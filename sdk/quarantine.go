@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Quarantine item states
+const (
+	quarantineHeld     = "quarantined"
+	quarantineReleased = "released"
+	quarantinePurged   = "purged"
+)
+
+const defaultQuarantineZipPassword = "infected"
+
+// quarantineKey encrypts quarantined files at rest (AES-256)
+var quarantineKey []byte
+
+// QuarantineItem is the MongoDB record of a quarantined upload. The file
+// itself is stored encrypted in the blob store under Key.
+type QuarantineItem struct {
+	ID            primitive.ObjectID  `json:"_id" bson:"_id"`
+	Status        string              `json:"status" bson:"status"`
+	Key           string              `json:"-" bson:"key"`
+	KeyID         string              `json:"keyId" bson:"keyId"`
+	SHA256        string              `json:"sha256" bson:"sha256"`
+	CRC32         uint32              `json:"-" bson:"crc32"`
+	FileName      string              `json:"fileName" bson:"fileName"`
+	Size          int64               `json:"size" bson:"size"`
+	Uploader      string              `json:"uploader,omitempty" bson:"uploader,omitempty"`
+	MalwareNames  []string            `json:"malwareNames" bson:"malwareNames"`
+	Scanner       string              `json:"scanner,omitempty" bson:"scanner,omitempty"`
+	Form          map[string][]string `json:"-" bson:"form"`
+	QuarantinedAt time.Time           `json:"quarantinedAt" bson:"quarantinedAt"`
+	LastRescan    *ScanResult         `json:"lastRescan,omitempty" bson:"lastRescan,omitempty"`
+	ReleasedAt    *time.Time          `json:"releasedAt,omitempty" bson:"releasedAt,omitempty"`
+	VideoID       string              `json:"videoId,omitempty" bson:"videoId,omitempty"`
+	PurgedAt      *time.Time          `json:"purgedAt,omitempty" bson:"purgedAt,omitempty"`
+}
+
+func quarantineItems() *mongo.Collection {
+	return db.Collection("quarantine")
+}
+
+// initQuarantine loads QUARANTINE_KEY (64 hex characters) and creates the
+// quarantine indexes. Without a key an ephemeral one is generated, so files
+// quarantined before a restart can no longer be downloaded or released.
+func initQuarantine() error {
+	if encoded := os.Getenv("QUARANTINE_KEY"); encoded != "" {
+		key, err := hex.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return errors.New("QUARANTINE_KEY must be 32 bytes encoded as 64 hex characters")
+		}
+		quarantineKey = key
+	} else {
+		quarantineKey = make([]byte, 32)
+		if _, err := rand.Read(quarantineKey); err != nil {
+			return err
+		}
+		log.Println("Warning: QUARANTINE_KEY not set; using an ephemeral key, quarantined files will be unreadable after a restart")
+	}
+	log.Printf("Quarantine encryption key id: %s", quarantineKeyID(quarantineKey))
+
+	if db == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := quarantineItems().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "quarantinedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "sha256", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create quarantine indexes: %v", err)
+	}
+	return nil
+}
+
+// quarantineUpload encrypts a malicious upload staged under key into the
+// quarantine area of the blob store and records it, so it is never served
+// but stays available for review
+func quarantineUpload(ctx context.Context, key, originalName string, form map[string][]string, result *ScanResult) (*QuarantineItem, error) {
+	r, info, err := mediaStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sealed, err := newSealReader(quarantineKey, r, info.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &QuarantineItem{
+		ID:            primitive.NewObjectID(),
+		Status:        quarantineHeld,
+		KeyID:         quarantineKeyID(quarantineKey),
+		FileName:      filepath.Base(originalName),
+		Size:          info.Size,
+		MalwareNames:  []string{},
+		Scanner:       result.Scanner,
+		Form:          form,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	item.Key = quarantinePrefix + item.ID.Hex() + ".bmq"
+	if values := form["uploader"]; len(values) > 0 {
+		item.Uploader = strings.TrimSpace(values[0])
+	}
+	for _, finding := range result.Malware {
+		item.MalwareNames = append(item.MalwareNames, finding.MalwareName)
+	}
+
+	if _, err := mediaStore.Put(ctx, item.Key, sealed, sealedSize(info.Size), "application/octet-stream"); err != nil {
+		return nil, fmt.Errorf("cannot store quarantined file: %w", err)
+	}
+	item.SHA256 = sealed.SHA256()
+	item.CRC32 = sealed.CRC32()
+
+	if _, err := quarantineItems().InsertOne(ctx, item); err != nil {
+		mediaStore.Delete(context.Background(), item.Key)
+		return nil, fmt.Errorf("cannot record quarantined file: %w", err)
+	}
+	if err := mediaStore.Delete(ctx, key); err != nil {
+		log.Printf("Failed to delete staged upload %s: %v", key, err)
+	}
+
+	log.Printf("Quarantined malicious upload %s (sha256 %s, malware %v) as %s", originalName, item.SHA256, item.MalwareNames, item.ID.Hex())
+	return item, nil
+}
+
+// openQuarantined opens a decrypting reader over a quarantined file
+func openQuarantined(ctx context.Context, item *QuarantineItem) (io.ReadCloser, *openReader, error) {
+	if item.KeyID != quarantineKeyID(quarantineKey) {
+		return nil, nil, fmt.Errorf("%w (key id %s, current key id %s)", errQuarantineCorrupt, item.KeyID, quarantineKeyID(quarantineKey))
+	}
+	r, _, err := mediaStore.Get(ctx, item.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := newOpenReader(quarantineKey, r)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, plain, nil
+}
+
+// quarantineHandler routes /admin/quarantine and /admin/quarantine/{id}[/action]
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, "GET, POST, DELETE, OPTIONS")
+		return
+	}
+	setCORSHeaders(w, r)
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/quarantine"), "/")
+	if path == "" {
+		if r.Method == http.MethodGet {
+			listQuarantine(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	item, ok := findQuarantineItem(w, id)
+	if !ok {
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeQuarantineItem(w, http.StatusOK, item)
+	case action == "" && r.Method == http.MethodDelete:
+		purgeQuarantined(w, r, item)
+	case action == "download" && r.Method == http.MethodGet:
+		downloadQuarantined(w, r, item)
+	case action == "rescan" && r.Method == http.MethodPost:
+		rescanQuarantined(w, r, item)
+	case action == "release" && r.Method == http.MethodPost:
+		releaseQuarantined(w, r, item)
+	case action == "" || action == "download" || action == "rescan" || action == "release":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func findQuarantineItem(w http.ResponseWriter, id string) (*QuarantineItem, bool) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid quarantine ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var item QuarantineItem
+	err = quarantineItems().FindOne(ctx, bson.M{"_id": objectID}).Decode(&item)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Quarantine item not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find quarantine item: %v", err)
+			http.Error(w, "Failed to find quarantine item", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &item, true
+}
+
+func writeQuarantineItem(w http.ResponseWriter, status int, item *QuarantineItem) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(item)
+}
+
+// List quarantined uploads, newest first. ?status= filters by state
+// (default "quarantined"; "all" lists every record).
+func listQuarantine(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+		filter["status"] = quarantineHeld
+	case "all":
+	case quarantineHeld, quarantineReleased, quarantinePurged:
+		filter["status"] = status
+	default:
+		http.Error(w, "status must be quarantined, released, purged or all", http.StatusBadRequest)
+		return
+	}
+	if sha := r.URL.Query().Get("sha256"); sha != "" {
+		filter["sha256"] = strings.ToLower(sha)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "quarantinedAt", Value: -1}}).SetLimit(500)
+	cursor, err := quarantineItems().Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("Failed to list quarantine: %v", err)
+		http.Error(w, "Failed to list quarantine", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	items := []QuarantineItem{}
+	if err := cursor.All(ctx, &items); err != nil {
+		log.Printf("Failed to decode quarantine: %v", err)
+		http.Error(w, "Failed to decode quarantine", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// Download a quarantined file wrapped in a password protected zip. The
+// password is QUARANTINE_ZIP_PASSWORD, "infected" by default as is customary
+// for malware samples.
+func downloadQuarantined(w http.ResponseWriter, r *http.Request, item *QuarantineItem) {
+	if item.Status != quarantineHeld {
+		http.Error(w, "Quarantine item is "+item.Status, http.StatusConflict)
+		return
+	}
+
+	body, plain, err := openQuarantined(r.Context(), item)
+	if err != nil {
+		log.Printf("Failed to open quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to open quarantined file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, item.ID.Hex()))
+	w.Header().Set("Cache-Control", "no-store")
+
+	zw := zip.NewWriter(w)
+	fw, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               item.FileName,
+		Method:             zip.Store,
+		Flags:              0x1, // encrypted
+		Modified:           item.QuarantinedAt,
+		CRC32:              item.CRC32,
+		CompressedSize64:   uint64(item.Size) + 12,
+		UncompressedSize64: uint64(item.Size),
+	})
+	if err == nil {
+		var zc *zipCryptoWriter
+		zc, err = newZipCryptoWriter(fw, getEnvOrDefault("QUARANTINE_ZIP_PASSWORD", defaultQuarantineZipPassword), item.CRC32)
+		if err == nil {
+			_, err = io.Copy(zc, plain)
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// Headers are already sent; the truncated zip will fail to open
+		log.Printf("Failed to write quarantine download %s: %v", item.ID.Hex(), err)
+		return
+	}
+	log.Printf("Quarantine item %s (%s) downloaded", item.ID.Hex(), item.SHA256)
+}
+
+// Rescan a quarantined file with the current scanner
+func rescanQuarantined(w http.ResponseWriter, r *http.Request, item *QuarantineItem) {
+	if item.Status != quarantineHeld {
+		http.Error(w, "Quarantine item is "+item.Status, http.StatusConflict)
+		return
+	}
+
+	body, plain, err := openQuarantined(r.Context(), item)
+	if err != nil {
+		log.Printf("Failed to open quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to open quarantined file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp("", "quarantine-*"+filepath.Ext(item.FileName))
+	if err != nil {
+		http.Error(w, "Failed to prepare rescan", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, plain)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Failed to decrypt quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to decrypt quarantined file", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := scanUploadedFile(r.Context(), tmp.Name(), item.Size)
+	if err != nil {
+		log.Printf("Rescan of quarantine item %s failed: %v", item.ID.Hex(), err)
+	}
+	storeScanVerdict(r.Context(), item.SHA256, result)
+	result.FileName = item.FileName
+	result.SHA256 = item.SHA256
+	result.Quarantined = true
+	result.QuarantineID = item.ID.Hex()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := quarantineItems().UpdateOne(ctx, bson.M{"_id": item.ID}, bson.M{"$set": bson.M{"lastRescan": result}}); err != nil {
+		log.Printf("Failed to record rescan of quarantine item %s: %v", item.ID.Hex(), err)
+	}
+	item.LastRescan = result
+
+	log.Printf("Rescanned quarantine item %s: %s", item.ID.Hex(), result.Status)
+	writeQuarantineItem(w, http.StatusOK, item)
+}
+
+// Release a quarantined file as a false positive, publishing it as a video.
+// Unless ?force=true, the latest rescan must have come back clean.
+func releaseQuarantined(w http.ResponseWriter, r *http.Request, item *QuarantineItem) {
+	if item.Status != quarantineHeld {
+		http.Error(w, "Quarantine item is "+item.Status, http.StatusConflict)
+		return
+	}
+	if r.URL.Query().Get("force") != "true" && (item.LastRescan == nil || item.LastRescan.Status != ScanStatusClean) {
+		http.Error(w, "Rescan the file clean before releasing it, or pass force=true", http.StatusConflict)
+		return
+	}
+
+	body, plain, err := openQuarantined(r.Context(), item)
+	if err != nil {
+		log.Printf("Failed to open quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to open quarantined file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	stagedKey := incomingPrefix + item.ID.Hex() + "-" + item.FileName
+	if _, err := mediaStore.Put(r.Context(), stagedKey, plain, item.Size, contentTypeForKey(item.FileName)); err != nil {
+		log.Printf("Failed to stage quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to decrypt quarantined file", http.StatusInternalServerError)
+		return
+	}
+	video, err := publishUpload(r.Context(), stagedKey, item.FileName, item.SHA256, item.Size, item.Form)
+	if err != nil {
+		mediaStore.Delete(context.Background(), stagedKey)
+		log.Printf("Failed to release quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to publish released file", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	item.Status = quarantineReleased
+	item.ReleasedAt = &now
+	item.VideoID = video.ID.Hex()
+	setQuarantineState(item, bson.M{"status": item.Status, "releasedAt": now, "videoId": item.VideoID})
+
+	log.Printf("Released quarantine item %s as video %s", item.ID.Hex(), item.VideoID)
+	writeQuarantineItem(w, http.StatusOK, item)
+}
+
+// Purge a quarantined file. The record is kept for auditing.
+func purgeQuarantined(w http.ResponseWriter, r *http.Request, item *QuarantineItem) {
+	if item.Status != quarantineHeld {
+		http.Error(w, "Quarantine item is "+item.Status, http.StatusConflict)
+		return
+	}
+
+	if err := mediaStore.Delete(r.Context(), item.Key); err != nil {
+		log.Printf("Failed to delete quarantine item %s: %v", item.ID.Hex(), err)
+		http.Error(w, "Failed to purge quarantined file", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	setQuarantineState(item, bson.M{"status": quarantinePurged, "purgedAt": now})
+
+	log.Printf("Purged quarantine item %s (%s)", item.ID.Hex(), item.SHA256)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setQuarantineState records a terminal state; the encrypted file has already
+// been published or deleted, so it is removed from the store on a best effort
+func setQuarantineState(item *QuarantineItem, set bson.M) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := quarantineItems().UpdateOne(ctx, bson.M{"_id": item.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("Failed to update quarantine item %s: %v", item.ID.Hex(), err)
+	}
+	if err := mediaStore.Delete(ctx, item.Key); err != nil {
+		log.Printf("Failed to delete quarantined file %s: %v", item.Key, err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Role-based access control. Every request is checked against accessPolicy
+// before it reaches its handler; handlers only add ownership checks, such as
+// a creator editing their own video. aichat and containerxdr enforce the
+// same roles with tables of their own.
+
+const (
+	roleViewer        = "viewer"
+	roleCreator       = "creator"
+	roleModerator     = "moderator"
+	roleSecurityAdmin = "security-admin"
+)
+
+// knownRoles lists every role, in increasing order of trust
+var knownRoles = []string{roleViewer, roleCreator, roleModerator, roleSecurityAdmin}
+
+func validRole(role string) bool {
+	for _, known := range knownRoles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Role sets used by the policy tables. A nil set lets anonymous requests in.
+var (
+	rolesPublic   []string
+	rolesSignedIn = knownRoles
+	rolesCreators = []string{roleCreator, roleModerator}
+	rolesStaff    = []string{roleModerator, roleSecurityAdmin}
+	rolesSecurity = []string{roleSecurityAdmin}
+)
+
+// accessRule grants Roles the requests with one of Methods (space
+// separated, "*" for any) whose path matches Path. In Path, "*" matches
+// one segment and a trailing "**" any number of them.
+type accessRule struct {
+	Methods string
+	Path    string
+	Roles   []string
+}
+
+// accessPolicy is searched in order and the first matching rule applies.
+// Requests no rule matches are refused.
+var accessPolicy = []accessRule{
+	{"GET HEAD", "/", rolesPublic},
+	{"GET HEAD", "/health", rolesPublic},
+	{"GET HEAD", "/media/**", rolesPublic},
+
+	// Uploads, scanned or not, and their scan status
+	{"GET", "/upload", rolesPublic},
+	{"POST", "/upload", rolesCreators},
+	{"GET", "/upload-vulnerable", rolesPublic},
+	{"POST", "/upload-vulnerable", rolesCreators},
+	{"*", "/files", rolesCreators},
+	{"*", "/files/*", rolesCreators},
+	{"GET", "/scans/*", rolesSignedIn},
+	{"GET", "/schemas/scan-result.json", rolesPublic},
+
+	// The catalog is public; creators manage their own videos and
+	// moderators everyone's
+	{"GET HEAD", "/videos", rolesPublic},
+	{"POST", "/videos", rolesCreators},
+	{"GET HEAD", "/videos/*", rolesPublic},
+	{"PATCH DELETE", "/videos/*", rolesCreators},
+	{"PUT", "/videos/*/views", rolesPublic},
+	{"POST", "/videos/*/watch", rolesSignedIn},
+	{"GET HEAD", "/videos/*/metadata", rolesPublic},
+	{"GET HEAD", "/videos/*/thumbnail", rolesPublic},
+	{"GET HEAD", "/videos/*/stream", rolesPublic},
+	{"GET", "/videos/*/hls", rolesPublic},
+	{"POST", "/videos/*/hls", rolesStaff},
+	{"GET HEAD", "/videos/*/hls/**", rolesPublic},
+
+	// Anyone reads comments; accounts write them, and comments.go lets
+	// only authors edit and authors or moderators delete
+	{"GET", "/videos/*/comments", rolesPublic},
+	{"POST", "/videos/*/comments", rolesSignedIn},
+	{"GET", "/videos/*/comments/*", rolesPublic},
+	{"PATCH DELETE", "/videos/*/comments/*", rolesSignedIn},
+	{"PUT DELETE", "/videos/*/comments/*/like", rolesSignedIn},
+	{"GET", "/search", rolesPublic},
+
+	// Profiles are public, watch histories are for their owner
+	{"GET", "/users", rolesPublic},
+	{"GET", "/users/*", rolesPublic},
+	{"GET", "/users/*/history", rolesSignedIn},
+	{"GET", "/users/*/cowatched", rolesSignedIn},
+
+	// Sign-in; /auth/me and /auth/logout check the caller themselves
+	{"GET POST", "/auth/**", rolesPublic},
+	{"GET", "/.well-known/jwks.json", rolesPublic},
+
+	// Demo mode, quarantine, audit trail and role assignment
+	{"GET", "/demo-mode", rolesPublic},
+	{"*", "/admin/**", rolesSecurity},
+}
+
+// matchPath reports whether path matches an accessRule pattern
+func matchPath(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range patternParts {
+		if part == "**" && i == len(patternParts)-1 {
+			return true
+		}
+		if i >= len(pathParts) || (part != "*" && part != pathParts[i]) || (part == "*" && pathParts[i] == "") {
+			return false
+		}
+	}
+	return len(pathParts) == len(patternParts)
+}
+
+// findAccessRule returns the first rule of policy matching the request
+func findAccessRule(policy []accessRule, method, path string) (*accessRule, bool) {
+	for i, rule := range policy {
+		if rule.Methods != "*" && !strings.Contains(" "+rule.Methods+" ", " "+method+" ") {
+			continue
+		}
+		if matchPath(rule.Path, path) {
+			return &policy[i], true
+		}
+	}
+	return nil, false
+}
+
+// effectiveRoles are the roles of an identity. Accounts without any are
+// viewers.
+func (i *Identity) effectiveRoles() []string {
+	if len(i.Roles) == 0 {
+		return []string{roleViewer}
+	}
+	return i.Roles
+}
+
+// hasRole reports whether the identity holds one of roles
+func (i *Identity) hasRole(roles ...string) bool {
+	if i == nil {
+		return false
+	}
+	for _, have := range i.effectiveRoles() {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denyAccess refuses a request with 401 for anonymous callers and 403 for
+// signed-in ones, and records the denial in the audit trail
+func denyAccess(w http.ResponseWriter, r *http.Request, required []string, reason string) {
+	identity := identityFrom(r)
+	status := http.StatusForbidden
+	if identity == nil {
+		status = http.StatusUnauthorized
+	}
+	details := map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"status": status,
+		"reason": reason,
+	}
+	if len(required) > 0 {
+		details["required"] = required
+	}
+	if identity != nil {
+		details["roles"] = identity.effectiveRoles()
+	}
+	recordAudit(r, "access_denied", details)
+
+	setCORSHeaders(w, r)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sdk"`)
+		http.Error(w, "Authentication required", status)
+		return
+	}
+	http.Error(w, "Forbidden: "+reason, status)
+}
+
+// authorize enforces accessPolicy. Preflight requests always pass so
+// browsers can learn the CORS headers.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule, ok := findAccessRule(accessPolicy, r.Method, r.URL.Path)
+		if !ok {
+			denyAccess(w, r, nil, "no access rule for this request")
+			return
+		}
+		if rule.Roles != nil && !identityFrom(r).hasRole(rule.Roles...) {
+			denyAccess(w, r, rule.Roles, fmt.Sprintf("requires one of the roles %s", strings.Join(rule.Roles, ", ")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireOwnerOr lets the request through when the caller is owner or
+// holds one of roles, and denies it otherwise
+func requireOwnerOr(w http.ResponseWriter, r *http.Request, owner string, roles ...string) bool {
+	identity := identityFrom(r)
+	if identity != nil && ((owner != "" && identity.Username == owner) || identity.hasRole(roles...)) {
+		return true
+	}
+	denyAccess(w, r, roles, "not the owner")
+	return false
+}
+
+// formOwner returns the uploader named by upload form fields
+func formOwner(form map[string][]string) string {
+	if values := form["uploader"]; len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// uploadOwner returns the uploader to publish an upload as: the caller,
+// unless a moderator names someone else
+func uploadOwner(w http.ResponseWriter, r *http.Request, named string) (string, bool) {
+	identity := identityFrom(r)
+	if identity == nil {
+		denyAccess(w, r, rolesCreators, "uploads need an account")
+		return "", false
+	}
+	if named == "" || named == identity.Username {
+		return identity.Username, true
+	}
+	if identity.hasRole(roleModerator) {
+		return named, true
+	}
+	denyAccess(w, r, []string{roleModerator}, "only moderators upload for someone else")
+	return "", false
+}
+
+// adminTokenIdentity returns the identity of the ADMIN_TOKEN bearer token,
+// a break-glass security admin for deployments without accounts, or nil
+// when token is not ADMIN_TOKEN
+func adminTokenIdentity(token string) *Identity {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return nil
+	}
+	return &Identity{Username: "admin-token", Roles: []string{roleSecurityAdmin}}
+}
+
+// Replace the roles of an account (security admins only)
+func setUserRoles(w http.ResponseWriter, r *http.Request, username string) {
+	setCORSHeaders(w, r)
+
+	var req struct {
+		Roles []string `json:"roles"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, role := range req.Roles {
+		if !validRole(role) {
+			http.Error(w, fmt.Sprintf("Unknown role %q, want one of %s", role, strings.Join(knownRoles, ", ")), http.StatusBadRequest)
+			return
+		}
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = []string{roleViewer}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var before User
+	err := db.Collection("users").FindOneAndUpdate(ctx,
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"roles": roles}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"roles": 1}),
+	).Decode(&before)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to update roles of %s: %v", username, err)
+			http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		}
+		return
+	}
+	recordAudit(r, "roles_changed", map[string]interface{}{
+		"username": username,
+		"before":   before.Roles,
+		"after":    roles,
+	})
+
+	// Tokens already issued keep their roles until they expire
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": username, "roles": roles})
+}
+
+// adminUsersHandler routes /admin/users/{username}/roles
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	username, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/")
+	if username == "" || action != "roles" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		handlePreflight(w, r, "PUT, OPTIONS")
+	case http.MethodPut:
+		setUserRoles(w, r, username)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store talks to an S3-compatible object store (AWS S3, MinIO, GCS interop)
+// using path-style requests signed with AWS Signature Version 4
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3StoreFromEnv configures the store from S3_ENDPOINT, S3_BUCKET,
+// S3_REGION, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY
+func newS3StoreFromEnv() (*s3Store, error) {
+	endpoint := getEnvOrDefault("S3_ENDPOINT", "https://s3.amazonaws.com")
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is required for the s3 storage backend")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	store := &s3Store{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    getEnvOrDefault("S3_REGION", "us-east-1"),
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	log.Printf("Using S3 blob storage at %s/%s", u.Host, bucket)
+	return store, nil
+}
+
+// s3EscapePath applies the URI encoding SigV4 expects, leaving slashes intact
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// newRequest builds a signed request for the object key (or the bucket when
+// key is empty)
+func (s *s3Store) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	escapedPath := "/" + s3EscapePath(s.bucket)
+	if key != "" {
+		escapedPath += "/" + s3EscapePath(key)
+	}
+
+	// Canonical query strings are sorted by key and use the SigV4 escaping
+	var queryParts []string
+	for k, values := range query {
+		for _, v := range values {
+			queryParts = append(queryParts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(queryParts)
+	rawQuery := strings.Join(queryParts, "&")
+
+	target := s.endpoint.Scheme + "://" + s.endpoint.Host + escapedPath
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	if s.accessKey == "" {
+		return req, nil
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		rawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := shortDate + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+	return req, nil
+}
+
+// do sends the request and converts error responses into Go errors
+func (s *s3Store) do(req *http.Request) (*http.Response, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: HTTP %d: %s", req.Method, req.URL.Path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return res, nil
+}
+
+func (s *s3Store) infoFromResponse(key string, res *http.Response) ObjectInfo {
+	h := res.Header
+	size := res.ContentLength
+	if size < 0 {
+		size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	}
+	modified, _ := http.ParseTime(h.Get("Last-Modified"))
+	return ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ContentType:  h.Get("Content-Type"),
+		ETag:         h.Get("ETag"),
+		LastModified: modified.UTC(),
+	}
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size < 0 {
+		return ObjectInfo{}, errors.New("s3 storage requires a known object size")
+	}
+
+	// An empty body must be http.NoBody, or the request is sent chunked
+	// without a Content-Length, which S3 rejects
+	var body io.Reader = io.NopCloser(r)
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, body, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	req.ContentLength = size
+	if contentType == "" {
+		contentType = contentTypeForKey(key)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ContentType:  contentType,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return res.Body, s.infoFromResponse(key, res), nil
+}
+
+func (s *s3Store) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+	return s.infoFromResponse(key, res), nil
+}
+
+// listBucketResult is the subset of the ListObjectsV2 response the sdk uses
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode bucket listing: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          c.Key,
+				Size:         c.Size,
+				ContentType:  contentTypeForKey(c.Key),
+				ETag:         c.ETag,
+				LastModified: c.LastModified.UTC(),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
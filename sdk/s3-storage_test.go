@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory S3 bucket serving path-style requests. Listings
+// return two keys a page so pagination is exercised.
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3Store) {
+	t.Helper()
+	f := &fakeS3{t: t, bucket: "media", objects: map[string]fakeS3Object{}}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	store := &s3Store{
+		endpoint:  endpoint,
+		bucket:    f.bucket,
+		region:    "us-east-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "secret",
+		client:    server.Client(),
+	}
+	return f, store
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("x-amz-date") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket)
+	if !ok {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	object, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		if len(r.TransferEncoding) > 0 || r.ContentLength < 0 {
+			http.Error(w, "MissingContentLength", http.StatusLengthRequired)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = fakeS3Object{data: data, contentType: r.Header.Get("Content-Type")}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(data)))
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		data := object.data
+		status := http.StatusOK
+		if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			first, last, _ := strings.Cut(spec, "-")
+			start, _ := strconv.Atoi(first)
+			end := len(data) - 1
+			if last != "" {
+				end, _ = strconv.Atoi(last)
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		http.Error(w, "only ListObjectsV2", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{Key: key, Size: int64(len(f.objects[key].data))})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Store(t *testing.T) {
+	fake, store := newFakeS3(t)
+	ctx := context.Background()
+
+	info, err := store.Put(ctx, "videos/a b.mp4", strings.NewReader("0123456789"), 10, "")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if info.Size != 10 || info.ContentType != "video/mp4" || info.ETag == "" {
+		t.Errorf("Put info = %+v", info)
+	}
+	if got := fake.objects["videos/a b.mp4"]; string(got.data) != "0123456789" {
+		t.Errorf("stored %q", got.data)
+	}
+
+	// An empty object is sent with a Content-Length of 0, not chunked
+	if _, err := store.Put(ctx, "videos/empty.mp4", strings.NewReader(""), 0, "video/mp4"); err != nil {
+		t.Fatalf("Put of an empty object: %v", err)
+	}
+	if _, ok := fake.objects["videos/empty.mp4"]; !ok {
+		t.Error("empty object was not stored")
+	}
+	if _, err := store.Put(ctx, "videos/unknown.mp4", strings.NewReader("x"), -1, ""); err == nil {
+		t.Error("Put of unknown size succeeded")
+	}
+
+	r, info, err := store.Get(ctx, "videos/a b.mp4")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "0123456789" || info.Size != 10 || info.ContentType != "video/mp4" || info.LastModified.IsZero() {
+		t.Errorf("Get = %q, %+v", data, info)
+	}
+
+	for _, tt := range []struct {
+		offset, length int64
+		want           string
+	}{{2, 3, "234"}, {7, -1, "789"}, {4, 0, ""}} {
+		r, err := store.GetRange(ctx, "videos/a b.mp4", tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+
+	if info, err := store.Stat(ctx, "videos/a b.mp4"); err != nil || info.Size != 10 {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+	if _, err := store.Stat(ctx, "videos/missing.mp4"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Stat of a missing object: err = %v", err)
+	}
+	if _, _, err := store.Get(ctx, "videos/missing.mp4"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Get of a missing object: err = %v", err)
+	}
+
+	for _, key := range []string{"videos/b.mp4", "videos/c.mp4", "thumbnails/a/small.jpg"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := store.List(ctx, videosPrefix)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	if got := strings.Join(keys, ","); got != "videos/a b.mp4,videos/b.mp4,videos/c.mp4,videos/empty.mp4" {
+		t.Errorf("List = %s", got)
+	}
+
+	if err := store.Delete(ctx, "videos/a b.mp4"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := fake.objects["videos/a b.mp4"]; ok {
+		t.Error("object still stored after Delete")
+	}
+	if err := store.Delete(ctx, "videos/a b.mp4"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+
+	if _, err := store.Put(ctx, "../escape", strings.NewReader("x"), 1, ""); err == nil {
+		t.Error("Put accepted a traversal key")
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	}))
+	defer server.Close()
+	endpoint, _ := url.Parse(server.URL)
+	store := &s3Store{endpoint: endpoint, bucket: "media", region: "us-east-1", client: server.Client()}
+
+	_, err := store.Put(context.Background(), "a.mp4", strings.NewReader("x"), 1, "")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 403") || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("err = %v, want the S3 error", err)
+	}
+}
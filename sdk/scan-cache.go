@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultScanCacheTTL = 24 * time.Hour
+
+// scanCacheTTL is how long a verdict is reused; zero disables the cache
+var scanCacheTTL = defaultScanCacheTTL
+
+// ScanVerdict is a cached clean or malicious verdict for some content,
+// keyed by its SHA-256 and the scanner name and version that produced it
+type ScanVerdict struct {
+	ID             string                 `bson:"_id"`
+	SHA256         string                 `bson:"sha256"`
+	Scanner        string                 `bson:"scanner"`
+	ScannerVersion string                 `bson:"scannerVersion"`
+	Status         ScanStatus             `bson:"status"`
+	Malware        []MalwareFinding       `bson:"malware"`
+	Raw            map[string]interface{} `bson:"scanResults"`
+	CreatedAt      time.Time              `bson:"createdAt"`
+	ExpireAt       time.Time              `bson:"expireAt"`
+}
+
+func scanVerdicts() *mongo.Collection {
+	return db.Collection("scan_verdicts")
+}
+
+func scanVerdictID(sha256, scanner, version string) string {
+	return sha256 + ":" + scanner + ":" + version
+}
+
+// initScanCache reads SCAN_CACHE_TTL (a duration, "0" to disable) and
+// creates the expiry index
+func initScanCache() {
+	if value := getEnvOrDefault("SCAN_CACHE_TTL", ""); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			log.Printf("Warning: invalid SCAN_CACHE_TTL %q, using %s", value, defaultScanCacheTTL)
+		} else {
+			scanCacheTTL = ttl
+		}
+	}
+	if scanCacheTTL == 0 {
+		log.Println("Scan verdict cache disabled")
+		return
+	}
+	if db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := scanVerdicts().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create scan verdict index: %v", err)
+	}
+}
+
+// cachedScanResult returns a result built from a cached verdict for the
+// content, or nil when there is none for the current scanner version
+func cachedScanResult(ctx context.Context, sha256, fileName string, fileSize int64) *ScanResult {
+	if scanCacheTTL == 0 || sha256 == "" || fileScanner == nil {
+		return nil
+	}
+	version := fileScanner.Version(ctx)
+	if version == "" {
+		return nil
+	}
+
+	var verdict ScanVerdict
+	err := scanVerdicts().FindOne(ctx, bson.M{
+		"_id":      scanVerdictID(sha256, fileScanner.Name(), version),
+		"expireAt": bson.M{"$gt": time.Now().UTC()}, // the TTL monitor only runs once a minute
+	}).Decode(&verdict)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to look up scan verdict: %v", err)
+		}
+		return nil
+	}
+
+	// Entries must agree with the scanner response they were made from;
+	// older releases cached unparseable verdicts as clean
+	if rawVerdictStatus(verdict.Raw, verdict.Malware) != verdict.Status {
+		log.Printf("Ignoring cached %s verdict for %s that its scanner response does not support", verdict.Status, sha256)
+		return nil
+	}
+
+	result := newScanResult(verdict.Status, fileName, fileSize)
+	result.Scanner = verdict.Scanner
+	result.Malware = verdict.Malware
+	result.Raw = verdict.Raw
+	result.Cached = true
+	log.Printf("Reusing cached %s verdict for %s (scanner %s %s)", verdict.Status, sha256, verdict.Scanner, version)
+	return result
+}
+
+// storeScanVerdict caches a clean or malicious result for the content.
+// Skipped and failed scans are never cached.
+func storeScanVerdict(ctx context.Context, sha256 string, result *ScanResult) {
+	if scanCacheTTL == 0 || sha256 == "" || fileScanner == nil {
+		return
+	}
+	if result.Status != ScanStatusClean && result.Status != ScanStatusMalicious {
+		return
+	}
+	if rawVerdictStatus(result.Raw, result.Malware) != result.Status {
+		return
+	}
+
+	// Key by the version that produced the verdict, when the scanner reports it
+	version, _ := result.Raw["scannerVersion"].(string)
+	if version == "" {
+		version = fileScanner.Version(ctx)
+	}
+	if version == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	verdict := ScanVerdict{
+		ID:             scanVerdictID(sha256, result.Scanner, version),
+		SHA256:         sha256,
+		Scanner:        result.Scanner,
+		ScannerVersion: version,
+		Status:         result.Status,
+		Malware:        result.Malware,
+		Raw:            result.Raw,
+		CreatedAt:      now,
+		ExpireAt:       now.Add(scanCacheTTL),
+	}
+	opts := options.Replace().SetUpsert(true)
+	if _, err := scanVerdicts().ReplaceOne(ctx, bson.M{"_id": verdict.ID}, verdict, opts); err != nil {
+		log.Printf("Failed to cache scan verdict: %v", err)
+	}
+}
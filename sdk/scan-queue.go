@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scan job states
+const (
+	scanJobQueued    = "queued"
+	scanJobRunning   = "running"
+	scanJobRetrying  = "retrying"
+	scanJobCompleted = "completed"
+	scanJobFailed    = "failed"
+)
+
+const (
+	scanMaxAttempts   = 5
+	scanRetryBase     = 5 * time.Second
+	scanRetryMax      = 5 * time.Minute
+	scanJobTimeout    = 15 * time.Minute
+	scanJobLease      = 20 * time.Minute // longer than scanJobTimeout, so only jobs whose worker died are reclaimed
+	scanPollInterval  = 5 * time.Second
+	scanJobRetention  = 7 * 24 * time.Hour
+	defaultScanWorker = 4
+)
+
+// errTransientScan marks scan failures worth retrying, such as the
+// "unknown error" responses the File Security API returns intermittently
+var errTransientScan = errors.New("transient scan failure")
+
+// errUploadNotMoved marks a scanned upload that could not be moved out of
+// staging. The job is retried and the staged upload kept.
+var errUploadNotMoved = errors.New("upload left in staging")
+
+// ScanJob is the persisted state of an asynchronous upload scan
+type ScanJob struct {
+	ID            primitive.ObjectID  `json:"_id" bson:"_id"`
+	Status        string              `json:"status" bson:"status"`
+	Key           string              `json:"-" bson:"key"`
+	Filename      string              `json:"filename" bson:"filename"`
+	Size          int64               `json:"size" bson:"size"`
+	SHA256        string              `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	Form          map[string][]string `json:"-" bson:"form"`
+	Attempts      int                 `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time           `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LeaseExpires  time.Time           `json:"-" bson:"leaseExpiresAt,omitempty"`
+	LastError     string              `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Result        *ScanResult         `json:"result,omitempty" bson:"result,omitempty"`
+	CreatedAt     time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time           `json:"updatedAt" bson:"updatedAt"`
+	ExpireAt      time.Time           `json:"-" bson:"expireAt,omitempty"`
+}
+
+// scanWakeup nudges idle workers when a job is enqueued
+var scanWakeup = make(chan struct{}, defaultScanWorker)
+
+func scanJobs() *mongo.Collection {
+	return db.Collection("scan_jobs")
+}
+
+// startScanWorkers creates the scan_jobs indexes and starts SCAN_WORKERS
+// workers. Job state lives in MongoDB, so any replica can pick up a job and
+// jobs left running by a crashed process are reclaimed once their lease ends.
+func startScanWorkers() {
+	workers := defaultScanWorker
+	if n, err := strconv.Atoi(getEnvOrDefault("SCAN_WORKERS", "")); err == nil && n > 0 {
+		workers = n
+	}
+	if db == nil {
+		log.Println("Warning: MongoDB unavailable; scan workers not started")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := scanJobs().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "expireAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("Failed to create scan job indexes: %v", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		go scanWorker()
+	}
+	log.Printf("Started %d scan workers", workers)
+}
+
+// enqueueScanJob records a scan for an upload staged under key. sha256 is the
+// hex digest of the content, computed while it was staged.
+func enqueueScanJob(ctx context.Context, key, filename string, size int64, sha256 string, form map[string][]string) (*ScanJob, error) {
+	now := time.Now().UTC()
+	job := &ScanJob{
+		ID:            primitive.NewObjectID(),
+		Status:        scanJobQueued,
+		Key:           key,
+		Filename:      filename,
+		Size:          size,
+		SHA256:        sha256,
+		Form:          form,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if _, err := scanJobs().InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case scanWakeup <- struct{}{}:
+	default:
+	}
+	log.Printf("Queued scan job %s for %s", job.ID.Hex(), filename)
+	return job, nil
+}
+
+func scanWorker() {
+	for {
+		job, err := claimScanJob()
+		if err != nil {
+			log.Printf("Failed to claim scan job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-scanWakeup:
+			case <-time.After(scanPollInterval):
+			}
+			continue
+		}
+		runScanJob(job)
+	}
+}
+
+// claimScanJob atomically takes the oldest due job, if any
+func claimScanJob() (*ScanJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{"$or": []bson.M{
+		{"status": bson.M{"$in": []string{scanJobQueued, scanJobRetrying}}, "nextAttemptAt": bson.M{"$lte": now}},
+		{"status": scanJobRunning, "leaseExpiresAt": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": scanJobRunning, "leaseExpiresAt": now.Add(scanJobLease), "updatedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job ScanJob
+	err := scanJobs().FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// scanRetryDelay is the exponential backoff before the given attempt is retried
+func scanRetryDelay(attempt int) time.Duration {
+	delay := scanRetryBase << (attempt - 1)
+	if delay <= 0 || delay > scanRetryMax {
+		return scanRetryMax
+	}
+	return delay
+}
+
+// runScanJob scans, publishes or quarantines one upload and records the outcome
+func runScanJob(job *ScanJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), scanJobTimeout)
+	defer cancel()
+
+	log.Printf("Running scan job %s (attempt %d/%d)", job.ID.Hex(), job.Attempts, scanMaxAttempts)
+	result, err := processStagedUpload(ctx, job.Key, job.Filename, job.Size, job.SHA256, job.Form)
+
+	now := time.Now().UTC()
+	set := bson.M{"updatedAt": now}
+	retryable := errors.Is(err, errTransientScan) || errors.Is(err, errUploadNotMoved)
+	switch {
+	case retryable && job.Attempts < scanMaxAttempts:
+		delay := scanRetryDelay(job.Attempts)
+		log.Printf("Scan job %s hit a transient error, retrying in %s: %v", job.ID.Hex(), delay, err)
+		set["status"] = scanJobRetrying
+		set["nextAttemptAt"] = now.Add(delay)
+		set["lastError"] = err.Error()
+	case err != nil && (result == nil || errors.Is(err, errUploadNotMoved)):
+		log.Printf("Scan job %s failed: %v", job.ID.Hex(), err)
+		set["status"] = scanJobFailed
+		set["lastError"] = err.Error()
+		set["expireAt"] = now.Add(scanJobRetention)
+		if result != nil {
+			set["result"] = result
+		}
+	default:
+		if err != nil {
+			set["lastError"] = err.Error()
+		}
+		set["status"] = scanJobCompleted
+		set["result"] = result
+		set["expireAt"] = now.Add(scanJobRetention)
+	}
+
+	// Published and quarantined uploads have been moved; drop whatever is
+	// left. Anything else stays staged, so a malicious or clean upload is
+	// never lost to a failed move.
+	if result != nil && (result.Published || result.Quarantined) {
+		if err := mediaStore.Delete(context.Background(), job.Key); err != nil {
+			log.Printf("Failed to delete staged upload %s: %v", job.Key, err)
+		}
+	}
+
+	updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer updateCancel()
+	if _, err := scanJobs().UpdateOne(updateCtx, bson.M{"_id": job.ID}, bson.M{"$set": set, "$unset": bson.M{"leaseExpiresAt": ""}}); err != nil {
+		log.Printf("Failed to record scan job %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// writeScanAccepted answers an upload with 202 and where to poll for its scan
+func writeScanAccepted(w http.ResponseWriter, job *ScanJob) {
+	statusURL := "/scans/" + job.ID.Hex()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", statusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":     job.ID.Hex(),
+		"status":     job.Status,
+		"status_url": statusURL,
+	})
+}
+
+// Get the status and results of a scan job
+func getScanJob(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid scan ID", http.StatusBadRequest)
+		return
+	}
+
+	var job ScanJob
+	err = scanJobs().FindOne(ctx, bson.M{"_id": objectID}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Scan not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find scan job: %v", err)
+			http.Error(w, "Failed to find scan", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !requireOwnerOr(w, r, formOwner(job.Form), roleModerator, roleSecurityAdmin) {
+		return
+	}
+
+	if job.Status != scanJobCompleted && job.Status != scanJobFailed {
+		w.Header().Set("Retry-After", "2")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// useMediaStore swaps the process-wide blob store for a local one in a
+// temporary directory for the length of a test
+func useMediaStore(t *testing.T) *localStore {
+	t.Helper()
+	store, err := newLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := mediaStore
+	mediaStore = store
+	t.Cleanup(func() { mediaStore = previous })
+	return store
+}
+
+// stageUpload stores data under a fresh incoming key
+func stageUpload(t *testing.T, store BlobStore, data string) string {
+	t.Helper()
+	key := incomingPrefix + primitive.NewObjectID().Hex() + "-upload.mp4"
+	if _, err := store.Put(context.Background(), key, strings.NewReader(data), int64(len(data)), "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestScanJobKeepsMaliciousUploadWhenQuarantineFails(t *testing.T) {
+	useScanner(t, fakeScanner{})
+	previousKey := quarantineKey
+	quarantineKey = make([]byte, 32)
+	t.Cleanup(func() { quarantineKey = previousKey })
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range []struct {
+		name     string
+		attempts int
+		status   string
+	}{
+		{"retried", 1, scanJobRetrying},
+		{"failed after the last attempt", scanMaxAttempts, scanJobFailed},
+	} {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockDB(mt)
+			store := useMediaStore(mt.T)
+			data := "prefix " + eicarSignature
+			key := stageUpload(mt.T, store, data)
+			mt.AddMockResponses(
+				mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted"}), // quarantine record
+				mtest.CreateSuccessResponse(), // job update
+			)
+
+			runScanJob(&ScanJob{ID: primitive.NewObjectID(), Key: key, Filename: "upload.mp4", Size: int64(len(data)), Attempts: tt.attempts})
+
+			if _, err := store.Stat(context.Background(), key); err != nil {
+				mt.Fatalf("staged malicious upload was deleted: %v", err)
+			}
+			if keys, _ := store.List(context.Background(), quarantinePrefix); len(keys) != 0 {
+				mt.Errorf("quarantine left %v behind", keys)
+			}
+
+			events := mt.GetAllStartedEvents()
+			update := events[len(events)-1].Command
+			set := update.Lookup("updates", "0", "u", "$set")
+			if got := set.Document().Lookup("status").StringValue(); got != tt.status {
+				mt.Errorf("status = %q, want %q", got, tt.status)
+			}
+			if tt.status == scanJobFailed {
+				var result ScanResult
+				raw, err := set.Document().LookupErr("result")
+				if err != nil || bson.Unmarshal(raw.Document(), &result) != nil || result.Status != ScanStatusMalicious || result.Quarantined {
+					mt.Errorf("failed job result = %+v, %v", result, err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanJobKeepsCleanUploadWhenPublishFails(t *testing.T) {
+	useScanner(t, fakeScanner{})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("insert fails", func(mt *mtest.T) {
+		useMockDB(mt)
+		store := useMediaStore(mt.T)
+		data := "just a video"
+		key := stageUpload(mt.T, store, data)
+		mt.AddMockResponses(
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted"}), // video insert
+			mtest.CreateSuccessResponse(), // job update
+		)
+
+		runScanJob(&ScanJob{ID: primitive.NewObjectID(), Key: key, Filename: "upload.mp4", Size: int64(len(data)), Attempts: 1})
+
+		if _, err := store.Stat(context.Background(), key); err != nil {
+			mt.Fatalf("staged clean upload is gone: %v", err)
+		}
+		if keys, _ := store.List(context.Background(), videosPrefix); len(keys) != 0 {
+			mt.Errorf("failed publish left %v behind", keys)
+		}
+		events := mt.GetAllStartedEvents()
+		set := events[len(events)-1].Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("status").StringValue(); got != scanJobRetrying {
+			mt.Errorf("status = %q, want %q", got, scanJobRetrying)
+		}
+	})
+
+	mt.Run("title taken", func(mt *mtest.T) {
+		useMockDB(mt)
+		store := useMediaStore(mt.T)
+		data := "just a video"
+		key := stageUpload(mt.T, store, data)
+		duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"})
+		mt.AddMockResponses(
+			duplicate, duplicate, // "upload" and "upload (2)" exist
+			mtest.CreateSuccessResponse(), // video insert
+			mtest.CreateSuccessResponse(), // job update
+		)
+
+		runScanJob(&ScanJob{ID: primitive.NewObjectID(), Key: key, Filename: "upload.mp4", Size: int64(len(data)), Attempts: 1})
+
+		var titles []string
+		var videoID primitive.ObjectID
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				titles = append(titles, event.Command.Lookup("documents", "0", "title").StringValue())
+				videoID = event.Command.Lookup("documents", "0", "_id").ObjectID()
+			}
+		}
+		if got := strings.Join(titles, ","); got != "upload,upload (2),upload (3)" {
+			mt.Errorf("inserted titles %s", got)
+		}
+		events := mt.GetAllStartedEvents()
+		set := events[len(events)-1].Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("status").StringValue(); got != scanJobCompleted {
+			mt.Errorf("status = %q, want %q", got, scanJobCompleted)
+		}
+
+		// Let the thumbnails of the published video finish
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			thumbnailRuns.Lock()
+			_, running := thumbnailRuns.videos[videoID]
+			thumbnailRuns.Unlock()
+			if !running {
+				break
+			}
+		}
+	})
+
+	mt.Run("invalid form", func(mt *mtest.T) {
+		useMockDB(mt)
+		store := useMediaStore(mt.T)
+		data := "just a video"
+		key := stageUpload(mt.T, store, data)
+		mt.AddMockResponses(mtest.CreateSuccessResponse()) // job update
+
+		form := map[string][]string{"category": {"Not a category"}}
+		runScanJob(&ScanJob{ID: primitive.NewObjectID(), Key: key, Filename: "upload.mp4", Size: int64(len(data)), Form: form, Attempts: 1})
+
+		if _, err := store.Stat(context.Background(), key); err != nil {
+			mt.Fatalf("staged upload is gone: %v", err)
+		}
+		set := mt.GetStartedEvent().Command.Lookup("updates", "0", "u", "$set").Document()
+		if got := set.Lookup("status").StringValue(); got != scanJobFailed {
+			mt.Errorf("status = %q, want %q without retrying", got, scanJobFailed)
+		}
+	})
+}
+
+func TestPublishTimeout(t *testing.T) {
+	if got := publishTimeout(maxScanSize); got < 2*time.Minute || got >= scanJobTimeout {
+		t.Errorf("publishTimeout(%d) = %s", maxScanSize, got)
+	}
+	if scanJobLease <= scanJobTimeout {
+		t.Errorf("scan job lease %s is not longer than the job timeout %s", scanJobLease, scanJobTimeout)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// scanResultSchemaVersion is bumped whenever the ScanResult JSON shape changes
+// incompatibly; the matching JSON Schema is served at /schemas/scan-result.json
+const scanResultSchemaVersion = "1.0"
+
+// ScanStatus is the outcome of scanning one file
+type ScanStatus string
+
+const (
+	ScanStatusClean           ScanStatus = "clean"
+	ScanStatusMalicious       ScanStatus = "malicious"
+	ScanStatusSkippedNoKey    ScanStatus = "skipped_no_key"
+	ScanStatusSkippedEmpty    ScanStatus = "skipped_empty"
+	ScanStatusSkippedTooLarge ScanStatus = "skipped_too_large"
+	ScanStatusError           ScanStatus = "error"
+	ScanStatusUnscanned       ScanStatus = "unscanned"
+)
+
+// LegacyCode maps a status to the scan_result_code older clients expect
+func (s ScanStatus) LegacyCode() int {
+	switch s {
+	case ScanStatusClean:
+		return 0
+	case ScanStatusMalicious:
+		return 1
+	case ScanStatusSkippedNoKey:
+		return -1
+	case ScanStatusError:
+		return -2
+	case ScanStatusSkippedEmpty, ScanStatusSkippedTooLarge:
+		return -3
+	default:
+		return -4
+	}
+}
+
+// MalwareFinding is one entry of the scanner's foundMalwares list
+type MalwareFinding struct {
+	FileName    string `json:"fileName" bson:"fileName"`
+	MalwareName string `json:"malwareName" bson:"malwareName"`
+}
+
+// ScanResult is the response for a scanned (or deliberately unscanned)
+// upload. scan_result_code and scan_results keep the pre-1.0 shape for
+// existing clients; new clients should read status and malware.
+type ScanResult struct {
+	SchemaVersion string           `json:"schema_version" bson:"schemaVersion"`
+	Status        ScanStatus       `json:"status" bson:"status"`
+	Code          int              `json:"scan_result_code" bson:"scanResultCode"`
+	Reason        string           `json:"reason,omitempty" bson:"reason,omitempty"`
+	Error         string           `json:"error,omitempty" bson:"error,omitempty"`
+	FileName      string           `json:"file_name,omitempty" bson:"fileName,omitempty"`
+	FileSize      int64            `json:"file_size" bson:"fileSize"`
+	SHA256        string           `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	Scanner       string           `json:"scanner,omitempty" bson:"scanner,omitempty"`
+	ScannedAt     time.Time        `json:"scanned_at" bson:"scannedAt"`
+	DurationMs    int64            `json:"duration_ms" bson:"durationMs"`
+	Cached        bool             `json:"cached,omitempty" bson:"cached,omitempty"`
+	Malware       []MalwareFinding `json:"malware" bson:"malware"`
+
+	// Raw holds the legacy scan_results object: the scanner's own response
+	// for completed scans, or a status/reason/message block otherwise
+	Raw map[string]interface{} `json:"scan_results" bson:"scanResults"`
+
+	// Publication outcome, filled in after the verdict is acted on
+	Published    bool   `json:"published" bson:"published"`
+	Quarantined  bool   `json:"quarantined,omitempty" bson:"quarantined,omitempty"`
+	QuarantineID string `json:"quarantine_id,omitempty" bson:"quarantineId,omitempty"`
+	VideoID      string `json:"video_id,omitempty" bson:"videoId,omitempty"`
+	VideoURL     string `json:"video_url,omitempty" bson:"videoUrl,omitempty"`
+}
+
+// newScanResult starts a result with the legacy fields derived from status
+func newScanResult(status ScanStatus, fileName string, fileSize int64) *ScanResult {
+	return &ScanResult{
+		SchemaVersion: scanResultSchemaVersion,
+		Status:        status,
+		Code:          status.LegacyCode(),
+		FileName:      fileName,
+		FileSize:      fileSize,
+		ScannedAt:     time.Now().UTC(),
+		Malware:       []MalwareFinding{},
+	}
+}
+
+// scanResultJSONSchema describes ScanResult for clients
+const scanResultJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "/schemas/scan-result.json",
+  "title": "ScanResult",
+  "type": "object",
+  "required": ["schema_version", "status", "scan_result_code", "file_size", "scanned_at", "malware", "scan_results", "published"],
+  "properties": {
+    "schema_version": {"const": "1.0"},
+    "status": {"enum": ["clean", "malicious", "skipped_no_key", "skipped_empty", "skipped_too_large", "error", "unscanned"]},
+    "scan_result_code": {
+      "description": "Legacy code: 0 clean, 1 malicious, -1 skipped (no key), -2 error, -3 skipped (empty or too large), -4 unscanned",
+      "enum": [0, 1, -1, -2, -3, -4]
+    },
+    "reason": {"type": "string"},
+    "error": {"type": "string"},
+    "file_name": {"type": "string"},
+    "file_size": {"type": "integer", "minimum": 0},
+    "sha256": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+    "scanner": {"type": "string"},
+    "scanned_at": {"type": "string", "format": "date-time"},
+    "duration_ms": {"type": "integer", "minimum": 0},
+    "cached": {"type": "boolean", "description": "The verdict was reused from an earlier scan of identical content"},
+    "malware": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["fileName", "malwareName"],
+        "properties": {
+          "fileName": {"type": "string"},
+          "malwareName": {"type": "string"}
+        }
+      }
+    },
+    "scan_results": {"type": ["object", "null"], "description": "Legacy scanner response"},
+    "published": {"type": "boolean"},
+    "quarantined": {"type": "boolean"},
+    "quarantine_id": {"type": "string"},
+    "video_id": {"type": "string"},
+    "video_url": {"type": "string"}
+  }
+}
+`
+
+func scanResultSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write([]byte(scanResultJSONSchema))
+}
+
+// parseScannerResult decodes a Vision One format verdict into findings
+func parseScannerResult(raw string) (map[string]interface{}, *int, []MalwareFinding, error) {
+	var resultMap map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &resultMap); err != nil {
+		return nil, nil, nil, err
+	}
+	var parsed struct {
+		ScanResult    *int             `json:"scanResult"`
+		FoundMalwares []MalwareFinding `json:"foundMalwares"`
+	}
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil, nil, nil, err
+	}
+	return resultMap, parsed.ScanResult, parsed.FoundMalwares, nil
+}
+
+// verdictStatus maps a parsed verdict to a status. Found malware or
+// scanResult 1 is malicious and only scanResult 0 is clean; anything else,
+// including a missing scanResult, is an error so the upload is not
+// published.
+func verdictStatus(verdict *int, malware []MalwareFinding) ScanStatus {
+	switch {
+	case len(malware) > 0, verdict != nil && *verdict == 1:
+		return ScanStatusMalicious
+	case verdict != nil && *verdict == 0:
+		return ScanStatusClean
+	default:
+		return ScanStatusError
+	}
+}
+
+// rawVerdictStatus is verdictStatus for a scanner response already decoded
+// into scan_results, as stored in the verdict cache
+func rawVerdictStatus(raw map[string]interface{}, malware []MalwareFinding) ScanStatus {
+	var code int
+	switch v := raw["scanResult"].(type) {
+	case int:
+		code = v
+	case int32:
+		code = int(v)
+	case int64:
+		code = int(v)
+	case float64:
+		code = int(v)
+		if float64(code) != v {
+			return ScanStatusError
+		}
+	default:
+		return verdictStatus(nil, malware)
+	}
+	return verdictStatus(&code, malware)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScanFile writes data to a file in a fresh temporary directory
+func writeScanFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useScanner swaps the process-wide scanner for the length of a test
+func useScanner(t *testing.T, s Scanner) {
+	t.Helper()
+	previous := fileScanner
+	fileScanner = s
+	t.Cleanup(func() { fileScanner = previous })
+}
+
+func TestScanUploadedFileWithFakeScanner(t *testing.T) {
+	useScanner(t, fakeScanner{})
+
+	tests := []struct {
+		name      string
+		data      string
+		status    ScanStatus
+		malware   string
+		transient bool
+	}{
+		{name: "clean", data: "just a video", status: ScanStatusClean},
+		{name: "malicious", data: "prefix " + eicarSignature + " suffix", status: ScanStatusMalicious, malware: "EICAR-Test-File"},
+		{name: "transient", data: "header " + fakeScanErrorMarker, status: ScanStatusError, transient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeScanFile(t, "upload.mp4", []byte(tt.data))
+			result, err := scanUploadedFile(context.Background(), path, int64(len(tt.data)))
+			if tt.transient {
+				if !errors.Is(err, errTransientScan) {
+					t.Fatalf("err = %v, want errTransientScan", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.Status != tt.status {
+				t.Fatalf("status = %q, want %q", result.Status, tt.status)
+			}
+			if result.Code != tt.status.LegacyCode() {
+				t.Errorf("scan_result_code = %d, want %d", result.Code, tt.status.LegacyCode())
+			}
+			if result.Scanner != "fake" {
+				t.Errorf("scanner = %q, want fake", result.Scanner)
+			}
+			switch {
+			case tt.malware != "":
+				if len(result.Malware) != 1 || result.Malware[0].MalwareName != tt.malware {
+					t.Errorf("malware = %+v, want %s", result.Malware, tt.malware)
+				}
+			case len(result.Malware) != 0:
+				t.Errorf("malware = %+v, want none", result.Malware)
+			}
+		})
+	}
+}
+
+func TestScanUploadedFileScannerError(t *testing.T) {
+	useScanner(t, fakeScanner{})
+
+	// The scanner cannot read the file: an error verdict, not worth retrying
+	path := filepath.Join(t.TempDir(), "missing.mp4")
+	result, err := scanUploadedFile(context.Background(), path, 42)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != ScanStatusError || result.Code != -2 {
+		t.Fatalf("status = %q (%d), want error (-2)", result.Status, result.Code)
+	}
+	if result.Reason != "File scan failed" || result.Error == "" {
+		t.Errorf("reason = %q, error = %q", result.Reason, result.Error)
+	}
+}
+
+func TestScanUploadedFileSkips(t *testing.T) {
+	useScanner(t, nil)
+	result, err := scanUploadedFile(context.Background(), "unused.mp4", 10)
+	if err != nil || result.Status != ScanStatusSkippedNoKey {
+		t.Fatalf("no scanner: status = %q, err = %v", result.Status, err)
+	}
+
+	useScanner(t, fakeScanner{})
+	result, err = scanUploadedFile(context.Background(), "unused.mp4", 0)
+	if err != nil || result.Status != ScanStatusSkippedEmpty {
+		t.Fatalf("empty file: status = %q, err = %v", result.Status, err)
+	}
+	result, err = scanUploadedFile(context.Background(), "unused.mp4", maxScanSize+1)
+	if err != nil || result.Status != ScanStatusSkippedTooLarge {
+		t.Fatalf("large file: status = %q, err = %v", result.Status, err)
+	}
+}
+
+func TestVerdictStatus(t *testing.T) {
+	verdict := func(v int) *int { return &v }
+	found := []MalwareFinding{{FileName: "a.mp4", MalwareName: "EICAR-Test-File"}}
+
+	tests := []struct {
+		name    string
+		verdict *int
+		malware []MalwareFinding
+		want    ScanStatus
+	}{
+		{"clean", verdict(0), nil, ScanStatusClean},
+		{"malicious", verdict(1), nil, ScanStatusMalicious},
+		{"findings override a clean verdict", verdict(0), found, ScanStatusMalicious},
+		{"missing verdict", nil, nil, ScanStatusError},
+		{"unknown verdict", verdict(2), nil, ScanStatusError},
+	}
+	for _, tt := range tests {
+		if got := verdictStatus(tt.verdict, tt.malware); got != tt.want {
+			t.Errorf("%s: verdictStatus = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// clamdStub serves the clamd VERSION and INSTREAM commands on a local port.
+// INSTREAM answers with reply and sends the streamed bytes on streamed.
+type clamdStub struct {
+	addr     string
+	reply    string
+	streamed chan []byte
+}
+
+const clamdStubVersion = "ClamAV 1.3.1/27350/Mon Jul 22 08:36:53 2024"
+
+func startClamdStub(t *testing.T, reply string) *clamdStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	stub := &clamdStub{addr: ln.Addr().String(), reply: reply, streamed: make(chan []byte, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (s *clamdStub) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch strings.TrimRight(command, "\x00") {
+	case "zVERSION":
+		conn.Write([]byte(clamdStubVersion + "\x00"))
+	case "zINSTREAM":
+		var data bytes.Buffer
+		var size [4]byte
+		for {
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+				return
+			}
+		}
+		s.streamed <- data.Bytes()
+		conn.Write([]byte(s.reply + "\x00"))
+	}
+}
+
+func TestClamdScannerInstream(t *testing.T) {
+	// Larger than one chunk, so the stream is split
+	content := bytes.Repeat([]byte("0123456789abcdef"), clamdChunkSize/8)
+
+	tests := []struct {
+		name    string
+		reply   string
+		status  ScanStatus
+		malware string
+	}{
+		{name: "ok", reply: "stream: OK", status: ScanStatusClean},
+		{name: "found", reply: "stream: Win.Test.EICAR_HDB-1 FOUND", status: ScanStatusMalicious, malware: "Win.Test.EICAR_HDB-1"},
+		{name: "error", reply: "INSTREAM size limit exceeded. ERROR", status: ScanStatusError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := startClamdStub(t, tt.reply)
+			scanner := &clamdScanner{address: stub.addr, timeout: 10 * time.Second}
+			useScanner(t, scanner)
+			path := writeScanFile(t, "upload.mp4", content)
+
+			result, err := scanUploadedFile(context.Background(), path, int64(len(content)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := <-stub.streamed; !bytes.Equal(got, content) {
+				t.Fatalf("clamd received %d bytes, want %d", len(got), len(content))
+			}
+			if result.Status != tt.status {
+				t.Fatalf("status = %q, want %q (error %q)", result.Status, tt.status, result.Error)
+			}
+			if result.Scanner != "clamav" {
+				t.Errorf("scanner = %q, want clamav", result.Scanner)
+			}
+
+			switch tt.status {
+			case ScanStatusMalicious:
+				if len(result.Malware) != 1 || result.Malware[0].MalwareName != tt.malware {
+					t.Errorf("malware = %+v, want %s", result.Malware, tt.malware)
+				}
+			case ScanStatusClean:
+				if got := result.Raw["scannerVersion"]; got != clamdStubVersion {
+					t.Errorf("scannerVersion = %v, want %q", got, clamdStubVersion)
+				}
+			case ScanStatusError:
+				if !strings.Contains(result.Error, tt.reply) {
+					t.Errorf("error = %q, want it to contain the clamd reply", result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	scanner := &clamdScanner{address: addr, timeout: time.Second}
+	path := writeScanFile(t, "upload.mp4", []byte("data"))
+	if _, err := scanner.ScanFile(context.Background(), path, nil); !errors.Is(err, errScanClient) {
+		t.Fatalf("err = %v, want errScanClient", err)
+	}
+}
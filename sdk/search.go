@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchPageSize = 10
+	maxSearchPageSize     = 50
+	maxSearchCandidates   = 1000
+	maxFacetValues        = 20
+	maxPrefixExpansions   = 5
+	maxTypoCorrections    = 3
+	searchVocabularyTTL   = time.Minute
+	snippetLength         = 160
+)
+
+// searchWeights ranks a match in the title above one in the tags, category
+// or description
+var searchWeights = bson.D{
+	{Key: "title", Value: 10},
+	{Key: "tags", Value: 5},
+	{Key: "category", Value: 3},
+	{Key: "description", Value: 1},
+}
+
+// SearchHighlights marks the query terms in a result with <mark> tags. Text
+// is HTML escaped, so it can be rendered as is.
+type SearchHighlights struct {
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// SearchResult is one video matching a search
+type SearchResult struct {
+	Video      Video            `json:"video"`
+	Score      float64          `json:"score"`
+	Highlights SearchHighlights `json:"highlights"`
+}
+
+// FacetCount is the number of results with a facet value
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// SearchResponse is a page of search results
+type SearchResponse struct {
+	Query       string                  `json:"query"`
+	Total       int                     `json:"total"`
+	Page        int                     `json:"page"`
+	Limit       int                     `json:"limit"`
+	Results     []SearchResult          `json:"results"`
+	Facets      map[string][]FacetCount `json:"facets"`
+	Corrections map[string][]string     `json:"corrections,omitempty"`
+}
+
+// ensureSearchIndex creates the weighted text index over the searchable
+// video fields. A collection has at most one text index.
+func ensureSearchIndex() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keys := bson.D{}
+	for _, field := range searchWeights {
+		keys = append(keys, bson.E{Key: field.Key, Value: "text"})
+	}
+	opts := options.Index().SetName("video_search").SetWeights(searchWeights).SetDefaultLanguage("english")
+	if _, err := db.Collection("videos").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts}); err != nil {
+		log.Printf("Failed to create search index: %v", err)
+	}
+}
+
+// searchTokens splits text into lower case words
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// stemWord strips common English suffixes so that "videos" matches "video"
+func stemWord(word string) string {
+	for _, suffix := range []string{"ies", "ing", "ed", "es", "s"} {
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 {
+			if suffix == "ies" {
+				return word[:len(word)-3] + "y"
+			}
+			return word[:len(word)-len(suffix)]
+		}
+	}
+	return word
+}
+
+// searchVocabulary caches the words of the catalog, which query terms are
+// completed and corrected against
+var searchVocabulary struct {
+	sync.Mutex
+	words    []string // sorted
+	known    map[string]bool
+	loadedAt time.Time
+}
+
+func loadSearchVocabulary(ctx context.Context) ([]string, map[string]bool, error) {
+	searchVocabulary.Lock()
+	defer searchVocabulary.Unlock()
+	if time.Since(searchVocabulary.loadedAt) < searchVocabularyTTL {
+		return searchVocabulary.words, searchVocabulary.known, nil
+	}
+
+	projection := bson.M{"title": 1, "description": 1, "tags": 1, "category": 1}
+	cursor, err := db.Collection("videos").Find(ctx, bson.M{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	known := map[string]bool{}
+	for cursor.Next(ctx) {
+		var video Video
+		if err := cursor.Decode(&video); err != nil {
+			continue
+		}
+		text := strings.Join(append([]string{video.Title, video.Description, video.Category}, video.Tags...), " ")
+		for _, word := range searchTokens(text) {
+			if len(word) >= 2 {
+				known[word] = true
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	words := make([]string, 0, len(known))
+	for word := range known {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	searchVocabulary.words, searchVocabulary.known, searchVocabulary.loadedAt = words, known, time.Now()
+	return words, known, nil
+}
+
+// editDistance is the Levenshtein distance between a and b, or limit+1 once
+// it is known to exceed limit
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if v := prev[j] + 1; v < cur[j] {
+				cur[j] = v
+			}
+			if v := cur[j-1] + 1; v < cur[j] {
+				cur[j] = v
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// searchTerm is a query word with the catalog words it was expanded to
+type searchTerm struct {
+	word        string
+	prefixes    []string // catalog words it is a prefix of
+	corrections []string // catalog words within a small edit distance
+}
+
+// expandSearchTerms completes each query word to catalog words it is a
+// prefix of and, for words not in the catalog, adds likely spellings
+func expandSearchTerms(words []string, vocabulary []string, known map[string]bool) []searchTerm {
+	terms := make([]searchTerm, 0, len(words))
+	for _, word := range words {
+		term := searchTerm{word: word}
+
+		for i := sort.SearchStrings(vocabulary, word); i < len(vocabulary) && strings.HasPrefix(vocabulary[i], word); i++ {
+			if vocabulary[i] != word {
+				term.prefixes = append(term.prefixes, vocabulary[i])
+			}
+		}
+		sort.SliceStable(term.prefixes, func(i, j int) bool { return len(term.prefixes[i]) < len(term.prefixes[j]) })
+		if len(term.prefixes) > maxPrefixExpansions {
+			term.prefixes = term.prefixes[:maxPrefixExpansions]
+		}
+
+		if !known[word] && len(term.prefixes) == 0 && len(word) >= 4 {
+			maxDistance := 1
+			if len(word) >= 8 {
+				maxDistance = 2
+			}
+			type candidate struct {
+				word     string
+				distance int
+			}
+			var candidates []candidate
+			for _, v := range vocabulary {
+				if d := editDistance(word, v, maxDistance); d <= maxDistance {
+					candidates = append(candidates, candidate{v, d})
+				}
+			}
+			sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+			for i := 0; i < len(candidates) && i < maxTypoCorrections; i++ {
+				term.corrections = append(term.corrections, candidates[i].word)
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// matchQuality scores how well a word of the result text matches a term:
+// 1 for the word itself (or the same stem), 0.8 for a completion and 0.6
+// for a spelling correction
+func (t searchTerm) matchQuality(word string) float64 {
+	switch {
+	case word == t.word || stemWord(word) == stemWord(t.word):
+		return 1
+	case strings.HasPrefix(word, t.word):
+		return 0.8
+	}
+	for _, correction := range t.corrections {
+		if word == correction || stemWord(word) == stemWord(correction) {
+			return 0.6
+		}
+	}
+	return 0
+}
+
+// termCoverage is the average best match quality of the terms in a video
+func termCoverage(terms []searchTerm, video *Video) float64 {
+	words := searchTokens(strings.Join(append([]string{video.Title, video.Description, video.Category}, video.Tags...), " "))
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for _, word := range words {
+			if q := term.matchQuality(word); q > best {
+				best = q
+			}
+		}
+		total += best
+	}
+	return total / float64(len(terms))
+}
+
+// highlightText escapes text and wraps the words matching any term in
+// <mark> tags. With window > 0 only about window bytes around the first
+// match are kept.
+func highlightText(text string, terms []searchTerm, window int) (string, bool) {
+	type span struct{ start, end int }
+	var marks []span
+	start := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			word := strings.ToLower(text[start:i])
+			for _, term := range terms {
+				if term.matchQuality(word) > 0 {
+					marks = append(marks, span{start, i})
+					break
+				}
+			}
+			start = -1
+		}
+	}
+	if len(marks) == 0 {
+		return "", false
+	}
+
+	from, to := 0, len(text)
+	if window > 0 && len(text) > window {
+		from = marks[0].start - window/3
+		if from < 0 {
+			from = 0
+		}
+		to = from + window
+		if to > len(text) {
+			to = len(text)
+		}
+		// Cut at spaces so words stay whole
+		if from > 0 {
+			if i := strings.IndexByte(text[from:], ' '); i >= 0 && from+i < marks[0].start {
+				from += i + 1
+			}
+		}
+		if to < len(text) {
+			if i := strings.LastIndexByte(text[:to], ' '); i > from {
+				to = i
+			}
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, m := range marks {
+		if m.start < from || m.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:m.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[m.start:m.end]) + "</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// facetCounts counts the values of a facet over the results, most common
+// first
+func facetCounts(results []SearchResult, values func(*Video) []string) []FacetCount {
+	counts := map[string]int{}
+	for i := range results {
+		seen := map[string]bool{}
+		for _, value := range values(&results[i].Video) {
+			if value != "" && !seen[value] {
+				seen[value] = true
+				counts[value]++
+			}
+		}
+	}
+	facets := make([]FacetCount, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, FacetCount{value, count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	if len(facets) > maxFacetValues {
+		facets = facets[:maxFacetValues]
+	}
+	return facets
+}
+
+// Search videos. q is the query; category (comma separated, any of) and tag
+// (repeatable, all of) narrow the results; page and limit (1-50, default 10)
+// select a page. Results are ranked by the weighted text score scaled by how
+// well the video covers the query's words, and come with highlighted
+// snippets and category and tag facet counts.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handlePreflight(w, r, "GET, OPTIONS")
+		return
+	}
+	setCORSHeaders(w, r)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	var words []string
+	for _, word := range searchTokens(q) {
+		if len(word) >= 2 {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		http.Error(w, "Missing search query q", http.StatusBadRequest)
+		return
+	}
+	if len(words) > 10 {
+		words = words[:10]
+	}
+
+	page, limit := 1, defaultSearchPageSize
+	if value := query.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchPageSize {
+			http.Error(w, fmt.Sprintf("Invalid limit: must be between 1 and %d", maxSearchPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var categories, tags []string
+	if value := query.Get("category"); value != "" {
+		categories = strings.Split(value, ",")
+	}
+	for _, value := range query["tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	vocabulary, known, err := loadSearchVocabulary(ctx)
+	if err != nil {
+		log.Printf("Failed to load search vocabulary: %v", err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	terms := expandSearchTerms(words, vocabulary, known)
+
+	// MongoDB matches any of the words; completions and corrections are
+	// searched alongside the query's own words
+	var search []string
+	corrections := map[string][]string{}
+	for _, term := range terms {
+		search = append(search, term.word)
+		search = append(search, term.prefixes...)
+		search = append(search, term.corrections...)
+		if len(term.corrections) > 0 {
+			corrections[term.word] = term.corrections
+		}
+	}
+
+	opts := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetLimit(maxSearchCandidates)
+	cursor, err := db.Collection("videos").Find(ctx, bson.M{"$text": bson.M{"$search": strings.Join(search, " ")}}, opts)
+	if err != nil {
+		log.Printf("Failed to search videos: %v", err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var candidates []struct {
+		Video `bson:",inline"`
+		Score float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		log.Printf("Failed to decode search results: %v", err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]SearchResult, 0, len(candidates))
+	for _, c := range candidates {
+		score := c.Score * (0.25 + 0.75*termCoverage(terms, &c.Video))
+		results = append(results, SearchResult{Video: c.Video, Score: math.Round(score*1000) / 1000})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Video.Views > results[j].Video.Views
+	})
+
+	// Facets count what each filter would match with the other filters
+	// applied, so the category facet still offers the other categories
+	inCategory := func(v *Video) bool {
+		if len(categories) == 0 {
+			return true
+		}
+		for _, category := range categories {
+			if v.Category == category {
+				return true
+			}
+		}
+		return false
+	}
+	hasTags := func(v *Video) bool {
+		for _, tag := range tags {
+			found := false
+			for _, t := range v.Tags {
+				found = found || t == tag
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	var byTag, filtered []SearchResult
+	for _, result := range results {
+		if hasTags(&result.Video) {
+			byTag = append(byTag, result)
+			if inCategory(&result.Video) {
+				filtered = append(filtered, result)
+			}
+		}
+	}
+
+	response := SearchResponse{
+		Query:   q,
+		Total:   len(filtered),
+		Page:    page,
+		Limit:   limit,
+		Results: []SearchResult{},
+		Facets: map[string][]FacetCount{
+			"category": facetCounts(byTag, func(v *Video) []string { return []string{v.Category} }),
+			"tag":      facetCounts(filtered, func(v *Video) []string { return v.Tags }),
+		},
+	}
+	if len(corrections) > 0 {
+		response.Corrections = corrections
+	}
+
+	if from := (page - 1) * limit; from < len(filtered) {
+		to := from + limit
+		if to > len(filtered) {
+			to = len(filtered)
+		}
+		for _, result := range filtered[from:to] {
+			result.Highlights.Title, _ = highlightText(result.Video.Title, terms, 0)
+			result.Highlights.Description, _ = highlightText(result.Video.Description, terms, snippetLength)
+			for _, tag := range result.Video.Tags {
+				if marked, ok := highlightText(tag, terms, 0); ok {
+					result.Highlights.Tags = append(result.Highlights.Tags, marked)
+				}
+			}
+			response.Results = append(response.Results, result)
+		}
+	}
+
+	var links []string
+	pageLink := func(n int, rel string) {
+		linkQuery := cloneValues(query)
+		linkQuery.Set("page", strconv.Itoa(n))
+		links = append(links, fmt.Sprintf(`</search?%s>; rel="%s"`, linkQuery.Encode(), rel))
+	}
+	if page > 1 {
+		pageLink(page-1, "prev")
+	}
+	if page*limit < len(filtered) {
+		pageLink(page+1, "next")
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(filtered)))
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage key prefixes used by the sdk
+const (
+	incomingPrefix   = "incoming/"   // uploads waiting for a scan verdict
+	videosPrefix     = "videos/"     // published media, served at /media/
+	quarantinePrefix = "quarantine/" // uploads flagged as malicious
+	thumbnailsPrefix = "thumbnails/" // generated thumbnails, one folder per video
+	hlsPrefix        = "hls/"        // HLS playlists and segments, one folder per video
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored blob
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// BlobStore is the storage backend for uploaded media. Keys are slash
+// separated paths such as "videos/<id>.mp4".
+type BlobStore interface {
+	// Put stores the contents of r under key. size is the exact length of r.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error)
+	// Get opens a streaming reader over the object stored under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// GetRange opens a reader over length bytes starting at offset. A negative
+	// length reads to the end of the object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the object; deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat returns the object's metadata or errObjectNotFound.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns every object whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// mediaStore is the process-wide blob store, set up in main
+var mediaStore BlobStore
+
+// newBlobStoreFromEnv selects a backend with STORAGE_BACKEND ("local" or "s3")
+func newBlobStoreFromEnv() (BlobStore, error) {
+	switch backend := strings.ToLower(getEnvOrDefault("STORAGE_BACKEND", "local")); backend {
+	case "local":
+		return newLocalStore(getEnvOrDefault("STORAGE_DIR", "./storage"))
+	case "s3":
+		return newS3StoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// cleanKey rejects keys that are empty or would escape the store
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return cleaned, nil
+}
+
+// contentTypeForKey guesses a content type from the key's extension
+func contentTypeForKey(key string) string {
+	if ct := mime.TypeByExtension(strings.ToLower(path.Ext(key))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// moveObject moves an object between keys, using a rename when the backend
+// supports it
+func moveObject(ctx context.Context, store BlobStore, src, dst string) error {
+	if local, ok := store.(*localStore); ok {
+		return local.rename(src, dst)
+	}
+	if err := copyObject(ctx, store, src, dst); err != nil {
+		return err
+	}
+	return store.Delete(ctx, src)
+}
+
+// copyObject copies an object to another key
+func copyObject(ctx context.Context, store BlobStore, src, dst string) error {
+	r, info, err := store.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = store.Put(ctx, dst, r, info.Size, info.ContentType)
+	return err
+}
+
+// withLocalFile runs fn with a local filesystem path holding the object's
+// contents, downloading it to a temporary file when the backend is remote
+func withLocalFile(ctx context.Context, store BlobStore, key string, fn func(filePath string) error) error {
+	if local, ok := store.(*localStore); ok {
+		filePath, err := local.path(key)
+		if err != nil {
+			return err
+		}
+		return fn(filePath)
+	}
+
+	r, _, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "sdk-*"+path.Ext(key))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return fn(tmp.Name())
+}
+
+// localStore keeps objects as files below a root directory
+type localStore struct {
+	root string
+}
+
+func newLocalStore(root string) (*localStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	log.Printf("Using local blob storage at %s", root)
+	return &localStore{root: root}, nil
+}
+
+func (s *localStore) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localStore) info(key string, fi fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  contentTypeForKey(key),
+		ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime().UTC(),
+	}
+}
+
+func (s *localStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write to a temporary file first so readers never see partial objects
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".put-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && written != size {
+		return ObjectInfo{}, fmt.Errorf("short write for %s: wrote %d of %d bytes", key, written, size)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, errObjectNotFound
+		}
+		return nil, ObjectInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, s.info(key, fi), nil
+}
+
+func (s *localStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	r, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f := r.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, errObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, errObjectNotFound
+	}
+	return s.info(key, fi), nil
+}
+
+func (s *localStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, s.info(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *localStore) rename(src, dst string) error {
+	srcPath, err := s.path(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errObjectNotFound
+		}
+		return err
+	}
+	return nil
+}
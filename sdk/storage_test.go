@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	valid := map[string]string{
+		"videos/a.mp4":  "videos/a.mp4",
+		"/videos/a.mp4": "videos/a.mp4",
+		"a":             "a",
+		"..a/b..":       "..a/b..",
+	}
+	for key, want := range valid {
+		if got, err := cleanKey(key); err != nil || got != want {
+			t.Errorf("cleanKey(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	for _, key := range []string{"", "/", ".", "..", "../a", "a/../../b", "a/../b", "a/./b", "a//b", "a/", "videos/../../etc/passwd"} {
+		if got, err := cleanKey(key); err == nil {
+			t.Errorf("cleanKey(%q) = %q, want an error", key, got)
+		}
+	}
+}
+
+func TestLocalStoreStaysInsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	store, err := newLocalStore(filepath.Join(parent, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := store.Put(ctx, "inside", strings.NewReader("x"), 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../escape", "a/../../escape", "../root-sibling/x"} {
+		if _, err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, _, err := store.Get(ctx, key); err == nil {
+			t.Errorf("Get(%q) succeeded", key)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+		if err := store.rename(key, "inside"); err == nil {
+			t.Errorf("rename(%q, inside) succeeded", key)
+		}
+		if err := store.rename("inside", key); err == nil {
+			t.Errorf("rename(inside, %q) succeeded", key)
+		}
+	}
+	entries, _ := os.ReadDir(parent)
+	if len(entries) != 1 {
+		t.Errorf("files were written next to the root: %v", entries)
+	}
+}
+
+// failingReader returns data and then err
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestLocalStorePutIsAtomic(t *testing.T) {
+	store, err := newLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := "videos/a.mp4"
+	if _, err := store.Put(ctx, key, strings.NewReader("old content"), 11, "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	readBack := func() string {
+		t.Helper()
+		r, _, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		return string(data)
+	}
+
+	// A failed or short write leaves the previous object and no temporary file
+	broken := errors.New("connection reset")
+	if _, err := store.Put(ctx, key, &failingReader{data: "new co", err: broken}, 11, ""); !errors.Is(err, broken) {
+		t.Fatalf("Put with a failing reader: err = %v", err)
+	}
+	if _, err := store.Put(ctx, key, strings.NewReader("new"), 11, ""); err == nil {
+		t.Fatal("short write succeeded")
+	}
+	if got := readBack(); got != "old content" {
+		t.Errorf("content after failed writes = %q", got)
+	}
+	if objects, _ := store.List(ctx, ""); len(objects) != 1 {
+		t.Errorf("List = %v, want only %s", objects, key)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(store.root, "videos", ".put-*")); len(temps) != 0 {
+		t.Errorf("temporary files left behind: %v", temps)
+	}
+
+	info, err := store.Put(ctx, key, strings.NewReader("new content!"), -1, "")
+	if err != nil || info.Size != 12 || readBack() != "new content!" {
+		t.Errorf("Put of unknown size = %+v, %v", info, err)
+	}
+
+	// rename moves the object and reports a missing source as not found
+	if err := store.rename(key, "quarantine/a.bmq"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, key); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("source still there after rename: %v", err)
+	}
+	if info, err := store.Stat(ctx, "quarantine/a.bmq"); err != nil || info.Size != 12 {
+		t.Errorf("renamed object = %+v, %v", info, err)
+	}
+	if err := store.rename(key, "elsewhere"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("rename of a missing object: err = %v", err)
+	}
+}
+
+func TestLocalStoreGetRange(t *testing.T) {
+	store, err := newLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := store.Put(ctx, "a.bin", strings.NewReader("0123456789"), 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		offset, length int64
+		want           string
+	}{{0, 4, "0123"}, {6, -1, "6789"}, {8, 10, "89"}, {3, 0, ""}} {
+		r, err := store.GetRange(ctx, "a.bin", tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+}
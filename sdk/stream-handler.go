@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sniffLength is how many leading bytes http.DetectContentType looks at
+const sniffLength = 512
+
+// blobReadSeeker adapts a stored object to io.ReadSeeker so it can be handed
+// to http.ServeContent. Each seek drops the open reader and the next read
+// opens a ranged reader from the new offset.
+type blobReadSeeker struct {
+	ctx    context.Context
+	store  BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		body, err := b.store.GetRange(b.ctx, b.key, b.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.body = body
+	}
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = b.offset + offset
+	case io.SeekEnd:
+		next = b.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if next < 0 {
+		return 0, errors.New("negative position")
+	}
+	if next != b.offset {
+		b.Close()
+		b.offset = next
+	}
+	return next, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
+
+// blobReaderAt adapts a stored object to io.ReaderAt with one ranged read
+// per call, for parsers that jump around a file
+type blobReaderAt struct {
+	ctx   context.Context
+	store BlobStore
+	key   string
+	size  int64
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > b.size {
+		length = b.size - off
+	}
+	body, err := b.store.GetRange(b.ctx, b.key, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:length])
+	if err == nil && length < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// sniffContentType detects the object's type from its leading bytes, falling
+// back to the stored or extension-derived type when sniffing is inconclusive
+func sniffContentType(ctx context.Context, key string, info ObjectInfo) string {
+	fallback := info.ContentType
+	if fallback == "" || fallback == "application/octet-stream" {
+		fallback = contentTypeForKey(key)
+	}
+
+	head, err := mediaStore.GetRange(ctx, key, 0, sniffLength)
+	if err != nil {
+		return fallback
+	}
+	defer head.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(head, sniffLength))
+	if err != nil || len(buf) == 0 {
+		return fallback
+	}
+	detected := http.DetectContentType(buf)
+	if detected == "application/octet-stream" || strings.HasPrefix(detected, "text/plain") {
+		return fallback
+	}
+	return detected
+}
+
+// serveBlob writes a stored object with Range, If-Range and conditional GET
+// support, delegating the HTTP semantics to http.ServeContent. A Content-Type
+// set by the caller is kept; otherwise it is sniffed.
+func serveBlob(w http.ResponseWriter, r *http.Request, key string) {
+	info, err := mediaStore.Stat(r.Context(), key)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		if errors.Is(err, errObjectNotFound) {
+			http.NotFound(w, r)
+		} else {
+			log.Printf("Failed to stat media %s: %v", key, err)
+			http.Error(w, "Failed to open media", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", sniffContentType(r.Context(), key, info))
+	}
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Length, Content-Range, ETag, Last-Modified")
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+
+	content := &blobReadSeeker{ctx: r.Context(), store: mediaStore, key: key, size: info.Size}
+	defer content.Close()
+	http.ServeContent(w, r, path.Base(key), info.LastModified, content)
+}
+
+// Stream the media of a video with HTTP range support so players can seek
+func streamVideo(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	var video Video
+	err = db.Collection("videos").FindOne(ctx, bson.M{"_id": objectID}).Decode(&video)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find video: %v", err)
+			http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	key, ok := mediaKeyForURL(video.VideoURL)
+	if !ok {
+		http.Error(w, "Video has no stored media", http.StatusNotFound)
+		return
+	}
+	serveBlob(w, r, key)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Thumbnail sizes generated for every video, smallest first. All are 16:9;
+// frames with another aspect ratio are cropped around their centre.
+var thumbnailSizes = []struct {
+	Name string
+	Size image.Point
+}{
+	{"small", image.Pt(160, 90)},
+	{"medium", image.Pt(320, 180)},
+	{"large", image.Pt(640, 360)},
+}
+
+const defaultThumbnailSize = "medium"
+
+var errNoFrame = errors.New("no frame available")
+
+// FrameSource describes the video a thumbnail frame is taken from
+type FrameSource struct {
+	Key      string  // blob store key of the media, empty when there is none
+	Title    string  // video title
+	Duration float64 // seconds, 0 when unknown
+}
+
+// FrameExtractor produces the still image a video's thumbnails are cut from
+type FrameExtractor interface {
+	// Name identifies the extractor in logs.
+	Name() string
+	// ExtractFrame returns a representative frame, or an error wrapping
+	// errNoFrame when the source has none.
+	ExtractFrame(ctx context.Context, src FrameSource) (image.Image, error)
+}
+
+// frameExtractor is the process-wide frame extractor, set up in main
+var frameExtractor FrameExtractor
+
+// newFrameExtractorFromEnv selects an extractor with THUMBNAIL_EXTRACTOR:
+// "ffmpeg", "placeholder", or "auto" (the default) to use ffmpeg when the
+// binary is available
+func newFrameExtractorFromEnv() (FrameExtractor, error) {
+	switch backend := strings.ToLower(getEnvOrDefault("THUMBNAIL_EXTRACTOR", "auto")); backend {
+	case "auto":
+		path, err := findFFmpeg()
+		if err != nil {
+			log.Println("ffmpeg not found; thumbnails will be title placeholders")
+			return placeholderExtractor{}, nil
+		}
+		log.Printf("Using ffmpeg at %s for thumbnails", path)
+		return &ffmpegExtractor{path: path}, nil
+	case "ffmpeg":
+		path, err := findFFmpeg()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using ffmpeg at %s for thumbnails", path)
+		return &ffmpegExtractor{path: path}, nil
+	case "placeholder":
+		log.Println("Using title placeholders for thumbnails")
+		return placeholderExtractor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown THUMBNAIL_EXTRACTOR %q", backend)
+	}
+}
+
+// findFFmpeg locates the ffmpeg binary from FFMPEG_PATH or the PATH
+func findFFmpeg() (string, error) {
+	if path := os.Getenv("FFMPEG_PATH"); path != "" {
+		return exec.LookPath(path)
+	}
+	return exec.LookPath("ffmpeg")
+}
+
+// ffmpegExtractor grabs a frame from the media with the ffmpeg binary
+type ffmpegExtractor struct {
+	path string
+}
+
+func (e *ffmpegExtractor) Name() string { return "ffmpeg" }
+
+func (e *ffmpegExtractor) ExtractFrame(ctx context.Context, src FrameSource) (image.Image, error) {
+	if src.Key == "" {
+		return nil, errNoFrame
+	}
+
+	// Skip intros and fades, but fall back to the first frame for short
+	// clips and media whose duration is unknown
+	offsets := []float64{0}
+	if src.Duration > 1 {
+		offsets = []float64{src.Duration / 10, 0}
+		if offsets[0] > 10 {
+			offsets[0] = 10
+		}
+	}
+
+	var frame image.Image
+	err := withLocalFile(ctx, mediaStore, src.Key, func(filePath string) error {
+		var err error
+		for _, offset := range offsets {
+			if frame, err = e.frameAt(ctx, filePath, offset); err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	return frame, err
+}
+
+// frameAt decodes the first frame at or after offset seconds
+func (e *ffmpegExtractor) frameAt(ctx context.Context, filePath string, offset float64) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.path,
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", filePath,
+		"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("%w at %.3fs", errNoFrame, offset)
+	}
+	return png.Decode(&stdout)
+}
+
+// placeholderPalette holds the background gradients of placeholder
+// thumbnails, picked by a hash of the title
+var placeholderPalette = [][2]color.RGBA{
+	{{0x1e, 0x3a, 0x5f, 0xff}, {0x0b, 0x16, 0x24, 0xff}},
+	{{0x5b, 0x21, 0x4e, 0xff}, {0x22, 0x0c, 0x1d, 0xff}},
+	{{0x1f, 0x5c, 0x4a, 0xff}, {0x0a, 0x22, 0x1b, 0xff}},
+	{{0x6b, 0x3a, 0x14, 0xff}, {0x2a, 0x15, 0x06, 0xff}},
+	{{0x3d, 0x2c, 0x6e, 0xff}, {0x15, 0x0f, 0x29, 0xff}},
+	{{0x6e, 0x1f, 0x24, 0xff}, {0x29, 0x0a, 0x0c, 0xff}},
+	{{0x24, 0x4f, 0x6b, 0xff}, {0x0c, 0x1d, 0x28, 0xff}},
+	{{0x4a, 0x4f, 0x1c, 0xff}, {0x1b, 0x1d, 0x09, 0xff}},
+}
+
+// placeholderExtractor draws the title on a coloured background. It never
+// fails and the same title always gives the same image.
+type placeholderExtractor struct{}
+
+func (placeholderExtractor) Name() string { return "placeholder" }
+
+func (placeholderExtractor) ExtractFrame(ctx context.Context, src FrameSource) (image.Image, error) {
+	size := thumbnailSizes[len(thumbnailSizes)-1].Size
+	img := image.NewRGBA(image.Rectangle{Max: size})
+
+	h := fnv.New32a()
+	h.Write([]byte(src.Title))
+	colors := placeholderPalette[h.Sum32()%uint32(len(placeholderPalette))]
+
+	// Vertical gradient from the top colour to the bottom one
+	for y := 0; y < size.Y; y++ {
+		t := float64(y) / float64(size.Y-1)
+		mix := func(a, b uint8) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t) }
+		c := color.RGBA{mix(colors[0].R, colors[1].R), mix(colors[0].G, colors[1].G), mix(colors[0].B, colors[1].B), 0xff}
+		draw.Draw(img, image.Rect(0, y, size.X, y+1), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+
+	// Centre the wrapped title, with a drop shadow for contrast
+	const scale, lineGap, maxLines = 4, 3, 3
+	margin := size.X / 16
+	lines := wrapTitle(src.Title, (size.X-2*margin+scale)/(glyphAdvance*scale), maxLines)
+	lineHeight := (glyphHeight + lineGap) * scale
+	y := (size.Y - len(lines)*lineHeight + lineGap*scale) / 2
+	shadow := color.RGBA{0, 0, 0, 0x80}
+	for _, line := range lines {
+		x := (size.X - textWidth(line, scale)) / 2
+		drawText(img, image.Pt(x+scale/2, y+scale/2), line, scale, shadow)
+		drawText(img, image.Pt(x, y), line, scale, color.White)
+		y += lineHeight
+	}
+	return img, nil
+}
+
+// wrapTitle breaks a title into at most maxLines lines of width characters,
+// splitting overlong words and ending with "..." when the title is cut short
+func wrapTitle(title string, width, maxLines int) []string {
+	var lines []string
+	var line []rune
+	for _, word := range strings.Fields(title) {
+		w := []rune(word)
+		for len(w) > 0 {
+			switch {
+			case len(line) == 0:
+			case len(line)+1+len(w) <= width:
+				line = append(line, ' ')
+			default:
+				lines = append(lines, string(line))
+				line = nil
+			}
+			n := len(w)
+			if n > width-len(line) {
+				n = width - len(line)
+			}
+			line = append(line, w[:n]...)
+			w = w[n:]
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, string(line))
+	}
+	if len(lines) == 0 {
+		return []string{"UNTITLED"}
+	}
+	if len(lines) > maxLines {
+		last := []rune(lines[maxLines-1])
+		if len(last) > width-3 {
+			last = last[:width-3]
+		}
+		lines = append(lines[:maxLines-1], strings.TrimRight(string(last), " ")+"...")
+	}
+	return lines
+}
+
+// resizeCover scales img to exactly size, cropping the longer side around
+// its centre and averaging the source pixels under each output pixel
+func resizeCover(img image.Image, size image.Point) *image.RGBA {
+	dst := image.NewRGBA(image.Rectangle{Max: size})
+	b := img.Bounds()
+	if b.Empty() {
+		return dst
+	}
+
+	crop := b
+	if b.Dx()*size.Y > b.Dy()*size.X {
+		w := b.Dy() * size.X / size.Y
+		crop.Min.X = b.Min.X + (b.Dx()-w)/2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		h := b.Dx() * size.Y / size.X
+		crop.Min.Y = b.Min.Y + (b.Dy()-h)/2
+		crop.Max.Y = crop.Min.Y + h
+	}
+	if crop.Empty() {
+		crop = b
+	}
+	src := image.NewRGBA(image.Rectangle{Max: crop.Size()})
+	draw.Draw(src, src.Bounds(), img, crop.Min, draw.Src)
+
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	for y := 0; y < size.Y; y++ {
+		y0, y1 := y*sh/size.Y, (y+1)*sh/size.Y
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size.X; x++ {
+			x0, x1 := x*sw/size.X, (x+1)*sw/size.X
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]uint32
+			for sy := y0; sy < y1; sy++ {
+				off := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for i := range sum {
+						sum[i] += uint32(src.Pix[off+i])
+					}
+					off += 4
+				}
+			}
+			n := uint32((y1 - y0) * (x1 - x0))
+			off := dst.PixOffset(x, y)
+			for i := range sum {
+				dst.Pix[off+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// thumbnailKey is the blob store key of a video's thumbnail in a size
+func thumbnailKey(videoID primitive.ObjectID, size string) string {
+	return thumbnailsPrefix + videoID.Hex() + "/" + size + ".jpg"
+}
+
+// generateThumbnails extracts a frame from the video's media and stores it as
+// a JPEG in every thumbnail size. A placeholder is used when the extractor
+// cannot produce a frame.
+func generateThumbnails(ctx context.Context, video *Video) error {
+	src := FrameSource{Title: video.Title, Duration: float64(video.Duration)}
+	if video.Media != nil && video.Media.Duration > 0 {
+		src.Duration = video.Media.Duration
+	}
+	if key, ok := mediaKeyForURL(video.VideoURL); ok {
+		src.Key = key
+	}
+
+	extractor := frameExtractor
+	if extractor == nil {
+		extractor = placeholderExtractor{}
+	}
+	frame, err := extractor.ExtractFrame(ctx, src)
+	if err != nil {
+		if !errors.Is(err, errNoFrame) && !errors.Is(err, errObjectNotFound) {
+			log.Printf("Failed to extract a frame for video %s with %s: %v", video.ID.Hex(), extractor.Name(), err)
+		}
+		extractor = placeholderExtractor{}
+		frame, _ = extractor.ExtractFrame(ctx, src)
+	}
+
+	for _, ts := range thumbnailSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeCover(frame, ts.Size), &jpeg.Options{Quality: 85}); err != nil {
+			return err
+		}
+		if _, err := mediaStore.Put(ctx, thumbnailKey(video.ID, ts.Name), &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+			return fmt.Errorf("cannot store %s thumbnail: %w", ts.Name, err)
+		}
+	}
+	log.Printf("Generated %s thumbnails for video %s", extractor.Name(), video.ID.Hex())
+	return nil
+}
+
+// thumbnailRuns holds the videos whose thumbnails are being generated. The
+// flag is set when the thumbnails were deleted meanwhile, so the run's
+// output is stale and it generates them again.
+var thumbnailRuns = struct {
+	sync.Mutex
+	videos map[primitive.ObjectID]bool
+}{videos: map[primitive.ObjectID]bool{}}
+
+// generateThumbnailsAsync generates thumbnails in the background so that
+// neither publishing nor thumbnail requests wait for ffmpeg. Only one
+// generation runs per video at a time.
+func generateThumbnailsAsync(video Video) {
+	thumbnailRuns.Lock()
+	if _, running := thumbnailRuns.videos[video.ID]; running {
+		thumbnailRuns.Unlock()
+		return
+	}
+	thumbnailRuns.videos[video.ID] = false
+	thumbnailRuns.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		for {
+			if err := generateThumbnails(ctx, &video); err != nil {
+				log.Printf("Failed to generate thumbnails for video %s: %v", video.ID.Hex(), err)
+			}
+
+			thumbnailRuns.Lock()
+			stale := thumbnailRuns.videos[video.ID]
+			if !stale {
+				delete(thumbnailRuns.videos, video.ID)
+				thumbnailRuns.Unlock()
+				return
+			}
+			thumbnailRuns.videos[video.ID] = false
+			thumbnailRuns.Unlock()
+
+			// The video changed or was deleted while the frame was extracted
+			err := db.Collection("videos").FindOne(ctx, bson.M{"_id": video.ID}).Decode(&video)
+			if err != nil {
+				thumbnailRuns.Lock()
+				delete(thumbnailRuns.videos, video.ID)
+				thumbnailRuns.Unlock()
+				deleteThumbnails(ctx, video.ID)
+				return
+			}
+		}
+	}()
+}
+
+// servePlaceholderThumbnail answers with the placeholder thumbnail of a
+// video, which is cheap to draw, while its real thumbnails are generated
+func servePlaceholderThumbnail(w http.ResponseWriter, video *Video, size string) {
+	frame, _ := placeholderExtractor{}.ExtractFrame(context.Background(), FrameSource{Title: video.Title})
+	var buf bytes.Buffer
+	for _, ts := range thumbnailSizes {
+		if ts.Name == size {
+			jpeg.Encode(&buf, resizeCover(frame, ts.Size), &jpeg.Options{Quality: 85})
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// deleteThumbnails removes every stored thumbnail of a video. They are
+// regenerated on the next request.
+func deleteThumbnails(ctx context.Context, videoID primitive.ObjectID) {
+	thumbnailRuns.Lock()
+	if _, running := thumbnailRuns.videos[videoID]; running {
+		thumbnailRuns.videos[videoID] = true
+	}
+	thumbnailRuns.Unlock()
+
+	for _, ts := range thumbnailSizes {
+		key := thumbnailKey(videoID, ts.Name)
+		if err := mediaStore.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete thumbnail %s: %v", key, err)
+		}
+	}
+}
+
+// Serve a video's thumbnail in the size given by ?size= (small, medium or
+// large). Missing thumbnails are generated in the background and a
+// placeholder is served until they are ready.
+func getVideoThumbnail(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = defaultThumbnailSize
+	}
+	var names []string
+	valid := false
+	for _, ts := range thumbnailSizes {
+		names = append(names, ts.Name)
+		valid = valid || ts.Name == size
+	}
+	if !valid {
+		http.Error(w, "Invalid thumbnail size; use one of "+strings.Join(names, ", "), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	var video Video
+	err = db.Collection("videos").FindOne(ctx, bson.M{"_id": objectID}).Decode(&video)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Video not found", http.StatusNotFound)
+		} else {
+			log.Printf("Failed to find video: %v", err)
+			http.Error(w, "Failed to find video", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	key := thumbnailKey(objectID, size)
+	if _, err := mediaStore.Stat(ctx, key); errors.Is(err, errObjectNotFound) {
+		generateThumbnailsAsync(video)
+		servePlaceholderThumbnail(w, &video, size)
+		return
+	}
+	serveBlob(w, r, key)
+}
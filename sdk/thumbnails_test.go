@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// blockingExtractor counts frame extractions and holds each one until
+// release is closed
+type blockingExtractor struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (e *blockingExtractor) Name() string { return "blocking" }
+
+func (e *blockingExtractor) ExtractFrame(ctx context.Context, src FrameSource) (image.Image, error) {
+	e.calls.Add(1)
+	<-e.release
+	return image.NewRGBA(image.Rect(0, 0, 64, 36)), nil
+}
+
+func useFrameExtractor(t *testing.T, e FrameExtractor) {
+	t.Helper()
+	previous := frameExtractor
+	frameExtractor = e
+	t.Cleanup(func() { frameExtractor = previous })
+}
+
+func TestThumbnailMissGeneratesOnceInBackground(t *testing.T) {
+	extractor := &blockingExtractor{release: make(chan struct{})}
+	useFrameExtractor(t, extractor)
+	store := useMediaStore(t)
+
+	videoID := primitive.NewObjectID()
+	video := bson.D{{Key: "_id", Value: videoID}, {Key: "title", Value: "Spotting phishing email"}, {Key: "videoUrl", Value: "/media/a.mp4"}}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("concurrent misses", func(mt *mtest.T) {
+		useMockDB(mt)
+		const requests = 8
+		for i := 0; i < requests; i++ {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, video))
+		}
+
+		// Every request is answered with the placeholder straight away
+		var wg sync.WaitGroup
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				getVideoThumbnail(w, httptest.NewRequest(http.MethodGet, "/videos/x/thumbnail?size=small", nil), videoID.Hex())
+				if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || w.Header().Get("Cache-Control") != "no-store" || w.Body.Len() == 0 {
+					mt.Errorf("miss answered %d %v with %d bytes", w.Code, w.Header(), w.Body.Len())
+				}
+			}()
+		}
+		wg.Wait()
+
+		close(extractor.release)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := store.Stat(context.Background(), thumbnailKey(videoID, "large")); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				mt.Fatal("thumbnails were not generated")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := extractor.calls.Load(); got != 1 {
+			mt.Errorf("extracted %d frames for %d concurrent requests, want 1", got, requests)
+		}
+
+		// Once stored, the generated thumbnail is served
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "boringmedia.videos", mtest.FirstBatch, video))
+		w := httptest.NewRecorder()
+		getVideoThumbnail(w, httptest.NewRequest(http.MethodGet, "/videos/x/thumbnail?size=large", nil), videoID.Hex())
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") == "no-store" || w.Header().Get("ETag") == "" {
+			mt.Errorf("stored thumbnail answered %d %v", w.Code, w.Header())
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FFmpegExecutor runs ffmpeg. progress, if not nil, is called with how much
+// of the input has been processed so far.
+type FFmpegExecutor interface {
+	Run(ctx context.Context, args []string, progress func(processed time.Duration)) error
+}
+
+// hlsTranscoder packages videos for HLS; nil when packaging is disabled
+var hlsTranscoder FFmpegExecutor
+
+// newTranscoderFromEnv sets up HLS packaging with HLS_PACKAGING: "ffmpeg",
+// "off", or "auto" (the default) to package when the ffmpeg binary is found
+func newTranscoderFromEnv() (FFmpegExecutor, error) {
+	switch mode := strings.ToLower(getEnvOrDefault("HLS_PACKAGING", "auto")); mode {
+	case "auto", "ffmpeg":
+		path, err := findFFmpeg()
+		if err != nil {
+			if mode == "auto" {
+				log.Println("ffmpeg not found; HLS packaging is disabled")
+				return nil, nil
+			}
+			return nil, err
+		}
+		log.Printf("Using ffmpeg at %s for HLS packaging", path)
+		return &execFFmpeg{path: path}, nil
+	case "off":
+		log.Println("HLS packaging is disabled")
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown HLS_PACKAGING %q", mode)
+	}
+}
+
+// execFFmpeg runs a local ffmpeg binary and follows its -progress output
+type execFFmpeg struct {
+	path string
+}
+
+func (e *execFFmpeg) Run(ctx context.Context, args []string, progress func(time.Duration)) error {
+	cmd := exec.CommandContext(ctx, e.path, append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Progress is reported as key=value lines; out_time_us is the position
+	// reached in the output (older releases call it out_time_ms)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if progress == nil || (key != "out_time_us" && key != "out_time_ms") {
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			progress(time.Duration(us) * time.Microsecond)
+		}
+	}
+	io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 2000 {
+			msg = "..." + msg[len(msg)-2000:]
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, msg)
+	}
+	return nil
+}
+
+// hlsRendition is one rung of the HLS ladder
+type hlsRendition struct {
+	Name         string
+	Height       int
+	VideoBitrate int // kbit/s
+	AudioBitrate int // kbit/s
+}
+
+// hlsLadder lists the renditions a video may be packaged in, largest first
+var hlsLadder = []hlsRendition{
+	{"1080p", 1080, 5000, 192},
+	{"720p", 720, 2800, 128},
+	{"480p", 480, 1400, 128},
+	{"360p", 360, 800, 96},
+}
+
+const (
+	hlsSegmentSeconds   = 6
+	hlsUnknownMaxHeight = 720 // ladder top when the source resolution is unknown
+)
+
+// hlsRenditionsFor picks the rungs of the ladder that do not upscale the
+// source. Sources smaller than the lowest rung get a single rendition at
+// their own height.
+func hlsRenditionsFor(media *MediaInfo) []hlsRendition {
+	maxHeight := hlsUnknownMaxHeight
+	if media != nil && media.Height > 0 {
+		maxHeight = media.Height
+	}
+
+	var renditions []hlsRendition
+	for _, r := range hlsLadder {
+		if r.Height <= maxHeight {
+			renditions = append(renditions, r)
+		}
+	}
+	if len(renditions) == 0 {
+		r := hlsLadder[len(hlsLadder)-1]
+		r.Height = maxHeight &^ 1
+		r.Name = strconv.Itoa(r.Height) + "p"
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+// hlsHasAudio reports whether to encode an audio stream. Without metadata
+// the audio is left out: mapping a stream a silent video does not have
+// fails the whole encode, while a dropped soundtrack only costs the sound.
+func hlsHasAudio(media *MediaInfo) bool {
+	return media != nil && media.AudioCodec != ""
+}
+
+// hlsArgs builds the ffmpeg arguments that encode input into every
+// rendition at once and write outDir/master.m3u8 with a directory of
+// segments and a media playlist per rendition
+func hlsArgs(input, outDir string, renditions []hlsRendition, hasAudio bool) []string {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v:0]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[s%d]", i)
+	}
+	for i, r := range renditions {
+		fmt.Fprintf(&filter, ";[s%d]scale=-2:%d[v%d]", i, r.Height, i)
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-i", input,
+		"-filter_complex", filter.String()}
+	var streams []string
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%d]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate*3/2))
+		stream := fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			args = append(args,
+				"-map", "0:a:0",
+				fmt.Sprintf("-c:a:%d", i), "aac",
+				fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", r.AudioBitrate))
+			stream += fmt.Sprintf(",a:%d", i)
+		}
+		streams = append(streams, stream+",name:"+r.Name)
+	}
+
+	// Key frames on segment boundaries keep every segment independently
+	// decodable, so players can switch renditions between any two
+	return append(args,
+		"-preset", "veryfast", "-pix_fmt", "yuv420p", "-sc_threshold", "0",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_type", "mpegts",
+		"-hls_segment_filename", filepath.Join(outDir, "%v", "segment_%05d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streams, " "),
+		filepath.Join(outDir, "%v", "index.m3u8"))
+}
+
+// hlsContentType is the Content-Type of an HLS file
+func hlsContentType(name string) string {
+	if strings.HasSuffix(name, ".m3u8") {
+		return "application/vnd.apple.mpegurl"
+	}
+	return "video/mp2t"
+}
+
+// rewritePlaylist passes each URI line of an m3u8 playlist through fn
+func rewritePlaylist(data []byte, fn func(uri string) string) []byte {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		uri := strings.TrimSpace(line)
+		if uri != "" && !strings.HasPrefix(uri, "#") {
+			lines[i] = fn(uri)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// storeHLSOutput uploads the packaged renditions in outDir to the blob store
+// under hls/<videoID>/<version>/ and then switches hls/<videoID>/master.m3u8
+// over to them. Playlists are rewritten so every URI is relative to the
+// served master, and older versions are removed once the switch is made.
+func storeHLSOutput(ctx context.Context, videoID, version, outDir string, renditions []hlsRendition) error {
+	prefix := hlsPrefix + videoID + "/"
+	put := func(key string, data []byte) error {
+		_, err := mediaStore.Put(ctx, key, bytes.NewReader(data), int64(len(data)), hlsContentType(key))
+		return err
+	}
+
+	for _, r := range renditions {
+		dir := filepath.Join(outDir, r.Name)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key := prefix + version + "/" + r.Name + "/" + entry.Name()
+			if entry.Name() == "index.m3u8" {
+				data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					return err
+				}
+				if err := put(key, rewritePlaylist(data, path.Base)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := putFile(ctx, key, filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	master, err := os.ReadFile(filepath.Join(outDir, "master.m3u8"))
+	if err != nil {
+		return err
+	}
+	master = rewritePlaylist(master, func(uri string) string { return version + "/" + uri })
+	if err := put(prefix+"master.m3u8", master); err != nil {
+		return err
+	}
+
+	// Drop renditions of earlier packaging runs
+	objects, err := mediaStore.List(ctx, prefix)
+	if err != nil {
+		log.Printf("Failed to list HLS output of video %s: %v", videoID, err)
+		return nil
+	}
+	for _, obj := range objects {
+		if obj.Key != prefix+"master.m3u8" && !strings.HasPrefix(obj.Key, prefix+version+"/") {
+			mediaStore.Delete(ctx, obj.Key)
+		}
+	}
+	return nil
+}
+
+// putFile uploads a local file as an HLS object
+func putFile(ctx context.Context, key, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = mediaStore.Put(ctx, key, f, fi.Size(), hlsContentType(key))
+	return err
+}
+
+// deleteHLSOutput removes every stored HLS file of a video
+func deleteHLSOutput(ctx context.Context, videoID string) {
+	objects, err := mediaStore.List(ctx, hlsPrefix+videoID+"/")
+	if err != nil {
+		log.Printf("Failed to list HLS output of video %s: %v", videoID, err)
+		return
+	}
+	for _, obj := range objects {
+		if err := mediaStore.Delete(ctx, obj.Key); err != nil {
+			log.Printf("Failed to delete %s: %v", obj.Key, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHLSRenditionsFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		media *MediaInfo
+		want  []string
+	}{
+		{"unknown", nil, []string{"720p", "480p", "360p"}},
+		{"unknown height", &MediaInfo{Width: 1920}, []string{"720p", "480p", "360p"}},
+		{"4k", &MediaInfo{Height: 2160}, []string{"1080p", "720p", "480p", "360p"}},
+		{"1080p", &MediaInfo{Height: 1080}, []string{"1080p", "720p", "480p", "360p"}},
+		{"between rungs", &MediaInfo{Height: 600}, []string{"480p", "360p"}},
+		{"lowest rung", &MediaInfo{Height: 360}, []string{"360p"}},
+		{"below the ladder", &MediaInfo{Height: 240}, []string{"240p"}},
+		{"odd height", &MediaInfo{Height: 145}, []string{"144p"}},
+	}
+	for _, tt := range tests {
+		var names []string
+		for _, r := range hlsRenditionsFor(tt.media) {
+			names = append(names, r.Name)
+			if r.Name != strconv.Itoa(r.Height)+"p" || r.Height%2 != 0 {
+				t.Errorf("%s: rendition %+v", tt.name, r)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: renditions = %v, want %v", tt.name, names, tt.want)
+		}
+	}
+
+	// A source below the ladder keeps the lowest rung's bitrates
+	small := hlsRenditionsFor(&MediaInfo{Height: 240})[0]
+	lowest := hlsLadder[len(hlsLadder)-1]
+	if small.Height != 240 || small.VideoBitrate != lowest.VideoBitrate || small.AudioBitrate != lowest.AudioBitrate {
+		t.Errorf("small rendition = %+v", small)
+	}
+}
+
+func TestHLSHasAudio(t *testing.T) {
+	if hlsHasAudio(nil) {
+		t.Error("unknown media is encoded with audio")
+	}
+	if hlsHasAudio(&MediaInfo{VideoCodec: "h264"}) {
+		t.Error("silent media is encoded with audio")
+	}
+	if !hlsHasAudio(&MediaInfo{VideoCodec: "h264", AudioCodec: "aac"}) {
+		t.Error("audio track is dropped")
+	}
+}
+
+// argValue returns the argument following flag, or "" when flag is absent
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestHLSArgs(t *testing.T) {
+	renditions := hlsRenditionsFor(&MediaInfo{Height: 720})
+	outDir := filepath.Join("tmp", "hls-1")
+
+	for _, hasAudio := range []bool{true, false} {
+		args := hlsArgs("in.mp4", outDir, renditions, hasAudio)
+		joined := strings.Join(args, " ")
+
+		if got := argValue(args, "-i"); got != "in.mp4" {
+			t.Errorf("input = %q", got)
+		}
+		wantFilter := "[0:v:0]split=3[s0][s1][s2];[s0]scale=-2:720[v0];[s1]scale=-2:480[v1];[s2]scale=-2:360[v2]"
+		if got := argValue(args, "-filter_complex"); got != wantFilter {
+			t.Errorf("filter = %q, want %q", got, wantFilter)
+		}
+		for _, want := range []string{"-map [v0] -c:v:0 libx264 -b:v:0 2800k", "-map [v2] -c:v:2 libx264 -b:v:2 800k", "-hls_time 6", "-master_pl_name master.m3u8"} {
+			if !strings.Contains(joined, want) {
+				t.Errorf("audio %v: args lack %q: %s", hasAudio, want, joined)
+			}
+		}
+		if got := argValue(args, "-hls_segment_filename"); got != filepath.Join(outDir, "%v", "segment_%05d.ts") {
+			t.Errorf("segment filename = %q", got)
+		}
+		if got := args[len(args)-1]; got != filepath.Join(outDir, "%v", "index.m3u8") {
+			t.Errorf("output = %q", got)
+		}
+
+		streamMap := argValue(args, "-var_stream_map")
+		if hasAudio {
+			if got := strings.Count(joined, "-map 0:a:0"); got != 3 {
+				t.Errorf("audio mapped %d times, want once per rendition", got)
+			}
+			if !strings.Contains(joined, "-c:a:1 aac -b:a:1 128k") {
+				t.Errorf("args lack the audio encoder: %s", joined)
+			}
+			if streamMap != "v:0,a:0,name:720p v:1,a:1,name:480p v:2,a:2,name:360p" {
+				t.Errorf("stream map = %q", streamMap)
+			}
+		} else {
+			if strings.Contains(joined, "0:a") || strings.Contains(joined, "-c:a") {
+				t.Errorf("video-only args map audio: %s", joined)
+			}
+			if streamMap != "v:0,name:720p v:1,name:480p v:2,name:360p" {
+				t.Errorf("stream map = %q", streamMap)
+			}
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus 1.0.x resumable uploads (https://tus.io/protocols/resumable-upload).
+// Partial uploads are assembled below tusFolder as <id>.bin with a JSON
+// <id>.info sidecar; completed uploads are staged in blob storage and go
+// through the same scan queue as POST /upload.
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,expiration"
+	tusUploadTTL    = 24 * time.Hour
+	tusSweepEvery   = 10 * time.Minute
+	tusOffsetStream = "application/offset+octet-stream"
+)
+
+var (
+	tusFolder  = getEnvOrDefault("TUS_DIR", "./tus")
+	tusMaxSize = int64(maxScanSize) // every upload is scanned, so no larger than the scanner takes
+)
+
+// tusUpload is the persisted state of one resumable upload
+type tusUpload struct {
+	ID        string                 `json:"id"`
+	Length    int64                  `json:"length"`
+	Offset    int64                  `json:"offset"`
+	Metadata  map[string]string      `json:"metadata"`
+	RawMeta   string                 `json:"rawMetadata,omitempty"`
+	Owner     string                 `json:"owner,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+	ExpiresAt time.Time              `json:"expiresAt"`
+	Completed bool                   `json:"completed"`
+	Result    map[string]interface{} `json:"result,omitempty"`
+}
+
+var (
+	tusLocksMu sync.Mutex
+	tusLocks   = map[string]*sync.Mutex{}
+)
+
+// tusLock serializes requests touching the same upload
+func tusLock(id string) *sync.Mutex {
+	tusLocksMu.Lock()
+	defer tusLocksMu.Unlock()
+	lock, ok := tusLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		tusLocks[id] = lock
+	}
+	return lock
+}
+
+func tusForget(id string) {
+	tusLocksMu.Lock()
+	delete(tusLocks, id)
+	tusLocksMu.Unlock()
+}
+
+func tusInfoPath(id string) string { return filepath.Join(tusFolder, id+".info") }
+func tusDataPath(id string) string { return filepath.Join(tusFolder, id+".bin") }
+
+// validTusID reports whether id looks like one generated by newTusID
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func saveTusUpload(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := tusInfoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tusInfoPath(upload.ID))
+}
+
+func removeTusUpload(id string) {
+	os.Remove(tusDataPath(id))
+	os.Remove(tusInfoPath(id))
+	tusForget(id)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs where the value may be omitted
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 value for metadata key %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func setTusHeaders(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Max-Size, Tus-Extension, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires")
+}
+
+func setTusExpires(w http.ResponseWriter, upload *tusUpload) {
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// tusHandler serves the tus collection (/files) and upload resources (/files/{id})
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w, r)
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = strings.ToUpper(override)
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Requested-With, X-HTTP-Method-Override, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/files"), "/")
+
+	// GET is a plain JSON status view for clients that want the scan outcome
+	if method != http.MethodGet && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if id == "" {
+		if method == http.MethodPost {
+			createTusUpload(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if !validTusID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	lock := tusLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := loadTusUpload(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			log.Printf("Failed to load tus upload %s: %v", id, err)
+			http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+		}
+		return
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		removeTusUpload(id)
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+	if !requireOwnerOr(w, r, upload.Owner, roleModerator) {
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.RawMeta != "" {
+			w.Header().Set("Upload-Metadata", upload.RawMeta)
+		}
+		setTusExpires(w, upload)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upload)
+	case http.MethodPatch:
+		patchTusUpload(w, r, upload)
+	case http.MethodDelete:
+		removeTusUpload(id)
+		log.Printf("Terminated tus upload %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createTusUpload implements the creation extension
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > tusMaxSize {
+		http.Error(w, fmt.Sprintf("Upload-Length exceeds Tus-Max-Size of %d bytes", tusMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+	if tusFilename(metadata) == "" {
+		http.Error(w, "Upload-Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+	if violation := uploadPolicyFor("tus").CheckDeclared(tusFilename(metadata), length); violation != nil {
+		log.Printf("tus upload rejected by policy: %s: %s", violation.Code, violation.Message)
+		writePolicyViolation(w, violation)
+		return
+	}
+
+	// The video is published as the caller
+	owner, ok := uploadOwner(w, r, strings.TrimSpace(metadata["uploader"]))
+	if !ok {
+		return
+	}
+	metadata["uploader"] = owner
+
+	id, err := newTusID()
+	if err != nil {
+		log.Printf("Failed to generate tus upload id: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	upload := &tusUpload{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		RawMeta:   r.Header.Get("Upload-Metadata"),
+		Owner:     identityFrom(r).Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(tusUploadTTL),
+	}
+
+	data, err := os.OpenFile(tusDataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to create tus data file: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	data.Close()
+	if err := saveTusUpload(upload); err != nil {
+		os.Remove(tusDataPath(id))
+		log.Printf("Failed to save tus upload: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created tus upload %s (%s, %d bytes)", id, tusFilename(metadata), length)
+
+	// Relative to the request URL so the Location survives path-prefixing proxies
+	location := "files/" + id
+	if strings.HasSuffix(r.URL.Path, "/") {
+		location = id
+	}
+	w.Header().Set("Location", location)
+	setTusExpires(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchTusUpload appends a chunk at Upload-Offset and finishes the upload
+// once every byte has arrived
+func patchTusUpload(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != tusOffsetStream {
+		http.Error(w, "Content-Type must be "+tusOffsetStream, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if upload.Completed || offset != upload.Offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset mismatch: server is at %d", upload.Offset), http.StatusConflict)
+		return
+	}
+
+	data, err := os.OpenFile(tusDataPath(upload.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open tus data file: %v", err)
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	// Drop any bytes past the recorded offset left by an interrupted write
+	if err := data.Truncate(upload.Offset); err == nil {
+		_, err = data.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		data.Close()
+		log.Printf("Failed to position tus data file: %v", err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Keep whatever arrived even if the client disconnects mid-chunk
+	written, copyErr := io.Copy(data, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	closeErr := data.Close()
+	if closeErr != nil {
+		written = 0
+	}
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().UTC().Add(tusUploadTTL)
+	if err := saveTusUpload(upload); err != nil {
+		log.Printf("Failed to save tus upload: %v", err)
+		http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil || closeErr != nil {
+		log.Printf("Tus upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, errors.Join(copyErr, closeErr))
+		http.Error(w, "Failed to write chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		finishTusUpload(r.Context(), upload)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	setTusExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload stages the assembled file in blob storage and queues its
+// scan. The scan job ID is recorded on the upload and exposed by GET /files/{id}.
+func finishTusUpload(ctx context.Context, upload *tusUpload) {
+	filename := filepath.Base(tusFilename(upload.Metadata))
+	key := incomingPrefix + upload.ID + "-" + filename
+
+	result, err := func() (map[string]interface{}, error) {
+		data, err := os.Open(tusDataPath(upload.ID))
+		if err != nil {
+			return nil, err
+		}
+		defer data.Close()
+
+		// The content is only known now, so it is checked against the policy
+		// here; the declared name and size were checked at creation
+		kind, violation := uploadPolicyFor("tus").Check(filename, upload.Length, data)
+		if violation != nil {
+			log.Printf("tus upload %s rejected by policy: %s: %s", upload.ID, violation.Code, violation.Message)
+			return map[string]interface{}{"error": violation.Message, "policy": violation, "published": false}, nil
+		}
+		contentType := upload.Metadata["filetype"]
+		if kind != nil {
+			contentType = kind.MIME
+		}
+
+		digest := sha256.New()
+		if _, err := mediaStore.Put(ctx, key, io.TeeReader(data, digest), upload.Length, contentType); err != nil {
+			return nil, err
+		}
+
+		form := map[string][]string{}
+		for k, v := range upload.Metadata {
+			form[k] = []string{v}
+		}
+		job, err := enqueueScanJob(ctx, key, filename, upload.Length, hex.EncodeToString(digest.Sum(nil)), form)
+		if err != nil {
+			mediaStore.Delete(context.Background(), key)
+			return nil, err
+		}
+		return map[string]interface{}{
+			"job_id":     job.ID.Hex(),
+			"status":     job.Status,
+			"status_url": "/scans/" + job.ID.Hex(),
+		}, nil
+	}()
+	if err != nil {
+		log.Printf("Failed to queue scan for tus upload %s: %v", upload.ID, err)
+		result = map[string]interface{}{"error": err.Error(), "published": false}
+	}
+
+	upload.Completed = true
+	upload.Result = result
+	if err := saveTusUpload(upload); err != nil {
+		log.Printf("Failed to save tus upload result: %v", err)
+	}
+	os.Remove(tusDataPath(upload.ID))
+	log.Printf("Completed tus upload %s (%s)", upload.ID, filename)
+}
+
+// tusFilename returns the client supplied file name from upload metadata
+func tusFilename(metadata map[string]string) string {
+	if name := metadata["filename"]; name != "" {
+		return name
+	}
+	return metadata["name"]
+}
+
+// sweepTusUploads periodically removes expired uploads (expiration extension)
+func sweepTusUploads() {
+	for {
+		entries, err := os.ReadDir(tusFolder)
+		if err != nil {
+			log.Printf("Failed to list tus uploads: %v", err)
+		}
+		for _, entry := range entries {
+			id, ok := strings.CutSuffix(entry.Name(), ".info")
+			if !ok || !validTusID(id) {
+				continue
+			}
+			lock := tusLock(id)
+			lock.Lock()
+			if upload, err := loadTusUpload(id); err == nil && time.Now().After(upload.ExpiresAt) {
+				removeTusUpload(id)
+				log.Printf("Removed expired tus upload %s", id)
+			}
+			lock.Unlock()
+		}
+		time.Sleep(tusSweepEvery)
+	}
+}
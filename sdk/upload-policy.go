@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Upload policies decide which files an endpoint accepts, based on the file's
+// magic bytes rather than its name or the client's Content-Type. Defaults can
+// be overridden per endpoint with a JSON file named by UPLOAD_POLICY_FILE:
+//
+//	{"upload": {"enforce": true, "allow": ["mp4", "webm"], "maxSize": {"mp4": 10485760}}}
+const (
+	sniffHeadSize = 4 << 10
+	sniffTailSize = 64 << 10
+)
+
+// mediaKind is a file format the sniffer recognizes
+type mediaKind struct {
+	Name       string
+	MIME       string
+	Extensions []string
+	match      func(head []byte) bool
+}
+
+var mediaKinds = []mediaKind{
+	{Name: "mp4", MIME: "video/mp4", Extensions: []string{".mp4", ".m4v"}, match: isMP4},
+	{Name: "mov", MIME: "video/quicktime", Extensions: []string{".mov", ".qt"}, match: isQuickTime},
+	{Name: "webm", MIME: "video/webm", Extensions: []string{".webm"}, match: func(head []byte) bool { return ebmlDocType(head) == "webm" }},
+	// WebM is a Matroska profile, so .mkv files may carry either doctype
+	{Name: "mkv", MIME: "video/x-matroska", Extensions: []string{".mkv"}, match: func(head []byte) bool {
+		docType := ebmlDocType(head)
+		return docType == "matroska" || docType == "webm"
+	}},
+	{Name: "jpeg", MIME: "image/jpeg", Extensions: []string{".jpg", ".jpeg"}, match: func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF})
+	}},
+	{Name: "png", MIME: "image/png", Extensions: []string{".png"}, match: func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n"))
+	}},
+	{Name: "gif", MIME: "image/gif", Extensions: []string{".gif"}, match: func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a"))
+	}},
+	{Name: "webp", MIME: "image/webp", Extensions: []string{".webp"}, match: func(head []byte) bool {
+		return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP"
+	}},
+}
+
+// ftypBrands returns the major and compatible brands of an ISO BMFF file
+func ftypBrands(head []byte) (string, []string, bool) {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return "", nil, false
+	}
+	end := int(binary.BigEndian.Uint32(head[:4]))
+	if end > len(head) {
+		end = len(head)
+	}
+	var compatible []string
+	for i := 16; i+4 <= end; i += 4 {
+		compatible = append(compatible, string(head[i:i+4]))
+	}
+	return string(head[8:12]), compatible, true
+}
+
+// isMP4 matches ISO BMFF video; audio-only and HEIF image brands are not video
+func isMP4(head []byte) bool {
+	major, _, ok := ftypBrands(head)
+	if !ok {
+		return false
+	}
+	switch major {
+	case "qt  ", "M4A ", "M4B ", "M4P ", "heic", "heix", "mif1", "msf1", "avif":
+		return false
+	}
+	return true
+}
+
+// isQuickTime matches QuickTime movies, with or without an ftyp box
+func isQuickTime(head []byte) bool {
+	if major, compatible, ok := ftypBrands(head); ok {
+		if major == "qt  " {
+			return true
+		}
+		for _, brand := range compatible {
+			if brand == "qt  " {
+				return true
+			}
+		}
+		return false
+	}
+	if len(head) < 8 {
+		return false
+	}
+	switch string(head[4:8]) {
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// ebmlDocType returns the DocType of an EBML (Matroska/WebM) header
+func ebmlDocType(head []byte) string {
+	if !bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return ""
+	}
+	limit := head
+	if len(limit) > 64 {
+		limit = limit[:64]
+	}
+	i := bytes.Index(limit, []byte{0x42, 0x82})
+	if i < 0 || i+3 > len(limit) || limit[i+2]&0x80 == 0 {
+		return ""
+	}
+	size := int(limit[i+2] & 0x7F)
+	if i+3+size > len(limit) {
+		return ""
+	}
+	return string(limit[i+3 : i+3+size])
+}
+
+// sniffMediaKinds returns every kind whose signature matches
+func sniffMediaKinds(head []byte) []*mediaKind {
+	var kinds []*mediaKind
+	for i := range mediaKinds {
+		if mediaKinds[i].match(head) {
+			kinds = append(kinds, &mediaKinds[i])
+		}
+	}
+	return kinds
+}
+
+func mediaKindByName(name string) *mediaKind {
+	for i := range mediaKinds {
+		if mediaKinds[i].Name == name {
+			return &mediaKinds[i]
+		}
+	}
+	return nil
+}
+
+// polyglotMarkers are signatures of formats that must not hide inside media:
+// markup and scripts a browser might execute, PDFs and embedded archives
+var polyglotMarkers = []struct {
+	name      string
+	signature []byte
+	fold      bool
+}{
+	{"HTML", []byte("<html"), true},
+	{"HTML", []byte("<!doctype html"), true},
+	{"script", []byte("<script"), true},
+	{"SVG", []byte("<svg"), true},
+	{"PHP", []byte("<?php"), true},
+	{"PDF", []byte("%PDF-"), false},
+	{"ZIP", []byte("PK\x03\x04"), false},
+}
+
+// findPolyglot looks for another format inside a file's head, and for a zip
+// central directory at its end (how zip/jar polyglots like GIFAR are built)
+func findPolyglot(head, tail []byte) string {
+	lowered := bytes.ToLower(head)
+	for _, marker := range polyglotMarkers {
+		haystack := head
+		if marker.fold {
+			haystack = lowered
+		}
+		if bytes.Contains(haystack, marker.signature) {
+			return marker.name
+		}
+	}
+	if bytes.Contains(tail, []byte("PK\x05\x06")) {
+		return "ZIP"
+	}
+	return ""
+}
+
+// UploadPolicy is the file acceptance policy of one upload endpoint
+type UploadPolicy struct {
+	// Enforce turns the policy on; a policy that is not enforced accepts anything
+	Enforce bool `json:"enforce"`
+	// Allow lists accepted media kinds: mp4, mov, webm, mkv, jpeg, png, gif, webp
+	Allow []string `json:"allow"`
+	// MaxSize limits the size in bytes per kind; kinds without a limit are
+	// bounded only by the endpoint
+	MaxSize map[string]int64 `json:"maxSize"`
+	// CheckExtension rejects files whose extension does not match their content
+	CheckExtension bool `json:"checkExtension"`
+	// RejectPolyglots rejects files that also contain another format
+	RejectPolyglots bool `json:"rejectPolyglots"`
+
+	endpoint string
+}
+
+// PolicyViolation is the structured error returned for a rejected upload
+type PolicyViolation struct {
+	Status    int      `json:"-"`
+	Code      string   `json:"error"`
+	Message   string   `json:"message"`
+	Policy    string   `json:"policy"`
+	FileName  string   `json:"file_name,omitempty"`
+	Detected  string   `json:"detected,omitempty"`
+	Extension string   `json:"extension,omitempty"`
+	Allowed   []string `json:"allowed,omitempty"`
+	Size      int64    `json:"size,omitempty"`
+	Limit     int64    `json:"limit,omitempty"`
+}
+
+func (v *PolicyViolation) Error() string { return v.Message }
+
+func defaultUploadPolicies() map[string]*UploadPolicy {
+	// Uploads are published as videos; images are only accepted where a
+	// policy file allows them
+	videos := []string{"mp4", "mov", "webm", "mkv"}
+	strict := func(endpoint string) *UploadPolicy {
+		maxSize := map[string]int64{}
+		for _, kind := range videos {
+			maxSize[kind] = maxScanSize
+		}
+		return &UploadPolicy{Enforce: true, Allow: append([]string(nil), videos...), MaxSize: maxSize, CheckExtension: true, RejectPolyglots: true, endpoint: endpoint}
+	}
+	return map[string]*UploadPolicy{
+		"upload": strict("upload"),
+		"tus":    strict("tus"),
+		// The vulnerable demo endpoint deliberately accepts anything
+		"upload-vulnerable": {Enforce: false, endpoint: "upload-vulnerable"},
+	}
+}
+
+var uploadPolicies = defaultUploadPolicies()
+
+// scannedEndpoints are the endpoints whose uploads are scanned before they
+// are published. A file the scanner cannot take would be skipped and
+// discarded, so it is refused up front whatever the policy allows.
+var scannedEndpoints = map[string]bool{"upload": true, "tus": true}
+
+// loadUploadPolicies applies the endpoint policies in UPLOAD_POLICY_FILE, if set
+func loadUploadPolicies() error {
+	path := os.Getenv("UPLOAD_POLICY_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var overrides map[string]*UploadPolicy
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for endpoint, policy := range overrides {
+		if _, ok := uploadPolicies[endpoint]; !ok {
+			return fmt.Errorf("invalid %s: unknown endpoint %q", path, endpoint)
+		}
+		for _, name := range policy.Allow {
+			if mediaKindByName(name) == nil {
+				return fmt.Errorf("invalid %s: unknown media kind %q for %s", path, name, endpoint)
+			}
+		}
+		policy.endpoint = endpoint
+		uploadPolicies[endpoint] = policy
+		log.Printf("Upload policy for %s: enforce=%t allow=%v", endpoint, policy.Enforce, policy.Allow)
+	}
+	return nil
+}
+
+// uploadPolicyFor returns the policy of an endpoint; unknown endpoints get a
+// policy that rejects everything
+func uploadPolicyFor(endpoint string) *UploadPolicy {
+	if policy, ok := uploadPolicies[endpoint]; ok {
+		return policy
+	}
+	return &UploadPolicy{Enforce: true, endpoint: endpoint}
+}
+
+func (p *UploadPolicy) allows(kind string) bool {
+	for _, name := range p.Allow {
+		if name == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// kindsForExtension returns the allowed kinds a file name's extension claims
+func (p *UploadPolicy) kindsForExtension(ext string) []string {
+	var kinds []string
+	for _, name := range p.Allow {
+		if kind := mediaKindByName(name); kind != nil {
+			for _, e := range kind.Extensions {
+				if e == ext {
+					kinds = append(kinds, name)
+				}
+			}
+		}
+	}
+	return kinds
+}
+
+func (p *UploadPolicy) allowedExtensions() []string {
+	var exts []string
+	for _, name := range p.Allow {
+		if kind := mediaKindByName(name); kind != nil {
+			exts = append(exts, kind.Extensions...)
+		}
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// CheckDeclared validates what is known before the content arrives: the
+// file name's extension and the announced size
+func (p *UploadPolicy) CheckDeclared(fileName string, size int64) *PolicyViolation {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if scannedEndpoints[p.endpoint] && size > maxScanSize {
+		return &PolicyViolation{
+			Status:    http.StatusRequestEntityTooLarge,
+			Code:      "exceeds_scan_limit",
+			Message:   fmt.Sprintf("Uploads are scanned and limited to %d bytes", int64(maxScanSize)),
+			Policy:    p.endpoint,
+			FileName:  fileName,
+			Extension: ext,
+			Size:      size,
+			Limit:     maxScanSize,
+		}
+	}
+	if !p.Enforce {
+		return nil
+	}
+	kinds := p.kindsForExtension(ext)
+	if len(kinds) == 0 {
+		return &PolicyViolation{
+			Status:    http.StatusUnsupportedMediaType,
+			Code:      "unsupported_extension",
+			Message:   fmt.Sprintf("Files with extension %q are not accepted", ext),
+			Policy:    p.endpoint,
+			FileName:  fileName,
+			Extension: ext,
+			Allowed:   p.allowedExtensions(),
+		}
+	}
+
+	var limit int64
+	for _, kind := range kinds {
+		if max, ok := p.MaxSize[kind]; !ok || max == 0 {
+			return nil
+		} else if max > limit {
+			limit = max
+		}
+	}
+	if size > limit {
+		return &PolicyViolation{
+			Status:    http.StatusRequestEntityTooLarge,
+			Code:      "file_too_large",
+			Message:   fmt.Sprintf("%s files are limited to %d bytes", strings.Join(kinds, "/"), limit),
+			Policy:    p.endpoint,
+			FileName:  fileName,
+			Extension: ext,
+			Size:      size,
+			Limit:     limit,
+		}
+	}
+	return nil
+}
+
+// Check sniffs the content in r and validates it against the policy. The
+// detected kind is returned when the file is accepted (nil if unenforced).
+func (p *UploadPolicy) Check(fileName string, size int64, r io.ReaderAt) (*mediaKind, *PolicyViolation) {
+	if !p.Enforce {
+		return nil, nil
+	}
+
+	head := make([]byte, sniffHeadSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, &PolicyViolation{Status: http.StatusBadRequest, Code: "unreadable_file", Message: "Cannot read upload", Policy: p.endpoint, FileName: fileName}
+	}
+	head = head[:n]
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	violation := func(status int, code, message string) *PolicyViolation {
+		return &PolicyViolation{
+			Status:    status,
+			Code:      code,
+			Message:   message,
+			Policy:    p.endpoint,
+			FileName:  fileName,
+			Extension: ext,
+			Detected:  http.DetectContentType(head),
+			Allowed:   p.Allow,
+		}
+	}
+
+	var sniffed []string
+	var kind *mediaKind
+	for _, candidate := range sniffMediaKinds(head) {
+		sniffed = append(sniffed, candidate.Name)
+		if kind == nil && p.allows(candidate.Name) {
+			kind = candidate
+		}
+	}
+	if len(sniffed) == 0 {
+		return nil, violation(http.StatusUnsupportedMediaType, "unsupported_media_type", "File content is not a supported video or image format")
+	}
+	if kind == nil {
+		v := violation(http.StatusUnsupportedMediaType, "media_type_not_allowed", fmt.Sprintf("%s files are not accepted here", sniffed[0]))
+		v.Detected = sniffed[0]
+		return nil, v
+	}
+
+	if p.CheckExtension {
+		kind = nil
+		for _, claimed := range p.kindsForExtension(ext) {
+			for _, name := range sniffed {
+				if claimed == name {
+					kind = mediaKindByName(name)
+				}
+			}
+		}
+		if kind == nil {
+			v := violation(http.StatusUnsupportedMediaType, "extension_mismatch", fmt.Sprintf("Extension %q does not match the %s content of the file", ext, sniffed[0]))
+			v.Detected = sniffed[0]
+			return nil, v
+		}
+	}
+
+	if limit, ok := p.MaxSize[kind.Name]; ok && limit > 0 && size > limit {
+		v := violation(http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("%s files are limited to %d bytes", kind.Name, limit))
+		v.Detected = kind.Name
+		v.Allowed = nil
+		v.Size = size
+		v.Limit = limit
+		return nil, v
+	}
+
+	if p.RejectPolyglots {
+		tail := head
+		if size > int64(len(head)) {
+			tailSize := int64(sniffTailSize)
+			if size-int64(len(head)) < tailSize {
+				tailSize = size - int64(len(head))
+			}
+			tail = make([]byte, tailSize)
+			n, err := r.ReadAt(tail, size-tailSize)
+			if err != nil && err != io.EOF {
+				return nil, &PolicyViolation{Status: http.StatusBadRequest, Code: "unreadable_file", Message: "Cannot read upload", Policy: p.endpoint, FileName: fileName}
+			}
+			tail = tail[:n]
+		}
+		if embedded := findPolyglot(head, tail); embedded != "" {
+			v := violation(http.StatusUnsupportedMediaType, "polyglot_file", fmt.Sprintf("The %s file also contains %s content", kind.Name, embedded))
+			v.Detected = kind.Name
+			return nil, v
+		}
+	}
+	return kind, nil
+}
+
+// writePolicyViolation answers with the violation as JSON
+func writePolicyViolation(w http.ResponseWriter, v *PolicyViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(v.Status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultUploadPoliciesAcceptOnlyVideo(t *testing.T) {
+	mp4 := mp4Box("ftyp", []byte("isom"), u32(0), []byte("isomavc1"))
+	files := []struct {
+		name string
+		data []byte
+		code string // empty when accepted
+	}{
+		{"clip.mp4", mp4, ""},
+		{"clip.webm", webmFile(1000), ""},
+		{"clip.mkv", matroskaFile("matroska", nil, nil, 0), ""},
+		{"cat.png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "media_type_not_allowed"},
+		{"cat.jpg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F'}, "media_type_not_allowed"},
+		{"cat.gif", []byte("GIF89a\x01\x00\x01\x00"), "media_type_not_allowed"},
+		{"cat.webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "media_type_not_allowed"},
+		{"cat.mp4", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "media_type_not_allowed"},
+	}
+
+	policies := defaultUploadPolicies()
+	for _, endpoint := range []string{"upload", "tus"} {
+		policy := policies[endpoint]
+		if want := []string{"mp4", "mov", "webm", "mkv"}; !reflect.DeepEqual(policy.Allow, want) {
+			t.Errorf("%s allows %v, want %v", endpoint, policy.Allow, want)
+		}
+		if v := policy.CheckDeclared("cat.png", 100); v == nil {
+			t.Errorf("%s accepted the name cat.png", endpoint)
+		}
+		for _, f := range files {
+			kind, v := policy.Check(f.name, int64(len(f.data)), bytes.NewReader(f.data))
+			switch {
+			case f.code == "" && v != nil:
+				t.Errorf("%s rejected %s: %s", endpoint, f.name, v.Message)
+			case f.code == "" && kind == nil:
+				t.Errorf("%s did not detect %s", endpoint, f.name)
+			case f.code != "" && (v == nil || v.Code != f.code || v.Status != http.StatusUnsupportedMediaType):
+				t.Errorf("%s on %s: violation = %+v, want %s", endpoint, f.name, v, f.code)
+			}
+		}
+	}
+}
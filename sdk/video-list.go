@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultVideoPageSize = 50
+	maxVideoPageSize     = 100
+)
+
+// videoSort is an order GET /videos can list videos in. Ties are broken by
+// _id in the same direction so every video has a stable position.
+type videoSort struct {
+	field string
+	asc   bool
+}
+
+var videoSorts = map[string]videoSort{
+	"newest":     {"uploadDate", false},
+	"oldest":     {"uploadDate", true},
+	"views":      {"views", false},
+	"likes":      {"likes", false},
+	"engagement": {"engagement", false},
+}
+
+// engagementScore is computed for sort=engagement: likes and comments count
+// for a video, dislikes against it
+var engagementScore = bson.M{"$subtract": bson.A{
+	bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$likes", 0}},
+		bson.M{"$ifNull": bson.A{"$commentCount", 0}},
+	}},
+	bson.M{"$ifNull": bson.A{"$dislikes", 0}},
+}}
+
+// videoCursor marks the last video of a page. It is handed out as an opaque
+// base64 token in the after parameter of the next page's link.
+type videoCursor struct {
+	Sort string   `json:"s"`
+	Time *int64   `json:"t,omitempty"` // unix milliseconds, for date sorts
+	Num  *float64 `json:"n,omitempty"` // for numeric sorts
+	ID   string   `json:"id"`
+}
+
+func (c videoCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeVideoCursor(token string) (videoCursor, primitive.ObjectID, error) {
+	var c videoCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+	id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return c, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+	return c, id, nil
+}
+
+// value is the sort key the cursor points after, or nil if it was missing
+func (c videoCursor) value() interface{} {
+	switch {
+	case c.Time != nil:
+		return time.UnixMilli(*c.Time).UTC()
+	case c.Num != nil:
+		return *c.Num
+	}
+	return nil
+}
+
+// cursorAfter builds the cursor for a video from its raw document
+func cursorAfter(sortName string, sort videoSort, doc bson.Raw) videoCursor {
+	c := videoCursor{Sort: sortName}
+	if id, ok := doc.Lookup("_id").ObjectIDOK(); ok {
+		c.ID = id.Hex()
+	}
+	value := doc.Lookup(sort.field)
+	var n float64
+	switch value.Type {
+	case bsontype.DateTime:
+		ms := value.DateTime()
+		c.Time = &ms
+		return c
+	case bsontype.Int32:
+		n = float64(value.Int32())
+	case bsontype.Int64:
+		n = float64(value.Int64())
+	case bsontype.Double:
+		n = value.Double()
+	default:
+		return c
+	}
+	c.Num = &n
+	return c
+}
+
+// afterFilter matches the videos that come after the cursor in sort order.
+// Missing sort keys order before every value, as MongoDB sorts them.
+func afterFilter(sort videoSort, c videoCursor, id primitive.ObjectID) bson.M {
+	cmp := "$lt"
+	if sort.asc {
+		cmp = "$gt"
+	}
+	value := c.value()
+	tie := bson.M{sort.field: value, "_id": bson.M{cmp: id}}
+	if value == nil {
+		if !sort.asc {
+			return tie
+		}
+		return bson.M{"$or": bson.A{bson.M{sort.field: bson.M{"$ne": nil}}, tie}}
+	}
+	return bson.M{"$or": bson.A{bson.M{sort.field: bson.M{cmp: value}}, tie}}
+}
+
+// videoJSONFields lists the JSON names of the Video fields, which are also
+// their document field names
+func videoJSONFields() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Video{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// parseUploadTime accepts an RFC 3339 timestamp or a plain date
+func parseUploadTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// videoListFilter builds the MongoDB filter for the list filters: category
+// (comma separated, any of), tag (repeatable, all of), uploader (username),
+// uploadedAfter and uploadedBefore (RFC 3339 or YYYY-MM-DD), and minViews
+func videoListFilter(query url.Values) (bson.M, error) {
+	filter := bson.M{}
+	if value := query.Get("category"); value != "" {
+		filter["category"] = bson.M{"$in": strings.Split(value, ",")}
+	}
+	var tags []string
+	for _, value := range query["tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) > 0 {
+		filter["tags"] = bson.M{"$all": tags}
+	}
+	if value := query.Get("uploader"); value != "" {
+		filter["uploader.username"] = value
+	}
+
+	uploaded := bson.M{}
+	for param, op := range map[string]string{"uploadedAfter": "$gte", "uploadedBefore": "$lt"} {
+		if value := query.Get(param); value != "" {
+			t, err := parseUploadTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: use RFC 3339 or YYYY-MM-DD", param)
+			}
+			uploaded[op] = t
+		}
+	}
+	if len(uploaded) > 0 {
+		filter["uploadDate"] = uploaded
+	}
+
+	if value := query.Get("minViews"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid minViews: must be a non-negative integer")
+		}
+		filter["views"] = bson.M{"$gte": n}
+	}
+	return filter, nil
+}
+
+// Get a page of videos. Supports the filters of videoListFilter, sort
+// (newest, oldest, views, likes or engagement), limit (1-100, default 50),
+// after (the cursor from the previous page's next link) and fields (a comma
+// separated list of fields to return besides _id). The total number of
+// matching videos is returned in X-Total-Count and the next page in Link.
+func getAllVideos(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := r.URL.Query()
+	filter, err := videoListFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = "newest"
+	}
+	sort, ok := videoSorts[sortName]
+	if !ok {
+		http.Error(w, "Invalid sort: use newest, oldest, views, likes or engagement", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultVideoPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxVideoPageSize {
+			http.Error(w, fmt.Sprintf("Invalid limit: must be between 1 and %d", maxVideoPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var fields []string
+	if value := query.Get("fields"); value != "" {
+		known := videoJSONFields()
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if !known[field] {
+				http.Error(w, fmt.Sprintf("Unknown field %q", field), http.StatusBadRequest)
+				return
+			}
+			fields = append(fields, field)
+		}
+	}
+
+	collection := db.Collection("videos")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Printf("Failed to count videos: %v", err)
+		http.Error(w, "Failed to fetch videos", http.StatusInternalServerError)
+		return
+	}
+
+	direction := -1
+	if sort.asc {
+		direction = 1
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: filter}}}
+	if sort.field == "engagement" {
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{"engagement": engagementScore}}})
+	}
+	if token := query.Get("after"); token != "" {
+		after, id, err := decodeVideoCursor(token)
+		if err != nil || after.Sort != sortName {
+			http.Error(w, "Invalid cursor for this sort", http.StatusBadRequest)
+			return
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: afterFilter(sort, after, id)}})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: sort.field, Value: direction}, {Key: "_id", Value: direction}}}},
+		bson.D{{Key: "$limit", Value: limit + 1}},
+	)
+	if len(fields) > 0 {
+		projection := bson.M{"_id": 1, sort.field: 1}
+		for _, field := range fields {
+			projection[field] = 1
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Printf("Failed to query videos: %v", err)
+		http.Error(w, "Failed to fetch videos", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var docs []bson.Raw
+	if err = cursor.All(ctx, &docs); err != nil {
+		log.Printf("Failed to decode videos: %v", err)
+		http.Error(w, "Failed to decode videos", http.StatusInternalServerError)
+		return
+	}
+
+	// The extra document only tells whether there is a next page
+	var next string
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = cursorAfter(sortName, sort, docs[limit-1]).encode()
+	}
+
+	videos := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		var video Video
+		if err := bson.Unmarshal(doc, &video); err != nil {
+			log.Printf("Failed to decode video: %v", err)
+			http.Error(w, "Failed to decode videos", http.StatusInternalServerError)
+			return
+		}
+		if len(fields) == 0 {
+			videos = append(videos, video)
+			continue
+		}
+		// Keep only the requested fields
+		data, _ := json.Marshal(video)
+		var full map[string]json.RawMessage
+		json.Unmarshal(data, &full)
+		sparse := map[string]json.RawMessage{"_id": full["_id"]}
+		for _, field := range fields {
+			sparse[field] = full[field]
+		}
+		videos = append(videos, sparse)
+	}
+
+	links := []string{}
+	if query.Get("after") != "" {
+		first := cloneValues(query)
+		first.Del("after")
+		links = append(links, fmt.Sprintf(`</videos?%s>; rel="first"`, first.Encode()))
+	}
+	if next != "" {
+		nextQuery := cloneValues(query)
+		nextQuery.Set("after", next)
+		links = append(links, fmt.Sprintf(`</videos?%s>; rel="next"`, nextQuery.Encode()))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(videos)
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := url.Values{}
+	for key, v := range values {
+		clone[key] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// ensureVideoIndexes creates the indexes behind the list sorts and filters
+func ensureVideoIndexes() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := db.Collection("videos").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "views", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "likes", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "category", Value: 1}, {Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "uploader.username", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create video indexes: %v", err)
+	}
+	// checkDuplicateVideo only reads; this makes concurrent writes of the
+	// same title for an uploader fail too
+	_, err = db.Collection("videos").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "uploader.username", Value: 1}, {Key: "title", Value: 1}},
+		Options: options.Index().SetName("uploader_title_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"uploader.username": bson.M{"$gt": ""}}),
+	})
+	if err != nil {
+		log.Printf("Failed to create video title index: %v", err)
+	}
+}
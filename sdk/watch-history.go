@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// A video counts as completed once this share of it has been watched
+	completionThreshold = 0.9
+
+	defaultHistoryLimit  = 50
+	maxHistoryLimit      = 200
+	defaultCoWatchLimit  = 20
+	maxCoWatchLimit      = 100
+	maxCoWatchPeers      = 1000
+	maxCoWatchSeedVideos = 200
+)
+
+// WatchEvent records one viewing session of a video by a user
+type WatchEvent struct {
+	ID             primitive.ObjectID `json:"_id" bson:"_id"`
+	VideoID        primitive.ObjectID `json:"videoId" bson:"videoId"`
+	Username       string             `json:"username" bson:"username"`
+	WatchedSeconds int                `json:"watchedSeconds" bson:"watchedSeconds"`
+	Completed      bool               `json:"completed" bson:"completed"`
+	WatchedAt      time.Time          `json:"watchedAt" bson:"watchedAt"`
+}
+
+// WatchSummary is a user's history with one video, over all sessions
+type WatchSummary struct {
+	VideoID        primitive.ObjectID `json:"videoId" bson:"_id"`
+	WatchedSeconds int                `json:"watchedSeconds" bson:"watchedSeconds"`
+	Completed      bool               `json:"completed" bson:"completed"`
+	Sessions       int                `json:"sessions" bson:"sessions"`
+	LastWatchedAt  time.Time          `json:"lastWatchedAt" bson:"lastWatchedAt"`
+}
+
+// CoWatch is a video completed by users who completed the same videos as
+// someone, with how many such users there are
+type CoWatch struct {
+	VideoID primitive.ObjectID `json:"videoId" bson:"_id"`
+	Users   int                `json:"users" bson:"users"`
+}
+
+func watchEvents() *mongo.Collection {
+	return db.Collection("watch_events")
+}
+
+func ensureWatchIndexes() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := watchEvents().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "watchedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "completed", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create watch event indexes: %v", err)
+	}
+}
+
+// recordWatch stores a watch event: POST /videos/{id}/watch with
+// {"username", "watchedSeconds", "completed"}. Signed-in callers may leave
+// out username and may not name anyone else. completed may be left out, in
+// which case it is worked out from the video's duration.
+func recordWatch(w http.ResponseWriter, r *http.Request, id string) {
+	setCORSHeaders(w, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	videoID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Username       string `json:"username"`
+		WatchedSeconds int    `json:"watchedSeconds"`
+		Completed      *bool  `json:"completed"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if identity := identityFrom(r); identity != nil {
+		if req.Username != "" && req.Username != identity.Username {
+			http.Error(w, "Cannot record watches for another user", http.StatusForbidden)
+			return
+		}
+		req.Username = identity.Username
+	}
+	if req.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if req.WatchedSeconds < 0 {
+		http.Error(w, "watchedSeconds must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var video Video
+	err = db.Collection("videos").FindOne(ctx, bson.M{"_id": videoID},
+		options.FindOne().SetProjection(bson.M{"duration": 1})).Decode(&video)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to find video %s: %v", id, err)
+		http.Error(w, "Failed to record watch", http.StatusInternalServerError)
+		return
+	}
+	err = db.Collection("users").FindOne(ctx, bson.M{"username": req.Username},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to find user %q: %v", req.Username, err)
+		http.Error(w, "Failed to record watch", http.StatusInternalServerError)
+		return
+	}
+
+	event := WatchEvent{
+		ID:             primitive.NewObjectID(),
+		VideoID:        videoID,
+		Username:       req.Username,
+		WatchedSeconds: req.WatchedSeconds,
+		WatchedAt:      time.Now().UTC(),
+	}
+	if video.Duration > 0 && event.WatchedSeconds > video.Duration {
+		// Seeking back and rewatching counts once
+		event.WatchedSeconds = video.Duration
+	}
+	if req.Completed != nil {
+		event.Completed = *req.Completed
+	} else {
+		event.Completed = video.Duration > 0 && float64(event.WatchedSeconds) >= completionThreshold*float64(video.Duration)
+	}
+
+	if _, err := watchEvents().InsertOne(ctx, event); err != nil {
+		log.Printf("Failed to store watch event: %v", err)
+		http.Error(w, "Failed to record watch", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(event)
+}
+
+// queryLimit parses the limit query parameter
+func queryLimit(r *http.Request, fallback, limit int) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > limit {
+		return 0, false
+	}
+	return n, true
+}
+
+// getWatchHistory serves GET /users/{username}/history: the videos the user
+// watched, most recent first, one entry per video
+func getWatchHistory(w http.ResponseWriter, r *http.Request, username string) {
+	setCORSHeaders(w, r)
+	if !requireOwnerOr(w, r, username, roleSecurityAdmin) {
+		return
+	}
+
+	limit, ok := queryLimit(r, defaultHistoryLimit, maxHistoryLimit)
+	if !ok {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	history, err := watchHistory(ctx, username, limit)
+	if err != nil {
+		log.Printf("Failed to aggregate watch history of %q: %v", username, err)
+		http.Error(w, "Failed to fetch watch history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func watchHistory(ctx context.Context, username string, limit int) ([]WatchSummary, error) {
+	cursor, err := watchEvents().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"username": username}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":            "$videoId",
+			"watchedSeconds": bson.M{"$max": "$watchedSeconds"},
+			"completed":      bson.M{"$max": "$completed"},
+			"sessions":       bson.M{"$sum": 1},
+			"lastWatchedAt":  bson.M{"$max": "$watchedAt"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "lastWatchedAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := []WatchSummary{}
+	if err := cursor.All(ctx, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// getCoWatched serves GET /users/{username}/cowatched: videos the user has
+// not watched that were completed by other users who completed a video the
+// user completed, by how many of those users completed them
+func getCoWatched(w http.ResponseWriter, r *http.Request, username string) {
+	setCORSHeaders(w, r)
+	if !requireOwnerOr(w, r, username, roleSecurityAdmin) {
+		return
+	}
+
+	limit, ok := queryLimit(r, defaultCoWatchLimit, maxCoWatchLimit)
+	if !ok {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxCoWatchLimit), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coWatched, err := coWatchedVideos(ctx, username, limit)
+	if err != nil {
+		log.Printf("Failed to aggregate co-watched videos of %q: %v", username, err)
+		http.Error(w, "Failed to fetch co-watched videos", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coWatched)
+}
+
+func coWatchedVideos(ctx context.Context, username string, limit int) ([]CoWatch, error) {
+	history, err := watchHistory(ctx, username, maxHistoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	watched := make([]primitive.ObjectID, 0, len(history))
+	completed := []primitive.ObjectID{}
+	for _, h := range history {
+		watched = append(watched, h.VideoID)
+		if h.Completed && len(completed) < maxCoWatchSeedVideos {
+			completed = append(completed, h.VideoID)
+		}
+	}
+	coWatched := []CoWatch{}
+	if len(completed) == 0 {
+		return coWatched, nil
+	}
+
+	peers, err := watchEvents().Distinct(ctx, "username", bson.M{
+		"videoId":   bson.M{"$in": completed},
+		"completed": true,
+		"username":  bson.M{"$ne": username},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(peers) == 0 {
+		return coWatched, nil
+	}
+	if len(peers) > maxCoWatchPeers {
+		peers = peers[:maxCoWatchPeers]
+	}
+
+	cursor, err := watchEvents().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"username":  bson.M{"$in": peers},
+			"completed": true,
+			"videoId":   bson.M{"$nin": watched},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$videoId", "users": bson.M{"$addToSet": "$username"}}}},
+		{{Key: "$project", Value: bson.M{"users": bson.M{"$size": "$users"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "users", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &coWatched); err != nil {
+		return nil, err
+	}
+	return coWatched, nil
+}
+
+// deleteWatchEvents drops the watch history of a deleted video
+func deleteWatchEvents(ctx context.Context, videoID primitive.ObjectID) {
+	if _, err := watchEvents().DeleteMany(ctx, bson.M{"videoId": videoID}); err != nil {
+		log.Printf("Failed to delete watch events of video %s: %v", videoID.Hex(), err)
+	}
+}
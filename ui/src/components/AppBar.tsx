@@ -15,8 +15,11 @@ import {
   CloudUpload as UploadIcon,
   VideoLibrary as LibraryIcon,
   Search as SearchIcon,
+  Login as LoginIcon,
+  Logout as LogoutIcon,
 } from '@mui/icons-material';
 import { useCart } from '../context/CartContext';
+import { useAuth } from '../context/AuthContext';
 import logo from '../assets/bpclogo.png';
 import { searchService } from '../services/searchService';
 
@@ -26,6 +29,7 @@ const AppBar: React.FC = () => {
   const { getItemCount } = useCart();
   const itemCount = getItemCount();
   const [searchQuery, setSearchQuery] = useState('');
+  const { user, logout } = useAuth();
 
   const handleSearch = async (query: string) => {
     if (!query.trim()) return;
@@ -165,6 +169,25 @@ const AppBar: React.FC = () => {
               </Button>
             );
           })}
+          {user ? (
+            <Button
+              startIcon={<LogoutIcon />}
+              onClick={logout}
+              title={`Signed in as ${user.username}`}
+              sx={{ color: 'rgba(255, 255, 255, 0.8)', fontWeight: 600 }}
+            >
+              <Box sx={{ display: { xs: 'none', md: 'block' } }}>Sign out</Box>
+            </Button>
+          ) : (
+            <Button
+              startIcon={<LoginIcon />}
+              onClick={() => navigate(`/login?returnTo=${encodeURIComponent(location.pathname)}`)}
+              variant={location.pathname === '/login' ? 'contained' : 'text'}
+              sx={{ color: '#FFFFFF', fontWeight: 600 }}
+            >
+              <Box sx={{ display: { xs: 'none', md: 'block' } }}>Sign in</Box>
+            </Button>
+          )}
         </Box>
 
         {/* Mobile Search Icon */}
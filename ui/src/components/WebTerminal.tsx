@@ -2,6 +2,7 @@ import React, { useEffect, useRef } from 'react';
 import { Terminal } from 'xterm';
 import { FitAddon } from 'xterm-addon-fit';
 import 'xterm/css/xterm.css';
+import { terminalApi } from '../services/api';
 
 interface WebTerminalProps {
   initialCommand?: string;
@@ -24,35 +25,50 @@ const WebTerminal: React.FC<WebTerminalProps> = ({ initialCommand }) => {
       fitAddon.fit();
     }
 
-    // Use current host for WebSocket connection (relative to current page)
-    const wsProtocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsHost = window.location.host;
-    const xdrUrl = `${wsProtocol}//${wsHost}/api/xdr/terminal`;
-    const ws = new WebSocket(xdrUrl);
-    ws.binaryType = 'arraybuffer';
-
-    ws.onopen = () => {
-      term.focus();
-      if (initialCommand) {
-        setTimeout(() => {
-          ws.send(initialCommand + '\r\n');
-        }, 500);
+    // The WebSocket needs a fresh single-use ticket for every connection
+    let ws: WebSocket | null = null;
+    let cancelled = false;
+
+    const connect = async () => {
+      let ticket: string;
+      try {
+        ticket = await terminalApi.getTicket();
+      } catch (error) {
+        term.write(`\r\n\x1b[31m*** ${(error as Error).message} ***\x1b[0m\r\n`);
+        return;
       }
+      if (cancelled) return;
+
+      // Use current host for WebSocket connection (relative to current page)
+      const socket = new WebSocket(terminalApi.getUrl(ticket));
+      socket.binaryType = 'arraybuffer';
+      ws = socket;
+
+      socket.onopen = () => {
+        term.focus();
+        if (initialCommand) {
+          setTimeout(() => {
+            socket.send(initialCommand + '\r\n');
+          }, 500);
+        }
+      };
+      socket.onmessage = (e) => term.write(new Uint8Array(e.data));
+      socket.onerror = () => term.write('\r\n\x1b[31m*** connection error ***\x1b[0m\r\n');
+      socket.onclose = () => term.write('\r\n\x1b[31m*** disconnected ***\x1b[0m\r\n');
     };
-    ws.onmessage = (e) => term.write(new Uint8Array(e.data));
-    ws.onerror = () => term.write('\r\n\x1b[31m*** connection error ***\x1b[0m\r\n');
-    ws.onclose = () => term.write('\r\n\x1b[31m*** disconnected ***\x1b[0m\r\n');
+    connect();
 
     term.onData((data: string) => {
-      if (ws.readyState === 1) ws.send(data);
+      if (ws && ws.readyState === 1) ws.send(data);
     });
 
     const handleResize = () => fitAddon.fit();
     window.addEventListener('resize', handleResize);
 
     return () => {
+      cancelled = true;
       window.removeEventListener('resize', handleResize);
-      ws.close();
+      ws?.close();
       term.dispose();
     };
   }, [initialCommand]);
@@ -0,0 +1,70 @@
+import React, { createContext, useContext, useState, useCallback, useEffect, ReactNode } from 'react';
+import {
+  AuthUser,
+  getCurrentUser,
+  login as loginWithPassword,
+  logout as endSession,
+  onAuthChange,
+} from '../services/auth';
+
+interface AuthContextType {
+  user: AuthUser | null;
+  loading: boolean;
+  login: (username: string, password: string) => Promise<void>;
+  logout: () => Promise<void>;
+  hasRole: (...roles: string[]) => boolean;
+}
+
+const AuthContext = createContext<AuthContextType | undefined>(undefined);
+
+export const useAuth = () => {
+  const context = useContext(AuthContext);
+  if (!context) {
+    throw new Error('useAuth must be used within AuthProvider');
+  }
+  return context;
+};
+
+interface AuthProviderProps {
+  children: ReactNode;
+}
+
+export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
+  const [user, setUser] = useState<AuthUser | null>(null);
+  const [loading, setLoading] = useState(true);
+
+  const reload = useCallback(async () => {
+    setUser(await getCurrentUser());
+    setLoading(false);
+  }, []);
+
+  // Follow sign-ins and sign-outs, including single sign-on and refreshes
+  useEffect(() => {
+    reload();
+    return onAuthChange(reload);
+  }, [reload]);
+
+  const login = useCallback(async (username: string, password: string) => {
+    await loginWithPassword(username, password);
+  }, []);
+
+  const logout = useCallback(async () => {
+    await endSession();
+  }, []);
+
+  // Accounts without roles are viewers
+  const hasRole = useCallback(
+    (...roles: string[]) => {
+      if (!user) return false;
+      const have = user.roles?.length ? user.roles : ['viewer'];
+      return roles.some((role) => have.includes(role));
+    },
+    [user]
+  );
+
+  return (
+    <AuthContext.Provider value={{ user, loading, login, logout, hasRole }}>
+      {children}
+    </AuthContext.Provider>
+  );
+};
@@ -0,0 +1,108 @@
+import React, { useEffect, useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { Box, Typography, Button, Alert, Paper, TextField, Divider } from '@mui/material';
+import { Login as LoginIcon } from '@mui/icons-material';
+import { useAuth } from '../context/AuthContext';
+import { consumeSignOnFragment, singleSignOnUrl } from '../services/auth';
+
+// Only paths of this site are followed after sign-in
+const safeReturnTo = (path: string | null) =>
+  path && path.startsWith('/') && !path.startsWith('//') ? path : '/';
+
+const Login: React.FC = () => {
+  const navigate = useNavigate();
+  const [searchParams] = useSearchParams();
+  const { login } = useAuth();
+  const [username, setUsername] = useState('');
+  const [password, setPassword] = useState('');
+  const [submitting, setSubmitting] = useState(false);
+  const [error, setError] = useState<string | null>(null);
+  const returnTo = safeReturnTo(searchParams.get('returnTo'));
+
+  // Single sign-on comes back here with the tokens in the URL fragment
+  useEffect(() => {
+    const result = consumeSignOnFragment();
+    if (result?.error) {
+      setError(result.error);
+    } else if (result) {
+      navigate(safeReturnTo(result.returnTo ?? null), { replace: true });
+    }
+  }, [navigate]);
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setError(null);
+    setSubmitting(true);
+    try {
+      await login(username.trim(), password);
+      navigate(returnTo, { replace: true });
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Sign-in failed');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  return (
+    <Box
+      sx={{
+        minHeight: 'calc(100vh - 64px)',
+        background: 'linear-gradient(135deg, #1a1a1a 0%, #2a2a2a 100%)',
+        display: 'flex',
+        alignItems: 'center',
+        justifyContent: 'center',
+        p: { xs: 2, sm: 3 },
+      }}
+    >
+      <Paper sx={{ p: 4, width: '100%', maxWidth: 420, background: 'rgba(255,255,255,0.05)' }}>
+        <Typography variant="h4" sx={{ fontWeight: 700, mb: 0.5, color: '#f5f1e8' }}>
+          Sign in
+        </Typography>
+        <Typography variant="body2" sx={{ color: 'rgba(245, 241, 232, 0.6)', mb: 3 }}>
+          Uploads, chat and the terminal need an account
+        </Typography>
+
+        {error && (
+          <Alert severity="error" sx={{ mb: 2 }}>
+            {error}
+          </Alert>
+        )}
+
+        <Box component="form" onSubmit={handleSubmit} sx={{ display: 'flex', flexDirection: 'column', gap: 2 }}>
+          <TextField
+            label="Username"
+            autoComplete="username"
+            value={username}
+            onChange={(e) => setUsername(e.target.value)}
+            required
+            fullWidth
+          />
+          <TextField
+            label="Password"
+            type="password"
+            autoComplete="current-password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            required
+            fullWidth
+          />
+          <Button type="submit" variant="contained" startIcon={<LoginIcon />} disabled={submitting}>
+            {submitting ? 'Signing in...' : 'Sign in'}
+          </Button>
+        </Box>
+
+        <Divider sx={{ borderColor: 'rgba(255,255,255,0.1)', my: 3 }}>
+          <Typography variant="caption" sx={{ color: 'rgba(245, 241, 232, 0.6)' }}>
+            or
+          </Typography>
+        </Divider>
+
+        <Button variant="outlined" fullWidth href={singleSignOnUrl(returnTo)}>
+          Sign in with single sign-on
+        </Button>
+      </Paper>
+    </Box>
+  );
+};
+
+export default Login;
@@ -13,6 +13,7 @@ import {
   CloudUpload as UploadIcon,
   CheckCircle as CheckCircleIcon,
 } from '@mui/icons-material';
+import { authFetch } from '../services/auth';
 
 const Submissions: React.FC = () => {
   const [uploadFile, setUploadFile] = useState<File | null>(null);
@@ -56,13 +57,46 @@ const Submissions: React.FC = () => {
       formData.append('file', uploadFile, uploadFile.name);
 
       const endpoint = securityEnabled ? '/api/sdk/upload' : '/api/sdk/upload-vulnerable';
-      const res = await fetch(endpoint, { method: 'POST', body: formData });
+      const res = await authFetch(endpoint, { method: 'POST', body: formData });
       
+      if (res.status === 401) {
+        throw new Error('Sign in to upload videos.');
+      }
       if (!res.ok) {
-        throw new Error(`Upload failed: ${res.status} ${res.statusText}`);
+        // Upload policy rejections (413/415) explain themselves in JSON
+        if (res.headers.get('Content-Type')?.includes('application/json')) {
+          const policy = await res.json();
+          throw new Error(`Upload rejected: ${policy.message}`);
+        }
+        // e.g. "Vulnerable demo mode is disabled"
+        const text = (await res.text()).trim();
+        throw new Error(`Upload failed: ${res.status} ${text || res.statusText}`);
       }
       
-      const json = await res.json();
+      let json = await res.json();
+
+      // Protected uploads are scanned asynchronously: poll the job until it finishes
+      if (res.status === 202 && json.status_url) {
+        setScanResult(json);
+        const statusUrl = `/api/sdk${json.status_url}`;
+        for (;;) {
+          await new Promise((resolve) => setTimeout(resolve, 2000));
+          const statusRes = await authFetch(statusUrl);
+          if (!statusRes.ok) {
+            throw new Error(`Scan status failed: ${statusRes.status} ${statusRes.statusText}`);
+          }
+          const job = await statusRes.json();
+          if (job.status === 'completed') {
+            json = job.result;
+            break;
+          }
+          if (job.status === 'failed') {
+            throw new Error(`Scan failed: ${job.lastError || 'unknown error'}`);
+          }
+          setScanResult(job);
+        }
+      }
+
       setScanResult(json);
     } catch (error) {
       setUploadError(error instanceof Error ? error.message : 'Upload failed');
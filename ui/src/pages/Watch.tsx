@@ -1,4 +1,4 @@
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { useParams, useNavigate } from 'react-router-dom';
 import {
   Box,
@@ -14,6 +14,7 @@ import {
   Dialog,
   DialogTitle,
   DialogContent,
+  Alert,
 } from '@mui/material';
 import {
   ThumbUp as ThumbUpIcon,
@@ -25,6 +26,8 @@ import {
   Close as CloseIcon,
 } from '@mui/icons-material';
 import WebTerminal from '../components/WebTerminal';
+import { useAuth } from '../context/AuthContext';
+import { commentsApi, videoApi, Comment } from '../services/api';
 
 interface Video {
   id: string;
@@ -39,18 +42,10 @@ interface Video {
   category: string;
   description: string;
   uploadDate: string;
-  comments?: Comment[];
 }
 
-interface Comment {
-  id: string;
-  author: string;
-  authorUsername: string;
-  authorAvatar: string;
-  text: string;
-  timestamp: Date | string;
-  likes: number;
-}
+// Uploaded videos have MongoDB ids; only they have comments on the SDK
+const isStoredVideoId = (id?: string): id is string => !!id && /^[0-9a-f]{24}$/i.test(id);
 
 const formatTimestamp = (timestamp: Date | string): string => {
   const date = new Date(timestamp);
@@ -78,27 +73,7 @@ const allVideos: Video[] = [
     duration: '5:42',
     category: 'Security',
     description: 'Learn how to prioritize security threats effectively. This video covers essential techniques for identifying and addressing the most critical security issues in your organization.',
-    uploadDate: '3 days ago',
-    comments: [
-      {
-        id: 'c1',
-        author: 'Sarah Chen',
-        authorUsername: 'cybersafetyexpert',
-        authorAvatar: 'https://via.placeholder.com/40/4CAF50/FFFFFF?text=SC',
-        text: 'Great overview! I use similar prioritization frameworks in my security assessments.',
-        timestamp: new Date('2024-01-16'),
-        likes: 23
-      },
-      {
-        id: 'c2',
-        author: 'Marcus Thompson',
-        authorUsername: 'devopsguru',
-        authorAvatar: 'https://via.placeholder.com/40/FF9800/FFFFFF?text=MT',
-        text: 'This aligns perfectly with the OWASP Top 10. Excellent explanation!',
-        timestamp: new Date('2024-01-17'),
-        likes: 15
-      }
-    ]
+    uploadDate: '3 days ago'
   },
   {
     id: '2',
@@ -111,27 +86,7 @@ const allVideos: Video[] = [
     duration: '4:38',
     category: 'Security',
     description: 'Comprehensive guide to mitigating security risks. Explore best practices and proven strategies for reducing vulnerabilities in your systems.',
-    uploadDate: '1 week ago',
-    comments: [
-      {
-        id: 'c3',
-        author: 'Alex Rivera',
-        authorUsername: 'cloudarchitect',
-        authorAvatar: 'https://via.placeholder.com/40/2196F3/FFFFFF?text=AR',
-        text: 'Great strategies! Have you tried implementing any of these in AWS/Azure environments?',
-        timestamp: new Date('2024-01-09'),
-        likes: 12
-      },
-      {
-        id: 'c4',
-        author: 'Emily Wang',
-        authorUsername: 'securityresearcher',
-        authorAvatar: 'https://via.placeholder.com/40/9C27B0/FFFFFF?text=EW',
-        text: 'The threat modeling approach here is spot on. Thanks for sharing!',
-        timestamp: new Date('2024-01-10'),
-        likes: 19
-      }
-    ]
+    uploadDate: '1 week ago'
   },
   {
     id: '3',
@@ -144,27 +99,7 @@ const allVideos: Video[] = [
     duration: '6:15',
     category: 'Security',
     description: 'Visualizing security risks effectively. Learn how to create compelling dashboards and reports that make complex security data easy to understand.',
-    uploadDate: '2 weeks ago',
-    comments: [
-      {
-        id: 'c5',
-        author: 'DataDefender',
-        authorUsername: 'datadefender',
-        authorAvatar: 'https://via.placeholder.com/40/2196F3/FFFFFF?text=DD',
-        text: 'The visualization tools are impressive! Which library did you use for the charts?',
-        timestamp: new Date('2024-01-05'),
-        likes: 12
-      },
-      {
-        id: 'c6',
-        author: 'Marcus Thompson',
-        authorUsername: 'devopsguru',
-        authorAvatar: 'https://via.placeholder.com/40/FF9800/FFFFFF?text=MT',
-        text: 'I implemented something similar in Grafana. This approach is way better!',
-        timestamp: new Date('2024-01-06'),
-        likes: 8
-      }
-    ]
+    uploadDate: '2 weeks ago'
   },
   {
     id: '4',
@@ -177,27 +112,7 @@ const allVideos: Video[] = [
     duration: '6:28',
     category: 'Security',
     description: 'Being proactive in security management. Discover how to stay ahead of threats and implement preventative measures before issues arise.',
-    uploadDate: '3 weeks ago',
-    comments: [
-      {
-        id: 'c7',
-        author: 'ResilientSec',
-        authorUsername: 'resilientsec',
-        authorAvatar: 'https://via.placeholder.com/40/FF4081/FFFFFF?text=RS',
-        text: 'Crucial information for modern security teams. Planning to implement this architecture!',
-        timestamp: new Date('2024-01-01'),
-        likes: 8
-      },
-      {
-        id: 'c8',
-        author: 'James Mitchell',
-        authorUsername: 'pentesterpro',
-        authorAvatar: 'https://via.placeholder.com/40/E91E63/FFFFFF?text=JM',
-        text: 'The proactive defense model you outlined is exactly what I advise clients. Well explained!',
-        timestamp: new Date('2024-01-02'),
-        likes: 14
-      }
-    ]
+    uploadDate: '3 weeks ago'
   },
 ];
 
@@ -221,6 +136,45 @@ const Watch: React.FC = () => {
   const [dislikes, setDislikes] = useState(video?.dislikes || 0);
   const [terminalOpen, setTerminalOpen] = useState(false);
   const [commentText, setCommentText] = useState('');
+  const { user } = useAuth();
+  const hasComments = isStoredVideoId(id);
+  const [commentCount, setCommentCount] = useState(0);
+  const [comments, setComments] = useState<Comment[]>([]);
+  const [nextComments, setNextComments] = useState<string | null>(null);
+  const [replies, setReplies] = useState<Record<string, Comment[]>>({});
+  const [replyTo, setReplyTo] = useState<Comment | null>(null);
+  const [likedComments, setLikedComments] = useState<Set<string>>(new Set());
+  const [commentError, setCommentError] = useState<string | null>(null);
+  const [posting, setPosting] = useState(false);
+
+  // commentCount covers comments and replies; the list is top-level only
+  useEffect(() => {
+    setComments([]);
+    setNextComments(null);
+    setReplies({});
+    setReplyTo(null);
+    setCommentCount(0);
+    setCommentError(null);
+    if (!isStoredVideoId(id)) return;
+
+    let cancelled = false;
+    videoApi.getVideo(id).then((stored) => {
+      if (!cancelled && stored) setCommentCount(stored.commentCount ?? 0);
+    });
+    commentsApi
+      .list(id, { sort: 'newest' })
+      .then((page) => {
+        if (cancelled) return;
+        setComments(page.comments);
+        setNextComments(page.next);
+      })
+      .catch((err) => {
+        if (!cancelled) setCommentError(err instanceof Error ? err.message : 'Failed to load comments');
+      });
+    return () => {
+      cancelled = true;
+    };
+  }, [id]);
 
   if (!video) {
     return (
@@ -259,16 +213,144 @@ const Watch: React.FC = () => {
     }
   };
 
-  const handleCommentSubmit = (e: React.FormEvent) => {
+  const requireSignIn = () => {
+    if (user) return true;
+    navigate(`/login?returnTo=${encodeURIComponent(`/watch/${id}`)}`);
+    return false;
+  };
+
+  const loadMoreComments = async () => {
+    if (!isStoredVideoId(id) || !nextComments) return;
+    try {
+      const page = await commentsApi.list(id, { sort: 'newest', after: nextComments });
+      setComments((current) => [...current, ...page.comments]);
+      setNextComments(page.next);
+    } catch (err) {
+      setCommentError(err instanceof Error ? err.message : 'Failed to load comments');
+    }
+  };
+
+  const loadReplies = async (parent: Comment) => {
+    if (!isStoredVideoId(id)) return;
+    try {
+      const page = await commentsApi.list(id, { parentId: parent._id, sort: 'oldest', limit: 100 });
+      setReplies((current) => ({ ...current, [parent._id]: page.comments }));
+    } catch (err) {
+      setCommentError(err instanceof Error ? err.message : 'Failed to load replies');
+    }
+  };
+
+  const updateComment = (commentId: string, update: (comment: Comment) => Comment) => {
+    setComments((current) => current.map((c) => (c._id === commentId ? update(c) : c)));
+    setReplies((current) =>
+      Object.fromEntries(
+        Object.entries(current).map(([parentId, list]) => [
+          parentId,
+          list.map((c) => (c._id === commentId ? update(c) : c)),
+        ])
+      )
+    );
+  };
+
+  const handleCommentLike = async (comment: Comment) => {
+    if (!isStoredVideoId(id) || !requireSignIn()) return;
+    const like = !likedComments.has(comment._id);
+    try {
+      const result = await commentsApi.setLiked(id, comment._id, like);
+      setLikedComments((current) => {
+        const updated = new Set(current);
+        if (result.liked) updated.add(comment._id);
+        else updated.delete(comment._id);
+        return updated;
+      });
+      updateComment(comment._id, (c) => ({ ...c, likes: result.likes }));
+    } catch (err) {
+      setCommentError(err instanceof Error ? err.message : 'Failed to like comment');
+    }
+  };
+
+  const handleCommentSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
-    if (commentText.trim()) {
-      // Trigger terminal popup when user tries to comment
+    const text = commentText.trim();
+    if (!text) return;
+    if (!isStoredVideoId(id)) {
+      // The bundled videos are not stored on the SDK, so their comment box
+      // opens the terminal instead
       setTerminalOpen(true);
-      console.log('Comment submitted:', commentText);
-      // In a real scenario, this would send the comment to the backend
+      return;
+    }
+    if (!requireSignIn() || posting) return;
+
+    setPosting(true);
+    setCommentError(null);
+    try {
+      const created = await commentsApi.create(id, text, replyTo?._id);
+      if (replyTo) {
+        setReplies((current) => ({ ...current, [replyTo._id]: [...(current[replyTo._id] ?? []), created] }));
+        updateComment(replyTo._id, (c) => ({ ...c, replies: c.replies + 1 }));
+      } else {
+        setComments((current) => [created, ...current]);
+      }
+      setCommentCount((count) => count + 1);
+      setCommentText('');
+      setReplyTo(null);
+    } catch (err) {
+      setCommentError(err instanceof Error ? err.message : 'Failed to post comment');
+    } finally {
+      setPosting(false);
     }
   };
 
+  const renderComment = (comment: Comment, isReply = false) => (
+    <Box key={comment._id} sx={{ display: 'flex', gap: 2 }}>
+      <Avatar src={comment.authorAvatar} sx={{ width: isReply ? 32 : 40, height: isReply ? 32 : 40 }}>
+        {comment.author?.[0]}
+      </Avatar>
+      <Box sx={{ flex: 1 }}>
+        <Typography variant="subtitle2" sx={{ color: '#f5f1e8' }}>
+          {comment.deleted ? 'Deleted comment' : comment.author} • {formatTimestamp(comment.timestamp)}
+          {comment.editedAt && ' (edited)'}
+        </Typography>
+        <Typography variant="body2" sx={{ color: 'rgba(245, 241, 232, 0.8)', mt: 0.5 }}>
+          {comment.deleted ? 'This comment was deleted.' : comment.text}
+        </Typography>
+        {!comment.deleted && (
+          <Box sx={{ display: 'flex', alignItems: 'center', gap: 2, mt: 1 }}>
+            <IconButton
+              size="small"
+              onClick={() => handleCommentLike(comment)}
+              sx={{ color: likedComments.has(comment._id) ? '#2196F3' : 'rgba(255,255,255,0.6)' }}
+            >
+              <ThumbUpIcon sx={{ fontSize: 16 }} />
+            </IconButton>
+            <Typography variant="caption" sx={{ color: 'rgba(255,255,255,0.6)' }}>
+              {comment.likes || 0}
+            </Typography>
+            {!isReply && (
+              <IconButton
+                size="small"
+                onClick={() => setReplyTo(comment)}
+                sx={{ color: 'rgba(255,255,255,0.6)' }}
+              >
+                <ReplyIcon sx={{ fontSize: 16 }} />
+              </IconButton>
+            )}
+          </Box>
+        )}
+        {!isReply && comment.replies > 0 && !replies[comment._id] && (
+          <Button size="small" onClick={() => loadReplies(comment)} sx={{ mt: 0.5, px: 0 }}>
+            {comment.replies} {comment.replies === 1 ? 'reply' : 'replies'}
+          </Button>
+        )}
+        {replies[comment._id] && (
+          <Stack spacing={2} sx={{ mt: 2 }}>
+            {replies[comment._id].map((reply) => renderComment(reply, true))}
+          </Stack>
+        )}
+      </Box>
+    </Box>
+  );
+
   return (
     <Box
       sx={{
@@ -382,20 +464,40 @@ const Watch: React.FC = () => {
 
             {/* Comments Section */}
             <Typography variant="h6" sx={{ color: '#f5f1e8', mb: 2 }}>
-              {video.comments?.length || 0} Comments
+              {commentCount} {commentCount === 1 ? 'Comment' : 'Comments'}
             </Typography>
 
+            {commentError && (
+              <Alert severity="error" onClose={() => setCommentError(null)} sx={{ mb: 2 }}>
+                {commentError}
+              </Alert>
+            )}
+
+            {replyTo && (
+              <Box sx={{ display: 'flex', alignItems: 'center', gap: 1, mb: 1, ml: 7 }}>
+                <Typography variant="caption" sx={{ color: 'rgba(245, 241, 232, 0.7)' }}>
+                  Replying to {replyTo.author}
+                </Typography>
+                <IconButton size="small" onClick={() => setReplyTo(null)} sx={{ color: 'rgba(255,255,255,0.6)' }}>
+                  <CloseIcon sx={{ fontSize: 14 }} />
+                </IconButton>
+              </Box>
+            )}
+
             <Box 
               component="form" 
               onSubmit={handleCommentSubmit}
               sx={{ display: 'flex', gap: 2, mb: 3 }}
             >
-              <Avatar sx={{ width: 40, height: 40 }}>Y</Avatar>
+              <Avatar src={user?.avatar} sx={{ width: 40, height: 40 }}>
+                {(user?.name || user?.username || 'Y')[0]}
+              </Avatar>
               <TextField
                 fullWidth
-                placeholder="Add a comment..."
+                placeholder={replyTo ? 'Add a reply...' : 'Add a comment...'}
                 variant="outlined"
                 value={commentText}
+                disabled={posting}
                 onChange={(e) => setCommentText(e.target.value)}
                 onKeyDown={(e) => {
                   if (e.key === 'Enter' && !e.shiftKey) {
@@ -416,41 +518,18 @@ const Watch: React.FC = () => {
 
             {/* Comments from MongoDB */}
             <Stack spacing={2}>
-              {video.comments && video.comments.length > 0 ? (
-                video.comments.map((comment: any, index: number) => (
-                  <Box key={comment.id || index} sx={{ display: 'flex', gap: 2 }}>
-                    <Avatar 
-                      src={comment.authorAvatar} 
-                      sx={{ width: 40, height: 40 }}
-                    >
-                      {comment.author[0]}
-                    </Avatar>
-                    <Box sx={{ flex: 1 }}>
-                      <Typography variant="subtitle2" sx={{ color: '#f5f1e8' }}>
-                        {comment.author} • {formatTimestamp(comment.timestamp)}
-                      </Typography>
-                      <Typography variant="body2" sx={{ color: 'rgba(245, 241, 232, 0.8)', mt: 0.5 }}>
-                        {comment.text}
-                      </Typography>
-                      <Box sx={{ display: 'flex', gap: 2, mt: 1 }}>
-                        <IconButton size="small" sx={{ color: 'rgba(255,255,255,0.6)' }}>
-                          <ThumbUpIcon sx={{ fontSize: 16 }} />
-                        </IconButton>
-                        <Typography variant="caption" sx={{ color: 'rgba(255,255,255,0.6)' }}>
-                          {comment.likes || 0}
-                        </Typography>
-                        <IconButton size="small" sx={{ color: 'rgba(255,255,255,0.6)' }}>
-                          <ReplyIcon sx={{ fontSize: 16 }} />
-                        </IconButton>
-                      </Box>
-                    </Box>
-                  </Box>
-                ))
+              {comments.length > 0 ? (
+                comments.map((comment) => renderComment(comment))
               ) : (
                 <Typography variant="body2" sx={{ color: 'rgba(245, 241, 232, 0.6)', textAlign: 'center', py: 4 }}>
-                  No comments yet. Be the first to comment!
+                  {hasComments ? 'No comments yet. Be the first to comment!' : 'Comments are available on uploaded videos.'}
                 </Typography>
               )}
+              {nextComments && (
+                <Button onClick={loadMoreComments} sx={{ alignSelf: 'center' }}>
+                  Show more comments
+                </Button>
+              )}
             </Stack>
           </Box>
 
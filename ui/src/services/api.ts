@@ -1,4 +1,5 @@
 // API Service Layer for Backend Communication
+import { authFetch } from './auth';
 
 export interface ApiResponse<T = any> {
   success: boolean;
@@ -20,7 +21,7 @@ export interface ChatResponse {
 
 export const chatApi = {
   sendMessage: async (message: string, securityEnabled: boolean): Promise<ChatResponse> => {
-    const response = await fetch('/api/chat/chat', {
+    const response = await authFetch('/api/chat/chat', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
@@ -28,9 +29,12 @@ export const chatApi = {
       body: JSON.stringify({ message, securityEnabled }),
     });
 
+    if (response.status === 401) {
+      throw new Error('Sign in to chat.');
+    }
     if (!response.ok) {
       const error = await response.json();
-      throw new Error(error.response || 'Failed to send message');
+      throw new Error(error.response || error.error || 'Failed to send message');
     }
 
     return response.json();
@@ -56,7 +60,7 @@ export const uploadApi = {
     formData.append('file', file, filename);
 
     const endpoint = protectedUpload ? '/api/sdk/upload' : '/api/sdk/upload-vulnerable';
-    const response = await fetch(endpoint, {
+    const response = await authFetch(endpoint, {
       method: 'POST',
       body: formData,
     });
@@ -73,12 +77,28 @@ export const uploadApi = {
  * Terminal API Service (WebSocket)
  */
 export const terminalApi = {
-  createConnection: (onMessage: (data: ArrayBuffer) => void) => {
+  // A single-use ticket for the terminal WebSocket, issued to security admins
+  // for the caller's access token
+  getTicket: async (): Promise<string> => {
+    const response = await authFetch('/api/xdr/terminal/ticket', { method: 'POST' });
+    if (response.status === 401) {
+      throw new Error('Sign in at /login to use the terminal');
+    }
+    if (!response.ok) {
+      throw new Error(response.status === 403 ? 'The terminal is for security admins' : 'Failed to get a terminal ticket');
+    }
+    const data = await response.json();
+    return data.ticket;
+  },
+
+  getUrl: (ticket: string) => {
     const wsProtocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
     const wsHost = window.location.host;
-    const wsUrl = `${wsProtocol}//${wsHost}/api/xdr/terminal`;
+    return `${wsProtocol}//${wsHost}/api/xdr/terminal?ticket=${encodeURIComponent(ticket)}`;
+  },
 
-    const ws = new WebSocket(wsUrl);
+  createConnection: async (onMessage: (data: ArrayBuffer) => void) => {
+    const ws = new WebSocket(terminalApi.getUrl(await terminalApi.getTicket()));
     ws.binaryType = 'arraybuffer';
 
     ws.onopen = () => console.log('Terminal connected');
@@ -112,7 +132,7 @@ export interface Video {
   dislikes: number;
   uploadDate: string;
   tags: string[];
-  comments: any[];
+  commentCount: number;
 }
 
 export interface User {
@@ -126,19 +146,39 @@ export interface User {
   totalViews: number;
 }
 
+// The `after` cursor of a list response's rel="next" Link, if any
+const nextCursor = (response: Response): string | null => {
+  const next = response.headers.get('Link')?.match(/[?&]after=([^&>]+)[^>]*>; rel="next"/);
+  return next ? decodeURIComponent(next[1]) : null;
+};
+
+// Pages of the video list fetched at most, 100 videos each
+const MAX_VIDEO_PAGES = 50;
+
 export const videoApi = {
+  // Every video, following the list's pages
   getVideos: async (): Promise<Video[]> => {
+    const videos: Video[] = [];
+    let after: string | null = null;
     try {
-      const response = await fetch(`${import.meta.env.VITE_API_BASE_URL}/videos`);
-      if (!response.ok) {
-        console.warn('Video API not available, using mock data');
-        return [];
+      for (let page = 0; page < MAX_VIDEO_PAGES; page++) {
+        const params = new URLSearchParams({ limit: '100' });
+        if (after) params.set('after', after);
+        const response = await fetch(`${import.meta.env.VITE_API_BASE_URL}/videos?${params}`);
+        if (!response.ok) {
+          console.warn(
+            videos.length ? 'Video API failed mid-list, showing the videos loaded so far' : 'Video API not available, using mock data'
+          );
+          break;
+        }
+        videos.push(...((await response.json()) as Video[]));
+        after = nextCursor(response);
+        if (!after) break;
       }
-      return response.json();
     } catch (error) {
       console.error('Error fetching videos:', error);
-      return [];
     }
+    return videos;
   },
 
   getVideo: async (id: string): Promise<Video | null> => {
@@ -178,7 +218,7 @@ export const videoApi = {
         return null;
       }
       const data = await response.json();
-      return data.recommendedVideo;
+      return data.recommendations?.[0]?.video ?? null;
     } catch (error) {
       console.error('Error fetching recommendation:', error);
       return null;
@@ -186,9 +226,88 @@ export const videoApi = {
   },
 };
 
+/**
+ * Comments API Service
+ */
+export interface Comment {
+  _id: string;
+  videoId: string;
+  parentId?: string;
+  author: string;
+  authorUsername: string;
+  authorAvatar: string;
+  text: string;
+  timestamp: string;
+  editedAt?: string;
+  history?: { text: string; writtenAt: string }[];
+  likes: number;
+  replies: number;
+  deleted?: boolean;
+}
+
+export interface CommentPage {
+  comments: Comment[];
+  total: number;
+  next: string | null; // cursor for the following page
+}
+
+const commentsUrl = (videoId: string) => `${import.meta.env.VITE_API_BASE_URL}/videos/${videoId}/comments`;
+
+// Writes need an account; moderators also see deleted comments in lists
+const commentRequest = async (url: string, method: string, body?: unknown) => {
+  const response = await authFetch(url, {
+    method,
+    headers: body ? { 'Content-Type': 'application/json' } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (response.status === 401) {
+    throw new Error('Sign in to comment.');
+  }
+  if (!response.ok) {
+    throw new Error((await response.text()).trim() || `Comment request failed: ${response.status}`);
+  }
+  return response.status === 204 ? null : response.json();
+};
+
+export const commentsApi = {
+  // A page of top-level comments, or of the replies to parentId
+  list: async (
+    videoId: string,
+    options: { parentId?: string; sort?: 'newest' | 'oldest' | 'top'; after?: string; limit?: number } = {}
+  ): Promise<CommentPage> => {
+    const params = new URLSearchParams();
+    if (options.parentId) params.set('parent', options.parentId);
+    if (options.sort) params.set('sort', options.sort);
+    if (options.after) params.set('after', options.after);
+    if (options.limit) params.set('limit', String(options.limit));
+    const response = await authFetch(`${commentsUrl(videoId)}?${params}`);
+    if (!response.ok) {
+      throw new Error(`Failed to fetch comments: ${response.status}`);
+    }
+    return {
+      comments: await response.json(),
+      total: Number(response.headers.get('X-Total-Count') ?? 0),
+      next: nextCursor(response),
+    };
+  },
+
+  create: (videoId: string, text: string, parentId?: string): Promise<Comment> =>
+    commentRequest(commentsUrl(videoId), 'POST', { text, parentId }),
+
+  edit: (videoId: string, commentId: string, text: string): Promise<Comment> =>
+    commentRequest(`${commentsUrl(videoId)}/${commentId}`, 'PATCH', { text }),
+
+  remove: (videoId: string, commentId: string): Promise<null> =>
+    commentRequest(`${commentsUrl(videoId)}/${commentId}`, 'DELETE'),
+
+  setLiked: (videoId: string, commentId: string, liked: boolean): Promise<{ likes: number; liked: boolean }> =>
+    commentRequest(`${commentsUrl(videoId)}/${commentId}/like`, liked ? 'PUT' : 'DELETE'),
+};
+
 export default {
   chatApi,
   uploadApi,
   terminalApi,
   videoApi,
+  commentsApi,
 };
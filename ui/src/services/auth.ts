@@ -0,0 +1,174 @@
+// Sign-in against the SDK: the access token goes in Authorization on every
+// call that needs an account, and the refresh token renews it before it
+// expires. Both are kept in localStorage so a reload stays signed in.
+
+const ACCESS_TOKEN_KEY = 'accessToken';
+const REFRESH_TOKEN_KEY = 'refreshToken';
+const EXPIRES_AT_KEY = 'accessTokenExpiresAt';
+
+// Renew this long before the access token expires
+const REFRESH_MARGIN_MS = 30 * 1000;
+
+export interface AuthUser {
+  _id: string;
+  username: string;
+  name: string;
+  email: string;
+  avatar: string;
+  roles?: string[];
+}
+
+interface TokenResponse {
+  accessToken: string;
+  refreshToken: string;
+  expiresIn: number;
+  user?: AuthUser;
+}
+
+type Listener = () => void;
+const listeners = new Set<Listener>();
+
+// Called whenever tokens are stored or cleared
+export const onAuthChange = (listener: Listener) => {
+  listeners.add(listener);
+  return () => {
+    listeners.delete(listener);
+  };
+};
+
+const storeTokens = (accessToken: string, refreshToken: string, expiresIn: number) => {
+  localStorage.setItem(ACCESS_TOKEN_KEY, accessToken);
+  localStorage.setItem(REFRESH_TOKEN_KEY, refreshToken);
+  localStorage.setItem(EXPIRES_AT_KEY, String(Date.now() + expiresIn * 1000));
+  listeners.forEach((listener) => listener());
+};
+
+export const clearTokens = () => {
+  localStorage.removeItem(ACCESS_TOKEN_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_KEY);
+  localStorage.removeItem(EXPIRES_AT_KEY);
+  listeners.forEach((listener) => listener());
+};
+
+export const isSignedIn = () => localStorage.getItem(ACCESS_TOKEN_KEY) !== null;
+
+const errorMessage = async (response: Response, fallback: string) =>
+  (await response.text()).trim() || `${fallback}: ${response.status}`;
+
+export const login = async (username: string, password: string): Promise<AuthUser | undefined> => {
+  const response = await fetch('/api/sdk/auth/login', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ username, password }),
+  });
+  if (!response.ok) {
+    throw new Error(await errorMessage(response, 'Sign-in failed'));
+  }
+  const tokens: TokenResponse = await response.json();
+  storeTokens(tokens.accessToken, tokens.refreshToken, tokens.expiresIn);
+  return tokens.user;
+};
+
+// Refresh tokens are single use, so concurrent callers share one refresh
+let refreshing: Promise<string | null> | null = null;
+
+const refresh = (): Promise<string | null> => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+      if (!refreshToken) return null;
+      try {
+        const response = await fetch('/api/sdk/auth/refresh', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ refreshToken }),
+        });
+        if (!response.ok) {
+          clearTokens();
+          return null;
+        }
+        const tokens: TokenResponse = await response.json();
+        storeTokens(tokens.accessToken, tokens.refreshToken, tokens.expiresIn);
+        return tokens.accessToken;
+      } catch (error) {
+        console.error('Error refreshing session:', error);
+        return null;
+      }
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
+// The access token to send, renewed first when it is about to expire
+export const getAccessToken = async (): Promise<string | null> => {
+  const token = localStorage.getItem(ACCESS_TOKEN_KEY);
+  const expiresAt = Number(localStorage.getItem(EXPIRES_AT_KEY) ?? 0);
+  if (token && Date.now() < expiresAt - REFRESH_MARGIN_MS) {
+    return token;
+  }
+  return (await refresh()) ?? token;
+};
+
+// fetch with the caller's access token. A 401 renews the token once and
+// retries, for tokens revoked or expired since they were read.
+export const authFetch = async (input: string, init: RequestInit = {}): Promise<Response> => {
+  const send = (token: string | null) => {
+    const headers = new Headers(init.headers);
+    if (token) headers.set('Authorization', `Bearer ${token}`);
+    return fetch(input, { ...init, headers });
+  };
+  const token = await getAccessToken();
+  const response = await send(token);
+  if (response.status !== 401 || !token) {
+    return response;
+  }
+  const renewed = await refresh();
+  return renewed ? send(renewed) : response;
+};
+
+export const logout = async () => {
+  const token = localStorage.getItem(ACCESS_TOKEN_KEY);
+  const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+  clearTokens();
+  if (!token) return;
+  try {
+    await fetch('/api/sdk/auth/logout', {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${token}`, 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refreshToken }),
+    });
+  } catch (error) {
+    console.error('Error signing out:', error);
+  }
+};
+
+export const getCurrentUser = async (): Promise<AuthUser | null> => {
+  if (!isSignedIn()) return null;
+  const response = await authFetch('/api/sdk/auth/me');
+  if (!response.ok) return null;
+  return response.json();
+};
+
+// Single sign-on starts at the SDK, which sends the browser to the identity
+// provider and back to OIDC_POST_LOGIN_URL (the /login page)
+export const singleSignOnUrl = (returnTo: string) =>
+  `/api/sdk/auth/oidc/login?returnTo=${encodeURIComponent(returnTo)}`;
+
+// Stores the tokens the single sign-on callback put in the URL fragment and
+// removes them from the address bar. Returns where to go next, or the
+// provider's error.
+export const consumeSignOnFragment = (): { returnTo?: string; error?: string } | null => {
+  const fragment = new URLSearchParams(window.location.hash.slice(1));
+  const error = fragment.get('error');
+  const accessToken = fragment.get('accessToken');
+  const refreshToken = fragment.get('refreshToken');
+  if (!error && !accessToken) return null;
+
+  window.history.replaceState(null, '', window.location.pathname + window.location.search);
+  if (error) return { error };
+  if (!refreshToken) return { error: 'Single sign-on returned no refresh token' };
+  storeTokens(accessToken!, refreshToken, Number(fragment.get('expiresIn') ?? 0));
+  return { returnTo: fragment.get('returnTo') ?? '/' };
+};
@@ -10,6 +10,37 @@ export interface Video {
   views: number;
   likes: number;
   uploadDate: string;
+  media?: MediaInfo;
+  hls?: HLSInfo;
+}
+
+// Technical metadata read from the video file (GET /videos/{id}/metadata)
+export interface MediaInfo {
+  container: 'mp4' | 'mov' | 'webm' | 'mkv';
+  duration: number; // seconds, 0 if unknown
+  width?: number;
+  height?: number;
+  videoCodec?: string;
+  audioCodec?: string;
+  bitrate?: number; // bits per second
+  frameRate?: number;
+  audioChannels?: number;
+  audioSampleRate?: number;
+  size: number;
+  extractedAt: string;
+}
+
+// Adaptive streaming renditions packaged by the sdk (GET /videos/{id}/hls)
+export interface HLSInfo {
+  masterUrl: string; // /videos/{id}/hls/master.m3u8
+  version: string;
+  renditions: {
+    name: string; // e.g. "720p"
+    width?: number;
+    height: number;
+    bandwidth: number; // bits per second
+  }[];
+  packagedAt: string;
 }
 
 // Watch List types
@@ -69,3 +100,40 @@ export interface UploadedFile {
   preview: string;
   type: 'image' | 'text';
 }
+
+// Scan result returned by the sdk (schema: /api/sdk/schemas/scan-result.json)
+export type ScanStatus =
+  | 'clean'
+  | 'malicious'
+  | 'skipped_no_key'
+  | 'skipped_empty'
+  | 'skipped_too_large'
+  | 'error'
+  | 'unscanned';
+
+export interface MalwareFinding {
+  fileName: string;
+  malwareName: string;
+}
+
+export interface ScanResult {
+  schema_version: '1.0';
+  status: ScanStatus;
+  scan_result_code: 0 | 1 | -1 | -2 | -3 | -4; // legacy code, prefer status
+  reason?: string;
+  error?: string;
+  file_name?: string;
+  file_size: number;
+  sha256?: string;
+  scanner?: string;
+  scanned_at: string;
+  duration_ms: number;
+  cached?: boolean;
+  malware: MalwareFinding[];
+  scan_results: Record<string, unknown> | null; // legacy scanner response
+  published: boolean;
+  quarantined?: boolean;
+  quarantine_id?: string;
+  video_id?: string;
+  video_url?: string;
+}
@@ -32,7 +32,7 @@ export interface VideoFromMongoDB {
   dislikes: number;
   uploadDate: string;
   tags: string[];
-  comments: any[];
+  commentCount: number;
 }
 
 /**